@@ -5,10 +5,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"filetransfer/internal/api"
 	"filetransfer/internal/config"
+	"filetransfer/internal/diagnose"
 	"filetransfer/internal/discovery"
 	"filetransfer/internal/storage"
 	"filetransfer/internal/transfer"
@@ -20,13 +26,18 @@ func main() {
 	webPort := flag.Int("web", 8080, "Web UI port")
 	transferPort := flag.Int("transfer", 9000, "File transfer TCP port")
 	deviceName := flag.String("name", "", "Device name (defaults to hostname)")
+	makeAdmin := flag.String("make-admin", "", "Grant admin rights to this registered email and exit")
+	diagnoseOnly := flag.Bool("diagnose", false, "Check the database, SMTP, ports, multicast and directories, then exit")
 	flag.Parse()
 
 	// Device name
 	hostname, _ := os.Hostname()
 	finalName := hostname
+	deviceNameFile := userConfigPath("DEVICE_NAME_FILE", "device-name")
 	if *deviceName != "" {
 		finalName = *deviceName
+	} else if saved, err := os.ReadFile(deviceNameFile); err == nil && strings.TrimSpace(string(saved)) != "" {
+		finalName = strings.TrimSpace(string(saved))
 	}
 
 	// Downloads dir → user's ~/Downloads
@@ -37,25 +48,106 @@ func main() {
 	downloadDir := homeDir + "/Downloads"
 	os.MkdirAll(downloadDir, 0755)
 
-	// SMTP config — env overrides, fallback to defaults
-	smtpFrom := getEnv("SMTP_FROM", "filetransfer@example.com")
-	smtpPass := getEnv("SMTP_PASS", "dyhz zlfe ejma xnna") // Gmail App Password
+	// SMTP config — email is disabled unless both are set
+	smtpFrom := getEnv("SMTP_FROM", "")
+	smtpPass := getEnv("SMTP_PASS", "") // e.g. a Gmail App Password
+
+	// Optional webhook for transfer events
+	webhookURL := getEnv("WEBHOOK_URL", "")
+	webhookSecret := getEnv("WEBHOOK_SECRET", "")
 
 	// PostgreSQL DSN — env override or default
 	dbDSN := getEnv("DATABASE_URL",
 		"host=127.0.0.1 port=5432 user=sameer password=Sameer@123 dbname=filetransfer sslmode=disable")
 
 	cfg := config.Config{
-		ServerPort:    *webPort,
-		TransferPort:  *transferPort,
-		DiscoveryPort: 9001,
-		ChunkSize:     65536,
-		DownloadDir:   downloadDir,
-		DeviceName:    finalName,
-		BroadcastInt:  3 * time.Second,
-		DBConnStr:     dbDSN,
-		SMTPFrom:      smtpFrom,
-		SMTPPass:      smtpPass,
+		ServerPort:            *webPort,
+		TransferPort:          *transferPort,
+		DiscoveryPort:         9001,
+		ChunkSize:             65536,
+		SocketReadBuffer:      int(getEnvInt64("SOCKET_READ_BUFFER", 0)),
+		SocketWriteBuffer:     int(getEnvInt64("SOCKET_WRITE_BUFFER", 0)),
+		DownloadDir:           downloadDir,
+		StagingDir:            userConfigPath("STAGING_DIR", "staging"),
+		FilenameTemplate:      os.Getenv("FILENAME_TEMPLATE"),
+		DuplicateFiles:        strings.ToLower(os.Getenv("DUPLICATE_FILES")),
+		SaveRoot:              os.Getenv("SAVE_ROOT"),
+		FileRetention:         getEnvDuration("FILE_RETENTION", 0),
+		MaxUploadBytes:        getEnvInt64("MAX_UPLOAD_BYTES", 0),
+		MaxFormMemory:         getEnvInt64("MAX_FORM_MEMORY", 0),
+		MaxDownloadBytes:      getEnvInt64("MAX_DOWNLOAD_BYTES", 0),
+		UserQuotaBytes:        getEnvInt64("USER_QUOTA_BYTES", 0),
+		DeviceName:            finalName,
+		DeviceNameFile:        deviceNameFile,
+		BroadcastInt:          3 * time.Second,
+		BroadcastJitter:       getEnvFloat("BROADCAST_JITTER", 0.2),
+		RequireSenderConfirm:  os.Getenv("REQUIRE_SENDER_CONFIRM") == "1",
+		ReuseConnections:      os.Getenv("REUSE_CONNECTIONS") == "1",
+		MaxSendRate:           getEnvInt64("MAX_SEND_RATE", 0),
+		Compress:              os.Getenv("COMPRESS_TRANSFERS") == "1",
+		ReliableTransfers:     os.Getenv("RELIABLE_TRANSFERS") == "1",
+		StallTimeout:          getEnvDuration("STALL_TIMEOUT", 0),
+		ProgressBatchInterval: getEnvDuration("PROGRESS_BATCH_INTERVAL", 0),
+		NoCompressExts:        getEnvList("NO_COMPRESS_EXTS"),
+		BlockedExtensions:     getEnvList("BLOCKED_EXTENSIONS"),
+		URLFetchAllow:         getEnvList("URL_FETCH_ALLOW"),
+		URLFetchDeny:          getEnvList("URL_FETCH_DENY"),
+		MaxIncoming:           int(getEnvInt64("MAX_INCOMING", 0)),
+		MaxPendingOffers:      int(getEnvInt64("MAX_PENDING_OFFERS", 0)),
+		DiscoveryMode:         getEnv("DISCOVERY_MODE", "multicast"),
+		RecentDevicesWindow:   getEnvDuration("RECENT_DEVICES_WINDOW", 0),
+		MulticastTTL:          int(getEnvInt64("MULTICAST_TTL", 1)),
+		TLSCertFile:           os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("TLS_KEY_FILE"),
+		PinnedCertsFile:       userConfigPath("PINNED_CERTS_FILE", "pinned-certs.json"),
+		DiscoveryInterfaces:   getEnvList("DISCOVERY_INTERFACES"),
+		DisableMulticastLoop:  os.Getenv("MULTICAST_LOOPBACK") == "0",
+		AdvertiseUsers:        os.Getenv("ADVERTISE_USERS") == "1",
+		SessionGCInterval:     getEnvDuration("SESSION_GC_INTERVAL", 0),
+		IdleTimeout:           getEnvDuration("IDLE_TIMEOUT", 0),
+		HistoryBufferFile:     userConfigPath("HISTORY_BUFFER_FILE", "history-pending.jsonl"),
+		DisableHistory:        os.Getenv("DISABLE_HISTORY") == "1",
+		IncognitoDefault:      os.Getenv("INCOGNITO_DEFAULT") == "1",
+		ResumeStateDir:        userConfigPath("RESUME_STATE_DIR", "resume"),
+		ClamdAddress:          os.Getenv("CLAMD_ADDRESS"),
+		ScanFailClosed:        os.Getenv("SCAN_FAIL_CLOSED") == "1",
+		QuarantineDir:         userConfigPath("QUARANTINE_DIR", "quarantine"),
+		DBConnStr:             dbDSN,
+		HTTPReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 0),
+		HTTPReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 0),
+		HTTPWriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 0),
+		HTTPIdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 0),
+		TrustProxy:            os.Getenv("TRUST_PROXY") == "1",
+		SingleSession:         os.Getenv("SINGLE_SESSION") == "1",
+		DeviceOwner:           os.Getenv("DEVICE_OWNER"),
+		AdminEmail:            os.Getenv("ADMIN_EMAIL"),
+		SMTPFrom:              smtpFrom,
+		SMTPPass:              smtpPass,
+		SMTPHost:              os.Getenv("SMTP_HOST"),
+		SMTPPort:              int(getEnvInt64("SMTP_PORT", 0)),
+		SMTPTLS:               strings.ToLower(os.Getenv("SMTP_TLS")),
+		DevMode:               os.Getenv("DEV_MODE") == "1",
+		OnReceiveCommand:      os.Getenv("ON_RECEIVE_COMMAND"),
+		WebhookURL:            webhookURL,
+		WebhookSecret:         webhookSecret,
+	}
+
+	// Diagnose reports an invalid configuration among its other checks
+	if *diagnoseOnly {
+		if !diagnose.Report(os.Stdout, diagnose.Run(cfg)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if !cfg.SMTPConfigured() {
+		if cfg.DevMode {
+			log.Println("WARNING: DEV_MODE is on and SMTP is not configured — verification codes will be printed to this log. This is insecure; never use it in production.")
+		} else {
+			log.Println("SMTP not configured (SMTP_FROM/SMTP_PASS); email features are disabled")
+		}
 	}
 
 	// Storage (Postgres)
@@ -63,8 +155,24 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot connect to database: %v\n  DSN: %s\n  Tip: set DATABASE_URL env var to override.", err, dbDSN)
 	}
+	defer store.Close()
 	log.Println("Connected to PostgreSQL database ✓")
 
+	if *makeAdmin != "" {
+		if err := store.SetAdmin(*makeAdmin, true); err != nil {
+			log.Fatalf("Cannot grant admin: %v", err)
+		}
+		log.Printf("%s is now an admin", *makeAdmin)
+		return
+	}
+
+	gcInterval := cfg.SessionGCInterval
+	if gcInterval <= 0 {
+		gcInterval = 10 * time.Minute
+	}
+	store.SetIdleTimeout(cfg.IdleTimeout)
+	store.StartMaintenance(gcInterval)
+
 	// Network
 	localIP := utils.GetLocalIP()
 	if localIP == "" {
@@ -73,13 +181,15 @@ func main() {
 	deviceID := fmt.Sprintf("%s-%d", localIP, time.Now().UnixNano())
 
 	// Wire up services
-	// API server created first so we can pass GetUsername to discovery
+	// API server created first so we can pass its presence to discovery
 	apiServer := api.NewServer(cfg, store, nil, nil, localIP, web.FS)
 
-	discSvc := discovery.NewService(cfg, localIP, deviceID, apiServer.GetUsername)
+	discSvc := discovery.NewService(cfg, localIP, deviceID, apiServer.Presence)
 
 	transferSvc := transfer.NewService(cfg, deviceID, store, discSvc, apiServer.Broadcast, apiServer.GetUsername)
+	transferSvc.SetDeviceName(apiServer.DeviceName())
 
+	discSvc.SetNotifier(apiServer.Broadcast)
 	apiServer.SetDiscovery(discSvc)
 	apiServer.SetTransfer(transferSvc)
 
@@ -89,7 +199,33 @@ func main() {
 
 	printBanner(cfg, localIP, downloadDir)
 
-	log.Fatal(apiServer.Start())
+	// Queued history is stored or buffered before exiting
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		transferSvc.Close()
+		store.Close()
+		os.Exit(0)
+	}()
+
+	err = apiServer.Start()
+	transferSvc.Close()
+	log.Fatal(err)
+}
+
+// userConfigPath returns the path in env, or name under the user's config
+// directory (e.g. staging, so large uploads don't land on a small tmpfs).
+func userConfigPath(env, name string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "filetransfer", name)
 }
 
 func getEnv(key, fallback string) string {
@@ -99,6 +235,54 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvList splits a comma-separated variable, returning nil when unset.
+func getEnvList(key string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid %s=%q: %v", key, v, err)
+		}
+		return d
+	}
+	return fallback
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s=%q: %v", key, v, err)
+		}
+		return n
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s=%q: %v", key, v, err)
+		}
+		return f
+	}
+	return fallback
+}
+
 func printBanner(cfg config.Config, localIP, downloadDir string) {
 	fmt.Printf("\n")
 	fmt.Printf("╔══════════════════════════════════════════════════════╗\n")
@@ -106,7 +290,7 @@ func printBanner(cfg config.Config, localIP, downloadDir string) {
 	fmt.Printf("╠══════════════════════════════════════════════════════╣\n")
 	fmt.Printf("║  Device   : %-40s║\n", cfg.DeviceName)
 	fmt.Printf("║  Local IP : %-40s║\n", localIP)
-	fmt.Printf("║  Web UI   : http://localhost:%-25d║\n", cfg.ServerPort)
+	fmt.Printf("║  Web UI   : %-40s║\n", fmt.Sprintf("%s://localhost:%d", cfg.WebScheme(), cfg.ServerPort))
 	fmt.Printf("║  Downloads: %-40s║\n", downloadDir)
 	fmt.Printf("╚══════════════════════════════════════════════════════╝\n\n")
 }
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"filetransfer/internal/discovery"
+	"filetransfer/internal/models"
+)
+
+// Admin-only views of the instance, mounted behind requireAdmin.
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.store.ListSessions())
+}
+
+// handleAdminConfig shows the effective configuration, secrets redacted,
+// with what was derived from it at startup, for diagnosing setups where
+// peers can't see or reach this device.
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	transferAddr := ""
+	if addr := s.transfer.ListenAddr(); addr != nil {
+		transferAddr = addr.String()
+	}
+	listening, sending := s.disc.Interfaces()
+	if listening == nil {
+		listening = []discovery.InterfaceStatus{}
+	}
+	if sending == nil {
+		sending = []discovery.InterfaceStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config": s.config.Redacted(),
+		"derived": map[string]interface{}{
+			"localIP":            s.currentIP(),
+			"transferListenAddr": transferAddr,
+			"tlsEnabled":         s.config.TLSEnabled(),
+			"smtpConfigured":     s.config.SMTPConfigured(),
+			"owner":              s.GetUsername(),
+			"discoveryListening": listening,
+			"discoverySending":   sending,
+		},
+	})
+}
+
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.store.ListUsers()
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	if users == nil {
+		users = []*models.User{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleWSClients lists the open WebSockets, oldest first. A client idle for
+// longer than the ping interval isn't answering pings and is likely stale.
+func (s *Server) handleWSClients(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	s.wsMu.Lock()
+	clients := make([]map[string]interface{}, 0, len(s.wsClients))
+	for _, c := range s.wsClients {
+		idle := now.Sub(c.lastActivity)
+		clients = append(clients, map[string]interface{}{
+			"email":        c.email,
+			"remoteAddr":   c.remoteAddr,
+			"connectedAt":  c.connectedAt,
+			"lastActivity": c.lastActivity,
+			"idleSeconds":  int(idle.Seconds()),
+			"stale":        idle > wsPingInterval+10*time.Second,
+		})
+	}
+	s.wsMu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i]["connectedAt"].(time.Time).Before(clients[j]["connectedAt"].(time.Time))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(clients),
+		"clients": clients,
+	})
+}
+
+// handleDebugDiscovery shows which network interfaces multicast discovery
+// joined and sends on, for diagnosing multi-homed hosts.
+func (s *Server) handleDebugDiscovery(w http.ResponseWriter, r *http.Request) {
+	listening, sending := s.disc.Interfaces()
+	if listening == nil {
+		listening = []discovery.InterfaceStatus{}
+	}
+	if sending == nil {
+		sending = []discovery.InterfaceStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":      s.config.DiscoveryMode,
+		"listening": listening,
+		"sending":   sending,
+	})
+}
+
+// handleForgetPin drops a device's pinned certificate so the one it now
+// announces is trusted. DELETE /api/devices/pin?deviceId=...
+func (s *Server) handleForgetPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	id := r.URL.Query().Get("deviceId")
+	if id == "" {
+		jsonError(w, ErrCodeBadRequest, "deviceId is required", 400)
+		return
+	}
+	if !s.disc.ForgetPin(id) {
+		jsonError(w, ErrCodeNotFound, "No certificate pinned for that device", 404)
+		return
+	}
+	jsonOK(w, "pin forgotten")
+}
+
+// handleAbortAll stops every transfer in flight, for recovering a stuck
+// instance without restarting it.
+func (s *Server) handleAbortAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	n := s.transfer.AbortAll()
+	logf(r, "[ADMIN] %s aborted %d transfers", contextUser(r).Email, n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"aborted": n})
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"embed"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/storage/storagemock"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	store := storagemock.New()
+	s := NewServer(config.Config{DownloadDir: t.TempDir(), AdminEmail: " admin@example.com "}, store, nil, nil, "127.0.0.1", embed.FS{})
+	auth := func(h func(w *httptest.ResponseRecorder), email string) bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w)
+		if w.Code != 200 {
+			t.Fatalf("%s: %d %s", email, w.Code, w.Body)
+		}
+		u, _ := store.GetUserByEmail(email)
+		return u.IsAdmin
+	}
+	register := func(email string) bool {
+		return auth(func(w *httptest.ResponseRecorder) {
+			s.handleRegister(w, httptest.NewRequest("POST", "/api/auth/register", strings.NewReader(`{"email":"`+email+`","password":"correct horse"}`)))
+		}, email)
+	}
+	login := func(email string) bool {
+		return auth(func(w *httptest.ResponseRecorder) {
+			s.handleLogin(w, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"email":"`+email+`","password":"correct horse"}`)))
+		}, email)
+	}
+
+	if register("Admin@Example.com") || login("Admin@Example.com") {
+		t.Error("an address differing in case was promoted")
+	}
+	if register("admin@example.com") {
+		t.Error("promoted on registration")
+	}
+	if !login("admin@example.com") {
+		t.Error("not promoted on login")
+	}
+
+	// Once an admin exists, nobody else is promoted this way
+	store.SetAdmin("admin@example.com", false)
+	store.SetAdmin("Admin@Example.com", true)
+	if login("admin@example.com") {
+		t.Error("promoted although an admin exists")
+	}
+}
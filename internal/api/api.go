@@ -1,14 +1,23 @@
 package api
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/mail"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,41 +30,91 @@ import (
 	"filetransfer/internal/transfer"
 )
 
+const minPasswordLen = 8
+
+// multipartSlack allows for the form fields and boundaries around the file
+// when capping a multipart body at MaxUploadBytes.
+const multipartSlack = 1 << 20
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// The server pings each WebSocket every wsPingInterval; one that shows no
+// sign of life (message or pong) for wsIdleTimeout is dropped.
+const (
+	wsPingInterval = 30 * time.Second
+	wsIdleTimeout  = 2 * wsPingInterval
+	// wsWriteTimeout bounds one write, so a half-open socket can't keep its
+	// writer blocked forever.
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsSendBuffer is how many messages may wait for a slow WebSocket before it
+// is disconnected. A variable so tests can shrink it.
+var wsSendBuffer = 256
+
+// wsClient is what the server tracks about one open WebSocket.
+type wsClient struct {
+	token        string // session cookie the socket was opened with
+	email        string // empty if it wasn't signed in
+	remoteAddr   string
+	connectedAt  time.Time
+	lastActivity time.Time
+	// send queues messages for the client's writer goroutine; closing it
+	// ends the writer, which closes the socket once the queue is written.
+	send chan interface{}
+}
+
+// Store is the persistence the API server needs.
+type Store interface {
+	storage.UserStore
+	storage.HistoryStore
+	storage.TrustStore
+	storage.GroupStore
+}
+
 type Server struct {
 	config     config.Config
-	store      *storage.Store
+	store      Store
 	disc       *discovery.Service
 	transfer   *transfer.Service
 	webContent embed.FS
 	localIP    string
 
-	wsClients map[*websocket.Conn]bool
+	wsClients map[*websocket.Conn]*wsClient
 	wsMu      sync.Mutex
 
-	mu          sync.RWMutex
-	currentUser *models.User // logged-in user for this instance
+	// owner is the account this device advertises in discovery and receives
+	// files for. It is an instance-wide identity, deliberately independent
+	// of whoever made the latest request; handlers use contextUser instead.
+	mu         sync.RWMutex
+	owner      string
+	deviceName string // advertised name; renamable at runtime
+
+	pairing pairTokens
+	relays  relayStore
+	uploads uploadStore
 }
 
 func NewServer(
 	cfg config.Config,
-	store *storage.Store,
+	store Store,
 	disc *discovery.Service,
 	ts *transfer.Service,
 	localIP string,
 	content embed.FS,
 ) *Server {
 	return &Server{
+		owner:      cfg.DeviceOwner,
+		deviceName: cfg.DeviceName,
 		config:     cfg,
 		store:      store,
 		disc:       disc,
 		transfer:   ts,
 		localIP:    localIP,
 		webContent: content,
-		wsClients:  make(map[*websocket.Conn]bool),
+		wsClients:  make(map[*websocket.Conn]*wsClient),
 	}
 }
 
@@ -65,63 +124,224 @@ func (s *Server) SetDiscovery(d *discovery.Service) { s.disc = d }
 // SetTransfer wires the transfer service.
 func (s *Server) SetTransfer(t *transfer.Service) { s.transfer = t }
 
-// GetUsername returns the email of the currently logged-in user (used by discovery).
+// currentIP is this device's address, as discovery last saw it.
+func (s *Server) currentIP() string {
+	if s.disc != nil {
+		return s.disc.LocalIP()
+	}
+	return s.localIP
+}
+
+// GetUsername returns the device owner's email (used by discovery and for
+// incoming transfers), or "" while nobody is signed in.
 func (s *Server) GetUsername() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if s.currentUser != nil {
-		return s.currentUser.Email
+	return s.owner
+}
+
+// Presence is the discovery.PresenceProvider for this instance: the owner
+// plus everyone with an active session.
+func (s *Server) Presence() discovery.Presence {
+	p := discovery.Presence{DeviceName: s.DeviceName(), Owner: s.GetUsername()}
+	seen := map[string]bool{}
+	for _, sess := range s.store.ListSessions() {
+		if !seen[sess.Email] {
+			seen[sess.Email] = true
+			p.Users = append(p.Users, sess.Email)
+		}
+	}
+	return p
+}
+
+// ownerCheckInterval is how often the owner is released once their last
+// session has expired or gone idle.
+const ownerCheckInterval = time.Minute
+
+// claimOwner makes email the device owner if there is none yet, or the
+// owner's sessions have all ended. Later sign-ins by other users don't take
+// the device over from a signed-in owner.
+func (s *Server) claimOwner(r *http.Request, email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == "" || (s.config.DeviceOwner == "" && !hasSession(s.store.ListSessions(), s.owner)) {
+		s.owner = email
+		logf(r, "[AUTH] Device owner is now %s", email)
+	}
+}
+
+// hasSession reports whether email is among sessions.
+func hasSession(sessions []*models.Session, email string) bool {
+	for _, sess := range sessions {
+		if sess.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// announce has discovery tell peers about a change in presence now rather
+// than at its next scheduled announcement.
+func (s *Server) announce() {
+	if s.disc != nil {
+		s.disc.Announce()
+	}
+}
+
+// releaseOwner hands ownership to the most recently active remaining
+// session once the owner has none left, whether they signed out or their
+// sessions expired, went idle or were revoked. A configured DeviceOwner is
+// never released. r is the sign-out request, or nil for a periodic check.
+func (s *Server) releaseOwner(r *http.Request) {
+	s.mu.Lock()
+	old := s.owner
+	sessions := s.store.ListSessions() // most recently used first
+	if old == "" || s.config.DeviceOwner != "" || hasSession(sessions, old) {
+		s.mu.Unlock()
+		return
+	}
+	s.owner = ""
+	if len(sessions) > 0 {
+		s.owner = sessions[0].Email
+	}
+	owner := s.owner
+	s.mu.Unlock()
+	logf(r, "[AUTH] Device owner changed from %s to %q", old, owner)
+	s.announce()
+}
+
+// runOwnerCheck releases the owner periodically, for sessions that end by
+// expiring or going idle rather than by a request.
+func (s *Server) runOwnerCheck() {
+	for range time.Tick(ownerCheckInterval) {
+		s.releaseOwner(nil)
 	}
-	return ""
 }
 
-// Broadcast sends a JSON message to all connected WebSocket clients.
+// Broadcast queues a JSON message for every connected WebSocket client. It
+// never waits on a client: one whose queue is full is disconnected.
 func (s *Server) Broadcast(msgType string, payload interface{}) {
+	s.queueWS(msgType, payload, func(*wsClient) bool { return true })
+}
+
+// notifyUsers queues a message like Broadcast, but only for clients signed
+// in as one of emails.
+func (s *Server) notifyUsers(msgType string, payload interface{}, emails ...string) {
+	s.queueWS(msgType, payload, func(c *wsClient) bool {
+		return c.email != "" && slices.Contains(emails, c.email)
+	})
+}
+
+func (s *Server) queueWS(msgType string, payload interface{}, want func(*wsClient) bool) {
 	s.wsMu.Lock()
 	defer s.wsMu.Unlock()
 	msg := map[string]interface{}{"type": msgType, "payload": payload}
-	for conn := range s.wsClients {
-		if err := conn.WriteJSON(msg); err != nil {
+	for conn, c := range s.wsClients {
+		if !want(c) {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			log.Printf("[WS] Dropping %s (%s): %d messages behind", c.remoteAddr, c.email, cap(c.send))
+			s.removeWS(conn)
 			conn.Close()
-			delete(s.wsClients, conn)
+		}
+	}
+}
+
+// removeWS forgets conn and ends its writer after the queued messages.
+// The caller holds wsMu.
+func (s *Server) removeWS(conn *websocket.Conn) {
+	if c, ok := s.wsClients[conn]; ok {
+		delete(s.wsClients, conn)
+		close(c.send)
+	}
+}
+
+// writeWS writes queued messages to conn until the queue is closed or a
+// write fails, then closes conn.
+func writeWS(conn *websocket.Conn, send <-chan interface{}) {
+	defer conn.Close()
+	for msg := range send {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteJSON(msg); err != nil {
+			// Closing the socket stops the read pump, which removes the client
+			return
 		}
 	}
 }
 
 func (s *Server) Start() error {
+	go s.relays.runPurge()
+	go s.uploads.runPurge()
+	go s.runOwnerCheck()
+
 	mux := http.NewServeMux()
 
 	// Auth (no middleware)
 	mux.HandleFunc("/api/auth/register", s.handleRegister)
 	mux.HandleFunc("/api/auth/login", s.handleLogin)
 	mux.HandleFunc("/api/auth/logout", s.requireAuth(s.handleLogout))
+	mux.HandleFunc("/api/auth/activity", s.requireAuth(s.handleAuthActivity))
 
 	// App (auth required)
 	mux.HandleFunc("/api/devices", s.requireAuth(s.handleDevices))
-	mux.HandleFunc("/api/transfer/send", s.requireAuth(s.handleSend))
+	mux.HandleFunc("/api/devices/recent", s.requireAuth(s.handleRecentDevices))
+	mux.HandleFunc("/api/devices/ping", s.requireAuth(s.handlePingDevice))
+	mux.HandleFunc("/api/devices/groups", s.requireAuth(s.handleDeviceGroups))
+	mux.HandleFunc("/api/transfer/send", s.requireAuth(longRunning(s.handleSend)))
+	mux.HandleFunc("/api/transfer/send-url", s.requireAuth(longRunning(s.handleSendURL)))
 	mux.HandleFunc("/api/transfer/accept", s.requireAuth(s.handleAccept))
 	mux.HandleFunc("/api/transfer/reject", s.requireAuth(s.handleReject))
+	mux.HandleFunc("/api/transfer/confirm", s.requireAuth(s.handleConfirm))
+	mux.HandleFunc("/api/transfer/relay", s.requireAuth(longRunning(s.handleRelay)))
+	mux.HandleFunc("/api/transfer/relay/", s.requireAuth(longRunning(s.handleRelay)))
+	mux.HandleFunc("/api/transfer/upload", s.requireAuth(longRunning(s.handleUpload)))
+	mux.HandleFunc("/api/transfer/upload/complete", s.requireAuth(longRunning(s.handleUploadComplete)))
 	mux.HandleFunc("/api/transfers/active", s.requireAuth(s.handleActiveTransfers))
+	mux.HandleFunc("/api/transfers/pending", s.requireAuth(s.handlePendingTransfers))
+	mux.HandleFunc("/api/stats/bandwidth", s.requireAuth(s.handleBandwidth))
 	mux.HandleFunc("/api/history", s.requireAuth(s.handleHistory))
+	mux.HandleFunc("/api/history/resend", s.requireAuth(longRunning(s.handleResend)))
+	mux.HandleFunc("/api/history/sync", s.requireAuth(s.handleHistorySync))
+	mux.HandleFunc("/api/history/export", s.requireAuth(longRunning(s.handleHistoryExport)))
 	mux.HandleFunc("/api/files", s.requireAuth(s.handleFiles))
+	mux.HandleFunc("/api/files/thumbnail", s.requireAuth(s.handleThumbnail))
+	mux.HandleFunc("/api/peers/stats", s.requireAuth(s.handlePeerStats))
 	mux.HandleFunc("/api/me", s.requireAuth(s.handleMe))
-	mux.HandleFunc("/ws", s.handleWS)
+	mux.HandleFunc("/api/me/usage", s.requireAuth(s.handleUsage))
+	mux.HandleFunc("/api/settings/trusted", s.requireAuth(s.handleTrusted))
+	mux.HandleFunc("/api/settings/device-name", s.requireAuth(s.handleDeviceName))
+	mux.HandleFunc("/api/settings/incognito", s.requireAuth(s.handleIncognito))
+	mux.HandleFunc("/api/pair/qr", s.requireAuth(s.handlePairQR))
+	mux.HandleFunc("/api/admin/sessions", s.requireAdmin(s.handleAdminSessions))
+	mux.HandleFunc("/api/admin/users", s.requireAdmin(s.handleAdminUsers))
+	mux.HandleFunc("/api/admin/config", s.requireAdmin(s.handleAdminConfig))
+	mux.HandleFunc("/api/admin/transfers/abort-all", s.requireAdmin(s.handleAbortAll))
+	mux.HandleFunc("/api/ws/clients", s.requireAdmin(s.handleWSClients))
+	mux.HandleFunc("/api/debug/discovery", s.requireAdmin(s.handleDebugDiscovery))
+	mux.HandleFunc("/api/devices/pin", s.requireAdmin(s.handleForgetPin))
+	mux.HandleFunc("/api/pair/claim", s.handlePairClaim)
+	mux.HandleFunc("/ws", s.handleWS) // sets its own deadlines once upgraded
 
 	// Static
 	staticFS, _ := fs.Sub(s.webContent, "static")
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
 
-	// Downloads (auth required)
-	mux.HandleFunc("/dl/", s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
-		http.StripPrefix("/dl/", http.FileServer(http.Dir(s.config.DownloadDir))).ServeHTTP(w, r)
-	}))
+	// Downloads (auth required, scoped to the user's own directory)
+	mux.HandleFunc("/dl/", s.requireAuth(longRunning(s.handleDownload)))
 
 	// Catch-all: serve SPA or redirect to auth
 	mux.HandleFunc("/", s.handleIndex)
 
 	addr := fmt.Sprintf(":%d", s.config.ServerPort)
-	log.Printf("Web UI listening on http://localhost%s", addr)
-	return http.ListenAndServe(addr, mux)
+	log.Printf("Web UI listening on %s://localhost%s", s.config.WebScheme(), addr)
+	srv := s.httpServer(addr, withRequestID(mux))
+	if s.config.TLSEnabled() {
+		return srv.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
 }
 
 // ---- Middleware ----
@@ -131,32 +351,103 @@ func (s *Server) sessionUser(r *http.Request) *models.User {
 	if err != nil {
 		return nil
 	}
-	email, ok := s.store.GetSession(cookie.Value)
+	lookup := s.store.GetSession
+	if isBackground(r) {
+		lookup = s.store.CheckSession
+	}
+	email, ok := lookup(cookie.Value)
 	if !ok {
-		log.Printf("[AUTH] Session not found for token: %s (maybe server restarted?)", cookie.Value)
+		logf(r, "[AUTH] Session not found for token: %s (maybe server restarted?)", cookie.Value)
 		return nil
 	}
 	u, err := s.store.GetUserByEmail(email)
 	if err != nil {
-		log.Printf("[AUTH] User %s not found in DB", email)
+		logf(r, "[AUTH] User %s not found in DB", email)
 		return nil
 	}
-	s.mu.Lock()
-	s.currentUser = u
-	s.mu.Unlock()
 	return u
 }
 
+// backgroundHeader marks requests the UI makes on its own, like polling for
+// devices. They don't count as activity for the idle timeout.
+const backgroundHeader = "X-Background-Request"
+
+func isBackground(r *http.Request) bool {
+	return r.Header.Get(backgroundHeader) != ""
+}
+
+type userKey struct{}
+
+// requireAuth rejects requests without a valid session and stores the
+// signed-in user in the request context (see contextUser).
 func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		u := s.sessionUser(r)
 		if u == nil {
-			log.Printf("[AUTH] Unauthorized request: %s %s", r.Method, r.URL.Path)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			logf(r, "[AUTH] Unauthorized request: %s %s", r.Method, r.URL.Path)
+			jsonError(w, ErrCodeUnauthorized, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+		// A long request, like an upload, is activity until it ends
+		if c, err := r.Cookie(s.cookieName()); err == nil && !isBackground(r) {
+			s.store.GetSession(c.Value)
+		}
+	}
+}
+
+// requireAdmin is requireAuth plus a check of the user's admin flag.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if u := contextUser(r); !u.IsAdmin {
+			logf(r, "[AUTH] %s denied %s %s (not an admin)", u.Email, r.Method, r.URL.Path)
+			jsonError(w, ErrCodeForbidden, "Admin only", http.StatusForbidden)
 			return
 		}
 		next(w, r)
+	})
+}
+
+// contextUser returns the user stored by requireAuth, or nil on routes that
+// don't require a session.
+func contextUser(r *http.Request) *models.User {
+	u, _ := r.Context().Value(userKey{}).(*models.User)
+	return u
+}
+
+// promoteBootstrapAdmin grants admin rights to the configured AdminEmail
+// when that user signs in while the instance has no admin yet, so a fresh
+// instance can get its first one. The address must match exactly: emails
+// are stored as registered, so "Admin@…" is a different account.
+func (s *Server) promoteBootstrapAdmin(r *http.Request, u *models.User) {
+	if u.IsAdmin || s.config.AdminEmail == "" || u.Email != normalizeEmail(s.config.AdminEmail) {
+		return
+	}
+	users, err := s.store.ListUsers()
+	if err != nil {
+		logf(r, "[AUTH] Cannot check for an existing admin: %v", err)
+		return
+	}
+	for _, other := range users {
+		if other.IsAdmin {
+			return
+		}
 	}
+	if err := s.store.SetAdmin(u.Email, true); err != nil {
+		logf(r, "[AUTH] Cannot promote %s to admin: %v", u.Email, err)
+		return
+	}
+	u.IsAdmin = true
+	logf(r, "[AUTH] Promoted bootstrap admin %s", u.Email)
+}
+
+// normalizeEmail returns the bare address of email, as registration
+// requires it to be written.
+func normalizeEmail(email string) string {
+	if addr, err := mail.ParseAddress(strings.TrimSpace(email)); err == nil {
+		return addr.Address
+	}
+	return strings.TrimSpace(email)
 }
 
 // ---- Page Handler ----
@@ -195,27 +486,41 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		jsonError(w, "Invalid request", 400)
+		jsonError(w, ErrCodeBadRequest, "Invalid request", 400)
 		return
 	}
 	if body.Email == "" || body.Password == "" {
-		jsonError(w, "Email and password required", 400)
+		jsonError(w, ErrCodeMissingField, "Email and password required", 400)
+		return
+	}
+	if addr, err := mail.ParseAddress(body.Email); err != nil || addr.Address != body.Email {
+		jsonError(w, ErrCodeInvalidEmail, "Invalid email address", 400)
+		return
+	}
+	if len(body.Password) < minPasswordLen {
+		jsonError(w, ErrCodeWeakPassword, fmt.Sprintf("Password must be at least %d characters", minPasswordLen), 400)
 		return
 	}
 	if err := s.store.RegisterUser(body.Email, body.Password); err != nil {
-		jsonError(w, "Email already registered", 400)
+		jsonError(w, ErrCodeEmailTaken, "Email already registered", 400)
 		return
 	}
+	if s.config.IncognitoDefault {
+		if err := s.store.SetIncognito(body.Email, true); err != nil {
+			logf(r, "[AUTH] Cannot turn history off for new user %s: %v", body.Email, err)
+		}
+	}
 
+	s.enforceSingleSession(r, body.Email)
 	token := s.store.CreateSession(body.Email)
 	http.SetCookie(w, s.sessionCookie(token))
 
-	u, _ := s.store.GetUserByEmail(body.Email)
-	s.mu.Lock()
-	s.currentUser = u
-	s.mu.Unlock()
+	s.ensureUserDir(r, body.Email)
+	s.claimOwner(r, body.Email)
+	s.announce()
 
-	log.Printf("[AUTH] New registration & login: %s", body.Email)
+	s.audit(r, body.Email, "register")
+	logf(r, "[AUTH] New registration & login: %s", body.Email)
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "email": body.Email})
 }
 
@@ -229,22 +534,26 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		jsonError(w, "Invalid request", 400)
+		jsonError(w, ErrCodeBadRequest, "Invalid request", 400)
 		return
 	}
 	user, err := s.store.AuthenticateUser(body.Email, body.Password)
 	if err != nil {
-		jsonError(w, err.Error(), 401)
+		s.audit(r, body.Email, "login_failed")
+		jsonError(w, ErrCodeInvalidCredentials, err.Error(), 401)
 		return
 	}
+	s.enforceSingleSession(r, user.Email)
 	token := s.store.CreateSession(user.Email)
 	http.SetCookie(w, s.sessionCookie(token))
 
-	s.mu.Lock()
-	s.currentUser = user
-	s.mu.Unlock()
+	s.promoteBootstrapAdmin(r, user)
+	s.ensureUserDir(r, user.Email)
+	s.claimOwner(r, user.Email)
+	s.announce()
 
-	log.Printf("[AUTH] Logged in: %s", user.Email)
+	s.audit(r, user.Email, "login")
+	logf(r, "[AUTH] Logged in: %s", user.Email)
 	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "email": user.Email})
 }
 
@@ -253,6 +562,8 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		s.store.DeleteSession(cookie.Value)
 	}
+	s.audit(r, contextUser(r).Email, "logout")
+	s.releaseOwner(r)
 	http.SetCookie(w, &http.Cookie{
 		Name:    s.cookieName(),
 		Value:   "",
@@ -263,41 +574,161 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
-	user := s.sessionUser(r)
+	user := contextUser(r)
+	incognito, err := s.store.Incognito(user.Email)
+	if err != nil {
+		logf(r, "[HISTORY] Cannot read the history setting of %s: %v", user.Email, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"email":      user.Email,
-		"deviceName": s.config.DeviceName,
-		"localIP":    s.localIP,
+		"deviceName": s.DeviceName(),
+		"localIP":    s.currentIP(),
+		"isAdmin":    user.IsAdmin,
+		"owner":      s.GetUsername(), // account this device advertises
+		// History is recorded only when both are false
+		"incognito":       incognito,
+		"historyDisabled": s.config.DisableHistory,
+	})
+}
+
+// handleUsage reports the disk the signed-in user's received files take and
+// their quota, 0 meaning unlimited.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"usedBytes":  s.transfer.Usage(u.Email),
+		"quotaBytes": s.config.UserQuotaBytes,
 	})
 }
 
+// handleIncognito turns the signed-in user's history recording off or on.
+// POST {"incognito": true|false}. Existing history is kept.
+func (s *Server) handleIncognito(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		Incognito *bool `json:"incognito"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Incognito == nil {
+		jsonError(w, ErrCodeMissingField, "incognito (true or false) is required", 400)
+		return
+	}
+	u := contextUser(r)
+	if err := s.store.SetIncognito(u.Email, *body.Incognito); err != nil {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	logf(r, "[HISTORY] %s turned incognito %v", u.Email, *body.Incognito)
+	jsonOK(w, "saved")
+}
+
 // ---- App Handlers ----
 
+// handleDevices lists the online devices with the user's groups for each;
+// ?group= keeps only the devices in that group.
 func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
-	devices := s.disc.GetDevices()
+	groups, err := s.store.ListDeviceGroups(contextUser(r).Email)
+	if err != nil {
+		logf(r, "[GROUPS] Cannot load device groups: %v", err)
+	}
+	filter := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("group")))
+	devices := []deviceView{}
+	for _, d := range s.disc.GetDevices() {
+		v := deviceView{Device: d, Groups: groups[d.ID]}
+		if filter != "" && !slices.Contains(v.Groups, filter) {
+			continue
+		}
+		devices = append(devices, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+func (s *Server) handleRecentDevices(w http.ResponseWriter, r *http.Request) {
+	devices := s.disc.RecentDevices()
 	w.Header().Set("Content-Type", "application/json")
 	if devices == nil {
-		devices = []*models.Device{}
+		devices = []models.RecentDevice{}
 	}
 	json.NewEncoder(w).Encode(devices)
 }
 
+// handlePingDevice checks that a peer's transfer port accepts connections,
+// which discovery alone doesn't show. POST {"deviceId"}.
+func (s *Server) handlePingDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		DeviceID string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.DeviceID == "" {
+		jsonError(w, ErrCodeMissingField, "deviceId is required", 400)
+		return
+	}
+	rtt, err := s.transfer.Ping(body.DeviceID)
+	if errors.Is(err, transfer.ErrPeerNotFound) {
+		sendError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"deviceId": body.DeviceID, "reachable": err == nil}
+	if err != nil {
+		logf(r, "[PING] %s is unreachable: %v", body.DeviceID, err)
+		resp["error"] = err.Error()
+	} else {
+		resp["latencyMs"] = float64(rtt.Microseconds()) / 1000
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// idempotencyHeader carries an optional client key for /api/send; a retry
+// with the same key doesn't send the file twice. The form field
+// "idempotencyKey" works too.
+const (
+	idempotencyHeader = "Idempotency-Key"
+	maxIdempotencyKey = 255
+)
+
 func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
 
+	// The body is streamed part by part. Two limits apply: MaxUploadBytes
+	// caps the file, checked against the declared fileSize and enforced on
+	// the raw body, while FormMemoryLimit caps the form fields, the only
+	// parts held in memory.
+	if max := s.config.MaxUploadBytes; max > 0 {
+		if r.ContentLength > max+multipartSlack {
+			s.uploadTooLarge(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max+multipartSlack)
+	}
+
 	mr, err := r.MultipartReader()
 	if err != nil {
-		jsonError(w, "Invalid multipart request", 400)
+		jsonError(w, ErrCodeBadRequest, "Invalid multipart request", 400)
 		return
 	}
 
 	var deviceID string
+	var username string
 	var fileSize int64
+	var haveSize bool // 0 is a valid size, so presence is tracked apart
 	var fileName string
+	var priority int
+	var requireConfirm bool
+	var resumeID string
+	idempotencyKey := r.Header.Get(idempotencyHeader)
+	fieldBudget := s.config.FormMemoryLimit()
 
 	for {
 		part, err := mr.NextPart()
@@ -305,28 +736,82 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		if err != nil {
-			jsonError(w, "Error reading part", 400)
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				s.uploadTooLarge(w)
+				return
+			}
+			jsonError(w, ErrCodeBadRequest, "Error reading part", 400)
 			return
 		}
 
+		var value string
+		if part.FormName() != "file" {
+			data, err := io.ReadAll(io.LimitReader(part, fieldBudget+1))
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				s.uploadTooLarge(w)
+				return
+			}
+			if fieldBudget -= int64(len(data)); fieldBudget < 0 {
+				jsonError(w, ErrCodeUploadTooLarge, "Form fields are too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			value = string(data)
+		}
+
 		switch part.FormName() {
 		case "deviceId":
-			data, _ := io.ReadAll(part)
-			deviceID = string(data)
+			deviceID = value
+		case "username":
+			username = value
 		case "fileSize":
-			data, _ := io.ReadAll(part)
-			fmt.Sscanf(string(data), "%d", &fileSize)
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || n < 0 {
+				jsonError(w, ErrCodeBadRequest, "fileSize must be a non-negative number", 400)
+				return
+			}
+			fileSize, haveSize = n, true
+		case "priority":
+			fmt.Sscanf(value, "%d", &priority)
+		case "requireConfirm":
+			requireConfirm = value == "true" || value == "1"
+		case "resumeId":
+			resumeID = value
+		case "idempotencyKey":
+			idempotencyKey = value
 		case "file":
 			fileName = part.FileName()
-			if deviceID == "" || fileSize == 0 {
-				jsonError(w, "deviceId and fileSize must precede the file part", 400)
+			if (deviceID == "" && username == "") || !haveSize {
+				jsonError(w, ErrCodeMissingField, "deviceId (or username) and fileSize must precede the file part", 400)
+				return
+			}
+			if s.config.MaxUploadBytes > 0 && fileSize > s.config.MaxUploadBytes {
+				s.uploadTooLarge(w)
 				return
 			}
+			if len(idempotencyKey) > maxIdempotencyKey {
+				jsonError(w, ErrCodeBadRequest, fmt.Sprintf("Idempotency key is longer than %d bytes", maxIdempotencyKey), 400)
+				return
+			}
+			if deviceID == "" {
+				var ok bool
+				if deviceID, ok = s.resolveUsername(w, username); !ok {
+					return
+				}
+			}
 			// Stream the file part directly to the transfer service
-			log.Printf("Initiating streaming transfer to %s: %s (%d bytes)", deviceID, fileName, fileSize)
-			if err := s.transfer.SendStream(deviceID, part, fileName, fileSize); err != nil {
-				log.Println("Streaming send error:", err)
-				jsonError(w, fmt.Sprintf("Transfer failed: %v", err), 500)
+			logf(r, "[SEND] Initiating streaming transfer to %s: %s (%d bytes)", deviceID, fileName, fileSize)
+			opts := transfer.SendOptions{
+				Priority:       priority,
+				RequireConfirm: requireConfirm,
+				SenderEmail:    contextUser(r).Email,
+				ResumeID:       resumeID,
+				IdempotencyKey: idempotencyKey,
+			}
+			if err := s.transfer.SendStreamWithOptions(deviceID, part, fileName, fileSize, opts); err != nil {
+				logf(r, "[SEND] Streaming send error: %v", err)
+				sendError(w, err)
 				return
 			}
 
@@ -335,7 +820,29 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	jsonError(w, "file part not found", 400)
+	jsonError(w, ErrCodeMissingField, "file part not found", 400)
+}
+
+// resolveUsername maps a username to the single device it is signed in on.
+// On failure it writes the error response (listing the candidates when the
+// name is ambiguous) and returns false.
+func (s *Server) resolveUsername(w http.ResponseWriter, username string) (string, bool) {
+	matches := s.disc.ResolvePeerByUsername(username)
+	switch len(matches) {
+	case 0:
+		jsonError(w, ErrCodePeerNotFound, fmt.Sprintf("No online device for user %s", username), 404)
+		return "", false
+	case 1:
+		return matches[0].ID, true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      fmt.Sprintf("%s is signed in on %d devices; pick one by deviceId", username, len(matches)),
+		"code":       ErrCodeAmbiguousPeer,
+		"candidates": matches,
+	})
+	return "", false
 }
 
 func (s *Server) handleAccept(w http.ResponseWriter, r *http.Request) {
@@ -345,10 +852,15 @@ func (s *Server) handleAccept(w http.ResponseWriter, r *http.Request) {
 	}
 	var body struct {
 		TransferID string `json:"transferId"`
+		DestDir    string `json:"destDir"` // optional, relative to the save root
 	}
 	json.NewDecoder(r.Body).Decode(&body)
-	if err := s.transfer.AcceptTransfer(body.TransferID); err != nil {
-		jsonError(w, err.Error(), 404)
+	if err := s.transfer.AcceptTransferTo(body.TransferID, body.DestDir); err != nil {
+		if errors.Is(err, transfer.ErrBadDestDir) {
+			jsonError(w, ErrCodeBadRequest, err.Error(), 400)
+			return
+		}
+		jsonError(w, ErrCodeNoPending, err.Error(), 404)
 		return
 	}
 	jsonOK(w, "accepted")
@@ -364,12 +876,36 @@ func (s *Server) handleReject(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewDecoder(r.Body).Decode(&body)
 	if err := s.transfer.RejectTransfer(body.TransferID); err != nil {
-		jsonError(w, err.Error(), 404)
+		jsonError(w, ErrCodeNoPending, err.Error(), 404)
 		return
 	}
 	jsonOK(w, "rejected")
 }
 
+// handleConfirm answers a send paused in awaiting_confirmation. Confirm
+// defaults to true; {"confirm": false} cancels the transfer.
+func (s *Server) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	body := struct {
+		TransferID string `json:"transferId"`
+		Confirm    *bool  `json:"confirm"`
+	}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	confirm := body.Confirm == nil || *body.Confirm
+	if err := s.transfer.ConfirmTransfer(body.TransferID, confirm); err != nil {
+		jsonError(w, ErrCodeNoPending, err.Error(), 404)
+		return
+	}
+	if confirm {
+		jsonOK(w, "confirmed")
+	} else {
+		jsonOK(w, "cancelled")
+	}
+}
+
 func (s *Server) handleActiveTransfers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	transfers := s.transfer.GetTransfers()
@@ -379,37 +915,152 @@ func (s *Server) handleActiveTransfers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(transfers)
 }
 
+// handlePendingTransfers lists incoming offers still awaiting an answer, so a
+// client that connected after their incoming_request broadcast can show them.
+func (s *Server) handlePendingTransfers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.transfer.GetPending())
+}
+
+// handleBandwidth reports this device's transfer traffic for the dashboard.
+func (s *Server) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.transfer.Bandwidth())
+}
+
+// historySkippedHeader on a history response counts records that exist but
+// couldn't be read, so the list shown is incomplete.
+const historySkippedHeader = "X-History-Skipped"
+
 func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
-	u := s.sessionUser(r)
-	history, err := s.store.GetHistory(u.Email)
+	u := contextUser(r)
+	f, err := historyFilter(r)
 	if err != nil {
-		jsonError(w, "DB error", 500)
+		jsonError(w, ErrCodeBadRequest, err.Error(), 400)
 		return
 	}
-	if history == nil {
-		history = []*models.TransferHistory{}
+	history := []*models.TransferHistory{}
+	err = s.store.EachHistory(u.Email, f, func(h *models.TransferHistory) error {
+		history = append(history, h)
+		return nil
+	})
+	var skipped *storage.SkippedRowsError
+	if errors.As(err, &skipped) {
+		// Show what could be read; the header tells the UI it isn't everything
+		w.Header().Set(historySkippedHeader, strconv.Itoa(skipped.Skipped))
+		err = nil
+	}
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(history)
 }
 
+// History sync page sizes.
+const (
+	defaultSyncLimit = 500
+	maxSyncLimit     = 1000
+)
+
+// handleHistorySync pages through the records added or changed since a
+// cursor, for a device to fill and then refresh a local copy of the
+// history. GET ?since=<cursor, RFC 3339 time, or empty for everything>&limit=N
+// returns {"items", "cursor", "more"}; pass cursor back as since for the
+// next page, or later to pick up what changed. The cursor is the last
+// record's "<updated RFC 3339 time>,<id>", so records changed in the same
+// instant are neither skipped nor repeated across a page boundary.
+func (s *Server) handleHistorySync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	q := r.URL.Query()
+	var since time.Time
+	var afterID string
+	if v := q.Get("since"); v != "" {
+		ts, id, _ := strings.Cut(v, ",")
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			jsonError(w, ErrCodeBadRequest, "since must be a cursor or an RFC 3339 time", 400)
+			return
+		}
+		since, afterID = t, id
+	}
+	limit := defaultSyncLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, ErrCodeBadRequest, "limit must be a positive number", 400)
+			return
+		}
+		limit = min(n, maxSyncLimit)
+	}
+
+	u := contextUser(r)
+	// One extra record tells whether another page follows
+	items, err := s.store.HistoryChangedSince(u.Email, since, afterID, limit+1)
+	if err != nil {
+		logf(r, "[HISTORY] Sync for %s failed: %v", u.Email, err)
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	more := len(items) > limit
+	if more {
+		items = items[:limit]
+	}
+	resp := map[string]interface{}{"items": items, "more": more, "cursor": q.Get("since")}
+	if len(items) > 0 {
+		last := items[len(items)-1]
+		resp["cursor"] = last.UpdatedAt.Format(time.RFC3339Nano) + "," + last.ID
+	} else {
+		resp["items"] = []*models.TransferHistory{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handlePeerStats(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	stats, err := s.store.GetPeerStats(u.Email)
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
-	entries, err := os.ReadDir(s.config.DownloadDir)
+	u := contextUser(r)
+	dir := s.config.UserDownloadDir(u.Email)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode([]interface{}{})
 		return
 	}
+	// The sender's type when the file arrived this session, else a guess
+	// from the extension
+	types := s.transfer.ReceivedContentTypes()
 	var files []map[string]interface{}
 	for _, e := range entries {
-		if e.IsDir() {
+		// A ".incomplete" file is a receive still in flight or one kept to
+		// resume; a sidecar only records another file's original name
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".incomplete") || transfer.IsSidecar(e.Name()) {
 			continue
 		}
 		info, _ := e.Info()
+		contentType, ok := types[filepath.Join(dir, e.Name())]
+		if !ok {
+			contentType = mime.TypeByExtension(filepath.Ext(e.Name()))
+		}
 		files = append(files, map[string]interface{}{
-			"name":      e.Name(),
-			"size":      info.Size(),
-			"timestamp": info.ModTime(),
+			"name":        e.Name(),
+			"size":        info.Size(),
+			"timestamp":   info.ModTime(),
+			"contentType": contentType,
 		})
 	}
 	if files == nil {
@@ -419,20 +1070,86 @@ func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
+// handleDownload serves a received file via http.ServeContent so Range and
+// If-Range requests work, letting browsers resume downloads and seek in media.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	dir := s.config.UserDownloadDir(u.Email)
+	rel := strings.TrimPrefix(r.URL.Path, "/dl/")
+	full := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+rel)))
+	if rel == "" || !withinDir(dir, full) || strings.HasSuffix(full, ".incomplete") {
+		jsonError(w, ErrCodeNotFound, "No such file", 404)
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		jsonError(w, ErrCodeNotFound, "No such file", 404)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		jsonError(w, ErrCodeNotFound, "No such file", 404)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// withinDir reports whether p is dir itself or lies beneath it.
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	now := time.Now()
+	client := &wsClient{remoteAddr: s.clientIP(r), connectedAt: now, lastActivity: now,
+		send: make(chan interface{}, wsSendBuffer)}
+	if c, err := r.Cookie(s.cookieName()); err == nil {
+		client.token = c.Value
+	}
+	if u := s.sessionUser(r); u != nil {
+		client.email = u.Email
+	}
 	s.wsMu.Lock()
-	s.wsClients[conn] = true
+	s.wsClients[conn] = client
 	s.wsMu.Unlock()
+	go writeWS(conn, client.send)
+
+	// Any message or pong counts as activity and pushes the deadline back
+	alive := func() {
+		s.wsMu.Lock()
+		client.lastActivity = time.Now()
+		s.wsMu.Unlock()
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	}
+	conn.SetReadDeadline(now.Add(wsIdleTimeout))
+	conn.SetPongHandler(func(string) error { alive(); return nil })
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			case <-done:
+				return
+			}
+		}
+	}()
 
-	// Keep alive — read pump to detect disconnects
+	// Read pump to detect disconnects
 	go func() {
 		defer func() {
+			close(done)
 			s.wsMu.Lock()
-			delete(s.wsClients, conn)
+			s.removeWS(conn)
 			s.wsMu.Unlock()
 			conn.Close()
 		}()
@@ -440,12 +1157,46 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 			if _, _, err := conn.ReadMessage(); err != nil {
 				break
 			}
+			alive()
 		}
 	}()
 }
 
 // ---- Helpers ----
 
+// enforceSingleSession ends email's other sessions when SingleSession is
+// set, telling their open pages to go back to the sign-in screen.
+func (s *Server) enforceSingleSession(r *http.Request, email string) {
+	if !s.config.SingleSession {
+		return
+	}
+	revoked := s.store.DeleteSessionsForUser(email)
+	if len(revoked) == 0 {
+		return
+	}
+	set := make(map[string]bool, len(revoked))
+	for _, t := range revoked {
+		set[t] = true
+	}
+	msg := map[string]interface{}{
+		"type":    models.EventSessionRevoked,
+		"payload": map[string]string{"reason": "signed in elsewhere"},
+	}
+	s.wsMu.Lock()
+	for conn, c := range s.wsClients {
+		if set[c.token] {
+			// Sent last; the writer closes the socket after it
+			select {
+			case c.send <- msg:
+			default:
+			}
+			s.removeWS(conn)
+		}
+	}
+	s.wsMu.Unlock()
+	logf(r, "[AUTH] Ended %d other sessions for %s", len(revoked), email)
+}
+
 func (s *Server) cookieName() string {
 	return fmt.Sprintf("ft_session_%d", s.config.ServerPort)
 }
@@ -456,7 +1207,14 @@ func (s *Server) sessionCookie(token string) *http.Cookie {
 		Value:    token,
 		Path:     "/",
 		HttpOnly: true,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  time.Now().Add(storage.SessionTTL),
+	}
+}
+
+// ensureUserDir creates the user's download directory if it doesn't exist yet.
+func (s *Server) ensureUserDir(r *http.Request, email string) {
+	if err := os.MkdirAll(s.config.UserDownloadDir(email), 0755); err != nil {
+		logf(r, "[FILES] Cannot create download dir for %s: %v", email, err)
 	}
 }
 
@@ -465,8 +1223,10 @@ func jsonOK(w http.ResponseWriter, msg string) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": msg})
 }
 
-func jsonError(w http.ResponseWriter, msg string, code int) {
+// jsonError writes {"error": msg, "code": code}. error is for people; code
+// is a stable identifier clients can branch on.
+func jsonError(w http.ResponseWriter, code, msg string, status int) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
 }
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"filetransfer/internal/models"
+)
+
+const authActivityLimit = 50
+
+// clientIP returns the caller's address: the last X-Forwarded-For entry
+// when TrustProxy is set, otherwise the connection's remote host. The
+// trusted proxy appends the address it saw, so earlier entries are whatever
+// the client chose to send.
+func (s *Server) clientIP(r *http.Request) string {
+	if fwd := r.Header.Values("X-Forwarded-For"); s.config.TrustProxy && len(fwd) > 0 {
+		last := fwd[len(fwd)-1]
+		if i := strings.LastIndex(last, ","); i >= 0 {
+			last = last[i+1:]
+		}
+		if last = strings.TrimSpace(last); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records an auth event for email. Failures are logged, never fatal
+// to the request.
+func (s *Server) audit(r *http.Request, email, event string) {
+	if err := s.store.RecordAuthEvent(email, event, s.clientIP(r), r.UserAgent()); err != nil {
+		logf(r, "[AUTH] Cannot record %s for %s: %v", event, email, err)
+	}
+}
+
+// handleAuthActivity lists the signed-in user's recent account activity.
+func (s *Server) handleAuthActivity(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	events, err := s.store.GetAuthEvents(u.Email, authActivityLimit)
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	if events == nil {
+		events = []*models.AuthEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"embed"
+	"net/http/httptest"
+	"testing"
+
+	"filetransfer/internal/config"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		trust bool
+		fwd   []string
+		want  string
+	}{
+		{false, []string{"203.0.113.9"}, "192.0.2.1"},
+		{true, nil, "192.0.2.1"},
+		{true, []string{"203.0.113.9"}, "203.0.113.9"},
+		// A client can prepend anything; the proxy's entry is the last
+		{true, []string{"10.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{true, []string{"10.0.0.1", "198.51.100.7,203.0.113.9 "}, "203.0.113.9"},
+		{true, []string{"10.0.0.1,"}, "192.0.2.1"},
+	} {
+		s := NewServer(config.Config{TrustProxy: tc.trust}, nil, nil, nil, "127.0.0.1", embed.FS{})
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		for _, v := range tc.fwd {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("clientIP(trust=%v, %q) = %s, want %s", tc.trust, tc.fwd, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDeviceNameLen bounds a device name, in characters.
+const maxDeviceNameLen = 64
+
+// DeviceName returns the name this device currently advertises.
+func (s *Server) DeviceName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deviceName
+}
+
+// handleDeviceName renames this device. POST {"name"}. Peers see the new
+// name on the next announcement; it is saved to DeviceNameFile so it
+// survives a restart. Only the device owner or an admin may rename it.
+func (s *Server) handleDeviceName(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	u := contextUser(r)
+	if !u.IsAdmin && !strings.EqualFold(u.Email, s.GetUsername()) {
+		jsonError(w, ErrCodeForbidden, "Only the device owner or an admin can rename it", http.StatusForbidden)
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		jsonError(w, ErrCodeMissingField, "name is required", 400)
+		return
+	}
+	if utf8.RuneCountInString(name) > maxDeviceNameLen || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		jsonError(w, ErrCodeBadRequest, "Name must be at most 64 characters with no control characters", 400)
+		return
+	}
+
+	s.mu.Lock()
+	old := s.deviceName
+	s.deviceName = name
+	s.mu.Unlock()
+	s.transfer.SetDeviceName(name)
+	s.announce()
+	logf(r, "[SETTINGS] %s renamed the device from %q to %q", u.Email, old, name)
+
+	if path := s.config.DeviceNameFile; path != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(name+"\n"), 0600)
+		}
+		if err != nil {
+			logf(r, "[SETTINGS] Cannot save device name: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"deviceName": name})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"filetransfer/internal/transfer"
+)
+
+// Error codes returned in the "code" field of error responses. They are part
+// of the API: don't rename them.
+const (
+	ErrCodeBadRequest         = "BAD_REQUEST"
+	ErrCodeMissingField       = "MISSING_FIELD"
+	ErrCodeInvalidEmail       = "INVALID_EMAIL"
+	ErrCodeWeakPassword       = "WEAK_PASSWORD"
+	ErrCodeEmailTaken         = "EMAIL_TAKEN"
+	ErrCodeInvalidCredentials = "INVALID_CREDENTIALS"
+	ErrCodeUnauthorized       = "UNAUTHORIZED"
+	ErrCodeForbidden          = "FORBIDDEN"
+	ErrCodeInvalidToken       = "INVALID_TOKEN"
+	ErrCodePeerNotFound       = "PEER_NOT_FOUND"
+	ErrCodeAmbiguousPeer      = "AMBIGUOUS_PEER"
+	ErrCodeSelfTransfer       = "SELF_TRANSFER"
+	ErrCodeTransferRejected   = "TRANSFER_REJECTED"
+	ErrCodeTransferCancelled  = "TRANSFER_CANCELLED"
+	ErrCodeTransferFailed     = "TRANSFER_FAILED"
+	ErrCodeNoPending          = "NO_PENDING_TRANSFER"
+	ErrCodeInProgress         = "TRANSFER_IN_PROGRESS"
+	ErrCodeUploadInterrupted  = "UPLOAD_INTERRUPTED"
+	ErrCodeUploadTooLarge     = "UPLOAD_TOO_LARGE"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeFileGone           = "FILE_GONE"
+	ErrCodePeerOffline        = "PEER_OFFLINE"
+	ErrCodePeerCertMismatch   = "PEER_CERT_MISMATCH"
+	ErrCodeUnsupportedMedia   = "UNSUPPORTED_MEDIA_TYPE"
+	ErrCodeFetchFailed        = "FETCH_FAILED"
+	ErrCodeInternal           = "INTERNAL"
+)
+
+// uploadTooLarge writes the 413 response for an upload over MaxUploadBytes.
+func (s *Server) uploadTooLarge(w http.ResponseWriter) {
+	jsonError(w, ErrCodeUploadTooLarge,
+		fmt.Sprintf("File exceeds the %d byte upload limit", s.config.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+}
+
+// sendError maps a SendStream error to a response.
+func sendError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, transfer.ErrSelfTransfer):
+		jsonError(w, ErrCodeSelfTransfer, err.Error(), 400)
+	case errors.Is(err, transfer.ErrBadFileName):
+		jsonError(w, ErrCodeBadRequest, err.Error(), 400)
+	case errors.Is(err, transfer.ErrPeerNotFound):
+		jsonError(w, ErrCodePeerNotFound, err.Error(), 404)
+	case errors.Is(err, transfer.ErrRejected):
+		jsonError(w, ErrCodeTransferRejected, err.Error(), 409)
+	case errors.Is(err, transfer.ErrCancelled):
+		jsonError(w, ErrCodeTransferCancelled, err.Error(), 409)
+	case errors.Is(err, transfer.ErrNotResumable):
+		jsonError(w, ErrCodeNotFound, err.Error(), 404)
+	case errors.Is(err, transfer.ErrInProgress):
+		jsonError(w, ErrCodeInProgress, err.Error(), 409)
+	case errors.Is(err, transfer.ErrCertMismatch):
+		jsonError(w, ErrCodePeerCertMismatch, err.Error(), 409)
+	default:
+		jsonError(w, ErrCodeTransferFailed, fmt.Sprintf("Transfer failed: %v", err), 500)
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filetransfer/internal/models"
+	"filetransfer/internal/storage"
+)
+
+// historyFilter reads the history filters shared by /api/history and its
+// export: direction, status, peer, and since/until as RFC 3339 times or
+// YYYY-MM-DD dates.
+func historyFilter(r *http.Request) (storage.HistoryFilter, error) {
+	q := r.URL.Query()
+	f := storage.HistoryFilter{
+		Direction: q.Get("direction"),
+		Status:    q.Get("status"),
+		PeerName:  q.Get("peer"),
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 time or a YYYY-MM-DD date", bound.name)
+			}
+		}
+		*bound.dst = t
+	}
+	return f, nil
+}
+
+var historyCSVHeader = []string{
+	"id", "timestamp", "direction", "peer_name", "peer_id", "file_name", "file_size",
+	"transferred", "status", "average_speed_mbps", "compression_ratio", "bytes_saved",
+	"device_name", "content_type",
+}
+
+// handleHistoryExport downloads the user's history, filtered like
+// /api/history, as CSV or JSON (?format=csv|json). Records are written as
+// they are read from the database, so a large history is never held in
+// memory; a failure partway leaves the download truncated.
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	f, err := historyFilter(r)
+	if err != nil {
+		jsonError(w, ErrCodeBadRequest, err.Error(), 400)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		jsonError(w, ErrCodeBadRequest, "format must be csv or json", 400)
+		return
+	}
+
+	name := fmt.Sprintf("transfer-history-%s.%s", time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	flusher, _ := w.(http.Flusher)
+	const flushEvery = 500
+	n := 0
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(historyCSVHeader)
+		err = s.store.EachHistory(u.Email, f, func(h *models.TransferHistory) error {
+			cw.Write([]string{
+				h.ID, h.Timestamp.UTC().Format(time.RFC3339), h.Direction, h.PeerName, h.PeerID,
+				h.FileName, strconv.FormatInt(h.FileSize, 10), strconv.FormatInt(h.Transferred, 10),
+				h.Status, strconv.FormatFloat(h.AverageSpeed, 'f', 3, 64),
+				strconv.FormatFloat(h.CompressionRatio, 'f', 3, 64), strconv.FormatInt(h.BytesSaved, 10),
+				h.DeviceName, h.ContentType,
+			})
+			if n++; n%flushEvery == 0 {
+				cw.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return cw.Error()
+		})
+		cw.Flush()
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+		err = s.store.EachHistory(u.Email, f, func(h *models.TransferHistory) error {
+			item, err := json.Marshal(h)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				w.Write([]byte(","))
+			}
+			if _, err := w.Write(item); err != nil {
+				return err
+			}
+			if n++; n%flushEvery == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+		w.Write([]byte("]\n"))
+	}
+	var skipped *storage.SkippedRowsError
+	if errors.As(err, &skipped) {
+		logf(r, "[HISTORY] Exported %d records for %s as %s, %d unreadable ones left out", n, u.Email, format, skipped.Skipped)
+		return
+	}
+	if err != nil {
+		logf(r, "[HISTORY] Export for %s stopped after %d records: %v", u.Email, n, err)
+		return
+	}
+	logf(r, "[HISTORY] Exported %d records for %s as %s", n, u.Email, format)
+}
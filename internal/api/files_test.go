@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/discovery"
+	"filetransfer/internal/models"
+	"filetransfer/internal/transfer"
+)
+
+func TestFilesHidePartials(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir()}
+	dir := cfg.UserDownloadDir("a@example.com")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "done.txt"), []byte("done"), 0644)
+	os.WriteFile(filepath.Join(dir, "big.iso.incomplete"), []byte("half"), 0644)
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "me", nil)
+	s := NewServer(cfg, nil, disc, nil, "127.0.0.1", embed.FS{})
+	s.SetTransfer(transfer.NewService(cfg, "me", nil, disc, func(string, interface{}) {}, func() string { return "" }))
+	do := func(h func(w http.ResponseWriter, r *http.Request), target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, &models.User{Email: "a@example.com"}))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	var files []map[string]interface{}
+	json.NewDecoder(do(s.handleFiles, "/api/files").Body).Decode(&files)
+	if len(files) != 1 || files[0]["name"] != "done.txt" {
+		t.Errorf("files %v", files)
+	}
+	if w := do(s.handleDownload, "/dl/done.txt"); w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Errorf("download: %d %q", w.Code, w.Body)
+	}
+	if w := do(s.handleDownload, "/dl/big.iso.incomplete"); w.Code != http.StatusNotFound {
+		t.Errorf("download of a partial: %d", w.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"filetransfer/internal/models"
+)
+
+// maxGroupName bounds a device group's name.
+const maxGroupName = 32
+
+// deviceView is a device as the signed-in user sees it, with their groups.
+type deviceView struct {
+	*models.Device
+	Groups []string `json:"groups,omitempty"`
+}
+
+// normalizeGroups trims, lowercases and dedupes group names, so "Office"
+// and "office " are one group.
+func normalizeGroups(groups []string) ([]string, error) {
+	seen := make(map[string]bool, len(groups))
+	var out []string
+	for _, g := range groups {
+		g = strings.ToLower(strings.TrimSpace(g))
+		if g == "" || seen[g] {
+			continue
+		}
+		if len(g) > maxGroupName {
+			return nil, fmt.Errorf("group name %q is longer than %d bytes", g, maxGroupName)
+		}
+		seen[g] = true
+		out = append(out, g)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// handleDeviceGroups manages the signed-in user's device groups:
+// GET returns {deviceId: [groups]}, POST {deviceId, groups} replaces a
+// device's groups (an empty list ungroups it). Groups are keyed by device
+// ID, like trusted devices.
+func (s *Server) handleDeviceGroups(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		groups, err := s.store.ListDeviceGroups(u.Email)
+		if err != nil {
+			jsonError(w, ErrCodeInternal, "DB error", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+
+	case http.MethodPost:
+		var body struct {
+			DeviceID string   `json:"deviceId"`
+			Groups   []string `json:"groups"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			jsonError(w, ErrCodeBadRequest, "Invalid request body", 400)
+			return
+		}
+		if body.DeviceID == "" {
+			jsonError(w, ErrCodeMissingField, "deviceId is required", 400)
+			return
+		}
+		groups, err := normalizeGroups(body.Groups)
+		if err != nil {
+			jsonError(w, ErrCodeBadRequest, err.Error(), 400)
+			return
+		}
+		if err := s.store.SetDeviceGroups(u.Email, body.DeviceID, groups); err != nil {
+			jsonError(w, ErrCodeInternal, "DB error", 500)
+			return
+		}
+		logf(r, "[GROUPS] %s put %s in %v", u.Email, body.DeviceID, groups)
+		jsonOK(w, "groups updated")
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
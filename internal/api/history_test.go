@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/models"
+	"filetransfer/internal/storage/storagemock"
+)
+
+func TestHistorySyncPaging(t *testing.T) {
+	store := storagemock.New()
+	for _, id := range []string{"a", "b", "c"} {
+		store.AddHistory("a@example.com", &models.TransferHistory{ID: id, Direction: "send", Status: "completed"})
+	}
+	s := NewServer(config.Config{}, store, nil, nil, "127.0.0.1", embed.FS{})
+
+	var got []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 3 {
+			t.Fatalf("paging did not finish: %v", got)
+		}
+		r := httptest.NewRequest("GET", "/api/history/sync?limit=1&since="+url.QueryEscape(cursor), nil)
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, &models.User{Email: "a@example.com"}))
+		w := httptest.NewRecorder()
+		s.handleHistorySync(w, r)
+		var resp struct {
+			Items  []*models.TransferHistory `json:"items"`
+			Cursor string                    `json:"cursor"`
+			More   bool                      `json:"more"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("page %d: %d %v", page, w.Code, err)
+		}
+		for _, h := range resp.Items {
+			got = append(got, h.ID)
+		}
+		cursor = resp.Cursor
+		if !resp.More {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("synced %v", got)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"embed"
+	"testing"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/storage/storagemock"
+)
+
+func TestDeviceOwner(t *testing.T) {
+	store := storagemock.New()
+	s := NewServer(config.Config{}, store, nil, nil, "127.0.0.1", embed.FS{})
+
+	a := store.CreateSession("a@example.com")
+	s.claimOwner(nil, "a@example.com")
+	store.CreateSession("b@example.com")
+	s.claimOwner(nil, "b@example.com")
+	if got := s.GetUsername(); got != "a@example.com" {
+		t.Fatalf("owner %q, want the first to sign in", got)
+	}
+
+	// The owner's last session ending, by sign-out, expiry or revocation,
+	// hands the device on
+	store.DeleteSession(a)
+	s.releaseOwner(nil)
+	if got := s.GetUsername(); got != "b@example.com" {
+		t.Errorf("owner %q after the owner's session ended", got)
+	}
+	store.DeleteSessionsForUser("b@example.com")
+	s.releaseOwner(nil)
+	if got := s.GetUsername(); got != "" {
+		t.Errorf("owner %q with nobody signed in", got)
+	}
+
+	// A sign-in takes over from an owner whose sessions lapsed unnoticed
+	s.owner = "gone@example.com"
+	store.CreateSession("c@example.com")
+	s.claimOwner(nil, "c@example.com")
+	if got := s.GetUsername(); got != "c@example.com" {
+		t.Errorf("owner %q, want the new sign-in", got)
+	}
+
+	fixed := NewServer(config.Config{DeviceOwner: "admin@example.com"}, store, nil, nil, "127.0.0.1", embed.FS{})
+	fixed.releaseOwner(nil)
+	fixed.claimOwner(nil, "c@example.com")
+	if got := fixed.GetUsername(); got != "admin@example.com" {
+		t.Errorf("configured owner replaced by %q", got)
+	}
+}
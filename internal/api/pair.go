@@ -0,0 +1,138 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"filetransfer/internal/models"
+	"filetransfer/pkg/qrcode"
+)
+
+const pairTokenTTL = 5 * time.Minute
+
+// pairTokens holds outstanding single-use QR pairing tokens → expiry.
+type pairTokens struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+func (p *pairTokens) issue() (string, time.Time) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	token := fmt.Sprintf("%x", b)
+	exp := time.Now().Add(pairTokenTTL)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens == nil {
+		p.tokens = make(map[string]time.Time)
+	}
+	for t, e := range p.tokens {
+		if time.Now().After(e) {
+			delete(p.tokens, t)
+		}
+	}
+	p.tokens[token] = exp
+	return token, exp
+}
+
+// redeem consumes token, reporting whether it was valid and unexpired.
+func (p *pairTokens) redeem(token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	exp, ok := p.tokens[token]
+	delete(p.tokens, token)
+	return ok && time.Now().Before(exp)
+}
+
+// handlePairQR returns a QR code encoding how to reach this device plus a
+// fresh pairing token. ?format=dataurl returns JSON with a data: URL instead
+// of a raw PNG.
+func (s *Server) handlePairQR(w http.ResponseWriter, r *http.Request) {
+	token, exp := s.pairing.issue()
+	payload, _ := json.Marshal(map[string]interface{}{
+		"ip":       s.currentIP(),
+		"port":     s.config.TransferPort,
+		"webPort":  s.config.ServerPort,
+		"token":    token,
+		"claimUrl": fmt.Sprintf("%s://%s/api/pair/claim", s.config.WebScheme(), net.JoinHostPort(s.currentIP(), fmt.Sprint(s.config.ServerPort))),
+	})
+
+	code, err := qrcode.Encode(payload)
+	if err != nil {
+		jsonError(w, ErrCodeInternal, err.Error(), 500)
+		return
+	}
+	img, err := code.PNG(8)
+	if err != nil {
+		jsonError(w, ErrCodeInternal, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "dataurl" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"dataUrl":   "data:image/png;base64," + base64.StdEncoding.EncodeToString(img),
+			"token":     token,
+			"expiresAt": exp,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(img)
+}
+
+// handlePairClaim lets a device that scanned our QR code register itself as
+// a manual peer. The single-use token stands in for a session, so this route
+// is not behind requireAuth.
+func (s *Server) handlePairClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		Token    string `json:"token"`
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Username string `json:"username"`
+		Port     int    `json:"port"`
+
+		Capabilities    []string `json:"capabilities"`
+		CertFingerprint string   `json:"certFingerprint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, ErrCodeBadRequest, "Invalid request", 400)
+		return
+	}
+	if body.ID == "" || body.Port <= 0 {
+		jsonError(w, ErrCodeMissingField, "id and port required", 400)
+		return
+	}
+	if !s.pairing.redeem(body.Token) {
+		jsonError(w, ErrCodeInvalidToken, "Invalid or expired pairing token", 403)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	s.disc.AddManualPeer(&models.Device{
+		ID:       body.ID,
+		Name:     body.Name,
+		Username: body.Username,
+		IP:       host,
+		Port:     body.Port,
+
+		Capabilities:    body.Capabilities,
+		CertFingerprint: body.CertFingerprint,
+	})
+	logf(r, "[PAIR] Claimed by %s (%s) from %s", body.Username, body.ID, host)
+	jsonOK(w, "paired")
+}
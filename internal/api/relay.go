@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"filetransfer/internal/models"
+	"filetransfer/internal/transfer"
+)
+
+// HTTP relay: for clients that can reach this web server but not a peer's raw
+// TCP transfer port.
+//
+//	POST /api/transfer/relay?deviceId=X&fileName=Y   body = raw file bytes
+//	    Streams the body straight to peer X via SendStream (push).
+//	POST /api/transfer/relay?fileName=Y&to=email     body = raw file bytes
+//	    Stages the file on this server for that user and returns its id (pull).
+//	GET  /api/transfer/relay/{id}
+//	    The recipient downloads a staged file once; it is deleted after a
+//	    full read.
+
+const (
+	relayTTL = time.Hour
+	// relayPurgeInterval is how often expired staged files are deleted.
+	relayPurgeInterval = 5 * time.Minute
+	// relayLeaseTimeout is how long a download holds a staged file before
+	// another request may fetch it again.
+	relayLeaseTimeout = 15 * time.Minute
+)
+
+type relayItem struct {
+	ID        string    `json:"id"`
+	FileName  string    `json:"fileName"`
+	FileSize  int64     `json:"fileSize"`
+	From      string    `json:"from"`
+	To        string    `json:"to"` // the only user who may fetch it
+	CreatedAt time.Time `json:"createdAt"`
+	path      string
+	// leasedUntil is set while a download is in progress
+	leasedUntil time.Time
+}
+
+type relayStore struct {
+	mu    sync.Mutex
+	items map[string]*relayItem
+}
+
+func (rs *relayStore) put(it *relayItem) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.items == nil {
+		rs.items = make(map[string]*relayItem)
+	}
+	rs.items[it.ID] = it
+}
+
+// purgeLocked deletes expired items and their files, except those being
+// downloaded; rs.mu held.
+func (rs *relayStore) purgeLocked() {
+	for k, it := range rs.items {
+		if time.Since(it.CreatedAt) > relayTTL && !time.Now().Before(it.leasedUntil) {
+			os.Remove(it.path)
+			delete(rs.items, k)
+		}
+	}
+}
+
+// lease returns the item if it exists, hasn't expired and is addressed to
+// email, and holds it for one download; leased reports that another
+// download already holds it. The item stays until done is called.
+func (rs *relayStore) lease(id, email string) (it *relayItem, leased bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.purgeLocked()
+	it, ok := rs.items[id]
+	if !ok || it.To != email {
+		return nil, false
+	}
+	if time.Now().Before(it.leasedUntil) {
+		return nil, true
+	}
+	it.leasedUntil = time.Now().Add(relayLeaseTimeout)
+	return it, false
+}
+
+// done ends a lease: a fetched item is deleted with its file, otherwise it
+// is released for a retry.
+func (rs *relayStore) done(it *relayItem, fetched bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if fetched {
+		os.Remove(it.path)
+		delete(rs.items, it.ID)
+		return
+	}
+	it.leasedUntil = time.Time{}
+}
+
+// runPurge deletes expired items periodically, so files nobody fetches
+// don't stay on disk.
+func (rs *relayStore) runPurge() {
+	for range time.Tick(relayPurgeInterval) {
+		rs.mu.Lock()
+		rs.purgeLocked()
+		rs.mu.Unlock()
+	}
+}
+
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/transfer/relay":
+		s.handleRelayUpload(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/transfer/relay/"):
+		s.handleRelayFetch(w, r, strings.TrimPrefix(r.URL.Path, "/api/transfer/relay/"))
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+func (s *Server) handleRelayUpload(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	q := r.URL.Query()
+	fileName := filepath.Base(q.Get("fileName"))
+	if fileName == "." || fileName == "/" {
+		jsonError(w, ErrCodeMissingField, "fileName required", 400)
+		return
+	}
+	fileSize := r.ContentLength
+	if v := q.Get("fileSize"); v != "" {
+		fileSize, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if max := s.config.MaxUploadBytes; max > 0 {
+		if fileSize > max || r.ContentLength > max {
+			s.uploadTooLarge(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+
+	if deviceID := q.Get("deviceId"); deviceID != "" {
+		if fileSize <= 0 {
+			jsonError(w, ErrCodeMissingField, "Content-Length or fileSize required", 400)
+			return
+		}
+		logf(r, "[RELAY] %s → %s: %s (%d bytes)", u.Email, deviceID, fileName, fileSize)
+		opts := transfer.SendOptions{SenderEmail: u.Email}
+		if err := s.transfer.SendStreamWithOptions(deviceID, r.Body, fileName, fileSize, opts); err != nil {
+			sendError(w, err)
+			return
+		}
+		jsonOK(w, "transfer completed")
+		return
+	}
+
+	// No target device: stage for a later pull by the named user
+	to := strings.TrimSpace(q.Get("to"))
+	if to == "" {
+		jsonError(w, ErrCodeMissingField, "deviceId or to required", 400)
+		return
+	}
+	if !s.knownRecipient(to) {
+		jsonError(w, ErrCodeBadRequest, "Unknown recipient", 400)
+		return
+	}
+	f, err := os.CreateTemp(s.config.UploadStagingDir(), "filetransfer-relay-*")
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "Cannot stage upload", 500)
+		return
+	}
+	n, err := io.Copy(f, r.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			s.uploadTooLarge(w)
+			return
+		}
+		jsonError(w, ErrCodeUploadInterrupted, "Upload interrupted", 400)
+		return
+	}
+	it := &relayItem{
+		ID:        uuid.New().String(),
+		FileName:  fileName,
+		FileSize:  n,
+		From:      u.Email,
+		To:        to,
+		CreatedAt: time.Now(),
+		path:      f.Name(),
+	}
+	s.relays.put(it)
+	logf(r, "[RELAY] Staged %s (%d bytes) from %s as %s", fileName, n, u.Email, it.ID)
+	s.notifyUsers(models.EventRelayAvailable, it, it.From, it.To)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(it)
+}
+
+// knownRecipient reports whether email is a user registered here or is
+// signed in on a device on the LAN.
+func (s *Server) knownRecipient(email string) bool {
+	if u, err := s.store.GetUserByEmail(email); err == nil && u != nil {
+		return true
+	}
+	return s.disc != nil && len(s.disc.ResolvePeerByUsername(email)) > 0
+}
+
+func (s *Server) handleRelayFetch(w http.ResponseWriter, r *http.Request, id string) {
+	u := contextUser(r)
+	it, leased := s.relays.lease(id, u.Email)
+	if leased {
+		jsonError(w, ErrCodeInProgress, "The relayed file is already being downloaded", http.StatusConflict)
+		return
+	}
+	if it == nil {
+		jsonError(w, ErrCodeNotFound, "No such relayed file", 404)
+		return
+	}
+	f, err := os.Open(it.path)
+	if err != nil {
+		s.relays.done(it, true)
+		jsonError(w, ErrCodeNotFound, "Relayed file is gone", 410)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(it.FileSize, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", it.FileName))
+	if _, err := io.Copy(w, f); err != nil {
+		// Client dropped mid-download; keep it for a retry
+		s.relays.done(it, false)
+		return
+	}
+	s.relays.done(it, true)
+	logf(r, "[RELAY] %s fetched %s (%s)", u.Email, it.FileName, it.ID)
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/models"
+	"filetransfer/internal/storage/storagemock"
+)
+
+func TestRelayStaging(t *testing.T) {
+	store := storagemock.New()
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		store.RegisterUser(email, "password123")
+	}
+	s := NewServer(config.Config{StagingDir: t.TempDir()}, store, nil, nil, "127.0.0.1", embed.FS{})
+	clients := map[string]*wsClient{}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", ""} {
+		c := &wsClient{email: email, send: make(chan interface{}, 4)}
+		s.wsClients[new(websocket.Conn)] = c
+		clients[email] = c
+	}
+	do := func(method, target, body, email string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, &models.User{Email: email}))
+		w := httptest.NewRecorder()
+		s.handleRelay(w, r)
+		return w
+	}
+
+	if w := do("POST", "/api/transfer/relay?fileName=a.txt", "data", "a@example.com"); w.Code != 400 {
+		t.Errorf("staging without a recipient: %d", w.Code)
+	}
+	if w := do("POST", "/api/transfer/relay?fileName=a.txt&to=nobody@example.com", "data", "a@example.com"); w.Code != 400 {
+		t.Errorf("staging for an unknown recipient: %d", w.Code)
+	}
+	if w := do("POST", "/api/transfer/relay?fileName=a.txt&to=b@example.com", "data", "a@example.com"); w.Code != http.StatusCreated {
+		t.Fatalf("staging: %d %s", w.Code, w.Body)
+	}
+	for email, want := range map[string]int{"a@example.com": 1, "b@example.com": 1, "c@example.com": 0, "": 0} {
+		if got := len(clients[email].send); got != want {
+			t.Errorf("%q got %d relay_available messages, want %d", email, got, want)
+		}
+	}
+	var id string
+	for _, it := range s.relays.items {
+		id = it.ID
+	}
+	if w := do("GET", "/api/transfer/relay/"+id, "", "c@example.com"); w.Code != 404 {
+		t.Errorf("another user fetched it: %d", w.Code)
+	}
+	// A download in progress holds the item until it ends
+	it, _ := s.relays.lease(id, "b@example.com")
+	if w := do("GET", "/api/transfer/relay/"+id, "", "b@example.com"); w.Code != http.StatusConflict {
+		t.Errorf("concurrent fetch: %d", w.Code)
+	}
+	s.relays.done(it, false)
+	if w := do("GET", "/api/transfer/relay/"+id, "", "b@example.com"); w.Code != 200 || w.Body.String() != "data" {
+		t.Errorf("recipient fetch: %d %q", w.Code, w.Body)
+	}
+
+	// Nobody fetches this one; the purge removes it once expired
+	do("POST", "/api/transfer/relay?fileName=old.txt&to=b@example.com", "data", "a@example.com")
+	s.relays.mu.Lock()
+	var path string
+	for _, it := range s.relays.items {
+		it.CreatedAt = time.Now().Add(-2 * relayTTL)
+		path = it.path
+	}
+	s.relays.purgeLocked()
+	left := len(s.relays.items)
+	s.relays.mu.Unlock()
+	if _, err := os.Stat(path); left != 0 || !os.IsNotExist(err) {
+		t.Errorf("expired item kept: %d items, stat %v", left, err)
+	}
+}
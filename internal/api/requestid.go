@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the correlation ID. An incoming value is reused
+// so IDs can be followed across proxies; otherwise one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with an ID, stores it in the request
+// context and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID, or "" outside it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf is log.Printf with the request's ID prepended. Helpers that also run
+// outside any request pass a nil r, which logs without an ID.
+func logf(r *http.Request, format string, args ...interface{}) {
+	if r == nil {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[req %s] %s", requestID(r), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"filetransfer/internal/models"
+	"filetransfer/internal/storage"
+	"filetransfer/internal/transfer"
+)
+
+// handleResend sends the file behind one of the user's history entries to
+// the same peer again. POST {"id"}. Only files this server holds can be
+// resent: received ones, while still in the download directory. Browser
+// uploads stream straight through and aren't kept. The transfer runs in the
+// background and reports progress over the WebSocket like any other.
+func (s *Server) handleResend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		jsonError(w, ErrCodeMissingField, "id is required", 400)
+		return
+	}
+
+	u := contextUser(r)
+	history, err := s.store.GetHistory(u.Email)
+	var skipped *storage.SkippedRowsError
+	if err != nil && !errors.As(err, &skipped) {
+		jsonError(w, ErrCodeInternal, "DB error", 500)
+		return
+	}
+	var item *models.TransferHistory
+	for _, h := range history {
+		if h.ID == body.ID {
+			item = h
+			break
+		}
+	}
+	if item == nil {
+		jsonError(w, ErrCodeNotFound, "No such history entry", 404)
+		return
+	}
+
+	if item.FilePath == "" {
+		jsonError(w, ErrCodeFileGone, "This server doesn't keep a copy of that file; send it again from your computer", http.StatusGone)
+		return
+	}
+	// Received files live in the user's download directory or under SaveRoot
+	bases := []string{s.config.UserDownloadDir(u.Email), s.config.SaveRoot}
+	f, info, err := transfer.OpenLocalFile(item.FilePath, bases)
+	if errors.Is(err, transfer.ErrUnsafePath) {
+		logf(r, "[SEND] Refusing to resend %s: %v", item.FilePath, err)
+		jsonError(w, ErrCodeForbidden, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		jsonError(w, ErrCodeFileGone, fmt.Sprintf("%s no longer exists on this server", item.FileName), http.StatusGone)
+		return
+	}
+
+	peerID := item.PeerID
+	if peerID == "" || !s.disc.Online(peerID) {
+		if len(s.disc.ResolvePeerByUsername(item.PeerName)) == 0 {
+			f.Close()
+			jsonError(w, ErrCodePeerOffline, fmt.Sprintf("%s is not online", item.PeerName), http.StatusConflict)
+			return
+		}
+		var ok bool
+		if peerID, ok = s.resolveUsername(w, item.PeerName); !ok {
+			f.Close()
+			return
+		}
+	}
+
+	logf(r, "[SEND] Resending %s (%d bytes) to %s from history", item.FileName, info.Size(), peerID)
+	go func() {
+		defer f.Close()
+		opts := transfer.SendOptions{SenderEmail: u.Email}
+		if err := s.transfer.SendStreamWithOptions(peerID, f, item.FileName, info.Size(), opts); err != nil {
+			logf(r, "[SEND] Resend of %s failed: %v", item.FileName, err)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "sending", "peerId": peerID, "fileName": item.FileName})
+}
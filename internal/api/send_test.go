@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/discovery"
+	"filetransfer/internal/models"
+	"filetransfer/internal/transfer"
+)
+
+func TestSendZeroByteFile(t *testing.T) {
+	// A receiver that accepts every offer and reports the size it was offered
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	offered := make(chan int64, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		line, _ := r.ReadBytes('\n')
+		var meta struct {
+			FileSize int64 `json:"fileSize"`
+		}
+		json.Unmarshal(line, &meta)
+		offered <- meta.FileSize
+		json.NewEncoder(conn).Encode(map[string]bool{"accept": true})
+		io.Copy(io.Discard, r)
+	}()
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{ID: "receiver", IP: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port})
+	s := NewServer(config.Config{}, nil, disc, nil, "127.0.0.1", embed.FS{})
+	s.SetTransfer(transfer.NewService(config.Config{ChunkSize: 1024}, "sender", nil, disc,
+		func(string, interface{}) {}, func() string { return "a@example.com" }))
+
+	send := func(fields [][2]string) int {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, f := range fields {
+			mw.WriteField(f[0], f[1])
+		}
+		mw.CreateFormFile("file", "empty.txt")
+		mw.Close()
+		r := httptest.NewRequest("POST", "/api/transfer/send", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, &models.User{Email: "a@example.com"}))
+		w := httptest.NewRecorder()
+		s.handleSend(w, r)
+		return w.Code
+	}
+
+	if code := send([][2]string{{"deviceId", "receiver"}}); code != http.StatusBadRequest {
+		t.Errorf("send without fileSize: %d", code)
+	}
+	if code := send([][2]string{{"deviceId", "receiver"}, {"fileSize", "-1"}}); code != http.StatusBadRequest {
+		t.Errorf("send with a negative fileSize: %d", code)
+	}
+	if code := send([][2]string{{"deviceId", "receiver"}, {"fileSize", "0"}}); code != http.StatusOK {
+		t.Fatalf("zero-byte send: %d", code)
+	}
+	if n := <-offered; n != 0 {
+		t.Errorf("receiver was offered %d bytes", n)
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/transfer"
+)
+
+// maxFetchRedirects bounds the redirects followed when sending from a URL.
+const maxFetchRedirects = 5
+
+// errBlockedAddress is returned for a URL that resolves to an address the
+// fetch policy doesn't allow.
+var errBlockedAddress = errors.New("address not allowed")
+
+// fetchPolicy decides which addresses send-url may connect to.
+type fetchPolicy struct {
+	allow, deny []*net.IPNet
+}
+
+func newFetchPolicy(cfg config.Config) fetchPolicy {
+	parse := func(cidrs []string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, c := range cidrs {
+			if _, n, err := net.ParseCIDR(c); err == nil {
+				nets = append(nets, n)
+			}
+		}
+		return nets
+	}
+	return fetchPolicy{allow: parse(cfg.URLFetchAllow), deny: parse(cfg.URLFetchDeny)}
+}
+
+// permits reports whether ip may be fetched from: public addresses are,
+// internal ones only if allowed, and denied ranges never.
+func (p fetchPolicy) permits(ip net.IP) bool {
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !internalIP(ip)
+}
+
+// cgnat is the carrier-grade NAT range, internal though not "private".
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnat.Contains(ip)
+}
+
+// fetchClient returns a client that checks every address it connects to,
+// after DNS resolution and on each redirect, so neither a hostname nor a
+// redirect can lead it to a blocked address. It ignores proxy settings,
+// which would hide the real target. Each fetch gets its own client, so it
+// keeps no connections alive afterwards.
+func fetchClient(cfg config.Config) *http.Client {
+	policy := newFetchPolicy(cfg)
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !policy.permits(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			DisableKeepAlives:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to a %s URL", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchFileName names a fetched file from Content-Disposition, else from
+// the last segment of the final URL's path.
+func fetchFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "download"
+}
+
+// handleSendURL fetches a URL on this server and streams the response to a
+// peer, so the file never passes through the browser.
+// POST {"deviceId" (or "username"), "url"}.
+func (s *Server) handleSendURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		DeviceID string `json:"deviceId"`
+		Username string `json:"username"`
+		URL      string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, ErrCodeBadRequest, "Invalid request body", 400)
+		return
+	}
+	if (body.DeviceID == "" && body.Username == "") || body.URL == "" {
+		jsonError(w, ErrCodeMissingField, "deviceId (or username) and url are required", 400)
+		return
+	}
+	target, err := url.Parse(body.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		jsonError(w, ErrCodeBadRequest, "url must be an absolute http(s) URL", 400)
+		return
+	}
+	deviceID := body.DeviceID
+	if deviceID == "" {
+		var ok bool
+		if deviceID, ok = s.resolveUsername(w, body.Username); !ok {
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		jsonError(w, ErrCodeBadRequest, "url must be an absolute http(s) URL", 400)
+		return
+	}
+	client := fetchClient(s.config)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		logf(r, "[SEND-URL] Fetching %s failed: %v", redactQuery(target), err)
+		if errors.Is(err, errBlockedAddress) {
+			jsonError(w, ErrCodeForbidden, "The URL points to an address this server may not fetch from", http.StatusForbidden)
+			return
+		}
+		jsonError(w, ErrCodeFetchFailed, fmt.Sprintf("Cannot fetch the URL: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		jsonError(w, ErrCodeFetchFailed, fmt.Sprintf("The URL returned %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+	if resp.ContentLength <= 0 {
+		jsonError(w, ErrCodeFetchFailed, "The URL's response has no Content-Length, so its size is unknown", http.StatusBadGateway)
+		return
+	}
+	if s.config.MaxUploadBytes > 0 && resp.ContentLength > s.config.MaxUploadBytes {
+		s.uploadTooLarge(w)
+		return
+	}
+
+	fileName := fetchFileName(resp)
+	u := contextUser(r)
+	logf(r, "[SEND-URL] %s → %s: %s from %s (%d bytes)", u.Email, deviceID, fileName, redactQuery(resp.Request.URL), resp.ContentLength)
+	opts := transfer.SendOptions{SenderEmail: u.Email}
+	if err := s.transfer.SendStreamWithOptions(deviceID, resp.Body, fileName, resp.ContentLength, opts); err != nil {
+		logf(r, "[SEND-URL] Send failed: %v", err)
+		sendError(w, err)
+		return
+	}
+	jsonOK(w, "transfer completed")
+}
+
+// redactQuery drops the query string, which may hold tokens, for logging.
+func redactQuery(u *url.URL) string {
+	c := *u
+	c.RawQuery = ""
+	c.User = nil
+	return c.String()
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"filetransfer/internal/config"
+)
+
+func TestFetchPolicy(t *testing.T) {
+	p := newFetchPolicy(config.Config{URLFetchAllow: []string{"10.1.0.0/16"}, URLFetchDeny: []string{"10.1.2.0/24", "203.0.113.0/24"}})
+	for ip, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.0.0.1":        false,
+		"169.254.169.254": false, // cloud metadata
+		"100.64.0.1":      false,
+		"fe80::1":         false,
+		"10.1.0.5":        true,  // allowed
+		"10.1.2.5":        false, // deny wins over allow
+		"203.0.113.9":     false,
+	} {
+		if got := p.permits(net.ParseIP(ip)); got != want {
+			t.Errorf("permits(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestFetchClientBlocksInternal(t *testing.T) {
+	keptAlive := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keptAlive = keptAlive || !r.Close
+		if r.URL.Path == "/hop" {
+			http.Redirect(w, r, "http://127.0.0.2:1/secret", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	if _, err := fetchClient(config.Config{}).Get(srv.URL); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("loopback fetch: %v", err)
+	}
+
+	c := fetchClient(config.Config{URLFetchAllow: []string{"127.0.0.1/32"}})
+	resp, err := c.Get(srv.URL + "/files/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if name := fetchFileName(resp); name != "report.pdf" {
+		t.Errorf("file name %q", name)
+	}
+	if keptAlive {
+		t.Error("fetch asked to keep the connection alive")
+	}
+	// A redirect can't reach an address the policy blocks
+	if _, err := c.Get(srv.URL + "/hop"); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("redirect to a blocked address: %v", err)
+	}
+}
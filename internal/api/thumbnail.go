@@ -0,0 +1,162 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	thumbMaxEdge = 256
+	// Images larger than this are not decoded at all; a 50MP RGBA bitmap
+	// is already 200MB.
+	maxThumbSourcePixels = 50_000_000
+)
+
+// thumbCacheDir holds generated thumbnails, outside DownloadDir so they
+// don't show up as received files or count toward retention.
+func thumbCacheDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "filetransfer", "thumbnails")
+}
+
+// handleThumbnail serves a small JPEG preview of an image in the user's
+// download directory. Thumbnails are cached on disk by path, size and
+// modification time, so a replaced file gets a fresh one.
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	name := r.URL.Query().Get("name")
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		jsonError(w, ErrCodeBadRequest, "Invalid file name", 400)
+		return
+	}
+	path := filepath.Join(s.config.UserDownloadDir(u.Email), name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(name, ".incomplete") {
+		jsonError(w, ErrCodeNotFound, "No such file", 404)
+		return
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", path, info.Size(), info.ModTime().UnixNano())))
+	cached := filepath.Join(thumbCacheDir(), fmt.Sprintf("%x.jpg", key[:16]))
+	if _, err := os.Stat(cached); err != nil {
+		status, err := writeThumbnail(path, cached)
+		if err != nil {
+			jsonError(w, thumbErrCode(status), err.Error(), status)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, cached)
+}
+
+func thumbErrCode(status int) string {
+	switch status {
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMedia
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeUploadTooLarge
+	}
+	return ErrCodeInternal
+}
+
+// writeThumbnail decodes the image at src and writes a scaled JPEG to dst.
+// On failure it returns the HTTP status that describes the problem.
+func writeThumbnail(src, dst string) (int, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("not a supported image")
+	}
+	if cfg.Width*cfg.Height > maxThumbSourcePixels {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("image is too large to preview (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("cannot decode image: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = jpeg.Encode(tmp, scaleDown(img, thumbMaxEdge), &jpeg.Options{Quality: 80})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// scaleDown fits img within maxEdge×maxEdge by averaging each destination
+// pixel's source box, flattening transparency onto white.
+func scaleDown(img image.Image, maxEdge int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > maxEdge || sh > maxEdge {
+		if sw >= sh {
+			dw, dh = maxEdge, max(1, sh*maxEdge/sw)
+		} else {
+			dw, dh = max(1, sw*maxEdge/sh), maxEdge
+		}
+	}
+
+	src := image.NewRGBA(b)
+	draw.Draw(src, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(src, b, img, b.Min, draw.Over)
+	if dw == sw && dh == sh {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(b.Min.X+x0, b.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[off])
+					g += uint32(src.Pix[off+1])
+					bl += uint32(src.Pix[off+2])
+					off += 4
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xFF})
+		}
+	}
+	return dst
+}
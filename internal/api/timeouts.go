@@ -0,0 +1,54 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Defaults for the zero Config.HTTP*Timeout fields. They bound ordinary API
+// requests; see longRunning for the routes that move whole files.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = time.Minute
+	defaultWriteTimeout      = 2 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// httpServer wraps handler in a server with connection timeouts, so a client
+// that trickles its request or stops reading can't hold a connection open.
+func (s *Server) httpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: orDefault(s.config.HTTPReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       orDefault(s.config.HTTPReadTimeout, defaultReadTimeout),
+		WriteTimeout:      orDefault(s.config.HTTPWriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       orDefault(s.config.HTTPIdleTimeout, defaultIdleTimeout),
+	}
+}
+
+// longRunning lifts the server's read and write deadlines for a request
+// that streams a file or waits on a peer transfer, which may take far
+// longer than any fixed timeout. Put it inside requireAuth, so only
+// signed-in clients get it; such transfers are bounded by their own
+// stall detection instead.
+func longRunning(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			log.Printf("[HTTP] Cannot lift the read deadline for %s: %v", r.URL.Path, err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Printf("[HTTP] Cannot lift the write deadline for %s: %v", r.URL.Path, err)
+		}
+		next(w, r)
+	}
+}
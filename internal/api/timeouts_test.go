@@ -0,0 +1,56 @@
+package api
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"filetransfer/internal/config"
+)
+
+func TestLongRunningLiftsReadTimeout(t *testing.T) {
+	s := &Server{config: config.Config{HTTPReadTimeout: 200 * time.Millisecond}}
+	read := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plain", read)
+	mux.HandleFunc("/long", longRunning(read))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.httpServer(ln.Addr().String(), mux)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// slowPost sends a body that takes longer than the read timeout to arrive.
+	slowPost := func(path string) (int, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; i < 4; i++ {
+				time.Sleep(100 * time.Millisecond)
+				pw.Write([]byte("chunk"))
+			}
+			pw.Close()
+		}()
+		resp, err := http.Post("http://"+ln.Addr().String()+path, "application/octet-stream", pr)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	if code, err := slowPost("/long"); err != nil || code != 200 {
+		t.Fatalf("long-running route: status %d, err %v", code, err)
+	}
+	if code, err := slowPost("/plain"); err == nil && code == 200 {
+		t.Fatal("plain route outlived the read timeout")
+	}
+}
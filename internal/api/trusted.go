@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"filetransfer/internal/models"
+)
+
+// handleTrusted manages the signed-in user's trusted devices:
+// GET lists them, POST {deviceId, username?, trustLevel?} adds or updates
+// one, DELETE ?deviceId= removes one. Trust takes effect while the user
+// owns this device.
+func (s *Server) handleTrusted(w http.ResponseWriter, r *http.Request) {
+	u := contextUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		devices, err := s.store.ListTrustedDevices(u.Email)
+		if err != nil {
+			jsonError(w, ErrCodeInternal, "DB error", 500)
+			return
+		}
+		if devices == nil {
+			devices = []*models.TrustedDevice{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+
+	case http.MethodPost:
+		var d models.TrustedDevice
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			jsonError(w, ErrCodeBadRequest, "Invalid request body", 400)
+			return
+		}
+		if d.DeviceID == "" {
+			jsonError(w, ErrCodeMissingField, "deviceId is required", 400)
+			return
+		}
+		switch d.TrustLevel {
+		case "":
+			d.TrustLevel = models.TrustAutoAccept
+		case models.TrustAutoAccept, models.TrustKnown:
+		default:
+			jsonError(w, ErrCodeBadRequest, "trustLevel must be auto_accept or known", 400)
+			return
+		}
+		if d.AutoAcceptMaxBytes < 0 {
+			jsonError(w, ErrCodeBadRequest, "autoAcceptMaxBytes cannot be negative", 400)
+			return
+		}
+		if d.Username == "" {
+			if dev, ok := s.disc.GetDevice(d.DeviceID); ok {
+				d.Username = dev.Username
+			}
+		}
+		if err := s.store.AddTrustedDevice(u.Email, &d); err != nil {
+			jsonError(w, ErrCodeInternal, "DB error", 500)
+			return
+		}
+		logf(r, "[TRUST] %s trusts %s (%s) as %s, up to %d bytes", u.Email, d.DeviceID, d.Username, d.TrustLevel, d.AutoAcceptMaxBytes)
+		jsonOK(w, "trusted")
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("deviceId")
+		if id == "" {
+			jsonError(w, ErrCodeMissingField, "deviceId is required", 400)
+			return
+		}
+		if err := s.store.RemoveTrustedDevice(u.Email, id); err != nil {
+			jsonError(w, ErrCodeNotFound, err.Error(), 404)
+			return
+		}
+		jsonOK(w, "removed")
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
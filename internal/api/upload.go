@@ -0,0 +1,333 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"filetransfer/internal/transfer"
+)
+
+// Resumable upload: a large file reaches this server in parts, so a dropped
+// browser connection only costs the part in flight, and is then sent on.
+//
+//	POST /api/transfer/upload?fileName=Y&fileSize=N          body = first part (may be empty)
+//	    Starts an upload and returns {uploadId, offset}.
+//	POST /api/transfer/upload?uploadId=U&offset=O            body = next part
+//	    Appends the part if O is where the upload stands; otherwise 409 with
+//	    the current offset.
+//	GET  /api/transfer/upload?uploadId=U
+//	    Reports the current offset, to resume after an error.
+//	POST /api/transfer/upload/complete   {uploadId, deviceId|username, priority}
+//	    Sends the finished upload to the peer, like /api/transfer/send.
+
+const (
+	// uploadTTL is how long an upload may sit untouched before it is discarded.
+	uploadTTL = 24 * time.Hour
+	// uploadPurgeInterval is how often abandoned uploads are deleted.
+	uploadPurgeInterval = 10 * time.Minute
+)
+
+type upload struct {
+	ID       string    `json:"uploadId"`
+	FileName string    `json:"fileName"`
+	FileSize int64     `json:"fileSize"`
+	Offset   int64     `json:"offset"`
+	Updated  time.Time `json:"updated"`
+	owner    string
+	path     string
+	busy     bool // a part is being written or the file is being sent
+}
+
+type uploadStore struct {
+	mu    sync.Mutex
+	items map[string]*upload
+}
+
+func (us *uploadStore) put(up *upload) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.items == nil {
+		us.items = make(map[string]*upload)
+	}
+	us.items[up.ID] = up
+}
+
+// purgeLocked discards uploads left untouched past uploadTTL; us.mu held.
+func (us *uploadStore) purgeLocked() {
+	for k, up := range us.items {
+		if !up.busy && time.Since(up.Updated) > uploadTTL {
+			os.Remove(up.path)
+			delete(us.items, k)
+		}
+	}
+}
+
+// runPurge discards abandoned uploads periodically, so their staged files
+// don't stay on disk when no further upload request comes.
+func (us *uploadStore) runPurge() {
+	for range time.Tick(uploadPurgeInterval) {
+		us.mu.Lock()
+		us.purgeLocked()
+		us.mu.Unlock()
+	}
+}
+
+// claim marks owner's upload busy and returns a copy of its state. It fails
+// if there's no such upload or another request is using it. Uploads left
+// untouched past uploadTTL are discarded along the way.
+func (us *uploadStore) claim(id, owner string) (upload, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.purgeLocked()
+	up, ok := us.items[id]
+	if !ok || up.owner != owner {
+		return upload{}, errNoUpload
+	}
+	if up.busy {
+		return upload{}, errUploadBusy
+	}
+	up.busy = true
+	return *up, nil
+}
+
+// release records the offset reached and frees the upload for the next
+// request.
+func (us *uploadStore) release(id string, offset int64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if up, ok := us.items[id]; ok {
+		up.Offset = offset
+		up.Updated = time.Now()
+		up.busy = false
+	}
+}
+
+// remove forgets the upload and deletes its staged file.
+func (us *uploadStore) remove(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if up, ok := us.items[id]; ok {
+		os.Remove(up.path)
+		delete(us.items, id)
+	}
+}
+
+var (
+	errNoUpload   = errors.New("no such upload")
+	errUploadBusy = errors.New("upload is in use by another request")
+)
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet:
+		s.handleUploadStatus(w, r)
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadId") == "":
+		s.handleUploadStart(w, r)
+	case r.Method == http.MethodPost:
+		s.handleUploadPart(w, r)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// uploadClaimError writes the response for a failed claim.
+func uploadClaimError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUploadBusy) {
+		jsonError(w, ErrCodeBadRequest, err.Error(), http.StatusConflict)
+		return
+	}
+	jsonError(w, ErrCodeNotFound, "No such upload", 404)
+}
+
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("uploadId")
+	s.uploads.mu.Lock()
+	up, ok := s.uploads.items[id]
+	var state upload
+	if ok {
+		state = *up
+	}
+	s.uploads.mu.Unlock()
+	if !ok || state.owner != contextUser(r).Email {
+		jsonError(w, ErrCodeNotFound, "No such upload", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func (s *Server) handleUploadStart(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fileName := filepath.Base(q.Get("fileName"))
+	fileSize, err := strconv.ParseInt(q.Get("fileSize"), 10, 64)
+	if fileName == "." || fileName == "/" || err != nil || fileSize < 0 {
+		jsonError(w, ErrCodeMissingField, "fileName and fileSize required", 400)
+		return
+	}
+	if s.config.MaxUploadBytes > 0 && fileSize > s.config.MaxUploadBytes {
+		s.uploadTooLarge(w)
+		return
+	}
+	f, err := os.CreateTemp(s.config.UploadStagingDir(), "filetransfer-upload-*")
+	if err != nil {
+		jsonError(w, ErrCodeInternal, "Cannot stage upload", 500)
+		return
+	}
+	f.Close()
+	up := &upload{
+		ID:       uuid.New().String(),
+		FileName: fileName,
+		FileSize: fileSize,
+		Updated:  time.Now(),
+		owner:    contextUser(r).Email,
+		path:     f.Name(),
+		busy:     true,
+	}
+	s.uploads.put(up)
+	logf(r, "[UPLOAD] %s started %s (%d bytes) as %s", up.owner, fileName, fileSize, up.ID)
+	s.appendPart(w, r, *up, http.StatusCreated)
+}
+
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	up, err := s.uploads.claim(q.Get("uploadId"), contextUser(r).Email)
+	if err != nil {
+		uploadClaimError(w, err)
+		return
+	}
+	offset, err := strconv.ParseInt(q.Get("offset"), 10, 64)
+	if err != nil || offset != up.Offset {
+		s.uploads.release(up.ID, up.Offset)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "offset does not match the upload",
+			"code":   ErrCodeBadRequest,
+			"offset": up.Offset,
+		})
+		return
+	}
+	s.appendPart(w, r, up, http.StatusOK)
+}
+
+// appendPart writes the request body at the end of the claimed upload and
+// releases it. Bytes that arrive before an interruption are kept, so the
+// client resumes from the offset it reads back.
+func (s *Server) appendPart(w http.ResponseWriter, r *http.Request, up upload, status int) {
+	offset := up.Offset
+	defer func() { s.uploads.release(up.ID, offset) }()
+
+	if r.ContentLength > up.FileSize-up.Offset {
+		jsonError(w, ErrCodeUploadTooLarge, "Part runs past fileSize", http.StatusRequestEntityTooLarge)
+		return
+	}
+	f, err := os.OpenFile(up.path, os.O_WRONLY, 0)
+	if err != nil {
+		jsonError(w, ErrCodeFileGone, "Staged upload is gone", 410)
+		return
+	}
+	if err := f.Truncate(up.Offset); err != nil {
+		f.Close()
+		jsonError(w, ErrCodeInternal, "Cannot write upload", 500)
+		return
+	}
+	f.Seek(up.Offset, io.SeekStart)
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, up.FileSize-up.Offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += n
+	if err != nil {
+		logf(r, "[UPLOAD] %s interrupted at %d of %d bytes: %v", up.ID, offset, up.FileSize, err)
+		resp := map[string]interface{}{"error": "Upload interrupted", "code": ErrCodeUploadInterrupted, "uploadId": up.ID, "offset": offset}
+		code := http.StatusBadRequest
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			resp["error"], resp["code"], code = "Part runs past fileSize", ErrCodeUploadTooLarge, http.StatusRequestEntityTooLarge
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadId": up.ID,
+		"offset":   offset,
+		"complete": offset == up.FileSize,
+	})
+}
+
+func (s *Server) handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var body struct {
+		UploadID       string `json:"uploadId"`
+		DeviceID       string `json:"deviceId"`
+		Username       string `json:"username"`
+		Priority       int    `json:"priority"`
+		RequireConfirm bool   `json:"requireConfirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, ErrCodeBadRequest, "Invalid request", 400)
+		return
+	}
+	if body.DeviceID == "" && body.Username == "" {
+		jsonError(w, ErrCodeMissingField, "deviceId or username required", 400)
+		return
+	}
+	u := contextUser(r)
+	up, err := s.uploads.claim(body.UploadID, u.Email)
+	if err != nil {
+		uploadClaimError(w, err)
+		return
+	}
+	if up.Offset != up.FileSize {
+		s.uploads.release(up.ID, up.Offset)
+		jsonError(w, ErrCodeMissingField, "Upload is not finished", 400)
+		return
+	}
+	deviceID := body.DeviceID
+	if deviceID == "" {
+		var ok bool
+		if deviceID, ok = s.resolveUsername(w, body.Username); !ok {
+			s.uploads.release(up.ID, up.Offset)
+			return
+		}
+	}
+	f, err := os.Open(up.path)
+	if err != nil {
+		s.uploads.remove(up.ID)
+		jsonError(w, ErrCodeFileGone, "Staged upload is gone", 410)
+		return
+	}
+	defer f.Close()
+
+	logf(r, "[UPLOAD] Sending %s (%s, %d bytes) to %s", up.ID, up.FileName, up.FileSize, deviceID)
+	opts := transfer.SendOptions{
+		Priority:       body.Priority,
+		RequireConfirm: body.RequireConfirm,
+		SenderEmail:    u.Email,
+	}
+	if err := s.transfer.SendStreamWithOptions(deviceID, f, up.FileName, up.FileSize, opts); err != nil {
+		// Keep the upload so the send can be retried without uploading again
+		s.uploads.release(up.ID, up.Offset)
+		logf(r, "[UPLOAD] Send of %s failed: %v", up.ID, err)
+		sendError(w, err)
+		return
+	}
+	s.uploads.remove(up.ID)
+	jsonOK(w, "transfer completed")
+}
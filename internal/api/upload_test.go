@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/models"
+)
+
+func TestResumableUpload(t *testing.T) {
+	s := NewServer(config.Config{StagingDir: t.TempDir()}, nil, nil, nil, "127.0.0.1", embed.FS{})
+	do := func(method, target, body, email string) (int, map[string]interface{}) {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, &models.User{Email: email}))
+		w := httptest.NewRecorder()
+		s.handleUpload(w, r)
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	code, resp := do("POST", "/api/transfer/upload?fileName=big.bin&fileSize=10", "0123", "a@example.com")
+	if code != http.StatusCreated || resp["offset"] != 4.0 {
+		t.Fatalf("start: %d %v", code, resp)
+	}
+	id := resp["uploadId"].(string)
+
+	// A retry of a part that already arrived is refused with the offset
+	if code, resp = do("POST", "/api/transfer/upload?uploadId="+id+"&offset=0", "0123", "a@example.com"); code != http.StatusConflict || resp["offset"] != 4.0 {
+		t.Errorf("stale offset: %d %v", code, resp)
+	}
+	if code, _ = do("GET", "/api/transfer/upload?uploadId="+id, "", "b@example.com"); code != http.StatusNotFound {
+		t.Errorf("another user saw the upload: %d", code)
+	}
+	if code, resp = do("GET", "/api/transfer/upload?uploadId="+id, "", "a@example.com"); code != http.StatusOK || resp["offset"] != 4.0 {
+		t.Errorf("status: %d %v", code, resp)
+	}
+	if code, _ = do("POST", "/api/transfer/upload?uploadId="+id+"&offset=4", "456789-extra", "a@example.com"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("part past fileSize: %d", code)
+	}
+	if code, resp = do("POST", "/api/transfer/upload?uploadId="+id+"&offset=4", "456789", "a@example.com"); code != http.StatusOK || resp["complete"] != true {
+		t.Fatalf("last part: %d %v", code, resp)
+	}
+
+	data, err := os.ReadFile(s.uploads.items[id].path)
+	if err != nil || string(data) != "0123456789" {
+		t.Errorf("staged %q, %v", data, err)
+	}
+
+	// An empty file is complete as soon as it starts
+	if code, resp = do("POST", "/api/transfer/upload?fileName=empty.txt&fileSize=0", "", "a@example.com"); code != http.StatusCreated || resp["complete"] != true {
+		t.Errorf("zero-byte start: %d %v", code, resp)
+	}
+	if code, _ = do("POST", "/api/transfer/upload?fileName=x.bin&fileSize=-1", "", "a@example.com"); code != http.StatusBadRequest {
+		t.Errorf("negative fileSize: %d", code)
+	}
+
+	// Nobody comes back for these; the purge removes them once expired
+	s.uploads.mu.Lock()
+	var paths []string
+	for _, up := range s.uploads.items {
+		up.Updated = time.Now().Add(-2 * uploadTTL)
+		paths = append(paths, up.path)
+	}
+	s.uploads.purgeLocked()
+	left := len(s.uploads.items)
+	s.uploads.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d expired uploads kept", left)
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("staged file %s kept: %v", p, err)
+		}
+	}
+}
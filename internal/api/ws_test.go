@@ -0,0 +1,107 @@
+package api
+
+import (
+	"embed"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"filetransfer/internal/config"
+)
+
+func TestBroadcastSkipsSlowClient(t *testing.T) {
+	defer func(n int) { wsSendBuffer = n }(wsSendBuffer)
+	wsSendBuffer = 4
+
+	s := NewServer(config.Config{}, nil, nil, nil, "127.0.0.1", embed.FS{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWS))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	waitClients := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.wsMu.Lock()
+			n := len(s.wsClients)
+			s.wsMu.Unlock()
+			if n == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d clients connected, want %d", n, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The slow client never reads. Small socket buffers at both ends make
+	// the server's writes to it block after a message or two.
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		c, err := net.Dial(network, addr)
+		if err == nil {
+			c.(*net.TCPConn).SetReadBuffer(4096)
+		}
+		return c, err
+	}}
+	slow, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	waitClients(1)
+	s.wsMu.Lock()
+	for conn := range s.wsClients {
+		conn.UnderlyingConn().(*net.TCPConn).SetWriteBuffer(4096)
+	}
+	s.wsMu.Unlock()
+
+	fast, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			var msg map[string]interface{}
+			if err := fast.ReadJSON(&msg); err != nil {
+				received <- n
+				return
+			}
+			if n++; msg["type"] == "done" {
+				received <- n
+				return
+			}
+		}
+	}()
+	waitClients(2)
+
+	const messages = 40
+	payload := strings.Repeat("x", 64<<10)
+	start := time.Now()
+	for i := 0; i < messages-1; i++ {
+		s.Broadcast("progress", payload)
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Broadcast("done", nil)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("broadcasts took %s; a slow client held them up", d)
+	}
+
+	waitClients(1)
+	select {
+	case n := <-received:
+		if n != messages {
+			t.Errorf("fast client got %d of %d messages", n, messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast client never got the last message")
+	}
+}
@@ -2,18 +2,147 @@ package auth
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
 
 	gomail "gopkg.in/gomail.v2"
+
+	"filetransfer/internal/config"
 )
 
-// SendOTPEmail sends a 6-digit OTP to the given address via Gmail SMTP.
-func SendOTPEmail(toEmail, otp, smtpFrom, smtpPass string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", smtpFrom)
-	m.SetHeader("To", toEmail)
-	m.SetHeader("Subject", "Your FileTransfer verification code")
-	m.SetBody("text/html", fmt.Sprintf(`
+// ErrEmailDisabled is returned when email is needed but SMTP isn't set up.
+var ErrEmailDisabled = errors.New("email is not configured on this server")
+
+// DeliverOTP sends otp to toEmail. Without SMTP settings it fails with
+// ErrEmailDisabled, unless DevMode is on, in which case the code is written
+// to the server log instead.
+func DeliverOTP(cfg config.Config, toEmail, otp string) error {
+	if cfg.SMTPConfigured() {
+		return NewMailer(cfg).SendOTPEmail(toEmail, otp)
+	}
+	if !cfg.DevMode {
+		return ErrEmailDisabled
+	}
+	log.Printf("[AUTH] DEV MODE — verification code for %s: %s (not emailed; SMTP is not configured)", toEmail, otp)
+	return nil
+}
+
+// Mailer sends email through the SMTP server described by the config.
+type Mailer struct {
+	host     string
+	port     int
+	tlsMode  string
+	from     string
+	password string
+}
+
+// NewMailer returns a Mailer for cfg, defaulting to Gmail on port 587 with
+// STARTTLS for whatever isn't set.
+func NewMailer(cfg config.Config) *Mailer {
+	m := &Mailer{
+		host:     cfg.SMTPHost,
+		port:     cfg.SMTPPort,
+		tlsMode:  cfg.SMTPTLS,
+		from:     cfg.SMTPFrom,
+		password: cfg.SMTPPass,
+	}
+	if m.host == "" {
+		m.host = "smtp.gmail.com"
+	}
+	if m.tlsMode == "" {
+		m.tlsMode = config.SMTPStartTLS
+	}
+	if m.port == 0 {
+		m.port = 587
+		if m.tlsMode == config.SMTPImplicitTLS {
+			m.port = 465
+		}
+	}
+	return m
+}
+
+// SendEmail sends an HTML email to a single recipient.
+func (m *Mailer) SendEmail(to, subject, htmlBody string) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.from)
+	msg.SetHeader("To", to)
+	msg.SetHeader("Subject", subject)
+	msg.SetBody("text/html", htmlBody)
+
+	if m.tlsMode == config.SMTPNoTLS {
+		return m.sendPlain(to, msg)
+	}
+	d := gomail.NewDialer(m.host, m.port, m.from, m.password)
+	d.SSL = m.tlsMode == config.SMTPImplicitTLS
+	d.TLSConfig = &tls.Config{ServerName: m.host}
+	return d.DialAndSend(msg)
+}
+
+// Check connects to the SMTP server and signs in, without sending anything.
+func (m *Mailer) Check() error {
+	if m.tlsMode == config.SMTPNoTLS {
+		c, err := smtp.Dial(net.JoinHostPort(m.host, strconv.Itoa(m.port)))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if m.password != "" {
+			if err := c.Auth(smtp.PlainAuth("", m.from, m.password, m.host)); err != nil {
+				return err
+			}
+		}
+		return c.Quit()
+	}
+	d := gomail.NewDialer(m.host, m.port, m.from, m.password)
+	d.SSL = m.tlsMode == config.SMTPImplicitTLS
+	d.TLSConfig = &tls.Config{ServerName: m.host}
+	sc, err := d.Dial()
+	if err != nil {
+		return err
+	}
+	return sc.Close()
+}
+
+// sendPlain delivers msg without TLS. gomail always upgrades when the server
+// offers STARTTLS, so this talks to the server directly. net/smtp refuses to
+// send credentials unencrypted to anything but localhost.
+func (m *Mailer) sendPlain(to string, msg *gomail.Message) error {
+	c, err := smtp.Dial(net.JoinHostPort(m.host, strconv.Itoa(m.port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if m.password != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.from, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SendOTPEmail sends a 6-digit OTP to the given address.
+func (m *Mailer) SendOTPEmail(toEmail, otp string) error {
+	body := fmt.Sprintf(`
 <!DOCTYPE html>
 <html>
 <body style="font-family: sans-serif; background:#0a0a0f; color:#e2e8f0; padding:40px;">
@@ -26,13 +155,8 @@ func SendOTPEmail(toEmail, otp, smtpFrom, smtpPass string) error {
     <p style="color:#64748b; font-size:14px;">This code expires in <strong>5 minutes</strong>. Do not share it with anyone.</p>
   </div>
 </body>
-</html>`, otp))
-
-	d := gomail.NewDialer("smtp.gmail.com", 587, smtpFrom, smtpPass)
-	// Allow TLS on port 587 (STARTTLS)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: false, ServerName: "smtp.gmail.com"}
-
-	if err := d.DialAndSend(m); err != nil {
+</html>`, otp)
+	if err := m.SendEmail(toEmail, "Your FileTransfer verification code", body); err != nil {
 		return fmt.Errorf("send OTP email: %w", err)
 	}
 	return nil
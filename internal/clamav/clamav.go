@@ -0,0 +1,135 @@
+// Package clamav streams data to a clamd daemon for scanning with its
+// INSTREAM command.
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 30 * time.Second
+	// resultTimeout bounds the wait for a verdict after the last chunk;
+	// clamd only starts scanning once it has the whole stream.
+	resultTimeout = 2 * time.Minute
+)
+
+// Scanner connects to one clamd. A nil *Scanner is valid and scans nothing.
+type Scanner struct {
+	network, address string
+}
+
+// New returns a Scanner for addr, or nil when addr is empty (scanning
+// disabled). addr is "unix:/path/to/clamd.ctl", a bare absolute socket
+// path, "tcp:host:port" or just "host:port".
+func New(addr string) *Scanner {
+	switch {
+	case addr == "":
+		return nil
+	case strings.HasPrefix(addr, "unix:"):
+		return &Scanner{"unix", strings.TrimPrefix(addr, "unix:")}
+	case strings.HasPrefix(addr, "/"):
+		return &Scanner{"unix", addr}
+	default:
+		return &Scanner{"tcp", strings.TrimPrefix(addr, "tcp:")}
+	}
+}
+
+// Start opens a scan. Data written to it is forwarded to clamd as it
+// arrives; Result ends the stream and returns the verdict. A failure at any
+// point is kept and reported by Result, so callers can write without
+// checking errors.
+func (s *Scanner) Start() *Scan {
+	sc := &Scan{}
+	conn, err := net.DialTimeout(s.network, s.address, dialTimeout)
+	if err != nil {
+		sc.err = fmt.Errorf("connect to clamd: %w", err)
+		return sc
+	}
+	sc.conn = conn
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		sc.fail(err)
+	}
+	return sc
+}
+
+// Scan is one INSTREAM session.
+type Scan struct {
+	conn net.Conn
+	err  error
+}
+
+// ErrInfected is returned by Result when clamd found something.
+var ErrInfected = errors.New("infected")
+
+func (sc *Scan) fail(err error) {
+	if sc.err == nil {
+		sc.err = fmt.Errorf("clamd: %w", err)
+	}
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
+
+// Write sends p as one chunk. It never fails the caller's write; see Start.
+func (sc *Scan) Write(p []byte) (int, error) {
+	if sc.err != nil || len(p) == 0 {
+		return len(p), nil
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+	sc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := sc.conn.Write(size[:]); err != nil {
+		sc.fail(err)
+	} else if _, err := sc.conn.Write(p); err != nil {
+		sc.fail(err)
+	}
+	return len(p), nil
+}
+
+// Result ends the stream and waits for clamd's verdict. It returns the
+// signature and an error wrapping ErrInfected if the data is infected, or
+// another error if it couldn't be scanned (including data over clamd's
+// StreamMaxLength).
+func (sc *Scan) Result() (string, error) {
+	if sc.err != nil {
+		return "", sc.err
+	}
+	defer sc.conn.Close()
+	sc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := sc.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(resultTimeout))
+	reply, err := bufio.NewReader(sc.conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("clamd: reading result: %w", err)
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply = strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(reply, " FOUND")
+		return sig, fmt.Errorf("%w: %s", ErrInfected, sig)
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// Close abandons the scan without a verdict.
+func (sc *Scan) Close() {
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
@@ -1,16 +1,384 @@
 package config
 
-import "time"
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	ServerPort    int
 	TransferPort  int
 	DiscoveryPort int
 	ChunkSize     int
-	DownloadDir   string
-	DeviceName    string
-	BroadcastInt  time.Duration
-	DBConnStr     string
-	SMTPFrom      string
-	SMTPPass      string
+	// Kernel buffer sizes for transfer connections, independent of the
+	// ChunkSize copy buffer; 0 = the OS default. Larger ones help fast LANs.
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+	DownloadDir       string
+	// Base for per-transfer destDir choices; empty = the user's download dir.
+	SaveRoot   string
+	StagingDir string // uploads held for later pickup; empty = os.TempDir()
+	// Retention for received files; zero disables each limit.
+	FileRetention        time.Duration // delete files older than this
+	MaxDownloadBytes     int64         // delete oldest files while DownloadDir exceeds this
+	UserQuotaBytes       int64         // refuse files that would take a user's downloads (or the SaveRoot directory saved into) past this; 0 = unlimited
+	RequireSenderConfirm bool          // senders confirm again after the receiver accepts
+	MaxUploadBytes       int64         // largest file accepted from the browser; 0 = unlimited
+	// Form fields sent alongside an upload are held in memory, up to this
+	// many bytes per request; the file itself is streamed. 0 = 10MB.
+	MaxFormMemory int64
+	// Gzip payloads to peers that support it, except for extensions in
+	// NoCompressExts (nil = transfer.DefaultNoCompressExts) and data that
+	// samples as incompressible.
+	Compress       bool
+	NoCompressExts []string
+	// Offers of files with these extensions (".exe" or "exe", any case) are
+	// refused without asking; nil = allow all.
+	BlockedExtensions []string
+	// Sending from a URL never reaches loopback, private, link-local or
+	// other internal addresses unless they fall in URLFetchAllow (CIDRs).
+	// URLFetchDeny blocks further ranges, and wins over the allow list.
+	URLFetchAllow []string
+	URLFetchDeny  []string
+	// A transfer that moves no data for this long is marked "stalled" and
+	// failed; 0 = 30s.
+	StallTimeout time.Duration
+	// When set, progress goes out as one transfers_snapshot of every active
+	// transfer at this interval instead of a transfer_progress per transfer.
+	ProgressBatchInterval time.Duration
+	// How received files are named, e.g. "{sender}_{date}_{name}"; see
+	// transfer.expandFileName for the placeholders. Empty = "{name}".
+	FilenameTemplate string
+	// A received file whose content matches one already in its directory is
+	// kept but marked ("flag") or not kept at all ("skip"); empty = no check.
+	DuplicateFiles string
+	// Failed receives leave "<name>.incomplete" unless this is set.
+	DeletePartialFiles bool
+	// Scan received files with the clamd at ClamdAddress ("unix:/path",
+	// "tcp:host:port" or "host:port"; empty disables) before they are moved
+	// into place. Infected files go to QuarantineDir, or are deleted if it is
+	// empty. A file that can't be scanned is accepted unless ScanFailClosed.
+	ClamdAddress   string
+	ScanFailClosed bool
+	QuarantineDir  string
+	// Send in acknowledged, checksummed chunks, resending corrupt or
+	// unacknowledged ones, to peers that support it. Slower; for flaky links.
+	ReliableTransfers bool
+	// Keep sender connections open between transfers to the same peer.
+	ReuseConnections bool
+	ConnIdleTimeout  time.Duration // how long a parked connection is kept; 0 = 30s
+	// Bytes per second shared by all sends, split by priority: each step
+	// above normal doubles a send's share. 0 = unlimited.
+	MaxSendRate int64
+	// Limits on incoming transfers; offers beyond them are rejected at once.
+	MaxIncoming      int // files being received concurrently; 0 = 4
+	MaxPendingOffers int // offers awaiting the user's decision; 0 = 16
+	DeviceName       string
+	// A device name set from the UI is saved here and used on the next start
+	// unless -name is given; empty = renames last until restart.
+	DeviceNameFile string
+	BroadcastInt   time.Duration
+	// Each wait between announcements is BroadcastInt varied randomly by up
+	// to this fraction either way, so devices don't announce in lockstep.
+	BroadcastJitter float64
+	DiscoveryMode   string // "multicast" (default), "broadcast", "both" or "mdns"
+	// Offline devices stay in /api/devices/recent this long; 0 = 24h.
+	RecentDevicesWindow time.Duration
+	// Scope of multicast presence packets: TTL 1 (the default when 0) keeps
+	// them on the local link; raise it to cross routers.
+	MulticastTTL int
+	// Announce the emails of everyone signed in, not just the owner, so
+	// peers can send to them here. Off by default: announcements are
+	// plaintext to the whole LAN.
+	AdvertiseUsers bool
+	// Certificate and key for HTTPS on the web UI. When set, the transfer
+	// port uses TLS with the same pair and advertises its fingerprint.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Peer certificate fingerprints, pinned on first sight, are kept here;
+	// empty = memory only.
+	PinnedCertsFile string
+	// Interfaces multicast discovery joins and sends on, by name; empty =
+	// every up, multicast-capable, non-loopback interface.
+	DiscoveryInterfaces  []string
+	DisableMulticastLoop bool   // don't deliver our own presence to this host
+	HistoryBufferFile    string // history records that couldn't reach the DB wait here
+	DisableHistory       bool   // record no one's transfer history, e.g. for ephemeral deployments
+	IncognitoDefault     bool   // new accounts start with their history off
+	ResumeStateDir       string // unfinished receives are recorded here; empty = memory only
+	DBConnStr            string
+	// Web server connection timeouts; 0 = 10s, 1m, 2m and 2m. Routes that
+	// stream files lift the read and write timeouts once signed in.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	SessionGCInterval     time.Duration // how often expired sessions are purged; 0 = 10m
+	IdleTimeout           time.Duration // sign out sessions unused this long; 0 = only the 24h expiry
+	TrustProxy            bool          // take client IPs from X-Forwarded-For
+	SingleSession         bool          // signing in ends the user's other sessions
+	DeviceOwner           string        // account advertised by this device; empty = first to sign in
+	AdminEmail            string        // promoted to admin on sign-in while there is no admin
+	SMTPFrom              string
+	SMTPPass              string
+	SMTPHost              string // empty = smtp.gmail.com
+	SMTPPort              int    // 0 = 587
+	SMTPTLS               string // SMTPStartTLS (default), SMTPImplicitTLS or SMTPNoTLS
+	// DevMode logs verification codes instead of emailing them when SMTP
+	// isn't configured. Insecure; for trying things out only.
+	DevMode bool
+	// OnReceiveCommand runs after each completed receive with the saved path
+	// and sender name appended as arguments. Split on whitespace; no shell.
+	OnReceiveCommand string
+	WebhookURL       string // POSTed on transfer completion/failure; empty disables
+	WebhookSecret    string // HMAC-SHA256 key for the X-FileTransfer-Signature header
+}
+
+// SMTP TLS modes.
+const (
+	SMTPStartTLS    = "starttls" // upgrade a plain connection, usually port 587
+	SMTPImplicitTLS = "tls"      // TLS from the first byte, usually port 465
+	SMTPNoTLS       = "none"     // plaintext; only for trusted local relays
+)
+
+// UserDownloadDir returns the per-user subdirectory of DownloadDir that holds
+// files received on behalf of email. The directory name is a short hash of the
+// email so it is filesystem-safe and doesn't leak addresses in paths.
+// An empty email maps to DownloadDir itself.
+func (c Config) UserDownloadDir(email string) string {
+	if email == "" {
+		return c.DownloadDir
+	}
+	sum := sha256.Sum256([]byte(email))
+	return filepath.Join(c.DownloadDir, fmt.Sprintf("%x", sum[:8]))
+}
+
+// UploadStagingDir is where uploads are staged before being handed on.
+func (c Config) UploadStagingDir() string {
+	if c.StagingDir == "" {
+		return os.TempDir()
+	}
+	return c.StagingDir
+}
+
+// DefaultMaxFormMemory is FormMemoryLimit when MaxFormMemory is unset.
+const DefaultMaxFormMemory = 10 << 20
+
+// FormMemoryLimit returns how many bytes of form fields an upload may hold
+// in memory.
+func (c Config) FormMemoryLimit() int64 {
+	if c.MaxFormMemory <= 0 {
+		return DefaultMaxFormMemory
+	}
+	return c.MaxFormMemory
+}
+
+// TLSEnabled reports whether a certificate is configured.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// WebScheme is the URL scheme the web UI is served on.
+func (c Config) WebScheme() string {
+	if c.TLSEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// LoadTLSCert loads the configured certificate and key.
+func (c Config) LoadTLSCert() (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+}
+
+// SMTPConfigured reports whether outgoing email has credentials.
+func (c Config) SMTPConfigured() bool {
+	return c.SMTPFrom != "" && c.SMTPPass != ""
+}
+
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "[redacted]"
+
+// Redacted returns a copy of c that is safe to show: passwords, the webhook
+// secret and credentials in the database and webhook URLs are replaced.
+func (c Config) Redacted() Config {
+	if c.SMTPPass != "" {
+		c.SMTPPass = redactedValue
+	}
+	if c.WebhookSecret != "" {
+		c.WebhookSecret = redactedValue
+	}
+	c.WebhookURL = redactURL(c.WebhookURL)
+	c.DBConnStr = redactConnStr(c.DBConnStr)
+	c.NoCompressExts = append([]string(nil), c.NoCompressExts...)
+	c.BlockedExtensions = append([]string(nil), c.BlockedExtensions...)
+	c.DiscoveryInterfaces = append([]string(nil), c.DiscoveryInterfaces...)
+	c.URLFetchAllow = append([]string(nil), c.URLFetchAllow...)
+	c.URLFetchDeny = append([]string(nil), c.URLFetchDeny...)
+	return c
+}
+
+// redactURL hides the password and query string of a URL, which may carry
+// tokens.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		if s != "" {
+			return redactedValue
+		}
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+// redactConnStr hides the password in a Postgres connection string, either
+// a URL or key=value pairs.
+func redactConnStr(s string) string {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return redactedValue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		return u.String()
+	}
+	return connStrPassword.ReplaceAllString(s, "password="+redactedValue)
+}
+
+// connStrPassword matches a password in key=value form, quoted or not.
+var connStrPassword = regexp.MustCompile(`(?i)password\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
+
+// Validate checks the configuration for values that would otherwise fail
+// confusingly later. All problems found are reported together.
+func (c Config) Validate() error {
+	var errs []error
+
+	ports := map[string]int{
+		"web port":       c.ServerPort,
+		"transfer port":  c.TransferPort,
+		"discovery port": c.DiscoveryPort,
+	}
+	seen := map[int]string{}
+	for _, name := range []string{"web port", "transfer port", "discovery port"} {
+		p := ports[name]
+		if p < 1 || p > 65535 {
+			errs = append(errs, fmt.Errorf("%s %d out of range 1-65535", name, p))
+			continue
+		}
+		if other, dup := seen[p]; dup {
+			errs = append(errs, fmt.Errorf("%s and %s both use %d", other, name, p))
+		}
+		seen[p] = name
+	}
+
+	if c.ChunkSize <= 0 {
+		errs = append(errs, fmt.Errorf("chunk size must be positive, got %d", c.ChunkSize))
+	}
+	if c.SocketReadBuffer < 0 || c.SocketWriteBuffer < 0 {
+		errs = append(errs, errors.New("socket buffer sizes cannot be negative"))
+	}
+	if c.BroadcastInt <= 0 {
+		errs = append(errs, fmt.Errorf("broadcast interval must be positive, got %s", c.BroadcastInt))
+	}
+	if c.BroadcastJitter < 0 || c.BroadcastJitter >= 1 {
+		errs = append(errs, fmt.Errorf("broadcast jitter must be at least 0 and below 1, got %g", c.BroadcastJitter))
+	}
+	switch c.DiscoveryMode {
+	case "", "multicast", "broadcast", "both", "mdns":
+	default:
+		errs = append(errs, fmt.Errorf("unknown discovery mode %q", c.DiscoveryMode))
+	}
+
+	if c.MulticastTTL < 0 || c.MulticastTTL > 255 {
+		errs = append(errs, fmt.Errorf("multicast TTL %d out of range 0-255", c.MulticastTTL))
+	}
+
+	if c.DownloadDir == "" {
+		errs = append(errs, errors.New("download dir is empty"))
+	} else if err := CheckWritable(c.DownloadDir); err != nil {
+		errs = append(errs, fmt.Errorf("download dir %s is not writable: %w", c.DownloadDir, err))
+	}
+	if c.StagingDir != "" {
+		if err := CheckWritable(c.StagingDir); err != nil {
+			errs = append(errs, fmt.Errorf("staging dir %s is not writable: %w", c.StagingDir, err))
+		}
+	}
+	if c.MaxIncoming < 0 || c.MaxPendingOffers < 0 {
+		errs = append(errs, errors.New("incoming transfer limits cannot be negative"))
+	}
+	if c.MaxSendRate < 0 {
+		errs = append(errs, errors.New("max send rate cannot be negative"))
+	}
+	if c.MaxUploadBytes < 0 || c.MaxFormMemory < 0 {
+		errs = append(errs, errors.New("max upload and form sizes cannot be negative"))
+	}
+	if c.FileRetention < 0 || c.MaxDownloadBytes < 0 || c.UserQuotaBytes < 0 {
+		errs = append(errs, errors.New("retention limits and the user quota cannot be negative"))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS certificate and key must be set together"))
+	} else if c.TLSEnabled() {
+		if _, err := c.LoadTLSCert(); err != nil {
+			errs = append(errs, fmt.Errorf("TLS certificate: %w", err))
+		}
+	}
+
+	if c.DBConnStr == "" {
+		errs = append(errs, errors.New("database connection string is empty"))
+	}
+	if (c.SMTPFrom == "") != (c.SMTPPass == "") {
+		errs = append(errs, errors.New("SMTP sender and password must be set together"))
+	}
+	if c.SMTPPort < 0 || c.SMTPPort > 65535 {
+		errs = append(errs, fmt.Errorf("SMTP port %d out of range", c.SMTPPort))
+	}
+	switch c.SMTPTLS {
+	case "", SMTPStartTLS, SMTPImplicitTLS, SMTPNoTLS:
+	default:
+		errs = append(errs, fmt.Errorf("SMTP TLS mode %q must be %q, %q or %q", c.SMTPTLS, SMTPStartTLS, SMTPImplicitTLS, SMTPNoTLS))
+	}
+	for _, cidr := range append(append([]string(nil), c.URLFetchAllow...), c.URLFetchDeny...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("URL fetch policy: %w", err))
+		}
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook URL %q is not an absolute http(s) URL", c.WebhookURL))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckWritable creates dir if needed and verifies a file can be created in it.
+func CheckWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
 }
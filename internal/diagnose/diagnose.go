@@ -0,0 +1,102 @@
+// Package diagnose runs the self-test behind the -diagnose flag: the checks
+// a user can run before filing an "it doesn't work" issue.
+package diagnose
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"filetransfer/internal/auth"
+	"filetransfer/internal/config"
+	"filetransfer/internal/discovery"
+	"filetransfer/internal/storage"
+)
+
+// multicastTimeout bounds how long the multicast probe waits to loop back.
+const multicastTimeout = 2 * time.Second
+
+// Result is the outcome of one check. A skipped check has a Note saying why
+// and counts as a pass.
+type Result struct {
+	Name string
+	Err  error
+	Note string
+}
+
+// Run performs every check for cfg, in order, and returns all the results;
+// one failure doesn't stop the rest, not even an invalid configuration.
+func Run(cfg config.Config) []Result {
+	results := []Result{
+		{Name: "configuration", Err: cfg.Validate()},
+		{Name: "database", Err: storage.Ping(cfg.DBConnStr)},
+		checkSMTP(cfg),
+		{Name: fmt.Sprintf("web port %d (tcp)", cfg.ServerPort), Err: CheckTCPPort(cfg.ServerPort)},
+		{Name: fmt.Sprintf("transfer port %d (tcp)", cfg.TransferPort), Err: CheckTCPPort(cfg.TransferPort)},
+	}
+	if cfg.DiscoveryMode == "mdns" {
+		results = append(results, Result{Name: "discovery port", Note: "mDNS discovery uses port 5353"})
+	} else {
+		results = append(results, Result{Name: fmt.Sprintf("discovery port %d (udp)", cfg.DiscoveryPort), Err: CheckUDPPort(cfg.DiscoveryPort)})
+	}
+	if cfg.DiscoveryMode == "broadcast" {
+		results = append(results, Result{Name: "multicast loopback", Note: "discovery mode is broadcast"})
+	} else {
+		results = append(results, Result{Name: "multicast loopback", Err: discovery.CheckMulticast(multicastTimeout)})
+	}
+	results = append(results, Result{Name: "download dir " + cfg.DownloadDir, Err: config.CheckWritable(cfg.DownloadDir)})
+	if cfg.StagingDir != "" {
+		results = append(results, Result{Name: "staging dir " + cfg.StagingDir, Err: config.CheckWritable(cfg.StagingDir)})
+	}
+	return results
+}
+
+func checkSMTP(cfg config.Config) Result {
+	if !cfg.SMTPConfigured() {
+		return Result{Name: "smtp", Note: "SMTP_FROM/SMTP_PASS not set"}
+	}
+	return Result{Name: "smtp", Err: auth.NewMailer(cfg).Check()}
+}
+
+// CheckTCPPort reports whether port can be bound on all interfaces, as the
+// web and transfer servers do.
+func CheckTCPPort(port int) error {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// CheckUDPPort reports whether the UDP port can be bound.
+func CheckUDPPort(port int) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Report writes one line per result and reports whether all passed.
+func Report(w io.Writer, results []Result) bool {
+	ok := true
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			ok = false
+			fmt.Fprintf(w, "FAIL  %s: %v\n", r.Name, r.Err)
+		case r.Note != "":
+			fmt.Fprintf(w, "SKIP  %s (%s)\n", r.Name, r.Note)
+		default:
+			fmt.Fprintf(w, "PASS  %s\n", r.Name)
+		}
+	}
+	if ok {
+		fmt.Fprintln(w, "All checks passed.")
+	} else {
+		fmt.Fprintln(w, "Some checks failed.")
+	}
+	return ok
+}
@@ -0,0 +1,37 @@
+package discovery
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Announce sends this device's presence now instead of at the next
+// scheduled announcement, e.g. after someone signs in.
+func (s *Service) Announce() {
+	select {
+	case s.announceNow <- struct{}{}:
+	default: // one is already due
+	}
+}
+
+// waitAnnounce waits until the next announcement on ctx's sockets is due
+// and reports whether ctx is still live.
+func (s *Service) waitAnnounce(ctx context.Context) bool {
+	d := jitter(announceInterval(ctx, s.config.BroadcastInt), s.config.BroadcastJitter, rand.Float64())
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+	case <-s.announceNow:
+	}
+	return true
+}
+
+// jitter varies d by up to frac of it either way; r in [0, 1) picks where in
+// that range the result falls.
+func jitter(d time.Duration, frac, r float64) time.Duration {
+	return d + time.Duration(float64(d)*frac*(2*r-1))
+}
@@ -1,96 +1,306 @@
 package discovery
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"filetransfer/internal/config"
 	"filetransfer/internal/models"
+	"filetransfer/pkg/utils"
 )
 
 const (
 	multicastAddr   = "239.0.0.1"
 	maxDatagramSize = 8192
+	// A discovered device is online while its announcements are this fresh.
+	onlineWindow = 10 * time.Second
 )
 
+// Presence is what this device advertises beyond its fixed address and ID.
+type Presence struct {
+	DeviceName string   // defaults to Config.DeviceName when empty
+	Owner      string   // account incoming files go to; may be empty
+	Users      []string // everyone currently signed in, owner included
+}
+
+// PresenceProvider reports the current presence. It is called on every
+// announcement, so it should be cheap.
+type PresenceProvider func() Presence
+
 type Service struct {
-	config      config.Config
-	localIP     string
-	deviceID    string
-	devices     map[string]*models.Device
-	mu          sync.RWMutex
-	getUsername func() string
+	config   config.Config
+	localIP  string
+	deviceID string
+	devices  map[string]*models.Device
+	mu       sync.RWMutex
+	presence PresenceProvider
+
+	notify func(string, interface{}) // device_online/offline events; may be nil
+	online map[string]bool           // devices last reported online, guarded by mu
+
+	capabilities []string          // advertised; LocalCapabilities plus CapTLS if enabled
+	fingerprint  string            // of our TLS certificate, if any
+	pins         map[string]string // device ID → pinned fingerprint, guarded by mu
+
+	listenIfaces []InterfaceStatus // multicast receive interfaces, guarded by mu
+	sendIfaces   []InterfaceStatus // multicast send interfaces, guarded by mu
+
+	ctx  context.Context // done once Stop is called
+	stop context.CancelFunc
+
+	announceNow chan struct{} // asks for an announcement without waiting; see Announce
+
+	// stopSockets ends the current set of discovery sockets, which
+	// restartSockets replaces when the network changes. Guarded by mu.
+	stopSockets context.CancelFunc
 }
 
-func NewService(cfg config.Config, localIP, deviceID string, getUserName func() string) *Service {
-	return &Service{
-		config:      cfg,
-		localIP:     localIP,
-		deviceID:    deviceID,
-		devices:     make(map[string]*models.Device),
-		getUsername: getUserName,
+func NewService(cfg config.Config, localIP, deviceID string, presence PresenceProvider) *Service {
+	ctx, stop := context.WithCancel(context.Background())
+	s := &Service{
+		config:       cfg,
+		localIP:      localIP,
+		deviceID:     deviceID,
+		devices:      make(map[string]*models.Device),
+		presence:     presence,
+		online:       make(map[string]bool),
+		capabilities: models.LocalCapabilities,
+		announceNow:  make(chan struct{}, 1),
+		ctx:          ctx,
+		stop:         stop,
+	}
+	s.loadPins()
+	if cfg.TLSEnabled() {
+		if cert, err := cfg.LoadTLSCert(); err != nil {
+			log.Printf("[DISCOVERY] Not advertising TLS: %v", err)
+		} else {
+			s.capabilities = append(append([]string(nil), models.LocalCapabilities...), models.CapTLS)
+			s.fingerprint = utils.CertFingerprint(&cert)
+		}
 	}
+	return s
+}
+
+// currentPresence returns the provider's presence with defaults filled in,
+// as it is announced: the signed-in users' emails are left out unless
+// AdvertiseUsers is set.
+func (s *Service) currentPresence() Presence {
+	var p Presence
+	if s.presence != nil {
+		p = s.presence()
+	}
+	if !s.config.AdvertiseUsers {
+		p.Users = nil
+	}
+	if p.DeviceName == "" {
+		p.DeviceName = s.config.DeviceName
+	}
+	return p
+}
+
+// SetNotifier registers fn to receive device_online and device_offline
+// events. Call it before Start.
+func (s *Service) SetNotifier(fn func(string, interface{})) {
+	s.notify = fn
 }
 
 func (s *Service) Start() {
-	go s.broadcastPresence()
-	go s.listenDiscovery()
+	go s.watchOffline()
+	go s.watchNetwork()
+	s.startSockets(false)
 }
 
-func (s *Service) broadcastPresence() {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", multicastAddr, s.config.DiscoveryPort))
-	if err != nil {
-		log.Fatal("resolve broadcast addr:", err)
+// startSockets opens the discovery sockets for the current network. With
+// burst set, the first few announcements go out quickly so peers notice a
+// device that has just switched networks.
+func (s *Service) startSockets(burst bool) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	if burst {
+		ctx = context.WithValue(ctx, burstKey{}, time.Now().Add(reannounceBurst))
 	}
+	s.mu.Lock()
+	s.stopSockets = cancel
+	s.mu.Unlock()
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Println("Broadcast dial error:", err)
+	switch s.config.DiscoveryMode {
+	case "mdns":
+		go s.runMDNS(ctx)
 		return
 	}
-	defer conn.Close()
+	go s.broadcastPresence(ctx)
+	if s.useMulticast() {
+		go s.listenDiscovery(ctx)
+	}
+	if s.useBroadcast() {
+		go s.listenBroadcast(ctx)
+	}
+}
+
+// LocalIP returns the address this device advertises, which follows the
+// machine across networks.
+func (s *Service) LocalIP() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.localIP
+}
+
+// Stop closes the discovery sockets and ends any retries still waiting for
+// the network.
+func (s *Service) Stop() {
+	s.stop()
+}
+
+// useMulticast reports whether presence goes to the multicast group.
+// This is the default for an empty or unknown DiscoveryMode.
+func (s *Service) useMulticast() bool {
+	return s.config.DiscoveryMode != "broadcast"
+}
+
+// useBroadcast reports whether presence goes to the subnet broadcast address.
+func (s *Service) useBroadcast() bool {
+	return s.config.DiscoveryMode == "broadcast" || s.config.DiscoveryMode == "both"
+}
+
+// multicastGroup is the discovery group address.
+func (s *Service) multicastGroup() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(multicastAddr), Port: s.config.DiscoveryPort}
+}
+
+// dialPresence opens a socket for each configured presence destination. If
+// any fails, none are kept, so the caller can retry them all together.
+func (s *Service) dialPresence() ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	fail := func(err error) ([]*net.UDPConn, error) {
+		for _, c := range conns {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	if s.useMulticast() {
+		ifaces, err := s.multicastInterfaces()
+		if err != nil {
+			return fail(err)
+		}
+		ttl := s.config.MulticastTTL
+		if ttl == 0 {
+			ttl = 1
+		}
+		mconns, err := s.dialMulticast(ifaces, ttl)
+		if err != nil {
+			return fail(err)
+		}
+		conns = append(conns, mconns...)
+	}
 
+	if s.useBroadcast() {
+		// Go enables SO_BROADCAST on every UDP socket, so a plain DialUDP to
+		// the subnet broadcast address is enough.
+		bcast := utils.SubnetBroadcast(s.LocalIP())
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: bcast, Port: s.config.DiscoveryPort})
+		if err != nil {
+			return fail(err)
+		}
+		log.Printf("[DISCOVERY] Broadcasting presence to %s:%d", bcast, s.config.DiscoveryPort)
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func (s *Service) broadcastPresence(ctx context.Context) {
+	var conns []*net.UDPConn
+	if !s.withRetry(ctx, "Presence socket", func() (err error) {
+		conns, err = s.dialPresence()
+		return err
+	}) {
+		return
+	}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	// The device is advertised whether or not anyone is signed in; the
+	// username and (with AdvertiseUsers) users fields just say who is there
+	// right now.
 	for {
-		username := s.getUsername()
-		// Only broadcast when logged in
-		if username != "" {
-			msg := map[string]interface{}{
-				"id":       s.deviceID,
-				"name":     s.config.DeviceName,
-				"username": username,
-				"ip":       s.localIP,
-				"port":     s.config.TransferPort,
-			}
-			data, _ := json.Marshal(msg)
+		p := s.currentPresence()
+		msg := map[string]interface{}{
+			"id":       s.deviceID,
+			"name":     p.DeviceName,
+			"username": p.Owner,
+			"users":    p.Users,
+			"ip":       s.LocalIP(),
+			"port":     s.config.TransferPort,
+
+			"capabilities": s.capabilities,
+			"certSha256":   s.fingerprint,
+		}
+		data, _ := json.Marshal(msg)
+		for _, conn := range conns {
 			if _, err := conn.Write(data); err != nil {
 				log.Println("Broadcast write error:", err)
 			}
 		}
-		time.Sleep(s.config.BroadcastInt)
+		if !s.waitAnnounce(ctx) {
+			return
+		}
 	}
 }
 
-func (s *Service) listenDiscovery() {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", multicastAddr, s.config.DiscoveryPort))
-	if err != nil {
-		log.Fatal("resolve discovery addr:", err)
+func (s *Service) listenDiscovery(ctx context.Context) {
+	var conn *net.UDPConn
+	if !s.withRetry(ctx, "Multicast listen", func() error {
+		ifaces, err := s.multicastInterfaces()
+		if err == nil {
+			conn, err = s.listenMulticast(ifaces)
+		}
+		return err
+	}) {
+		return
 	}
+	defer conn.Close()
+	closeOnStop(ctx, conn)
+	s.readPresence(conn)
+}
 
-	conn, err := net.ListenMulticastUDP("udp", nil, addr)
-	if err != nil {
-		log.Println("Discovery listen error:", err)
+// listenBroadcast receives presence sent to the subnet broadcast address.
+// The socket binds the wildcard address with SO_REUSEADDR so it can share
+// the discovery port with the multicast listener.
+func (s *Service) listenBroadcast(ctx context.Context) {
+	lc := net.ListenConfig{Control: reuseAddr}
+	var pc net.PacketConn
+	if !s.withRetry(ctx, "Broadcast listen", func() (err error) {
+		pc, err = lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", s.config.DiscoveryPort))
+		return err
+	}) {
 		return
 	}
-	defer conn.Close()
+	defer pc.Close()
+	closeOnStop(ctx, pc)
+	s.readPresence(pc.(*net.UDPConn))
+}
+
+// readPresence decodes presence datagrams from conn into the devices map
+// until conn is closed.
+func (s *Service) readPresence(conn *net.UDPConn) {
 	conn.SetReadBuffer(maxDatagramSize)
 
 	buf := make([]byte, maxDatagramSize)
 	for {
 		n, srcAddr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("Discovery read error:", err)
 			continue
@@ -113,34 +323,179 @@ func (s *Service) listenDiscovery() {
 		name, _ := msg["name"].(string)
 		log.Printf("[DISCOVERY] Found peer: %s (%s) from %s", username, name, srcAddr.String())
 		portFloat, _ := msg["port"].(float64)
+		caps := stringList(msg["capabilities"])
+		users := stringList(msg["users"])
+		fingerprint, _ := msg["certSha256"].(string)
 
-		s.mu.Lock()
-		s.devices[id] = &models.Device{
+		s.upsertDevice(&models.Device{
 			ID:       id,
 			Name:     name,
 			Username: username,
 			IP:       srcAddr.IP.String(),
 			Port:     int(portFloat),
 			LastSeen: time.Now(),
+
+			Capabilities:    caps,
+			Users:           users,
+			CertFingerprint: fingerprint,
+		})
+	}
+}
+
+// stringList converts a decoded JSON array to its string elements.
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var out []string
+	for _, item := range list {
+		if str, ok := item.(string); ok {
+			out = append(out, str)
 		}
-		s.mu.Unlock()
+	}
+	return out
+}
+
+// upsertDevice records a peer seen by any discovery backend, reporting it
+// online if it wasn't already.
+func (s *Service) upsertDevice(d *models.Device) {
+	s.mu.Lock()
+	s.applyPinLocked(d)
+	s.devices[d.ID] = d
+	appeared := d.ID != s.deviceID && !s.online[d.ID]
+	if appeared {
+		s.online[d.ID] = true
+	}
+	s.mu.Unlock()
+	if appeared && s.notify != nil {
+		s.notify(models.EventDeviceOnline, d)
 	}
 }
 
-// GetDevices returns devices seen in the last 10 seconds.
+// watchOffline reports devices whose announcements have stopped.
+func (s *Service) watchOffline() {
+	ticker := time.NewTicker(onlineWindow / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepOffline()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) sweepOffline() {
+	var gone []*models.Device
+	s.mu.Lock()
+	for id := range s.online {
+		d := s.devices[id]
+		if d == nil || !online(d) {
+			delete(s.online, id)
+			if d == nil {
+				d = &models.Device{ID: id}
+			}
+			gone = append(gone, d)
+		}
+	}
+	s.mu.Unlock()
+	if s.notify == nil {
+		return
+	}
+	for _, d := range gone {
+		s.notify(models.EventDeviceOffline, d)
+	}
+}
+
+// AddManualPeer registers a peer that was paired explicitly (e.g. via QR code)
+// rather than discovered. Manual peers stay listed until replaced.
+func (s *Service) AddManualPeer(d *models.Device) {
+	d.Manual = true
+	d.LastSeen = time.Now()
+	s.upsertDevice(d)
+	log.Printf("[DISCOVERY] Paired manual peer: %s (%s) at %s:%d", d.Username, d.Name, d.IP, d.Port)
+}
+
+// GetDevices returns manual peers plus devices seen within onlineWindow.
+// This device is never listed, even if it was paired with itself.
 func (s *Service) GetDevices() []*models.Device {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var devices []*models.Device
 	for _, d := range s.devices {
-		if time.Since(d.LastSeen) < 10*time.Second {
+		if d.ID == s.deviceID {
+			continue
+		}
+		if online(d) {
 			devices = append(devices, d)
 		}
 	}
 	return devices
 }
 
+// Online reports whether the device with id is currently announcing itself
+// (or was added manually).
+func (s *Service) Online(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.devices[id]
+	return ok && online(d)
+}
+
+func online(d *models.Device) bool {
+	return d.Manual || time.Since(d.LastSeen) < onlineWindow
+}
+
+// RecentDevices returns every device seen within Config.RecentDevicesWindow
+// (default 24h), most recently seen first, marking which are still online.
+// Devices older than the window are forgotten.
+func (s *Service) RecentDevices() []models.RecentDevice {
+	window := s.config.RecentDevicesWindow
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recent []models.RecentDevice
+	for id, d := range s.devices {
+		if id == s.deviceID {
+			continue
+		}
+		if !d.Manual && time.Since(d.LastSeen) > window {
+			delete(s.devices, id)
+			continue
+		}
+		recent = append(recent, models.RecentDevice{Device: d, Online: online(d)})
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].LastSeen.After(recent[j].LastSeen)
+	})
+	return recent
+}
+
+// ResolvePeerByUsername returns the currently listed devices owned by, or
+// with a session for, username. More than one result means the name alone
+// is ambiguous.
+func (s *Service) ResolvePeerByUsername(username string) []*models.Device {
+	var matches []*models.Device
+	for _, d := range s.GetDevices() {
+		if strings.EqualFold(d.Username, username) || containsFold(d.Users, username) {
+			matches = append(matches, d)
+		}
+	}
+	return matches
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Service) GetDevice(id string) (*models.Device, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"filetransfer/internal/config"
+)
+
+func TestJitterRange(t *testing.T) {
+	const d = 3 * time.Second
+	low, high := time.Duration(float64(d)*0.8), time.Duration(float64(d)*1.2)
+	for _, r := range []float64{0, 0.25, 0.5, 0.999} {
+		if got := jitter(d, 0.2, r); got < low || got > high {
+			t.Errorf("jitter(%s, 0.2, %g) = %s, outside [%s, %s]", d, r, got, low, high)
+		}
+	}
+	if got := jitter(d, 0, 0.9); got != d {
+		t.Errorf("no jitter: got %s, want %s", got, d)
+	}
+
+	s := NewService(config.Config{BroadcastInt: 50 * time.Millisecond, BroadcastJitter: 0.5}, "127.0.0.1", "dev", nil)
+	var lo, hi time.Duration
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		s.waitAnnounce(context.Background())
+		got := time.Since(start)
+		if i == 0 || got < lo {
+			lo = got
+		}
+		if got > hi {
+			hi = got
+		}
+	}
+	if lo < 25*time.Millisecond || hi > 150*time.Millisecond {
+		t.Errorf("waits ranged %s to %s, want within 25ms to 75ms (plus scheduling slack)", lo, hi)
+	}
+}
+
+func TestAnnounceSkipsWait(t *testing.T) {
+	s := NewService(config.Config{BroadcastInt: time.Hour}, "127.0.0.1", "dev", nil)
+	s.Announce()
+	s.Announce() // coalesced, doesn't block
+	done := make(chan bool)
+	go func() { done <- s.waitAnnounce(context.Background()) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("waitAnnounce reported a stopped service")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Announce did not cut the wait short")
+	}
+}
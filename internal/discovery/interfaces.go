@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// InterfaceStatus describes one interface multicast discovery tried to use
+// for listening or sending.
+type InterfaceStatus struct {
+	Name   string `json:"name"`
+	IP     string `json:"ip"`
+	Active bool   `json:"active"`
+	Error  string `json:"error,omitempty"`
+}
+
+type mcastIface struct {
+	iface net.Interface
+	ip    net.IP // IPv4 address, used to pick the interface for sending
+}
+
+// multicastInterfaces returns the up, multicast-capable IPv4 interfaces to
+// use: those named in Config.DiscoveryInterfaces, or else every one that
+// isn't a loopback.
+func (s *Service) multicastInterfaces() ([]mcastIface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var out []mcastIface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if len(s.config.DiscoveryInterfaces) > 0 {
+			if !containsFold(s.config.DiscoveryInterfaces, ifi.Name) {
+				continue
+			}
+		} else if ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if ip := interfaceIPv4(ifi); ip != nil {
+			out = append(out, mcastIface{iface: ifi, ip: ip})
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no multicast-capable interface is up")
+	}
+	return out, nil
+}
+
+func interfaceIPv4(ifi net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			if ip4 := ipn.IP.To4(); ip4 != nil {
+				return ip4
+			}
+		}
+	}
+	return nil
+}
+
+// listenMulticast opens one socket for the discovery group and joins it on
+// every interface in ifaces, so peers on any attached network are heard.
+// It fails only if no interface could be joined.
+func (s *Service) listenMulticast(ifaces []mcastIface) (*net.UDPConn, error) {
+	group := s.multicastGroup()
+	var conn *net.UDPConn
+	status := make([]InterfaceStatus, len(ifaces))
+	for i, mi := range ifaces {
+		status[i] = InterfaceStatus{Name: mi.iface.Name, IP: mi.ip.String()}
+		var err error
+		if conn == nil {
+			conn, err = net.ListenMulticastUDP("udp4", &mi.iface, group)
+		} else if rc, rerr := conn.SyscallConn(); rerr != nil {
+			err = rerr
+		} else {
+			err = joinGroup(rc, group.IP, mi.ip)
+		}
+		if err != nil {
+			status[i].Error = err.Error()
+			log.Printf("[DISCOVERY] Cannot join %s on %s: %v", group.IP, mi.iface.Name, err)
+			continue
+		}
+		status[i].Active = true
+		log.Printf("[DISCOVERY] Listening for peers on %s (%s)", mi.iface.Name, mi.ip)
+	}
+	s.mu.Lock()
+	s.listenIfaces = status
+	s.mu.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("could not join the discovery group on any of %d interfaces", len(ifaces))
+	}
+	return conn, nil
+}
+
+// dialMulticast opens a presence socket per interface in ifaces.
+func (s *Service) dialMulticast(ifaces []mcastIface, ttl int) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	status := make([]InterfaceStatus, len(ifaces))
+	for i, mi := range ifaces {
+		status[i] = InterfaceStatus{Name: mi.iface.Name, IP: mi.ip.String()}
+		conn, err := net.DialUDP("udp4", nil, s.multicastGroup())
+		if err == nil {
+			var rc syscall.RawConn
+			if rc, err = conn.SyscallConn(); err == nil {
+				err = setMulticastIf(rc, mi.ip)
+			}
+			if err == nil {
+				if err := setMulticastOpts(rc, ttl, !s.config.DisableMulticastLoop); err != nil {
+					log.Println("[DISCOVERY] Setting multicast options:", err)
+				}
+			} else {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			status[i].Error = err.Error()
+			log.Printf("[DISCOVERY] Cannot send presence on %s: %v", mi.iface.Name, err)
+			continue
+		}
+		status[i].Active = true
+		conns = append(conns, conn)
+	}
+	s.mu.Lock()
+	s.sendIfaces = status
+	s.mu.Unlock()
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("could not send on any of %d interfaces", len(ifaces))
+	}
+	return conns, nil
+}
+
+// Interfaces reports the interfaces multicast discovery is receiving and
+// sending presence on, with the error for any it couldn't use.
+func (s *Service) Interfaces() (listening, sending []InterfaceStatus) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]InterfaceStatus(nil), s.listenIfaces...), append([]InterfaceStatus(nil), s.sendIfaces...)
+}
@@ -0,0 +1,414 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// Minimal mDNS/DNS-SD (RFC 6762/6763) backend. It announces this device as
+// an instance of _filetransfer._tcp.local and browses for other instances,
+// feeding results into the same devices map as the multicast backend.
+
+const (
+	mdnsAddr    = "224.0.0.251:5353"
+	mdnsService = "_filetransfer._tcp.local."
+	mdnsTTL     = 120
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000
+)
+
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte // raw RDATA, names uncompressed when we build it
+	// Decoded views (filled by the parser)
+	Target string   // PTR target or SRV target
+	Port   uint16   // SRV
+	TXT    []string // TXT strings
+	IP     net.IP   // A
+}
+
+type dnsMessage struct {
+	Response  bool
+	Questions []dnsQuestion
+	Answers   []dnsRecord
+}
+
+type dnsQuestion struct {
+	Name string
+	Type uint16
+}
+
+func (s *Service) runMDNS(ctx context.Context) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		log.Fatal("resolve mdns addr:", err)
+	}
+	var conn *net.UDPConn
+	if !s.withRetry(ctx, "mDNS listen", func() (err error) {
+		conn, err = net.ListenMulticastUDP("udp4", nil, group)
+		return err
+	}) {
+		return
+	}
+	defer conn.Close()
+	closeOnStop(ctx, conn)
+	conn.SetReadBuffer(maxDatagramSize)
+	log.Printf("[DISCOVERY] mDNS backend browsing %s", mdnsService)
+
+	go func() {
+		for {
+			if pkt, err := s.mdnsAnnouncement(); err == nil {
+				conn.WriteToUDP(pkt, group)
+			}
+			conn.WriteToUDP(encodeDNSMessage(dnsMessage{
+				Questions: []dnsQuestion{{Name: mdnsService, Type: dnsTypePTR}},
+			}), group)
+			if !s.waitAnnounce(ctx) {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("mDNS read error:", err)
+			continue
+		}
+		msg, err := decodeDNSMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if !msg.Response {
+			if asksForService(msg) {
+				if pkt, err := s.mdnsAnnouncement(); err == nil {
+					conn.WriteToUDP(pkt, group)
+				}
+			}
+			continue
+		}
+		for _, d := range devicesFromMDNS(msg, src.IP) {
+			if d.ID == s.deviceID {
+				continue
+			}
+			log.Printf("[DISCOVERY] mDNS peer: %s (%s) at %s:%d", d.Username, d.Name, d.IP, d.Port)
+			s.upsertDevice(d)
+		}
+	}
+}
+
+func asksForService(msg dnsMessage) bool {
+	for _, q := range msg.Questions {
+		if strings.EqualFold(q.Name, mdnsService) && (q.Type == dnsTypePTR || q.Type == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsAnnouncement builds the PTR/SRV/TXT/A response advertising this device.
+func (s *Service) mdnsAnnouncement() ([]byte, error) {
+	ip := net.ParseIP(s.LocalIP()).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("no IPv4 address to advertise")
+	}
+	p := s.currentPresence()
+	sum := sha1.Sum([]byte(s.deviceID))
+	short := fmt.Sprintf("%x", sum[:4])
+	label := p.DeviceName
+	if len(label) > 50 {
+		label = label[:50]
+	}
+	label = strings.ReplaceAll(label, ".", "-") + "-" + short
+	instance := label + "." + mdnsService
+	host := "ft-" + short + ".local."
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(s.config.TransferPort))
+	srv = append(srv, encodeName(host)...)
+
+	txt := encodeTXT([]string{
+		"id=" + s.deviceID,
+		"name=" + p.DeviceName,
+		"username=" + p.Owner,
+		"caps=" + strings.Join(s.capabilities, ","),
+		txtList("users=", p.Users),
+		"cert=" + s.fingerprint,
+	})
+
+	return encodeDNSMessage(dnsMessage{
+		Response: true,
+		Answers: []dnsRecord{
+			{Name: mdnsService, Type: dnsTypePTR, Class: dnsClassIN, TTL: mdnsTTL, Data: encodeName(instance)},
+			{Name: instance, Type: dnsTypeSRV, Class: dnsClassIN | dnsCacheFlush, TTL: mdnsTTL, Data: srv},
+			{Name: instance, Type: dnsTypeTXT, Class: dnsClassIN | dnsCacheFlush, TTL: mdnsTTL, Data: txt},
+			{Name: host, Type: dnsTypeA, Class: dnsClassIN | dnsCacheFlush, TTL: mdnsTTL, Data: ip},
+		},
+	}), nil
+}
+
+// devicesFromMDNS maps the service instances in a response to devices.
+// Instances missing an id TXT key aren't ours and are skipped.
+func devicesFromMDNS(msg dnsMessage, src net.IP) []*models.Device {
+	srv := map[string]dnsRecord{}
+	txt := map[string][]string{}
+	addr := map[string]net.IP{}
+	var instances []string
+	for _, rr := range msg.Answers {
+		key := strings.ToLower(rr.Name)
+		switch rr.Type {
+		case dnsTypePTR:
+			if strings.EqualFold(rr.Name, mdnsService) {
+				instances = append(instances, strings.ToLower(rr.Target))
+			}
+		case dnsTypeSRV:
+			srv[key] = rr
+		case dnsTypeTXT:
+			txt[key] = rr.TXT
+		case dnsTypeA:
+			addr[key] = rr.IP
+		}
+	}
+
+	var out []*models.Device
+	for _, inst := range instances {
+		rr, ok := srv[inst]
+		if !ok {
+			continue
+		}
+		kv := map[string]string{}
+		for _, entry := range txt[inst] {
+			if k, v, ok := strings.Cut(entry, "="); ok {
+				kv[k] = v
+			}
+		}
+		if kv["id"] == "" {
+			continue
+		}
+		var caps, users []string
+		if kv["caps"] != "" {
+			caps = strings.Split(kv["caps"], ",")
+		}
+		if kv["users"] != "" {
+			users = strings.Split(kv["users"], ",")
+		}
+		ip := addr[strings.ToLower(rr.Target)]
+		if ip == nil {
+			ip = src
+		}
+		out = append(out, &models.Device{
+			ID:       kv["id"],
+			Name:     kv["name"],
+			Username: kv["username"],
+			IP:       ip.String(),
+			Port:     int(rr.Port),
+			LastSeen: time.Now(),
+
+			Capabilities:    caps,
+			Users:           users,
+			CertFingerprint: kv["cert"],
+		})
+	}
+	return out
+}
+
+// ---- DNS wire format ----
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// txtList joins values after key, dropping whole values that would push the
+// entry past the 255-byte TXT string limit.
+func txtList(key string, values []string) string {
+	entry := key
+	for i, v := range values {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if len(entry)+len(sep)+len(v) > 255 {
+			break
+		}
+		entry += sep + v
+	}
+	return entry
+}
+
+func encodeTXT(entries []string) []byte {
+	var b []byte
+	for _, e := range entries {
+		if len(e) > 255 {
+			e = e[:255]
+		}
+		b = append(b, byte(len(e)))
+		b = append(b, e...)
+	}
+	return b
+}
+
+func encodeDNSMessage(m dnsMessage) []byte {
+	hdr := make([]byte, 12)
+	if m.Response {
+		binary.BigEndian.PutUint16(hdr[2:], 0x8400) // QR + AA
+	}
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(hdr[6:], uint16(len(m.Answers)))
+	b := hdr
+	for _, q := range m.Questions {
+		b = append(b, encodeName(q.Name)...)
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	}
+	for _, rr := range m.Answers {
+		b = append(b, encodeName(rr.Name)...)
+		b = binary.BigEndian.AppendUint16(b, rr.Type)
+		b = binary.BigEndian.AppendUint16(b, rr.Class)
+		b = binary.BigEndian.AppendUint32(b, rr.TTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+		b = append(b, rr.Data...)
+	}
+	return b
+}
+
+var errShortDNS = errors.New("short dns message")
+
+func decodeDNSMessage(b []byte) (dnsMessage, error) {
+	var m dnsMessage
+	if len(b) < 12 {
+		return m, errShortDNS
+	}
+	m.Response = b[2]&0x80 != 0
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	rrCount := int(binary.BigEndian.Uint16(b[6:])) +
+		int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, n, err := decodeName(b, off)
+		if err != nil {
+			return m, err
+		}
+		off = n
+		if off+4 > len(b) {
+			return m, errShortDNS
+		}
+		m.Questions = append(m.Questions, dnsQuestion{Name: name, Type: binary.BigEndian.Uint16(b[off:])})
+		off += 4
+	}
+	for i := 0; i < rrCount; i++ {
+		name, n, err := decodeName(b, off)
+		if err != nil {
+			return m, err
+		}
+		off = n
+		if off+10 > len(b) {
+			return m, errShortDNS
+		}
+		rr := dnsRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off:]),
+			Class: binary.BigEndian.Uint16(b[off+2:]),
+			TTL:   binary.BigEndian.Uint32(b[off+4:]),
+		}
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlen > len(b) {
+			return m, errShortDNS
+		}
+		rr.Data = b[off : off+rdlen]
+		switch rr.Type {
+		case dnsTypePTR:
+			rr.Target, _, _ = decodeName(b, off)
+		case dnsTypeSRV:
+			if rdlen >= 7 {
+				rr.Port = binary.BigEndian.Uint16(b[off+4:])
+				rr.Target, _, _ = decodeName(b, off+6)
+			}
+		case dnsTypeTXT:
+			for p := 0; p < rdlen; {
+				l := int(rr.Data[p])
+				if p+1+l > rdlen {
+					break
+				}
+				rr.TXT = append(rr.TXT, string(rr.Data[p+1:p+1+l]))
+				p += 1 + l
+			}
+		case dnsTypeA:
+			if rdlen == 4 {
+				rr.IP = net.IP(append([]byte(nil), rr.Data...))
+			}
+		}
+		m.Answers = append(m.Answers, rr)
+		off += rdlen
+	}
+	return m, nil
+}
+
+// decodeName reads a possibly-compressed name at off and returns it along
+// with the offset just past it in the original (uncompressed) position.
+func decodeName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(b) {
+			return "", 0, errShortDNS
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errShortDNS
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errShortDNS
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errors.New("dns name: too many compression pointers")
+}
@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"filetransfer/internal/config"
+)
+
+func TestDNSRoundTrip(t *testing.T) {
+	srv := []byte{0, 0, 0, 0, 0x23, 0x28} // priority, weight, port 9000
+	srv = append(srv, encodeName("host.local.")...)
+	in := dnsMessage{
+		Response:  true,
+		Questions: []dnsQuestion{{Name: mdnsService, Type: dnsTypePTR}},
+		Answers: []dnsRecord{
+			{Name: mdnsService, Type: dnsTypePTR, Class: dnsClassIN, TTL: mdnsTTL, Data: encodeName("box." + mdnsService)},
+			{Name: "box." + mdnsService, Type: dnsTypeSRV, Class: dnsClassIN | dnsCacheFlush, TTL: mdnsTTL, Data: srv},
+			{Name: "box." + mdnsService, Type: dnsTypeTXT, Class: dnsClassIN, TTL: mdnsTTL, Data: encodeTXT([]string{"id=1", "", "name=Box"})},
+			{Name: "host.local.", Type: dnsTypeA, Class: dnsClassIN, TTL: 10, Data: []byte{192, 168, 1, 5}},
+		},
+	}
+	out, err := decodeDNSMessage(encodeDNSMessage(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.Response || !reflect.DeepEqual(out.Questions, in.Questions) || len(out.Answers) != len(in.Answers) {
+		t.Fatalf("decoded %+v", out)
+	}
+	for i, rr := range out.Answers {
+		want := in.Answers[i]
+		if rr.Name != want.Name || rr.Type != want.Type || rr.Class != want.Class || rr.TTL != want.TTL || string(rr.Data) != string(want.Data) {
+			t.Errorf("answer %d: %+v, want %+v", i, rr, want)
+		}
+	}
+	if got := out.Answers[0].Target; got != "box."+mdnsService {
+		t.Errorf("PTR target %q", got)
+	}
+	if rr := out.Answers[1]; rr.Port != 9000 || rr.Target != "host.local." {
+		t.Errorf("SRV %d %q", rr.Port, rr.Target)
+	}
+	if got := out.Answers[2].TXT; !reflect.DeepEqual(got, []string{"id=1", "", "name=Box"}) {
+		t.Errorf("TXT %q", got)
+	}
+	if got := out.Answers[3].IP; !got.Equal(net.IPv4(192, 168, 1, 5)) {
+		t.Errorf("A %v", got)
+	}
+}
+
+func TestMDNSAnnouncementRoundTrip(t *testing.T) {
+	presence := func() Presence {
+		return Presence{Owner: "a@example.com", Users: []string{"a@example.com", "b@example.com"}}
+	}
+	s := NewService(config.Config{DeviceName: "Desk.top", TransferPort: 9000, AdvertiseUsers: true}, "192.168.1.5", "dev-1", presence)
+	b, err := s.mdnsAnnouncement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := decodeDNSMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := devicesFromMDNS(msg, net.IPv4(10, 0, 0, 9))
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices", len(devices))
+	}
+	d := devices[0]
+	if d.ID != "dev-1" || d.Name != "Desk.top" || d.Username != "a@example.com" || d.IP != "192.168.1.5" || d.Port != 9000 ||
+		!reflect.DeepEqual(d.Users, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("device %+v", d)
+	}
+
+	// By default only the owner is announced
+	s = NewService(config.Config{DeviceName: "Desk.top", TransferPort: 9000}, "192.168.1.5", "dev-1", presence)
+	b, err = s.mdnsAnnouncement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = decodeDNSMessage(b)
+	if devices = devicesFromMDNS(msg, net.IPv4(10, 0, 0, 9)); len(devices) != 1 || len(devices[0].Users) != 0 || bytes.Contains(b, []byte("b@example.com")) {
+		t.Errorf("users announced by default: %+v", devices)
+	}
+}
+
+func TestDecodeNameCompression(t *testing.T) {
+	b := make([]byte, 12)
+	b = append(b, encodeName("foo.local.")...) // at 12
+	ptr := len(b)
+	b = append(b, 3, 'b', 'a', 'r', 0xC0, 12) // "bar" + pointer to foo.local.
+	b = append(b, 0xC0, byte(ptr))            // pointer to a pointer
+	name, end, err := decodeName(b, ptr)
+	if err != nil || name != "bar.foo.local." || end != ptr+6 {
+		t.Errorf("decodeName = %q, %d, %v", name, end, err)
+	}
+	name, end, err = decodeName(b, ptr+6)
+	if err != nil || name != "bar.foo.local." || end != ptr+8 {
+		t.Errorf("pointer chain: %q, %d, %v", name, end, err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	header := func(qd, an int) []byte {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint16(b[4:], uint16(qd))
+		binary.BigEndian.PutUint16(b[6:], uint16(an))
+		return b
+	}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	name := encodeName("a.local.")
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", make([]byte, 11)},
+		{"missing question", header(1, 0)},
+		{"question without type", cat(header(1, 0), name, []byte{0, 12})},
+		{"label past end", cat(header(1, 0), []byte{5, 'a', 'b'})},
+		{"truncated pointer", cat(header(1, 0), []byte{0xC0})},
+		{"pointer past end", cat(header(1, 0), []byte{0xC0, 0xFF})},
+		{"pointer to itself", cat(header(1, 0), []byte{0xC0, 12})},
+		{"pointer loop", cat(header(1, 0), []byte{1, 'a', 0xC0, 16, 1, 'b', 0xC0, 12})},
+		{"record header cut", cat(header(0, 1), name, []byte{0, 1, 0, 1, 0})},
+		{"rdata past end", cat(header(0, 1), name, []byte{0, 1, 0, 1, 0, 0, 0, 120, 0, 4, 10, 0})},
+		{"more records than sent", cat(header(0, 2), name, []byte{0, 1, 0, 1, 0, 0, 0, 120, 0, 4, 10, 0, 0, 1})},
+	} {
+		if _, err := decodeDNSMessage(tc.msg); err == nil {
+			t.Errorf("%s: decoded without an error", tc.name)
+		}
+	}
+
+	// Bad RDATA inside a well-formed record is tolerated, not trusted
+	msg := cat(header(0, 2),
+		name, []byte{0, dnsTypeSRV, 0, 1, 0, 0, 0, 120, 0, 3, 1, 2, 3},
+		name, []byte{0, dnsTypeTXT, 0, 1, 0, 0, 0, 120, 0, 3, 9, 'a', 'b'})
+	m, err := decodeDNSMessage(msg)
+	if err != nil || len(m.Answers) != 2 || m.Answers[0].Port != 0 || m.Answers[1].TXT != nil {
+		t.Errorf("bad rdata: %+v, %v", m, err)
+	}
+}
+
+func FuzzDecodeDNSMessage(f *testing.F) {
+	s := NewService(config.Config{DeviceName: "fuzz", TransferPort: 9000}, "192.168.1.5", "dev", nil)
+	announcement, _ := s.mdnsAnnouncement()
+	f.Add(announcement)
+	f.Add(encodeDNSMessage(dnsMessage{Questions: []dnsQuestion{{Name: mdnsService, Type: dnsTypePTR}}}))
+	f.Add([]byte{0, 0, 0x84, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := decodeDNSMessage(b)
+		if err != nil {
+			return
+		}
+		for _, q := range m.Questions {
+			if q.Name == "" || q.Name[len(q.Name)-1] != '.' {
+				t.Errorf("question name %q", q.Name)
+			}
+		}
+		devicesFromMDNS(m, net.IPv4(10, 0, 0, 1))
+	})
+}
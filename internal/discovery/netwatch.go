@@ -0,0 +1,85 @@
+package discovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"filetransfer/pkg/utils"
+)
+
+// How often interfaces are checked for a network change, and how long after
+// one presence is announced every burstInterval instead of BroadcastInt.
+const (
+	networkPollInterval = 5 * time.Second
+	reannounceBurst     = 5 * time.Second
+	burstInterval       = 500 * time.Millisecond
+)
+
+// burstKey marks a socket context started after a network change; its
+// value is when the re-announce burst ends.
+type burstKey struct{}
+
+// announceInterval returns the delay before the next announcement on ctx's
+// sockets, before jitter.
+func announceInterval(ctx context.Context, normal time.Duration) time.Duration {
+	if until, ok := ctx.Value(burstKey{}).(time.Time); ok && time.Now().Before(until) {
+		return min(normal, burstInterval)
+	}
+	return normal
+}
+
+// watchNetwork polls the interfaces and, when their addresses change (new
+// Wi-Fi, VPN up or down), reopens the discovery sockets on the new network
+// and re-reads the advertised IP. Sockets bound to the old network would
+// otherwise keep running against nothing.
+func (s *Service) watchNetwork() {
+	last := networkSignature()
+	for sleep(s.ctx, networkPollInterval) {
+		sig := networkSignature()
+		if sig == last {
+			continue
+		}
+		last = sig
+		s.restartSockets()
+	}
+}
+
+// restartSockets closes the current discovery sockets and opens new ones
+// for the network the machine is on now.
+func (s *Service) restartSockets() {
+	ip := utils.GetLocalIP()
+	s.mu.Lock()
+	s.stopSockets()
+	old := s.localIP
+	if ip != "" {
+		s.localIP = ip
+	}
+	s.mu.Unlock()
+	log.Printf("[DISCOVERY] Network changed (address %s → %s); reopening discovery sockets", old, s.LocalIP())
+	s.startSockets(true)
+}
+
+// networkSignature summarizes the up, non-loopback interfaces and their
+// addresses, so any change to them changes the result.
+func networkSignature() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			parts = append(parts, ifi.Name+"="+a.String())
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
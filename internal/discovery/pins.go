@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filetransfer/internal/models"
+)
+
+// Certificate pinning is trust on first use: the first TLS fingerprint a
+// device ID announces is remembered, in Config.PinnedCertsFile when set, and
+// a different or missing one later marks the device CertMismatch instead of
+// replacing it, as does a pinned device no longer offering TLS at all.
+// Senders refuse such devices until the pin is forgotten.
+
+func (s *Service) loadPins() {
+	s.pins = make(map[string]string)
+	if s.config.PinnedCertsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.config.PinnedCertsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[DISCOVERY] Cannot read certificate pins: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.pins); err != nil {
+		log.Printf("[DISCOVERY] Ignoring corrupt certificate pins file: %v", err)
+		s.pins = make(map[string]string)
+	}
+}
+
+// savePinsLocked writes the pins out; s.mu must be held.
+func (s *Service) savePinsLocked() {
+	if s.config.PinnedCertsFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(s.pins, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(s.config.PinnedCertsFile), 0700); err != nil {
+		log.Printf("[DISCOVERY] Cannot save certificate pins: %v", err)
+		return
+	}
+	tmp := s.config.PinnedCertsFile + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.config.PinnedCertsFile)
+	}
+	if err != nil {
+		log.Printf("[DISCOVERY] Cannot save certificate pins: %v", err)
+	}
+}
+
+// applyPinLocked checks d's announced fingerprint against its pin, pinning
+// it if it is the first. s.mu must be held.
+func (s *Service) applyPinLocked(d *models.Device) {
+	pinned, ok := s.pins[d.ID]
+	switch {
+	case !ok && d.CertFingerprint != "":
+		s.pins[d.ID] = d.CertFingerprint
+		s.savePinsLocked()
+		log.Printf("[DISCOVERY] Pinned certificate %s for %s", d.CertFingerprint, d.ID)
+	case ok && (d.CertFingerprint != pinned || !d.Supports(models.CapTLS)):
+		// Dropping TLS would otherwise downgrade a pinned peer to plaintext
+		if prev := s.devices[d.ID]; prev == nil || !prev.CertMismatch {
+			log.Printf("[DISCOVERY] WARNING: %s (%s) announces certificate %q (TLS %v) but %s is pinned; refusing transfers to it",
+				d.ID, d.Username, d.CertFingerprint, d.Supports(models.CapTLS), pinned)
+		}
+		d.CertMismatch = true
+		d.CertFingerprint = pinned
+	}
+}
+
+// ForgetPin drops the pinned certificate for device id, so the next one it
+// announces is trusted. Use it when a peer legitimately changed certificate.
+func (s *Service) ForgetPin(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pins[id]; !ok {
+		return false
+	}
+	delete(s.pins, id)
+	s.savePinsLocked()
+	if d := s.devices[id]; d != nil {
+		d.CertMismatch = false
+	}
+	log.Printf("[DISCOVERY] Forgot certificate pin for %s", id)
+	return true
+}
@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+)
+
+// Backoff between attempts to open a discovery socket that failed, e.g.
+// because no network interface was up yet at boot.
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = time.Minute
+)
+
+// withRetry calls open until it succeeds, backing off between attempts. It
+// gives up, returning false, only when ctx is done.
+func (s *Service) withRetry(ctx context.Context, what string, open func() error) bool {
+	backoff := retryMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := open()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("[DISCOVERY] %s recovered after %d attempts", what, attempt)
+			}
+			return true
+		}
+		log.Printf("[DISCOVERY] %s failed: %v (retrying in %s)", what, err, backoff)
+		select {
+		case <-ctx.Done():
+			log.Printf("[DISCOVERY] Stopped; no longer retrying %s", what)
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, retryMaxBackoff)
+	}
+}
+
+// closeOnStop closes c when ctx is done, ending any loop reading it.
+func closeOnStop(ctx context.Context, c io.Closer) {
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+}
+
+// sleep waits for d and reports whether ctx is still live.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// CheckMulticast sends a datagram to the discovery group and waits for it to
+// come back on this host. It uses a spare port so a running instance, or
+// peers, never see the probe. Failure usually means the host has no
+// multicast route or a firewall drops the group.
+func CheckMulticast(timeout time.Duration) error {
+	in, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(multicastAddr)})
+	if err != nil {
+		return fmt.Errorf("join %s: %w", multicastAddr, err)
+	}
+	defer in.Close()
+	group := &net.UDPAddr{IP: net.ParseIP(multicastAddr), Port: in.LocalAddr().(*net.UDPAddr).Port}
+
+	out, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("send socket: %w", err)
+	}
+	defer out.Close()
+	if rc, err := out.SyscallConn(); err == nil {
+		setMulticastOpts(rc, 1, true)
+	}
+
+	probe := fmt.Sprintf("filetransfer-selftest %d", time.Now().UnixNano())
+	if _, err := out.Write([]byte(probe)); err != nil {
+		return fmt.Errorf("send to %s: %w", group, err)
+	}
+	in.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := in.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return fmt.Errorf("probe sent to %s did not loop back within %s", group, timeout)
+			}
+			return err
+		}
+		if string(buf[:n]) == probe {
+			return nil
+		}
+	}
+}
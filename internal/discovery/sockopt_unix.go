@@ -0,0 +1,74 @@
+//go:build unix
+
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// reuseAddr sets SO_REUSEADDR so several discovery sockets can bind the
+// same UDP port.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setMulticastOpts sets the TTL of outgoing multicast packets and whether
+// they are looped back to listeners on this host.
+func setMulticastOpts(c syscall.RawConn, ttl int, loop bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+		if serr == nil {
+			serr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, b2i(loop))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setMulticastIf sends outgoing multicast through the interface with ip.
+func setMulticastIf(c syscall.RawConn, ip net.IP) error {
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// joinGroup adds membership of group on the interface with ip, on top of
+// any the socket already has.
+func joinGroup(c syscall.RawConn, group, ip net.IP) error {
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+	copy(mreq.Interface[:], ip.To4())
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func b2i(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package models
+
+// WebSocket event types pushed to the UI as {"type": ..., "payload": ...}.
+// The payload for each is noted alongside.
+const (
+	// A peer offered a file; payload *PendingTransfer. Answer via
+	// /api/transfer/accept or /api/transfer/reject.
+	EventIncomingRequest = "incoming_request"
+	// A transfer was created, in either direction; payload *Transfer with
+	// status "waiting_acceptance" (send) or "receiving".
+	EventTransferStarted = "transfer_started"
+	// Periodic progress, at most once a second; payload *Transfer with
+	// Transferred, Progress, Speed and the wire statistics updated.
+	EventTransferProgress = "transfer_progress"
+	// Replaces transfer_progress when Config.ProgressBatchInterval is set:
+	// every active transfer in one message; payload []*Transfer.
+	EventTransfersSnapshot = "transfers_snapshot"
+	// A non-terminal status change such as "sending", "stalled" or
+	// "awaiting_confirmation"; payload *Transfer.
+	EventTransferUpdate = "transfer_update"
+	// The transfer finished successfully; payload *Transfer.
+	EventTransferCompleted = "transfer_completed"
+	// The transfer ended without completing; payload *Transfer whose Status
+	// is "failed", "rejected", "cancelled", "timed_out" or "expired" (the
+	// sender left before an accepted receive began) and Error says why.
+	EventTransferFailed = "transfer_failed"
+	// A text message arrived; payload {"id", "senderId", "senderName",
+	// "text"}. It is not saved as a file.
+	EventTextReceived = "text_received"
+	// An incoming offer was declined on this device; payload
+	// {"id", "fileName", "reason"?}.
+	EventTransferRejected = "transfer_rejected"
+	// An incoming offer lapsed before anyone answered it, because it timed
+	// out or the sender hung up; payload {"id", "fileName", "reason"} with
+	// reason "timeout" or "disconnected". The UI drops its prompt.
+	EventRequestExpired = "request_expired"
+	// Files in the download directory changed; payload {"removed": n}.
+	EventFilesUpdated = "files_updated"
+	// A device started or stopped announcing itself; payload *Device.
+	EventDeviceOnline  = "device_online"
+	EventDeviceOffline = "device_offline"
+	// This browser's session was signed out from elsewhere; payload
+	// {"reason"}. The server closes the socket after sending it.
+	EventSessionRevoked = "session_revoked"
+	// An upload is staged for pickup; payload the relay item.
+	EventRelayAvailable = "relay_available"
+)
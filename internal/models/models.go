@@ -7,6 +7,16 @@ type User struct {
 	Email        string    `json:"email"`
 	PasswordHash string    `json:"-"`
 	CreatedAt    time.Time `json:"createdAt"`
+	IsAdmin      bool      `json:"isAdmin"`
+}
+
+// Session describes a signed-in browser session. ID is derived from a hash
+// of the token, enough to tell sessions apart without revealing any of it.
+type Session struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed"`
 }
 
 type Device struct {
@@ -16,6 +26,49 @@ type Device struct {
 	Port     int       `json:"port"`
 	Username string    `json:"username"`
 	LastSeen time.Time `json:"lastSeen"`
+	Manual   bool      `json:"manual"` // added by pairing rather than discovered; never expires
+	// Protocol features the peer advertises. Names this build doesn't know
+	// are kept but ignored.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Users signed in on the peer right now; Username is its owner.
+	Users []string `json:"users,omitempty"`
+	// CertFingerprint is the hex SHA-256 of the peer's TLS certificate, used
+	// to pin it when dialing a CapTLS peer.
+	CertFingerprint string `json:"certFingerprint,omitempty"`
+	// CertMismatch is set when the device announced a different fingerprint
+	// (or none) after one was pinned; CertFingerprint then holds the pin.
+	CertMismatch bool `json:"certMismatch,omitempty"`
+}
+
+// RecentDevice is a device seen within the recent-devices window, whether or
+// not it is still announcing itself.
+type RecentDevice struct {
+	*Device
+	Online bool `json:"online"`
+}
+
+// Capability names advertised in discovery.
+const (
+	CapFramed    = "framed"    // length-prefixed payloads
+	CapKeepAlive = "keepalive" // several transfers per connection
+	CapGzip      = "gzip"      // gzip-compressed payloads
+	CapHeader    = "header"    // length-prefixed metadata (protocol version 2)
+	CapTLS       = "tls"       // transfer port speaks TLS; see Device.CertFingerprint
+	CapReliable  = "reliable"  // acknowledged, checksummed chunks on request
+)
+
+// LocalCapabilities lists what this build supports. CapTLS is added to what
+// is advertised only when a certificate is configured.
+var LocalCapabilities = []string{CapFramed, CapKeepAlive, CapGzip, CapHeader, CapReliable}
+
+// Supports reports whether d advertised capability c.
+func (d *Device) Supports(c string) bool {
+	for _, have := range d.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
 }
 
 // PendingTransfer holds an incoming transfer request awaiting user accept/reject
@@ -25,23 +78,48 @@ type PendingTransfer struct {
 	FileSize   int64  `json:"fileSize"`
 	SenderID   string `json:"senderId"`
 	SenderName string `json:"senderName"`
+	// ContentType is the MIME type the sender detected; may be empty.
+	ContentType string `json:"contentType,omitempty"`
 	// Channel to signal accept (true) or reject (false) back to the TCP goroutine
 	Response chan bool `json:"-"`
+	// DestDir is where the receiver chose to save the file, already
+	// validated; empty means their download directory.
+	DestDir string `json:"-"`
 }
 
 type Transfer struct {
-	ID          string    `json:"id"`
-	FileName    string    `json:"fileName"`
-	FileSize    int64     `json:"fileSize"`
-	Transferred int64     `json:"transferred"`
-	Progress    float64   `json:"progress"`
-	Speed       float64   `json:"speed"` // MB/s
-	Status      string    `json:"status"`
-	Direction   string    `json:"direction"` // "send" | "receive"
-	PeerID      string    `json:"peerId"`
-	PeerName    string    `json:"peerName"`
-	StartTime   time.Time `json:"startTime"`
-	EndTime     int64     `json:"endTime"` // Unix timestamp in ms
+	ID          string  `json:"id"`
+	FileName    string  `json:"fileName"`
+	FileSize    int64   `json:"fileSize"`
+	Transferred int64   `json:"transferred"`
+	Progress    float64 `json:"progress"`
+	Speed       float64 `json:"speed"` // MB/s, smoothed over the last few seconds
+	// AverageSpeed is the whole-transfer average in MB/s.
+	AverageSpeed float64   `json:"averageSpeed"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"` // reason for a failed status
+	Direction    string    `json:"direction"`       // "send" | "receive"
+	PeerID       string    `json:"peerId"`
+	PeerName     string    `json:"peerName"`
+	StartTime    time.Time `json:"startTime"`
+	EndTime      int64     `json:"endTime"`  // Unix timestamp in ms
+	Priority     int       `json:"priority"` // higher goes first; 0 is normal
+	FilePath     string    `json:"-"`        // where a received file was saved
+	SenderEmail  string    `json:"-"`        // user who started a send, for resume checks
+	// OriginalName is the name the sender gave a received file, when it had
+	// to be changed to be saved.
+	OriginalName string `json:"originalName,omitempty"`
+	// ContentType is the MIME type the sender detected for the file.
+	ContentType string `json:"contentType,omitempty"`
+	// DuplicateOf names the file already in the download directory with the
+	// same content as this received one.
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+
+	// Wire accounting: bytes actually sent over the network, and how that
+	// compares to the original size (ratio 1.0 when uncompressed).
+	WireBytes        int64   `json:"wireBytes"`
+	CompressionRatio float64 `json:"compressionRatio"`
+	BytesSaved       int64   `json:"bytesSaved"`
 }
 
 type TransferHistory struct {
@@ -53,6 +131,65 @@ type TransferHistory struct {
 	PeerName  string    `json:"peerName"`
 	Timestamp time.Time `json:"timestamp"`
 	Status    string    `json:"status"`
+	// UpdatedAt is when the record was last written, which a resumed
+	// transfer finishing moves past Timestamp.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// PeerID is the peer's device ID and FilePath the file on this server
+	// (empty for browser uploads, which aren't kept); both serve resending.
+	PeerID   string `json:"peerId,omitempty"`
+	FilePath string `json:"filePath,omitempty"`
+	// DeviceName is the device that made the transfer, telling apart the
+	// devices sharing the account's history.
+	DeviceName string `json:"deviceName,omitempty"`
+	// OriginalName is the sender's name for the file, if it was changed.
+	OriginalName string `json:"originalName,omitempty"`
+	// ContentType is the file's MIME type, kept after the file is gone.
+	ContentType string `json:"contentType,omitempty"`
+	// DuplicateOf is set when the received content was already on file.
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+
+	Transferred      int64   `json:"transferred"` // bytes moved; < FileSize for partial transfers
+	CompressionRatio float64 `json:"compressionRatio"`
+	BytesSaved       int64   `json:"bytesSaved"`
+	AverageSpeed     float64 `json:"averageSpeed"` // MB/s over the whole transfer
+}
+
+// PeerStats aggregates a user's transfer history with one peer.
+type PeerStats struct {
+	PeerName        string    `json:"peerName"`
+	SentCount       int       `json:"sentCount"`
+	SentBytes       int64     `json:"sentBytes"`
+	ReceivedCount   int       `json:"receivedCount"`
+	ReceivedBytes   int64     `json:"receivedBytes"`
+	LastInteraction time.Time `json:"lastInteraction"`
+}
+
+// TrustedDevice is a peer a user has chosen to trust. Offers from it are
+// matched by device ID or, since IDs change when the peer restarts, by the
+// sender's username.
+type TrustedDevice struct {
+	DeviceID   string    `json:"deviceId"`
+	Username   string    `json:"username"`
+	TrustLevel string    `json:"trustLevel"`
+	AddedAt    time.Time `json:"addedAt"`
+	// AutoAcceptMaxBytes limits TrustAutoAccept to files up to this size;
+	// larger ones still prompt. 0 = any size.
+	AutoAcceptMaxBytes int64 `json:"autoAcceptMaxBytes,omitempty"`
+}
+
+// Trust levels. Only TrustAutoAccept changes behavior; TrustKnown just
+// remembers the device.
+const (
+	TrustAutoAccept = "auto_accept"
+	TrustKnown      = "known"
+)
+
+// AuthEvent is one entry of a user's account activity log.
+type AuthEvent struct {
+	Event     string    `json:"event"` // register, login, login_failed, logout
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type ReceivedFile struct {
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// HistoryStore persists per-user transfer history.
+type HistoryStore interface {
+	AddHistory(userEmail string, item *models.TransferHistory) error
+	GetHistory(userEmail string) ([]*models.TransferHistory, error)
+	EachHistory(userEmail string, f HistoryFilter, fn func(*models.TransferHistory) error) error
+	HistoryChangedSince(userEmail string, since time.Time, afterID string, limit int) ([]*models.TransferHistory, error)
+	GetPeerStats(userEmail string) ([]*models.PeerStats, error)
+
+	// Incognito users have no history recorded.
+	SetIncognito(email string, on bool) error
+	Incognito(email string) (bool, error)
+}
+
+// UserStore holds accounts, sessions and the auth audit log.
+type UserStore interface {
+	RegisterUser(email, password string) error
+	AuthenticateUser(email, password string) (*models.User, error)
+	GetUserByEmail(email string) (*models.User, error)
+	ListUsers() ([]*models.User, error)
+	SetAdmin(email string, admin bool) error
+
+	CreateSession(email string) string
+	GetSession(token string) (string, bool)
+	CheckSession(token string) (string, bool)
+	ListSessions() []*models.Session
+	DeleteSession(token string)
+	DeleteSessionsForUser(email string) []string
+
+	RecordAuthEvent(email, event, ip, userAgent string) error
+	GetAuthEvents(email string, limit int) ([]*models.AuthEvent, error)
+}
+
+// TrustStore holds each user's trusted devices.
+type TrustStore interface {
+	AddTrustedDevice(email string, d *models.TrustedDevice) error
+	ListTrustedDevices(email string) ([]*models.TrustedDevice, error)
+	RemoveTrustedDevice(email, deviceID string) error
+}
+
+// GroupStore holds the groups each user sorts devices into.
+type GroupStore interface {
+	SetDeviceGroups(email, deviceID string, groups []string) error
+	ListDeviceGroups(email string) (map[string][]string, error)
+}
+
+var (
+	_ HistoryStore = (*Store)(nil)
+	_ UserStore    = (*Store)(nil)
+	_ TrustStore   = (*Store)(nil)
+	_ GroupStore   = (*Store)(nil)
+)
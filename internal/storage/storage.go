@@ -2,9 +2,13 @@ package storage
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
@@ -12,10 +16,40 @@ import (
 	"filetransfer/internal/models"
 )
 
+// SessionTTL is how long a session stays valid after it is created.
+const SessionTTL = 24 * time.Hour
+
 type Store struct {
 	db       *sql.DB
-	sessions map[string]string // token → email
+	sessions map[string]*session            // by token
+	byUser   map[string]map[string]struct{} // email → tokens
 	mu       sync.RWMutex
+	// Sessions unused for longer than this expire early; 0 = never.
+	idleTimeout time.Duration
+
+	stopMaintenance chan struct{}
+	stopOnce        sync.Once
+}
+
+type session struct {
+	email     string
+	createdAt time.Time
+	lastUsed  time.Time
+	expiresAt time.Time
+}
+
+// Ping checks that the database at connStr accepts connections, without
+// migrating it or keeping the connection.
+func Ping(connStr string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("ping db: %w", err)
+	}
+	return nil
 }
 
 func NewStore(connStr string) (*Store, error) {
@@ -27,7 +61,7 @@ func NewStore(connStr string) (*Store, error) {
 		return nil, fmt.Errorf("ping db: %w", err)
 	}
 
-	s := &Store{db: db, sessions: make(map[string]string)}
+	s := &Store{db: db, sessions: make(map[string]*session), byUser: make(map[string]map[string]struct{}), stopMaintenance: make(chan struct{})}
 	if err := s.migrate(); err != nil {
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
@@ -54,6 +88,54 @@ func (s *Store) migrate() error {
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
 			PRIMARY KEY (id, user_email)
 		);
+
+		ALTER TABLE transfer_history
+			ADD COLUMN IF NOT EXISTS compression_ratio DOUBLE PRECISION NOT NULL DEFAULT 1,
+			ADD COLUMN IF NOT EXISTS bytes_saved       BIGINT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS transferred       BIGINT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS average_speed     DOUBLE PRECISION NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS peer_id           TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS file_path         TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS duplicate_of      TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS device_name       TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS original_name     TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS content_type      TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS updated_at        TIMESTAMPTZ;
+		UPDATE transfer_history SET updated_at = created_at WHERE updated_at IS NULL;
+		ALTER TABLE transfer_history ALTER COLUMN updated_at SET DEFAULT NOW();
+		CREATE INDEX IF NOT EXISTS transfer_history_updated_idx ON transfer_history (user_email, updated_at, id);
+
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS incognito BOOLEAN NOT NULL DEFAULT FALSE;
+
+		CREATE TABLE IF NOT EXISTS auth_audit (
+			id         BIGSERIAL PRIMARY KEY,
+			email      TEXT NOT NULL,
+			event      TEXT NOT NULL,
+			ip         TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS auth_audit_email_idx ON auth_audit (email, created_at DESC);
+
+		CREATE TABLE IF NOT EXISTS trusted_devices (
+			user_email  TEXT NOT NULL,
+			device_id   TEXT NOT NULL,
+			username    TEXT NOT NULL DEFAULT '',
+			trust_level TEXT NOT NULL DEFAULT 'auto_accept',
+			added_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (user_email, device_id)
+		);
+
+		ALTER TABLE trusted_devices
+			ADD COLUMN IF NOT EXISTS auto_accept_max_bytes BIGINT NOT NULL DEFAULT 0;
+
+		CREATE TABLE IF NOT EXISTS device_groups (
+			user_email TEXT NOT NULL,
+			device_id  TEXT NOT NULL,
+			group_name TEXT NOT NULL,
+			PRIMARY KEY (user_email, device_id, group_name)
+		);
 	`)
 	return err
 }
@@ -75,8 +157,8 @@ func (s *Store) RegisterUser(email, password string) error {
 func (s *Store) AuthenticateUser(email, password string) (*models.User, error) {
 	u := &models.User{}
 	err := s.db.QueryRow(
-		`SELECT id, email, password_hash, created_at FROM users WHERE email=$1`, email,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
+		`SELECT id, email, password_hash, created_at, is_admin FROM users WHERE email=$1`, email,
+	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt, &u.IsAdmin)
 	if err != nil {
 		return nil, fmt.Errorf("invalid credentials")
 	}
@@ -90,55 +172,388 @@ func (s *Store) AuthenticateUser(email, password string) (*models.User, error) {
 func (s *Store) GetUserByEmail(email string) (*models.User, error) {
 	u := &models.User{}
 	err := s.db.QueryRow(
-		`SELECT id, email, created_at FROM users WHERE email=$1`, email,
-	).Scan(&u.ID, &u.Email, &u.CreatedAt)
+		`SELECT id, email, created_at, is_admin FROM users WHERE email=$1`, email,
+	).Scan(&u.ID, &u.Email, &u.CreatedAt, &u.IsAdmin)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
+// ListUsers returns every registered user, oldest first.
+func (s *Store) ListUsers() ([]*models.User, error) {
+	rows, err := s.db.Query(`SELECT id, email, created_at, is_admin FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		u := &models.User{}
+		if err := rows.Scan(&u.ID, &u.Email, &u.CreatedAt, &u.IsAdmin); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SetAdmin grants or revokes admin rights for email.
+func (s *Store) SetAdmin(email string, admin bool) error {
+	res, err := s.db.Exec(`UPDATE users SET is_admin=$2 WHERE email=$1`, email, admin)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user: %s", email)
+	}
+	return nil
+}
+
+// SetIncognito turns email's history recording off (on=true) or back on.
+func (s *Store) SetIncognito(email string, on bool) error {
+	res, err := s.db.Exec(`UPDATE users SET incognito=$2 WHERE email=$1`, email, on)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user: %s", email)
+	}
+	return nil
+}
+
+// Incognito reports whether email has history recording off.
+func (s *Store) Incognito(email string) (bool, error) {
+	var on bool
+	err := s.db.QueryRow(`SELECT incognito FROM users WHERE email=$1`, email).Scan(&on)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return on, err
+}
+
 // CreateSession stores a session token → email mapping and returns the token.
 func (s *Store) CreateSession(email string) string {
 	token := generateToken()
+	now := time.Now()
 	s.mu.Lock()
-	s.sessions[token] = email
+	s.sessions[token] = &session{email: email, createdAt: now, lastUsed: now, expiresAt: now.Add(SessionTTL)}
+	if s.byUser[email] == nil {
+		s.byUser[email] = make(map[string]struct{})
+	}
+	s.byUser[email][token] = struct{}{}
 	s.mu.Unlock()
 	return token
 }
 
-// GetSession returns the email for the given session token.
+// removeSession drops token from both indexes. Callers hold mu.
+func (s *Store) removeSession(token string) {
+	sess, ok := s.sessions[token]
+	if !ok {
+		return
+	}
+	delete(s.sessions, token)
+	if tokens := s.byUser[sess.email]; tokens != nil {
+		delete(tokens, token)
+		if len(tokens) == 0 {
+			delete(s.byUser, sess.email)
+		}
+	}
+}
+
+// SetIdleTimeout makes sessions unused for longer than d expire before
+// SessionTTL is up. 0 disables the idle check.
+func (s *Store) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	s.idleTimeout = d
+	s.mu.Unlock()
+}
+
+// expired reports whether sess is past its expiry or idle timeout. Callers
+// hold mu.
+func (s *Store) expired(sess *session, now time.Time) bool {
+	return now.After(sess.expiresAt) || (s.idleTimeout > 0 && now.Sub(sess.lastUsed) > s.idleTimeout)
+}
+
+// GetSession returns the email for the given session token and marks the
+// session as used.
 func (s *Store) GetSession(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	sess, ok := s.sessions[token]
+	if !ok || s.expired(sess, now) {
+		return "", false
+	}
+	sess.lastUsed = now
+	return sess.email, true
+}
+
+// CheckSession is GetSession without marking the session as used, for
+// requests the user didn't make themselves, like background polling.
+func (s *Store) CheckSession(token string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[token]
+	if !ok || s.expired(sess, time.Now()) {
+		return "", false
+	}
+	return sess.email, true
+}
+
+// SessionID is the public ID of the session with token: a hash prefix, so
+// listing sessions never discloses part of a token.
+func SessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// ListSessions returns all active sessions, most recently used first.
+// Sessions past their expiry or idle timeout are left out even before
+// maintenance purges them.
+func (s *Store) ListSessions() []*models.Session {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	email, ok := s.sessions[token]
-	return email, ok
+	now := time.Now()
+	out := make([]*models.Session, 0, len(s.sessions))
+	for token, sess := range s.sessions {
+		if s.expired(sess, now) {
+			continue
+		}
+		out = append(out, &models.Session{
+			ID:        SessionID(token),
+			Email:     sess.email,
+			CreatedAt: sess.createdAt,
+			LastUsed:  sess.lastUsed,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastUsed.After(out[j].LastUsed) })
+	return out
 }
 
 // DeleteSession removes a session token.
 func (s *Store) DeleteSession(token string) {
 	s.mu.Lock()
-	delete(s.sessions, token)
+	s.removeSession(token)
 	s.mu.Unlock()
 }
 
-// AddHistory persists a completed transfer record for a specific user.
+// DeleteSessionsForUser signs email out everywhere and returns the tokens
+// that were revoked.
+func (s *Store) DeleteSessionsForUser(email string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var revoked []string
+	for token := range s.byUser[email] {
+		revoked = append(revoked, token)
+	}
+	for _, token := range revoked {
+		s.removeSession(token)
+	}
+	return revoked
+}
+
+// PurgeExpiredSessions drops sessions past their expiry or idle timeout and
+// returns how many were removed.
+func (s *Store) PurgeExpiredSessions() int {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for token, sess := range s.sessions {
+		if s.expired(sess, now) {
+			s.removeSession(token)
+			n++
+		}
+	}
+	return n
+}
+
+// StartMaintenance purges expired sessions every interval until Close.
+func (s *Store) StartMaintenance(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := s.PurgeExpiredSessions(); n > 0 {
+					log.Printf("[STORE] Purged %d expired sessions", n)
+				}
+			case <-s.stopMaintenance:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background maintenance and closes the database.
+func (s *Store) Close() error {
+	s.stopOnce.Do(func() { close(s.stopMaintenance) })
+	return s.db.Close()
+}
+
+// RecordAuthEvent appends an entry to the auth audit log.
+func (s *Store) RecordAuthEvent(email, event, ip, userAgent string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO auth_audit (email, event, ip, user_agent) VALUES ($1, $2, $3, $4)`,
+		email, event, ip, userAgent,
+	)
+	return err
+}
+
+// GetAuthEvents returns the user's most recent auth events, newest first.
+func (s *Store) GetAuthEvents(email string, limit int) ([]*models.AuthEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT event, ip, user_agent, created_at FROM auth_audit
+		 WHERE email=$1 ORDER BY created_at DESC LIMIT $2`,
+		email, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.AuthEvent
+	for rows.Next() {
+		e := &models.AuthEvent{}
+		if err := rows.Scan(&e.Event, &e.IP, &e.UserAgent, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// AddTrustedDevice trusts d for email, replacing any earlier entry for the
+// same device.
+func (s *Store) AddTrustedDevice(email string, d *models.TrustedDevice) error {
+	_, err := s.db.Exec(
+		`INSERT INTO trusted_devices (user_email, device_id, username, trust_level, auto_accept_max_bytes)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (user_email, device_id) DO UPDATE SET username=$3, trust_level=$4, auto_accept_max_bytes=$5`,
+		email, d.DeviceID, d.Username, d.TrustLevel, d.AutoAcceptMaxBytes,
+	)
+	return err
+}
+
+// ListTrustedDevices returns the devices email trusts, oldest first.
+func (s *Store) ListTrustedDevices(email string) ([]*models.TrustedDevice, error) {
+	rows, err := s.db.Query(
+		`SELECT device_id, username, trust_level, added_at, auto_accept_max_bytes FROM trusted_devices
+		 WHERE user_email=$1 ORDER BY added_at`,
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*models.TrustedDevice
+	for rows.Next() {
+		d := &models.TrustedDevice{}
+		if err := rows.Scan(&d.DeviceID, &d.Username, &d.TrustLevel, &d.AddedAt, &d.AutoAcceptMaxBytes); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// RemoveTrustedDevice stops email trusting deviceID.
+func (s *Store) RemoveTrustedDevice(email, deviceID string) error {
+	res, err := s.db.Exec(`DELETE FROM trusted_devices WHERE user_email=$1 AND device_id=$2`, email, deviceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("device %s is not trusted", deviceID)
+	}
+	return nil
+}
+
+// SetDeviceGroups replaces the groups email has put deviceID in; an empty
+// list takes it out of all of them.
+func (s *Store) SetDeviceGroups(email, deviceID string, groups []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM device_groups WHERE user_email=$1 AND device_id=$2`, email, deviceID); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if _, err := tx.Exec(
+			`INSERT INTO device_groups (user_email, device_id, group_name) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			email, deviceID, g,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListDeviceGroups maps each device email has grouped to its groups, sorted.
+func (s *Store) ListDeviceGroups(email string) (map[string][]string, error) {
+	rows, err := s.db.Query(
+		`SELECT device_id, group_name FROM device_groups WHERE user_email=$1 ORDER BY device_id, group_name`,
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make(map[string][]string)
+	for rows.Next() {
+		var id, g string
+		if err := rows.Scan(&id, &g); err != nil {
+			return nil, err
+		}
+		groups[id] = append(groups[id], g)
+	}
+	return groups, rows.Err()
+}
+
+// AddHistory persists a transfer record for a specific user. Recording the
+// same transfer again (a resumed one finishing) updates the earlier row.
 func (s *Store) AddHistory(userEmail string, item *models.TransferHistory) error {
 	_, err := s.db.Exec(
-		`INSERT INTO transfer_history (id, user_email, file_name, file_size, direction, peer_name, status)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)
-		 ON CONFLICT (id, user_email) DO NOTHING`,
+		`INSERT INTO transfer_history (id, user_email, file_name, file_size, direction, peer_name, status,
+		                               compression_ratio, bytes_saved, transferred, average_speed,
+		                               peer_id, file_path, duplicate_of, device_name, original_name, content_type)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		 ON CONFLICT (id, user_email) DO UPDATE SET status=$7, compression_ratio=$8,
+		     bytes_saved=$9, transferred=$10, average_speed=$11, file_path=$13, duplicate_of=$14, device_name=$15, original_name=$16, content_type=$17,
+		     updated_at=NOW()`,
 		item.ID, userEmail, item.FileName, item.FileSize, item.Direction, item.PeerName, item.Status,
+		item.CompressionRatio, item.BytesSaved, item.Transferred, item.AverageSpeed,
+		item.PeerID, item.FilePath, item.DuplicateOf, item.DeviceName, item.OriginalName, item.ContentType,
 	)
 	return err
 }
 
-// GetHistory returns all transfer history for the user, newest first.
+// GetHistory returns all transfer history for the user, newest first. With a
+// *SkippedRowsError the list is usable but incomplete.
 func (s *Store) GetHistory(userEmail string) ([]*models.TransferHistory, error) {
-	rows, err := s.db.Query(
-		`SELECT id, file_name, file_size, direction, peer_name, status, created_at
-		 FROM transfer_history WHERE user_email=$1 ORDER BY created_at DESC`,
-		userEmail,
+	var history []*models.TransferHistory
+	err := s.EachHistory(userEmail, HistoryFilter{}, func(item *models.TransferHistory) error {
+		history = append(history, item)
+		return nil
+	})
+	return history, err
+}
+
+// HistoryChangedSince returns up to limit of userEmail's history records
+// added or updated after the (since, afterID) cursor, ordered by UpdatedAt
+// then ID, so the UpdatedAt and ID of the last one are the cursor for the
+// next call. The ID breaks ties between records changed at the same time.
+func (s *Store) HistoryChangedSince(userEmail string, since time.Time, afterID string, limit int) ([]*models.TransferHistory, error) {
+	rows, err := s.db.Query(`SELECT `+historyColumns+`
+		 FROM transfer_history WHERE user_email=$1 AND (updated_at, id) > ($2, $3)
+		 ORDER BY updated_at, id LIMIT $4`,
+		userEmail, since, afterID, limit,
 	)
 	if err != nil {
 		return nil, err
@@ -147,14 +562,219 @@ func (s *Store) GetHistory(userEmail string) ([]*models.TransferHistory, error)
 
 	var history []*models.TransferHistory
 	for rows.Next() {
-		item := &models.TransferHistory{}
-		if err := rows.Scan(&item.ID, &item.FileName, &item.FileSize, &item.Direction,
-			&item.PeerName, &item.Status, &item.Timestamp); err != nil {
-			continue
+		item, err := scanHistory(rows)
+		if err != nil {
+			return nil, err
 		}
 		history = append(history, item)
 	}
-	return history, nil
+	return history, rows.Err()
+}
+
+// HistoryFilter narrows a history query; zero fields match everything.
+type HistoryFilter struct {
+	Direction string // "send" or "receive"
+	Status    string
+	PeerName  string
+	Since     time.Time // inclusive
+	Until     time.Time // exclusive
+}
+
+// Match reports whether item passes f, for filtering in memory.
+func (f HistoryFilter) Match(item *models.TransferHistory) bool {
+	return (f.Direction == "" || item.Direction == f.Direction) &&
+		(f.Status == "" || item.Status == f.Status) &&
+		(f.PeerName == "" || item.PeerName == f.PeerName) &&
+		(f.Since.IsZero() || !item.Timestamp.Before(f.Since)) &&
+		(f.Until.IsZero() || item.Timestamp.Before(f.Until))
+}
+
+// historyQuery builds the query for userEmail's history matching f, newest
+// first.
+func historyQuery(userEmail string, f HistoryFilter) (string, []interface{}) {
+	query := `SELECT ` + historyColumns + `
+		 FROM transfer_history WHERE user_email=$1`
+	args := []interface{}{userEmail}
+	where := func(cond string, v interface{}) {
+		args = append(args, v)
+		query += fmt.Sprintf(" AND %s $%d", cond, len(args))
+	}
+	if f.Direction != "" {
+		where("direction =", f.Direction)
+	}
+	if f.Status != "" {
+		where("status =", f.Status)
+	}
+	if f.PeerName != "" {
+		where("peer_name =", f.PeerName)
+	}
+	if !f.Since.IsZero() {
+		where("created_at >=", f.Since)
+	}
+	if !f.Until.IsZero() {
+		where("created_at <", f.Until)
+	}
+	return query + " ORDER BY created_at DESC", args
+}
+
+// EachHistory calls fn for each of userEmail's history records matching f,
+// newest first, reading them from the database as it goes rather than all
+// at once. An error from fn stops the iteration and is returned. Records that
+// can't be read are logged and skipped, and reported at the end with a
+// *SkippedRowsError.
+func (s *Store) EachHistory(userEmail string, f HistoryFilter, fn func(*models.TransferHistory) error) error {
+	query, args := historyQuery(userEmail, f)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	skipped := 0
+	for rows.Next() {
+		item, err := scanHistory(rows)
+		if err != nil {
+			skipped++
+			log.Printf("[HISTORY] Skipping unreadable record %s for %s: %v", rowKey(rows), userEmail, err)
+			continue
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return &SkippedRowsError{Skipped: skipped}
+	}
+	return nil
+}
+
+// SkippedRowsError is returned by EachHistory and GetHistory after every
+// readable record was delivered but some could not be read.
+type SkippedRowsError struct {
+	Skipped int
+}
+
+func (e *SkippedRowsError) Error() string {
+	return fmt.Sprintf("%d history records could not be read", e.Skipped)
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// historyColumns is the column list scanHistory expects.
+const historyColumns = `id, file_name, file_size, direction, peer_name, status, created_at,
+		        compression_ratio, bytes_saved, transferred, average_speed, peer_id, file_path,
+		        duplicate_of, device_name, original_name, content_type, updated_at`
+
+// scanHistory reads one history row. Everything but the key and timestamp
+// goes through sql.Null* so NULLs, which tables altered by hand or by older
+// migrations can hold, read as zero values instead of losing the row.
+func scanHistory(row rowScanner) (*models.TransferHistory, error) {
+	item := &models.TransferHistory{}
+	var fileName, direction, peerName, status, peerID, filePath, duplicateOf, deviceName, originalName, contentType sql.NullString
+	var fileSize, bytesSaved, transferred sql.NullInt64
+	var ratio, speed sql.NullFloat64
+	var updated sql.NullTime
+	if err := row.Scan(&item.ID, &fileName, &fileSize, &direction, &peerName, &status, &item.Timestamp,
+		&ratio, &bytesSaved, &transferred, &speed, &peerID, &filePath, &duplicateOf, &deviceName, &originalName, &contentType,
+		&updated); err != nil {
+		return nil, err
+	}
+	item.FileName = fileName.String
+	item.FileSize = fileSize.Int64
+	item.Direction = direction.String
+	item.PeerName = peerName.String
+	item.Status = status.String
+	item.CompressionRatio = 1
+	if ratio.Valid {
+		item.CompressionRatio = ratio.Float64
+	}
+	item.BytesSaved = bytesSaved.Int64
+	item.Transferred = transferred.Int64
+	item.AverageSpeed = speed.Float64
+	item.PeerID = peerID.String
+	item.FilePath = filePath.String
+	item.DuplicateOf = duplicateOf.String
+	item.DeviceName = deviceName.String
+	item.OriginalName = originalName.String
+	item.ContentType = contentType.String
+	item.UpdatedAt = item.Timestamp
+	if updated.Valid {
+		item.UpdatedAt = updated.Time
+	}
+	return item, nil
+}
+
+// rowKey returns the id of the current row for logging, or "?" if even that
+// can't be read.
+func rowKey(rows *sql.Rows) string {
+	dest := make([]interface{}, 18)
+	for i := range dest {
+		dest[i] = new(interface{})
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "?"
+	}
+	return fmt.Sprint(*dest[0].(*interface{}))
+}
+
+// GetPeerStats aggregates the user's history per peer, most recently
+// contacted first. Bytes count what actually moved, so partial transfers
+// contribute only their transferred part.
+func (s *Store) GetPeerStats(userEmail string) ([]*models.PeerStats, error) {
+	rows, err := s.db.Query(
+		`SELECT peer_name, direction, COUNT(*),
+		        COALESCE(SUM(CASE WHEN status = 'completed' THEN file_size ELSE transferred END), 0),
+		        MAX(created_at)
+		 FROM transfer_history WHERE user_email=$1
+		 GROUP BY peer_name, direction`,
+		userEmail,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byPeer := map[string]*models.PeerStats{}
+	for rows.Next() {
+		// Older rows may have NULL in either column, like in scanHistory
+		var peerName, direction sql.NullString
+		var count int
+		var bytes int64
+		var last time.Time
+		if err := rows.Scan(&peerName, &direction, &count, &bytes, &last); err != nil {
+			return nil, err
+		}
+		peer := peerName.String
+		ps, ok := byPeer[peer]
+		if !ok {
+			ps = &models.PeerStats{PeerName: peer}
+			byPeer[peer] = ps
+		}
+		if direction.String == "send" {
+			ps.SentCount, ps.SentBytes = count, bytes
+		} else {
+			ps.ReceivedCount, ps.ReceivedBytes = count, bytes
+		}
+		if last.After(ps.LastInteraction) {
+			ps.LastInteraction = last
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := make([]*models.PeerStats, 0, len(byPeer))
+	for _, ps := range byPeer {
+		stats = append(stats, ps)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].LastInteraction.After(stats[j].LastInteraction) })
+	return stats, nil
 }
 
 // generateToken returns a 32-byte hex session token.
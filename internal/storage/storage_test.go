@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+func newSessionStore() *Store {
+	return &Store{sessions: make(map[string]*session), byUser: make(map[string]map[string]struct{}), stopMaintenance: make(chan struct{})}
+}
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	s := newSessionStore()
+
+	live := s.CreateSession("live@example.com")
+	past := time.Now().Add(-time.Hour)
+	s.sessions["expired-token"] = &session{email: "old@example.com", createdAt: past.Add(-SessionTTL), lastUsed: past, expiresAt: past}
+
+	if _, ok := s.GetSession("expired-token"); ok {
+		t.Error("expired session still accepted")
+	}
+	if got := s.ListSessions(); len(got) != 1 || got[0].Email != "live@example.com" {
+		t.Errorf("listed %+v", got)
+	} else if got[0].ID != SessionID(live) || strings.HasPrefix(live, got[0].ID[:8]) {
+		t.Errorf("session ID %q reveals the token", got[0].ID)
+	}
+	if n := s.PurgeExpiredSessions(); n != 1 {
+		t.Errorf("purged %d sessions, want 1", n)
+	}
+	if _, ok := s.sessions["expired-token"]; ok {
+		t.Error("expired session still stored")
+	}
+	if _, ok := s.GetSession(live); !ok {
+		t.Error("live session was purged")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := newSessionStore()
+	s.SetIdleTimeout(time.Hour)
+	active := s.CreateSession("active@example.com")
+	idle := s.CreateSession("idle@example.com")
+	polled := s.CreateSession("polled@example.com")
+	longAgo := time.Now().Add(-2 * time.Hour)
+	for _, tok := range []string{active, idle, polled} {
+		s.sessions[tok].lastUsed = longAgo
+	}
+	s.sessions[active].lastUsed = time.Now().Add(-59 * time.Minute)
+
+	if _, ok := s.GetSession(active); !ok {
+		t.Error("session used within the idle timeout was rejected")
+	}
+	if _, ok := s.GetSession(idle); ok {
+		t.Error("idle session still valid")
+	}
+	// Background checks neither accept an idle session nor refresh one
+	if _, ok := s.CheckSession(polled); ok {
+		t.Error("CheckSession accepted an idle session")
+	}
+	s.sessions[polled].lastUsed = time.Now().Add(-30 * time.Minute)
+	if _, ok := s.CheckSession(polled); !ok {
+		t.Error("CheckSession rejected a live session")
+	}
+	if got := s.sessions[polled].lastUsed; time.Since(got) < 29*time.Minute {
+		t.Error("CheckSession marked the session as used")
+	}
+
+	if got := s.ListSessions(); len(got) != 2 {
+		t.Errorf("listed %d sessions, want the active and polled ones", len(got))
+	}
+
+	if n := s.PurgeExpiredSessions(); n != 1 {
+		t.Errorf("purged %d sessions, want the idle one", n)
+	}
+}
+
+func TestMaintenancePurgesInBackground(t *testing.T) {
+	s := newSessionStore()
+	s.sessions["expired-token"] = &session{email: "old@example.com", expiresAt: time.Now().Add(-time.Minute)}
+
+	s.StartMaintenance(10 * time.Millisecond)
+	defer s.stopOnce.Do(func() { close(s.stopMaintenance) })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.RLock()
+		n := len(s.sessions)
+		s.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("maintenance goroutine did not purge the expired session")
+}
+
+func TestDeleteSessionsForUser(t *testing.T) {
+	s := newSessionStore()
+	a1 := s.CreateSession("a@example.com")
+	a2 := s.CreateSession("a@example.com")
+	b := s.CreateSession("b@example.com")
+
+	revoked := s.DeleteSessionsForUser("a@example.com")
+	if len(revoked) != 2 {
+		t.Fatalf("revoked %d sessions, want 2", len(revoked))
+	}
+	for _, tok := range []string{a1, a2} {
+		if _, ok := s.GetSession(tok); ok {
+			t.Error("revoked session still valid")
+		}
+	}
+	if _, ok := s.GetSession(b); !ok {
+		t.Error("another user's session was revoked")
+	}
+	if n := len(s.DeleteSessionsForUser("a@example.com")); n != 0 {
+		t.Errorf("second revoke returned %d tokens", n)
+	}
+}
+
+// testStore connects to TEST_DATABASE_URL, skipping the test when it isn't
+// set. Each test should use its own emails; rows are not cleaned up between
+// runs beyond what the test deletes itself.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	s, err := NewStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTrustedDevices(t *testing.T) {
+	s := testStore(t)
+	email := fmt.Sprintf("trust-%d@example.com", time.Now().UnixNano())
+
+	if err := s.AddTrustedDevice(email, &models.TrustedDevice{DeviceID: "dev-a", Username: "alice", TrustLevel: models.TrustAutoAccept}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTrustedDevice(email, &models.TrustedDevice{DeviceID: "dev-b", Username: "bob", TrustLevel: models.TrustKnown}); err != nil {
+		t.Fatal(err)
+	}
+	// Adding again updates in place
+	if err := s.AddTrustedDevice(email, &models.TrustedDevice{DeviceID: "dev-b", Username: "bob", TrustLevel: models.TrustAutoAccept}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.ListTrustedDevices(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].DeviceID != "dev-a" || list[1].TrustLevel != models.TrustAutoAccept {
+		t.Fatalf("unexpected trusted devices: %+v", list)
+	}
+	if other, _ := s.ListTrustedDevices("someone-else-" + email); len(other) != 0 {
+		t.Errorf("trusted devices leaked to another user: %+v", other)
+	}
+
+	if err := s.RemoveTrustedDevice(email, "dev-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveTrustedDevice(email, "dev-a"); err == nil {
+		t.Error("removing an untrusted device should fail")
+	}
+	list, _ = s.ListTrustedDevices(email)
+	if len(list) != 1 || list[0].DeviceID != "dev-b" {
+		t.Errorf("after delete: %+v", list)
+	}
+	s.RemoveTrustedDevice(email, "dev-b")
+}
+
+func TestDeviceGroups(t *testing.T) {
+	s := testStore(t)
+	email := fmt.Sprintf("groups-%d@example.com", time.Now().UnixNano())
+
+	if err := s.SetDeviceGroups(email, "dev-a", []string{"office", "home"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDeviceGroups(email, "dev-b", []string{"office"}); err != nil {
+		t.Fatal(err)
+	}
+	// Setting again replaces the earlier groups
+	if err := s.SetDeviceGroups(email, "dev-a", []string{"home", "lab"}); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := s.ListDeviceGroups(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "map[dev-a:[home lab] dev-b:[office]]" {
+		t.Errorf("groups = %v", groups)
+	}
+	if other, _ := s.ListDeviceGroups("someone-else-" + email); len(other) != 0 {
+		t.Errorf("groups leaked to another user: %v", other)
+	}
+
+	s.SetDeviceGroups(email, "dev-a", nil)
+	s.SetDeviceGroups(email, "dev-b", nil)
+	if groups, _ = s.ListDeviceGroups(email); len(groups) != 0 {
+		t.Errorf("after clearing: %v", groups)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query, args := historyQuery("a@example.com", HistoryFilter{Direction: "send", PeerName: "bob", Since: since})
+	for _, want := range []string{"user_email=$1", "direction = $2", "peer_name = $3", "created_at >= $4", "ORDER BY created_at DESC"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query lacks %q:\n%s", want, query)
+		}
+	}
+	if len(args) != 4 || args[0] != "a@example.com" || args[1] != "send" || args[2] != "bob" || args[3] != since {
+		t.Errorf("args = %v", args)
+	}
+	if query, args := historyQuery("a@example.com", HistoryFilter{}); strings.Contains(query, "$2") || len(args) != 1 {
+		t.Errorf("empty filter: %s %v", query, args)
+	}
+
+	item := &models.TransferHistory{Direction: "send", Status: "completed", PeerName: "bob", Timestamp: since.Add(time.Hour)}
+	for _, tc := range []struct {
+		f    HistoryFilter
+		want bool
+	}{
+		{HistoryFilter{}, true},
+		{HistoryFilter{Direction: "send", Status: "completed", PeerName: "bob"}, true},
+		{HistoryFilter{Direction: "receive"}, false},
+		{HistoryFilter{PeerName: "carol"}, false},
+		{HistoryFilter{Since: since, Until: since.Add(2 * time.Hour)}, true},
+		{HistoryFilter{Since: since.Add(2 * time.Hour)}, false},
+		{HistoryFilter{Until: since.Add(time.Hour)}, false}, // exclusive
+	} {
+		if got := tc.f.Match(item); got != tc.want {
+			t.Errorf("%+v.Match = %v, want %v", tc.f, got, tc.want)
+		}
+	}
+}
+
+// nullRow scans fixed values the way database/sql would, nil being NULL.
+type nullRow []interface{}
+
+func (r nullRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case sql.Scanner:
+			if err := d.Scan(r[i]); err != nil {
+				return err
+			}
+		case *string:
+			*d = r[i].(string)
+		case *time.Time:
+			*d = r[i].(time.Time)
+		}
+	}
+	return nil
+}
+
+func TestScanHistoryNulls(t *testing.T) {
+	now := time.Now()
+	item, err := scanHistory(nullRow{"id-1", "a.txt", int64(5), "receive", nil, "completed", now,
+		nil, nil, int64(5), nil, nil, nil, nil, nil, nil, nil, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != "id-1" || item.FileName != "a.txt" || item.PeerName != "" || item.CompressionRatio != 1 || item.Transferred != 5 {
+		t.Errorf("scanned %+v", item)
+	}
+}
+
+func TestHistoryWithNullColumn(t *testing.T) {
+	s := testStore(t)
+	// A temporary table of the same name shadows the shared one, and lives
+	// on this store's single connection only, so nothing outside the test
+	// sees the relaxed columns
+	s.db.SetMaxOpenConns(1)
+	if _, err := s.db.Exec(`CREATE TEMP TABLE transfer_history (LIKE transfer_history INCLUDING DEFAULTS)`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Exec(`DROP TABLE pg_temp.transfer_history`) })
+	if _, err := s.db.Exec(`ALTER TABLE pg_temp.transfer_history
+		ALTER COLUMN peer_id DROP NOT NULL, ALTER COLUMN peer_name DROP NOT NULL, ALTER COLUMN direction DROP NOT NULL`); err != nil {
+		t.Fatal(err)
+	}
+	email := "nulls@example.com"
+	if _, err := s.db.Exec(`INSERT INTO transfer_history (id, user_email, file_name, file_size, direction, peer_name, status, peer_id)
+		VALUES ('legacy', $1, 'old.txt', 3, 'send', 'bob', 'completed', NULL),
+		       ('orphan', $1, 'lost.txt', 5, NULL, NULL, 'completed', NULL)`, email); err != nil {
+		t.Fatal(err)
+	}
+	history, err := s.GetHistory(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("history %+v", history)
+	}
+	for _, item := range history {
+		if item.ID == "legacy" && (item.PeerID != "" || item.PeerName != "bob") {
+			t.Errorf("legacy record %+v", item)
+		}
+	}
+	stats, err := s.GetPeerStats(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPeer := map[string]*models.PeerStats{}
+	for _, ps := range stats {
+		byPeer[ps.PeerName] = ps
+	}
+	if bob := byPeer["bob"]; len(stats) != 2 || bob == nil || bob.SentCount != 1 || byPeer[""] == nil || byPeer[""].ReceivedCount != 1 {
+		t.Errorf("peer stats %+v", stats)
+	}
+}
+
+func TestHistoryChangedSince(t *testing.T) {
+	s := testStore(t)
+	email := fmt.Sprintf("sync-%d@example.com", time.Now().UnixNano())
+	t.Cleanup(func() { s.db.Exec(`DELETE FROM transfer_history WHERE user_email=$1`, email) })
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.AddHistory(email, &models.TransferHistory{ID: id, FileName: id + ".txt", Direction: "send", PeerName: "bob", Status: "sending"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All three share one updated_at, so only the ID moves the cursor on
+	if _, err := s.db.Exec(`UPDATE transfer_history SET updated_at=NOW() WHERE user_email=$1`, email); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.HistoryChangedSince(email, time.Time{}, "", 2)
+	if err != nil || len(page) != 2 || page[0].ID != "a" || page[1].ID != "b" {
+		t.Fatalf("first page %+v, %v", page, err)
+	}
+	cursor, after := page[1].UpdatedAt, page[1].ID
+	if page, _ = s.HistoryChangedSince(email, cursor, after, 2); len(page) != 1 || page[0].ID != "c" {
+		t.Fatalf("second page %+v", page)
+	}
+	cursor, after = page[0].UpdatedAt, page[0].ID
+
+	// Finishing an old transfer brings it back past the cursor
+	if err := s.AddHistory(email, &models.TransferHistory{ID: "a", FileName: "a.txt", Direction: "send", PeerName: "bob", Status: "completed"}); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ = s.HistoryChangedSince(email, cursor, after, 10); len(page) != 1 || page[0].ID != "a" || page[0].Status != "completed" {
+		t.Errorf("after update %+v", page)
+	}
+}
@@ -0,0 +1,381 @@
+// Package storagemock is an in-memory implementation of the storage
+// interfaces for tests. Nothing is persisted and passwords are compared in
+// plain text.
+package storagemock
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"filetransfer/internal/models"
+	"filetransfer/internal/storage"
+)
+
+var (
+	_ storage.HistoryStore = (*Store)(nil)
+	_ storage.UserStore    = (*Store)(nil)
+	_ storage.TrustStore   = (*Store)(nil)
+)
+
+type Store struct {
+	mu       sync.Mutex
+	users    []*models.User
+	pass     map[string]string // email → password
+	sessions map[string]*models.Session
+	tokens   map[string]string // token → email
+	history  map[string][]*models.TransferHistory
+	events   map[string][]*models.AuthEvent
+	trusted  map[string][]*models.TrustedDevice
+	groups   map[string]map[string][]string // email → device ID → groups
+	// incognito marks users with history off; unlike the database it
+	// doesn't require them to be registered.
+	incognito map[string]bool
+}
+
+func New() *Store {
+	return &Store{
+		pass:     make(map[string]string),
+		sessions: make(map[string]*models.Session),
+		tokens:   make(map[string]string),
+		history:  make(map[string][]*models.TransferHistory),
+		events:   make(map[string][]*models.AuthEvent),
+		trusted:  make(map[string][]*models.TrustedDevice),
+		groups:   make(map[string]map[string][]string),
+
+		incognito: make(map[string]bool),
+	}
+}
+
+func (s *Store) RegisterUser(email, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pass[email]; ok {
+		return fmt.Errorf("duplicate key value: users_email_key")
+	}
+	s.pass[email] = password
+	s.users = append(s.users, &models.User{ID: len(s.users) + 1, Email: email, CreatedAt: time.Now()})
+	return nil
+}
+
+func (s *Store) AuthenticateUser(email, password string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pass[email]; !ok || p != password {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	return s.user(email), nil
+}
+
+func (s *Store) GetUserByEmail(email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.user(email); u != nil {
+		return u, nil
+	}
+	return nil, fmt.Errorf("no such user: %s", email)
+}
+
+// user returns a copy of the user record for email, or nil.
+func (s *Store) user(email string) *models.User {
+	for _, u := range s.users {
+		if u.Email == email {
+			c := *u
+			return &c
+		}
+	}
+	return nil
+}
+
+func (s *Store) ListUsers() ([]*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*models.User, len(s.users))
+	for i, u := range s.users {
+		c := *u
+		out[i] = &c
+	}
+	return out, nil
+}
+
+func (s *Store) SetAdmin(email string, admin bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			u.IsAdmin = admin
+			return nil
+		}
+	}
+	return fmt.Errorf("no such user: %s", email)
+}
+
+func (s *Store) CreateSession(email string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := fmt.Sprintf("%x", b)
+	now := time.Now()
+	s.mu.Lock()
+	s.tokens[token] = email
+	s.sessions[token] = &models.Session{ID: storage.SessionID(token), Email: email, CreatedAt: now, LastUsed: now}
+	s.mu.Unlock()
+	return token
+}
+
+func (s *Store) GetSession(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.tokens[token]
+	if ok {
+		s.sessions[token].LastUsed = time.Now()
+	}
+	return email, ok
+}
+
+func (s *Store) CheckSession(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.tokens[token]
+	return email, ok
+}
+
+func (s *Store) ListSessions() []*models.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*models.Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		c := *sess
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastUsed.After(out[j].LastUsed) })
+	return out
+}
+
+func (s *Store) DeleteSession(token string) {
+	s.mu.Lock()
+	delete(s.tokens, token)
+	delete(s.sessions, token)
+	s.mu.Unlock()
+}
+
+func (s *Store) DeleteSessionsForUser(email string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var revoked []string
+	for token, e := range s.tokens {
+		if e == email {
+			revoked = append(revoked, token)
+			delete(s.tokens, token)
+			delete(s.sessions, token)
+		}
+	}
+	return revoked
+}
+
+func (s *Store) RecordAuthEvent(email, event, ip, userAgent string) error {
+	s.mu.Lock()
+	s.events[email] = append(s.events[email], &models.AuthEvent{Event: event, IP: ip, UserAgent: userAgent, Timestamp: time.Now()})
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) GetAuthEvents(email string, limit int) ([]*models.AuthEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.events[email]
+	var out []*models.AuthEvent
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, all[i])
+	}
+	return out, nil
+}
+
+func (s *Store) AddTrustedDevice(email string, d *models.TrustedDevice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *d
+	c.AddedAt = time.Now()
+	for i, t := range s.trusted[email] {
+		if t.DeviceID == d.DeviceID {
+			c.AddedAt = t.AddedAt
+			s.trusted[email][i] = &c
+			return nil
+		}
+	}
+	s.trusted[email] = append(s.trusted[email], &c)
+	return nil
+}
+
+func (s *Store) ListTrustedDevices(email string) ([]*models.TrustedDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*models.TrustedDevice, 0, len(s.trusted[email]))
+	for _, t := range s.trusted[email] {
+		c := *t
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+func (s *Store) RemoveTrustedDevice(email, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.trusted[email]
+	for i, t := range list {
+		if t.DeviceID == deviceID {
+			s.trusted[email] = append(list[:i:i], list[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("device %s is not trusted", deviceID)
+}
+
+func (s *Store) SetIncognito(email string, on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incognito[email] = on
+	return nil
+}
+
+func (s *Store) Incognito(email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incognito[email], nil
+}
+
+func (s *Store) SetDeviceGroups(email, deviceID string, groups []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(groups) == 0 {
+		delete(s.groups[email], deviceID)
+		return nil
+	}
+	if s.groups[email] == nil {
+		s.groups[email] = make(map[string][]string)
+	}
+	sorted := append([]string(nil), groups...)
+	sort.Strings(sorted)
+	s.groups[email][deviceID] = sorted
+	return nil
+}
+
+func (s *Store) ListDeviceGroups(email string) (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]string, len(s.groups[email]))
+	for id, g := range s.groups[email] {
+		out[id] = append([]string(nil), g...)
+	}
+	return out, nil
+}
+
+// AddHistory replaces an earlier record with the same ID for the same user,
+// like the database's ON CONFLICT DO UPDATE.
+func (s *Store) AddHistory(userEmail string, item *models.TransferHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *item
+	c.UserEmail = userEmail
+	if c.Timestamp.IsZero() {
+		c.Timestamp = time.Now()
+	}
+	c.UpdatedAt = time.Now()
+	for i, h := range s.history[userEmail] {
+		if h.ID == item.ID {
+			c.Timestamp = h.Timestamp
+			s.history[userEmail][i] = &c
+			return nil
+		}
+	}
+	s.history[userEmail] = append(s.history[userEmail], &c)
+	return nil
+}
+
+func (s *Store) GetHistory(userEmail string) ([]*models.TransferHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.history[userEmail]
+	out := make([]*models.TransferHistory, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		c := *all[i]
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+func (s *Store) EachHistory(userEmail string, f storage.HistoryFilter, fn func(*models.TransferHistory) error) error {
+	all, _ := s.GetHistory(userEmail)
+	for _, h := range all {
+		if !f.Match(h) {
+			continue
+		}
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) HistoryChangedSince(userEmail string, since time.Time, afterID string, limit int) ([]*models.TransferHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*models.TransferHistory
+	for _, h := range s.history[userEmail] {
+		if h.UpdatedAt.After(since) || h.UpdatedAt.Equal(since) && h.ID > afterID {
+			c := *h
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].UpdatedAt.Equal(out[j].UpdatedAt) {
+			return out[i].UpdatedAt.Before(out[j].UpdatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *Store) GetPeerStats(userEmail string) ([]*models.PeerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byPeer := map[string]*models.PeerStats{}
+	for _, h := range s.history[userEmail] {
+		ps, ok := byPeer[h.PeerName]
+		if !ok {
+			ps = &models.PeerStats{PeerName: h.PeerName}
+			byPeer[h.PeerName] = ps
+		}
+		n := h.Transferred
+		if h.Status == "completed" {
+			n = h.FileSize
+		}
+		if h.Direction == "send" {
+			ps.SentCount++
+			ps.SentBytes += n
+		} else {
+			ps.ReceivedCount++
+			ps.ReceivedBytes += n
+		}
+		if h.Timestamp.After(ps.LastInteraction) {
+			ps.LastInteraction = h.Timestamp
+		}
+	}
+	stats := make([]*models.PeerStats, 0, len(byPeer))
+	for _, ps := range byPeer {
+		stats = append(stats, ps)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].LastInteraction.After(stats[j].LastInteraction) })
+	return stats, nil
+}
+
+// History returns every record stored for userEmail, oldest first.
+func (s *Store) History(userEmail string) []*models.TransferHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.TransferHistory(nil), s.history[userEmail]...)
+}
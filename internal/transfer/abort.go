@@ -0,0 +1,71 @@
+package transfer
+
+import (
+	"io"
+	"log"
+)
+
+// abortedError is the error shown on transfers stopped by AbortAll.
+const abortedError = "aborted by an administrator"
+
+// abortable lets AbortAll stop transfer id by closing c while it streams.
+// Call the returned func once the transfer has finished.
+func (s *Service) abortable(id string, c io.Closer) (done func()) {
+	s.mu.Lock()
+	s.streams[id] = c
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.streams, id)
+		delete(s.aborted, id)
+		s.mu.Unlock()
+	}
+}
+
+// AbortAll cancels every transfer in flight: streaming ones have their
+// connection closed, offers waiting for an answer are rejected and sends
+// waiting for the sender's confirmation are cancelled. It returns how many
+// were stopped. Transfers that complete meanwhile are left as they are.
+func (s *Service) AbortAll() int {
+	s.mu.Lock()
+	var conns []io.Closer
+	for id, c := range s.streams {
+		if t, ok := s.transfers[id]; ok && terminal(t.Status) {
+			continue
+		}
+		s.aborted[id] = true
+		conns = append(conns, c)
+	}
+	var answers []chan bool
+	for _, pt := range s.pending {
+		answers = append(answers, pt.Response)
+	}
+	for _, ch := range s.confirms {
+		answers = append(answers, ch)
+	}
+	s.mu.Unlock()
+
+	n := len(conns)
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, ch := range answers {
+		// Buffered; a full channel has been answered already
+		select {
+		case ch <- false:
+			n++
+		default:
+		}
+	}
+	log.Printf("[TRANSFER] Aborted %d transfers", n)
+	return n
+}
+
+// terminal reports whether status is final.
+func terminal(status string) bool {
+	switch status {
+	case "completed", "failed", "rejected", "cancelled", "timed_out", "expired":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package transfer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// bandwidthWindow is how many minutes of per-minute totals are kept.
+const bandwidthWindow = 60
+
+// bandwidth counts payload bytes moved since the service started, in total,
+// per peer and per minute.
+type bandwidth struct {
+	mu      sync.Mutex
+	since   time.Time
+	total   PeerBandwidth
+	peers   map[string]*PeerBandwidth
+	minutes [bandwidthWindow]MinuteBandwidth // ring indexed by unix minute
+}
+
+// PeerBandwidth is the traffic exchanged with one peer, or with all.
+type PeerBandwidth struct {
+	PeerID        string `json:"peerId,omitempty"`
+	PeerName      string `json:"peerName,omitempty"`
+	BytesSent     int64  `json:"bytesSent"`
+	BytesReceived int64  `json:"bytesReceived"`
+}
+
+// MinuteBandwidth is the traffic in the minute starting at Start.
+type MinuteBandwidth struct {
+	Start         time.Time `json:"start"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+}
+
+// BandwidthReport is the payload of GET /api/stats/bandwidth.
+type BandwidthReport struct {
+	Since         time.Time `json:"since"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+	// Current throughput in MB/s, the sum of the active transfers' Speed
+	SendSpeed       float64           `json:"sendSpeed"`
+	ReceiveSpeed    float64           `json:"receiveSpeed"`
+	ActiveTransfers int               `json:"activeTransfers"`
+	Peers           []PeerBandwidth   `json:"peers"`   // most traffic first
+	Minutes         []MinuteBandwidth `json:"minutes"` // the last hour, oldest first
+}
+
+// countBytes adds n bytes moved for t to the bandwidth counters.
+func (s *Service) countBytes(t *models.Transfer, n int) {
+	b := &s.bandwidth
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.peers == nil {
+		b.peers = make(map[string]*PeerBandwidth)
+	}
+	p := b.peers[t.PeerID]
+	if p == nil {
+		p = &PeerBandwidth{PeerID: t.PeerID}
+		b.peers[t.PeerID] = p
+	}
+	p.PeerName = t.PeerName
+	start := now.Truncate(time.Minute)
+	m := &b.minutes[start.Unix()/60%bandwidthWindow]
+	if !m.Start.Equal(start) {
+		*m = MinuteBandwidth{Start: start}
+	}
+	if t.Direction == "receive" {
+		b.total.BytesReceived += int64(n)
+		p.BytesReceived += int64(n)
+		m.BytesReceived += int64(n)
+	} else {
+		b.total.BytesSent += int64(n)
+		p.BytesSent += int64(n)
+		m.BytesSent += int64(n)
+	}
+}
+
+// Bandwidth reports the traffic moved since the service started and the
+// current throughput.
+func (s *Service) Bandwidth() BandwidthReport {
+	b := &s.bandwidth
+	now := time.Now()
+	r := BandwidthReport{Peers: []PeerBandwidth{}, Minutes: make([]MinuteBandwidth, 0, bandwidthWindow)}
+
+	b.mu.Lock()
+	r.Since = b.since
+	r.BytesSent = b.total.BytesSent
+	r.BytesReceived = b.total.BytesReceived
+	for _, p := range b.peers {
+		r.Peers = append(r.Peers, *p)
+	}
+	current := now.Truncate(time.Minute)
+	for i := bandwidthWindow - 1; i >= 0; i-- {
+		start := current.Add(-time.Duration(i) * time.Minute)
+		m := b.minutes[start.Unix()/60%bandwidthWindow]
+		if !m.Start.Equal(start) {
+			m = MinuteBandwidth{Start: start}
+		}
+		r.Minutes = append(r.Minutes, m)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(r.Peers, func(i, j int) bool {
+		return r.Peers[i].BytesSent+r.Peers[i].BytesReceived > r.Peers[j].BytesSent+r.Peers[j].BytesReceived
+	})
+	for _, t := range s.activeTransfers() {
+		r.ActiveTransfers++
+		if t.Direction == "receive" {
+			r.ReceiveSpeed += t.Speed
+		} else {
+			r.SendSpeed += t.Speed
+		}
+	}
+	return r
+}
@@ -0,0 +1,72 @@
+package transfer
+
+import (
+	"sync"
+
+	"filetransfer/internal/models"
+)
+
+// Typed callbacks for programs embedding the Service as a library. They run
+// alongside the broadcast function, which keeps feeding the web UI.
+//
+// Callbacks are called synchronously from transfer goroutines, possibly
+// several at once, so they must be safe for concurrent use and should return
+// quickly: a slow callback stalls the transfer that fired it. The Transfer
+// passed is a copy and may be kept; the PendingTransfer is shared and must
+// not be modified. Answer it with AcceptTransfer or RejectTransfer.
+type callbacks struct {
+	mu       sync.RWMutex
+	progress []func(*models.Transfer)
+	complete []func(*models.Transfer)
+	incoming []func(*models.PendingTransfer)
+}
+
+// OnProgress registers fn to be called with each progress update of a
+// transfer in either direction, about once a second. Unlike the UI's
+// progress events these are not batched by ProgressBatchInterval.
+func (s *Service) OnProgress(fn func(*models.Transfer)) {
+	s.callbacks.mu.Lock()
+	s.callbacks.progress = append(s.callbacks.progress, fn)
+	s.callbacks.mu.Unlock()
+}
+
+// OnTransferComplete registers fn to be called once a transfer in either
+// direction ends, successfully or not; check the Status.
+func (s *Service) OnTransferComplete(fn func(*models.Transfer)) {
+	s.callbacks.mu.Lock()
+	s.callbacks.complete = append(s.callbacks.complete, fn)
+	s.callbacks.mu.Unlock()
+}
+
+// OnIncomingRequest registers fn to be called for each offer that waits for
+// a decision. Offers auto-accepted from trusted devices are not reported.
+func (s *Service) OnIncomingRequest(fn func(*models.PendingTransfer)) {
+	s.callbacks.mu.Lock()
+	s.callbacks.incoming = append(s.callbacks.incoming, fn)
+	s.callbacks.mu.Unlock()
+}
+
+// notifyTransfer calls each of fns with a copy of t.
+func (s *Service) notifyTransfer(fns func(*callbacks) []func(*models.Transfer), t *models.Transfer) {
+	s.callbacks.mu.RLock()
+	list := fns(&s.callbacks)
+	s.callbacks.mu.RUnlock()
+	if len(list) == 0 {
+		return
+	}
+	s.mu.RLock()
+	cp := *t
+	s.mu.RUnlock()
+	for _, fn := range list {
+		fn(&cp)
+	}
+}
+
+func (s *Service) notifyIncoming(pt *models.PendingTransfer) {
+	s.callbacks.mu.RLock()
+	list := s.callbacks.incoming
+	s.callbacks.mu.RUnlock()
+	for _, fn := range list {
+		fn(pt)
+	}
+}
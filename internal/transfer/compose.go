@@ -0,0 +1,55 @@
+package transfer
+
+import "unicode/utf8"
+
+// latinMarks lists, for each combining mark, pairs of a letter and the
+// precomposed letter it forms with the mark.
+var latinMarks = map[rune]string{
+	0x0300: "aàeèiìnǹoòuùwẁyỳAÀEÈIÌNǸOÒUÙWẀYỲ",                                               // combining grave accent
+	0x0301: "aácćeégǵiíkḱlĺmḿnńoópṕrŕsśuúwẃyýzźAÁCĆEÉGǴIÍKḰLĹMḾNŃOÓPṔRŔSŚUÚWẂYÝZŹ",           // combining acute accent
+	0x0302: "aâcĉeêgĝhĥiîjĵoôsŝuûwŵyŷzẑAÂCĈEÊGĜHĤIÎJĴOÔSŜUÛWŴYŶZẐ",                           // combining circumflex accent
+	0x0303: "aãeẽiĩnñoõuũvṽyỹAÃEẼIĨNÑOÕUŨVṼYỸ",                                               // combining tilde
+	0x0304: "aāeēgḡiīoōuūyȳAĀEĒGḠIĪOŌUŪYȲ",                                                   // combining macron
+	0x0306: "aăeĕgğiĭoŏuŭAĂEĔGĞIĬOŎUŬ",                                                       // combining breve
+	0x0307: "aȧbḃcċdḋeėfḟgġhḣmṁnṅoȯpṗrṙsṡtṫwẇxẋyẏzżAȦBḂCĊDḊEĖFḞGĠHḢIİMṀNṄOȮPṖRṘSṠTṪWẆXẊYẎZŻ", // combining dot above
+	0x0308: "aäeëhḧiïoötẗuüwẅxẍyÿAÄEËHḦIÏOÖUÜWẄXẌYŸ",                                         // combining diaeresis
+	0x0309: "aảeẻiỉoỏuủyỷAẢEẺIỈOỎUỦYỶ",                                                       // combining hook above
+	0x030A: "aåuůwẘyẙAÅUŮ",                                                                   // combining ring above
+	0x030B: "oőuűOŐUŰ",                                                                       // combining double acute accent
+	0x030C: "aǎcčdďeěgǧhȟiǐjǰkǩlľnňoǒrřsštťuǔzžAǍCČDĎEĚGǦHȞIǏKǨLĽNŇOǑRŘSŠTŤUǓZŽ",             // combining caron
+	0x0327: "cçdḑeȩgģhḩkķlļnņrŗsştţCÇDḐEȨGĢHḨKĶLĻNŅRŖSŞTŢ",                                   // combining cedilla
+	0x0328: "aąeęiįoǫuųAĄEĘIĮOǪUŲ",                                                           // combining ogonek
+}
+
+// latinCompositions maps a letter and a following combining mark to the
+// precomposed letter.
+var latinCompositions = func() map[[2]rune]rune {
+	m := make(map[[2]rune]rune)
+	for mark, pairs := range latinMarks {
+		r := []rune(pairs)
+		for i := 0; i+1 < len(r); i += 2 {
+			m[[2]rune{r[i], mark}] = r[i+1]
+		}
+	}
+	return m
+}()
+
+// foldLatinMarks is a limited fold of decomposed Latin accents, not Unicode
+// NFC. macOS and some archivers store "é" as "e" followed by a combining
+// accent, which elsewhere looks identical but is a different name, so a Latin
+// letter directly followed by one of the marks above becomes the single
+// precomposed letter. Other scripts, stacked marks and canonical reordering
+// are left alone; the standard library has no normalizer to do them properly.
+func foldLatinMarks(s string) string {
+	out := make([]rune, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			if c, ok := latinCompositions[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
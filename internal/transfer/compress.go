@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"bufio"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultNoCompressExts lists extensions of formats that are already
+// compressed; gzipping them burns CPU for nothing.
+var DefaultNoCompressExts = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".aac", ".ogg", ".flac", ".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".docx", ".xlsx", ".pptx", ".pdf", ".apk", ".jar",
+}
+
+const (
+	// entropySample is how much of the payload is inspected before deciding.
+	entropySample = 4096
+	// Data above this many bits of entropy per byte barely compresses.
+	maxCompressibleEntropy = 7.5
+)
+
+// shouldCompress decides whether a payload is worth compressing: not if its
+// extension is on the skip list, nor if its first bytes look random.
+// The peeked sample stays buffered in r.
+func (s *Service) shouldCompress(fileName string, r *bufio.Reader) bool {
+	skip := s.config.NoCompressExts
+	if skip == nil {
+		skip = DefaultNoCompressExts
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, e := range skip {
+		if strings.EqualFold(e, ext) {
+			return false
+		}
+	}
+	sample, _ := r.Peek(entropySample)
+	return len(sample) > 0 && entropy(sample) <= maxCompressibleEntropy
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		h -= p * math.Log2(p)
+	}
+	return h
+}
@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duplicate handling modes for Config.DuplicateFiles.
+const (
+	DuplicateFlag = "flag" // save the file but mark the transfer DuplicateOf
+	DuplicateSkip = "skip" // don't keep the new copy; point at the existing one
+)
+
+// hashIndex remembers the SHA-256 of files already looked at, so each file
+// is hashed once until it changes. Only files the same size as a new
+// receive are ever hashed.
+type hashIndex struct {
+	mu    sync.Mutex
+	files map[string]hashEntry // by path
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// sum returns the hash of the file at path with the given info, from the
+// index if it hasn't changed since.
+func (x *hashIndex) sum(path string, info os.FileInfo) (string, error) {
+	x.mu.Lock()
+	e, ok := x.files[path]
+	x.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.sum, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	x.add(path, info, sum)
+	return sum, nil
+}
+
+func (x *hashIndex) add(path string, info os.FileInfo, sum string) {
+	x.mu.Lock()
+	if x.files == nil {
+		x.files = make(map[string]hashEntry)
+	}
+	x.files[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	x.mu.Unlock()
+}
+
+// findDuplicate returns a file in dir, other than those being received,
+// whose content hashes to sum, or "" if there is none.
+func (s *Service) findDuplicate(dir, sum string, size int64) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".incomplete") || IsSidecar(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.Size() != size {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		other, err := s.hashes.sum(path, info)
+		if err != nil {
+			log.Printf("[DEDUP] Cannot hash %s: %v", path, err)
+			continue
+		}
+		if other == sum {
+			return path
+		}
+	}
+	return ""
+}
+
+// hashPrefix feeds h the first n bytes of the file at path, which an earlier
+// attempt of a resumed receive wrote.
+func hashPrefix(h io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
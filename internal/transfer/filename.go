@@ -0,0 +1,162 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxFileNameBytes keeps received names, with the ".incomplete" and " (n)"
+// suffixes added while saving, under the 255-byte limit most file systems
+// put on a name.
+const maxFileNameBytes = 200
+
+// Device names Windows reserves in every directory, with or without an
+// extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName reduces a sender-supplied name to a bare file name that
+// is safe to join onto a download directory on any platform. Any directory
+// part (with / or \ separators) is dropped, decomposed Latin accents are
+// folded, characters Windows doesn't allow become "_" and long names are
+// shortened, keeping the extension. Names that are still unusable are rejected.
+func sanitizeFileName(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", errors.New("file name contains a null byte")
+	}
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if base != "/" {
+		// Windows drops trailing dots and spaces itself
+		base = strings.TrimRight(cleanNamePart(foldLatinMarks(strings.ToValidUTF8(base, "_"))), ". ")
+	}
+	// Names of only dots and spaces vanish or misbehave on Windows
+	if base == "/" || strings.Trim(base, ". \t") == "" {
+		return "", errors.New("file name is empty")
+	}
+	base = truncateName(base)
+	stem := strings.ToUpper(strings.TrimRight(base, ". "))
+	if i := strings.IndexByte(stem, '.'); i >= 0 {
+		stem = stem[:i]
+	}
+	if reservedNames[stem] {
+		return "", errors.New("file name is a reserved device name")
+	}
+	return base, nil
+}
+
+// truncateName shortens name to maxFileNameBytes at a character boundary,
+// keeping its extension.
+func truncateName(name string) string {
+	if len(name) <= maxFileNameBytes {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = "" // not really an extension
+	}
+	stem := name[:len(name)-len(ext)]
+	for len(stem) > maxFileNameBytes-len(ext) {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return strings.TrimRight(stem, ". ") + ext
+}
+
+// blockedExtension reports whether name's final extension is in blocked,
+// returning it. Trailing dots and spaces, which Windows drops, don't hide
+// it, so "setup.exe." and "photo.jpg.exe" both count as ".exe".
+func blockedExtension(name string, blocked []string) (string, bool) {
+	ext := strings.ToLower(path.Ext(strings.TrimRight(name, ". ")))
+	if ext == "" {
+		return "", false
+	}
+	for _, b := range blocked {
+		if strings.EqualFold("."+strings.TrimPrefix(strings.TrimSpace(b), "."), ext) {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+// unsafeNameChars are replaced in template values: path separators and
+// characters Windows doesn't allow in file names.
+var unsafeNameChars = strings.NewReplacer(
+	"/", "_", `\`, "_", ":", "_", "*", "_", "?", "_",
+	`"`, "_", "<", "_", ">", "_", "|", "_",
+)
+
+// expandFileName names a received file from template, which may use
+// {name} (the sanitized name), {base} and {ext} (its stem and extension),
+// {sender}, {date} (YYYY-MM-DD), {time} (HHMMSS) and {id}. Other text,
+// including unknown placeholders, is kept as is. An empty template or an
+// unusable result falls back to {name}.
+func expandFileName(template string, meta wireMetadata, now time.Time) string {
+	if template == "" || template == "{name}" {
+		return meta.FileName
+	}
+	ext := path.Ext(meta.FileName)
+	expanded := strings.NewReplacer(
+		"{name}", meta.FileName,
+		"{base}", strings.TrimSuffix(meta.FileName, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{sender}", cleanNamePart(meta.SenderName),
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("150405"),
+		"{id}", cleanNamePart(meta.ID),
+	).Replace(template)
+	name, err := sanitizeFileName(unsafeNameChars.Replace(expanded))
+	if err != nil || strings.TrimRight(name, ". ") == "" {
+		return meta.FileName
+	}
+	return name
+}
+
+// cleanNamePart makes a peer-supplied value safe inside a file name.
+func cleanNamePart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	return unsafeNameChars.Replace(s)
+}
+
+// sidecarSuffix ends the hidden file saved beside a received file whose name
+// was changed by sanitizing, recording the name the sender gave it.
+const sidecarSuffix = ".origname.json"
+
+// sidecarPath returns where the original-name sidecar of the file at p goes.
+func sidecarPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+sidecarSuffix)
+}
+
+// IsSidecar reports whether name is an original-name sidecar rather than a
+// received file, so listings and sweeps can leave it out.
+func IsSidecar(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, sidecarSuffix)
+}
+
+// writeSidecar records meta's original name beside the file saved at p.
+func writeSidecar(p string, meta wireMetadata) error {
+	data, err := json.Marshal(map[string]string{
+		"originalName": meta.originalName,
+		"sender":       meta.SenderName,
+		"transferId":   meta.ID,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath(p), data, 0644)
+}
@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// History writes go through one queue, in order, to a single writer that
+// Close drains. Each is retried with backoff; if the database stays
+// unreachable the record is appended to HistoryBufferFile and replayed on
+// the next start, so a brief outage doesn't lose history.
+
+const (
+	historyWriteAttempts = 4
+	historyQueueSize     = 1024
+)
+
+var historyRetryBase = 250 * time.Millisecond
+
+type historyWrite struct {
+	userEmail string
+	item      *models.TransferHistory
+}
+
+// historyWriter is the queue of history records waiting to be stored.
+type historyWriter struct {
+	mu     sync.RWMutex // held to send on queue, and to close it
+	queue  chan historyWrite
+	closed bool
+	stop   chan struct{} // closed by Close: stop retrying, buffer instead
+	done   chan struct{} // closed when the writer has drained the queue
+}
+
+func newHistoryWriter() *historyWriter {
+	return &historyWriter{
+		queue: make(chan historyWrite, historyQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// queueHistory hands a record to the writer. It waits if the queue is full
+// rather than drop or reorder records.
+func (s *Service) queueHistory(userEmail string, item *models.TransferHistory) {
+	w := s.history
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		log.Printf("[HISTORY] WARN: %s finished after shutdown; buffering it", item.ID)
+		if err := s.bufferHistory(bufferedHistory{UserEmail: userEmail, Item: item}); err != nil {
+			log.Printf("[HISTORY] WARN: cannot buffer %s, record lost: %v", item.ID, err)
+		}
+		return
+	}
+	w.queue <- historyWrite{userEmail, item}
+}
+
+// runHistoryWriter stores queued records one at a time until Close.
+func (s *Service) runHistoryWriter() {
+	defer close(s.history.done)
+	for w := range s.history.queue {
+		// The setting is a DB read, so it's checked here, off the transfer's path
+		if s.keepsHistory(w.userEmail) {
+			s.persistHistory(w.userEmail, w.item)
+		}
+	}
+}
+
+// Close stores or buffers every queued history record and stops the
+// writer. Records that can't reach the database by then go straight to the
+// buffer file. Later records are buffered too.
+func (s *Service) Close() {
+	w := s.history
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.stop)
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.done
+}
+
+type bufferedHistory struct {
+	UserEmail string                  `json:"userEmail"`
+	Item      *models.TransferHistory `json:"item"`
+}
+
+// keepsHistory reports whether userEmail's transfers go into the history:
+// not when DisableHistory is set, nor for an incognito user. If the setting
+// can't be read, nothing is recorded.
+func (s *Service) keepsHistory(userEmail string) bool {
+	if s.config.DisableHistory {
+		return false
+	}
+	incognito, err := s.store.Incognito(userEmail)
+	if err != nil {
+		log.Printf("[HISTORY] Cannot read the history setting of %s, not recording: %v", userEmail, err)
+		return false
+	}
+	return !incognito
+}
+
+// persistHistory stores item, retrying transient failures before falling
+// back to the local buffer file.
+func (s *Service) persistHistory(userEmail string, item *models.TransferHistory) {
+	var err error
+retry:
+	for attempt := 0; attempt < historyWriteAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(historyRetryBase << (attempt - 1)):
+			case <-s.history.stop:
+				break retry
+			}
+		}
+		if err = s.store.AddHistory(userEmail, item); err == nil {
+			return
+		}
+	}
+	log.Printf("[HISTORY] WARN: storing %s failed after %d attempts (%v); buffering locally", item.ID, historyWriteAttempts, err)
+	if err := s.bufferHistory(bufferedHistory{UserEmail: userEmail, Item: item}); err != nil {
+		log.Printf("[HISTORY] WARN: cannot buffer %s, record lost: %v", item.ID, err)
+	}
+}
+
+func (s *Service) bufferHistory(rec bufferedHistory) error {
+	if s.config.HistoryBufferFile == "" {
+		return errors.New("no history buffer file configured")
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.config.HistoryBufferFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.config.HistoryBufferFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replayHistoryBuffer stores the records buffered during earlier outages.
+// Records that still can't be written stay in the file for the next start.
+func (s *Service) replayHistoryBuffer() {
+	if s.store == nil || s.config.HistoryBufferFile == "" {
+		return
+	}
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	f, err := os.Open(s.config.HistoryBufferFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[HISTORY] WARN: cannot read buffer: %v", err)
+		}
+		return
+	}
+	var remaining [][]byte
+	replayed := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec bufferedHistory
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || rec.Item == nil {
+			continue // torn write; nothing to recover
+		}
+		if err := s.store.AddHistory(rec.UserEmail, rec.Item); err != nil {
+			remaining = append(remaining, append([]byte(nil), sc.Bytes()...))
+			continue
+		}
+		replayed++
+	}
+	f.Close()
+
+	if len(remaining) == 0 {
+		os.Remove(s.config.HistoryBufferFile)
+	} else {
+		var data []byte
+		for _, line := range remaining {
+			data = append(append(data, line...), '\n')
+		}
+		if err := os.WriteFile(s.config.HistoryBufferFile, data, 0600); err != nil {
+			log.Printf("[HISTORY] WARN: cannot rewrite buffer: %v", err)
+		}
+	}
+	if replayed > 0 || len(remaining) > 0 {
+		log.Printf("[HISTORY] Replayed %d buffered records, %d still pending", replayed, len(remaining))
+	}
+}
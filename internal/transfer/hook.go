@@ -0,0 +1,36 @@
+package transfer
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// receiveHookTimeout bounds how long OnReceiveCommand may run.
+var receiveHookTimeout = 2 * time.Minute
+
+// runReceiveHook runs the configured OnReceiveCommand for a completed receive,
+// appending the saved path and sender name as arguments. The command is split
+// on whitespace and executed directly, never through a shell, so nothing in a
+// file or sender name is interpreted.
+func (s *Service) runReceiveHook(id, path, sender string) {
+	argv := strings.Fields(s.config.OnReceiveCommand)
+	if len(argv) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), receiveHookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], append(argv[1:], path, sender)...)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("[HOOK %s] %s timed out after %s", id, argv[0], receiveHookTimeout)
+	} else if err != nil {
+		log.Printf("[HOOK %s] %s failed: %v", id, argv[0], err)
+	}
+	if out := strings.TrimSpace(string(out)); out != "" {
+		log.Printf("[HOOK %s] output:\n%s", id, out)
+	}
+}
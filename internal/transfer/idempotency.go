@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// idempotencyNamespace scopes the IDs derived from idempotency keys.
+var idempotencyNamespace = uuid.MustParse("6f1c2a7e-4b0d-4e57-9a43-1d8f0c6e2b91")
+
+// idempotentID derives a transfer ID from a client key. The sending device,
+// user and target peer are mixed in, so a key only matches a retry of the
+// same user's send to the same peer, never another user's transfer.
+func idempotentID(deviceID, senderEmail, peerID, key string) string {
+	return uuid.NewSHA1(idempotencyNamespace, []byte(deviceID+"\x00"+senderEmail+"\x00"+peerID+"\x00"+key)).String()
+}
+
+// checkResumable makes sure a ResumeID names a finished send by the same
+// user, if this service still knows it, so a resume can't take over another
+// user's transfer or one still running.
+func (s *Service) checkResumable(id, senderEmail string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transfers[id]
+	switch {
+	case !ok:
+		return nil
+	case t.Direction != "send" || t.SenderEmail != senderEmail:
+		return fmt.Errorf("%w: %s", ErrNotResumable, id)
+	case !terminal(t.Status):
+		return fmt.Errorf("%w: %s", ErrInProgress, id)
+	}
+	return nil
+}
+
+// checkIdempotent looks up an earlier transfer with this ID. done is true if
+// it already completed, so there's nothing to send; a failed one is retried.
+func (s *Service) checkIdempotent(id string) (done bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transfers[id]
+	if !ok {
+		return false, nil
+	}
+	switch {
+	case t.Status == "completed":
+		log.Printf("[TRANSFER %s] Already completed; not sending again", id)
+		return true, nil
+	case !terminal(t.Status):
+		return false, fmt.Errorf("%w: %s", ErrInProgress, id)
+	}
+	return false, nil
+}
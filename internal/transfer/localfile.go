@@ -0,0 +1,74 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is returned by OpenLocalFile for files that must not be
+// sent: outside the allowed directories, or not regular files.
+var ErrUnsafePath = errors.New("file cannot be sent")
+
+// OpenLocalFile opens a file on this server for sending. Once symlinks are
+// resolved it must lie inside one of bases and be a regular file: named
+// pipes, devices and sockets could block the sender forever or stream
+// without end. A missing file returns an error satisfying os.IsNotExist.
+func OpenLocalFile(path string, bases []string) (*os.File, os.FileInfo, error) {
+	if _, err := os.Lstat(path); err != nil {
+		return nil, nil, err
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return nil, nil, err
+	}
+	if !insideAny(real, bases) {
+		return nil, nil, fmt.Errorf("%w: %s is outside the allowed directories", ErrUnsafePath, filepath.Base(path))
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%w: %s is not a regular file (%s)", ErrUnsafePath, filepath.Base(path), info.Mode().Type())
+	}
+
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Make sure nothing was swapped in between the checks and the open
+	opened, err := f.Stat()
+	if err != nil || !os.SameFile(info, opened) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: %s changed while being opened", ErrUnsafePath, filepath.Base(path))
+	}
+	return f, opened, nil
+}
+
+// insideAny reports whether the absolute, symlink-free path is inside one of
+// bases, which are resolved the same way.
+func insideAny(path string, bases []string) bool {
+	for _, base := range bases {
+		if base == "" {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(base)
+		if err != nil {
+			continue
+		}
+		if resolved, err = filepath.Abs(resolved); err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolved, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package transfer
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenLocalFileRefusesFIFO(t *testing.T) {
+	base := t.TempDir()
+	fifo := filepath.Join(base, "pipe")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	// Opening a FIFO with no writer would block, so a hang is a failure too
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := OpenLocalFile(fifo, []string{base})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("FIFO: %v, want ErrUnsafePath", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenLocalFile blocked on a FIFO")
+	}
+}
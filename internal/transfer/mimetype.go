@@ -0,0 +1,26 @@
+package transfer
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// sniffLen is how much of the content http.DetectContentType looks at.
+const sniffLen = 512
+
+// detectContentType names the MIME type of a file about to be sent. The
+// extension wins when it is known, since sniffing can't tell apart formats
+// such as docx and zip; otherwise the first bytes decide. The peeked bytes
+// stay buffered in r.
+func detectContentType(fileName string, r *bufio.Reader) string {
+	if ct := mime.TypeByExtension(filepath.Ext(fileName)); ct != "" {
+		return ct
+	}
+	sample, _ := r.Peek(sniffLen)
+	if len(sample) == 0 {
+		return ""
+	}
+	return http.DetectContentType(sample)
+}
@@ -0,0 +1,29 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// pingTimeout bounds a Ping dial.
+const pingTimeout = 3 * time.Second
+
+// Ping opens a TCP connection to peerID's transfer port and closes it again,
+// returning how long the connect took. Discovery only shows that the peer's
+// announcements arrive; this checks that a transfer could reach it.
+func (s *Service) Ping(peerID string) (time.Duration, error) {
+	peer, ok := s.discovery.GetDevice(peerID)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrPeerNotFound, peerID)
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)), pingTimeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
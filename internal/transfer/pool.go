@@ -0,0 +1,88 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// Sender-side connection reuse. With ReuseConnections on, a connection that
+// finished a transfer cleanly is parked here (one per peer address) and
+// picked up by the next SendStream to the same peer, saving a TCP handshake
+// per file. Parked connections are closed after the idle timeout.
+
+const defaultIdleTimeout = 30 * time.Second
+
+type pooledConn struct {
+	net.Conn
+	idleSince time.Time
+}
+
+func (s *Service) idleTimeout() time.Duration {
+	if s.config.ConnIdleTimeout > 0 {
+		return s.config.ConnIdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+// acquireConn returns a parked connection to addr if one is available and
+// fresh, otherwise it dials peer there. reused reports which happened.
+func (s *Service) acquireConn(peer *models.Device, addr string) (conn net.Conn, reused bool, err error) {
+	if s.config.ReuseConnections {
+		s.poolMu.Lock()
+		pc, ok := s.pool[addr]
+		delete(s.pool, addr)
+		s.poolMu.Unlock()
+		if ok {
+			if time.Since(pc.idleSince) < s.idleTimeout() {
+				return pc.Conn, true, nil
+			}
+			pc.Close()
+		}
+	}
+	conn, err = s.dialPeer(peer, addr)
+	return conn, false, err
+}
+
+// releaseConn parks conn for reuse when the transfer left it in a clean
+// state, and closes it otherwise.
+func (s *Service) releaseConn(addr string, conn net.Conn, clean bool) {
+	if conn == nil {
+		return
+	}
+	if !clean || !s.config.ReuseConnections {
+		conn.Close()
+		return
+	}
+	pc := &pooledConn{Conn: conn, idleSince: time.Now()}
+
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+	if _, taken := s.pool[addr]; taken {
+		conn.Close()
+		return
+	}
+	s.pool[addr] = pc
+	time.AfterFunc(s.idleTimeout(), func() {
+		s.poolMu.Lock()
+		defer s.poolMu.Unlock()
+		if s.pool[addr] == pc {
+			delete(s.pool, addr)
+			pc.Close()
+		}
+	})
+}
+
+// isStaleConnErr reports whether err looks like the peer already closed a
+// parked connection, in which case the offer can safely be retried on a new
+// one: the receiver never saw it.
+func isStaleConnErr(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// quotaExceeded is the reason a sender is given when the file would take the
+// receiving user past Config.UserQuotaBytes.
+const quotaExceeded = "quota exceeded"
+
+// quotaTracker knows how many bytes each directory receives are charged to
+// holds: a user's download directory, or a save directory outside it.
+// Sizes are scanned from disk when first needed and again after something
+// changes the directory; receives under way hold reservations on top.
+type quotaTracker struct {
+	mu       sync.Mutex
+	used     map[string]int64 // by directory
+	reserved map[string]int64 // by directory
+}
+
+// dirSize sums the regular files under dir, partial receives included.
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// usedLocked returns dir's cached size, scanning it if unknown; q.mu held.
+func (q *quotaTracker) usedLocked(dir string) int64 {
+	if n, ok := q.used[dir]; ok {
+		return n
+	}
+	if q.used == nil {
+		q.used = make(map[string]int64)
+	}
+	n := dirSize(dir)
+	q.used[dir] = n
+	return n
+}
+
+// changed forgets dir's size, or every size if dir is empty, so the next
+// check scans again.
+func (q *quotaTracker) changed(dir string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if dir == "" {
+		clear(q.used)
+		return
+	}
+	delete(q.used, dir)
+}
+
+// loadUsage scans each user directory under DownloadDir, so usage is
+// current from startup.
+func (s *Service) loadUsage() {
+	entries, err := os.ReadDir(s.config.DownloadDir)
+	if err != nil {
+		return
+	}
+	s.quota.mu.Lock()
+	defer s.quota.mu.Unlock()
+	for _, e := range entries {
+		if e.IsDir() {
+			s.quota.usedLocked(filepath.Join(s.config.DownloadDir, e.Name()))
+		}
+	}
+}
+
+// Usage returns the bytes email's download directory holds.
+func (s *Service) Usage(email string) int64 {
+	s.quota.mu.Lock()
+	defer s.quota.mu.Unlock()
+	return s.quota.usedLocked(s.config.UserDownloadDir(email))
+}
+
+// quotaDir is the directory a receive into destDir is charged to: the
+// signed-in user's download directory when destDir is empty or inside it,
+// otherwise destDir itself, so a file saved under SaveRoot counts against
+// the directory it actually lands in.
+func (s *Service) quotaDir(destDir string) string {
+	dir := s.config.UserDownloadDir(s.getUsername())
+	if destDir == "" {
+		return dir
+	}
+	if rel, err := filepath.Rel(dir, destDir); err == nil && filepath.IsLocal(rel) {
+		return dir
+	}
+	return destDir
+}
+
+// fitsQuota reports whether n more bytes fit in dir's quota.
+func (s *Service) fitsQuota(dir string, n int64) bool {
+	if s.config.UserQuotaBytes <= 0 {
+		return true
+	}
+	s.quota.mu.Lock()
+	defer s.quota.mu.Unlock()
+	return s.quota.usedLocked(dir)+s.quota.reserved[dir]+n <= s.config.UserQuotaBytes
+}
+
+// reserveQuota sets n bytes of dir's quota aside for a receive, if they
+// fit, so receives accepted together can't overrun it. release gives them
+// back once the receive is over and its file counted.
+func (s *Service) reserveQuota(dir string, n int64) (release func(), ok bool) {
+	if s.config.UserQuotaBytes <= 0 {
+		return func() {}, true
+	}
+	s.quota.mu.Lock()
+	defer s.quota.mu.Unlock()
+	if s.quota.usedLocked(dir)+s.quota.reserved[dir]+n > s.config.UserQuotaBytes {
+		log.Printf("[QUOTA] %s has no room for %d more bytes", dir, n)
+		return nil, false
+	}
+	if s.quota.reserved == nil {
+		s.quota.reserved = make(map[string]int64)
+	}
+	s.quota.reserved[dir] += n
+	return func() {
+		s.quota.mu.Lock()
+		defer s.quota.mu.Unlock()
+		if s.quota.reserved[dir] -= n; s.quota.reserved[dir] <= 0 {
+			delete(s.quota.reserved, dir)
+		}
+	}, true
+}
@@ -0,0 +1,74 @@
+package transfer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// maxPriorityStep bounds how far priority moves a send's share, so one
+// extreme value can't starve everything else.
+const maxPriorityStep = 8
+
+// sendLimiter shares Config.MaxSendRate among the sends under way in
+// proportion to their priority weights.
+type sendLimiter struct {
+	mu      sync.Mutex
+	weights map[string]float64 // by transfer ID
+	total   float64
+}
+
+// priorityWeight is a send's weight in the shared budget: each step of
+// priority above normal doubles it, each step below halves it.
+func priorityWeight(priority int) float64 {
+	if priority > maxPriorityStep {
+		priority = maxPriorityStep
+	} else if priority < -maxPriorityStep {
+		priority = -maxPriorityStep
+	}
+	return math.Ldexp(1, priority)
+}
+
+// add enters a send into the budget.
+func (l *sendLimiter) add(id string, priority int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.weights == nil {
+		l.weights = make(map[string]float64)
+	}
+	w := priorityWeight(priority)
+	l.total += w - l.weights[id]
+	l.weights[id] = w
+}
+
+// remove takes a finished send out of the budget.
+func (l *sendLimiter) remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total -= l.weights[id]
+	delete(l.weights, id)
+}
+
+// share returns the fraction of the budget the send currently gets.
+func (l *sendLimiter) share(id string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.weights[id]
+	if !ok || l.total <= 0 {
+		return 1
+	}
+	return w / l.total
+}
+
+// throttle paces send t after it wrote n bytes, so it keeps to its share of
+// MaxSendRate. It returns at once when there is no limit.
+func (s *Service) throttle(t *models.Transfer, n int) {
+	rate := s.config.MaxSendRate
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	perSecond := float64(rate) * s.limiter.share(t.ID)
+	time.Sleep(time.Duration(float64(n) / perSecond * float64(time.Second)))
+}
@@ -0,0 +1,195 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Reliable mode (wireMetadata.Reliable) carries the framed payload as
+// checksummed chunk records, each acknowledged by the receiver:
+//
+//	record: index uint32 | length uint32 | crc32 uint32 | data
+//	ack:    index uint32 | status byte
+//
+// A record with length 0 ends the payload and is acknowledged like the
+// others. The sender waits for each ack before the next record and resends a
+// chunk that was rejected as corrupt or not acknowledged in time, up to
+// maxChunkAttempts times. The receiver acknowledges duplicates again without
+// using them, so a resend after a lost or late ack is harmless.
+const (
+	chunkAckOK      byte = 1
+	chunkAckCorrupt byte = 2
+
+	maxChunkAttempts = 3
+	maxChunkRecord   = 4 << 20
+)
+
+// chunkAckTimeout is how long a sender waits for an ack before resending.
+// A variable so tests can shorten it.
+var chunkAckTimeout = 10 * time.Second
+
+var errChunkProtocol = errors.New("reliable mode: protocol error")
+
+// chunkWriter is the sender side: each Write is sent as one or more records
+// on w, with acks read back from conn.
+type chunkWriter struct {
+	id           string // transfer, for logs
+	w            io.Writer
+	conn         net.Conn
+	stallTimeout time.Duration // bounds each record write
+	index        uint32
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxChunkRecord {
+			n = maxChunkRecord
+		}
+		if err := c.send(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sends the end record and waits for its ack, after which nothing
+// more is due from the receiver.
+func (c *chunkWriter) Close() error {
+	return c.send(nil)
+}
+
+// send writes data as the next record until the receiver acknowledges it.
+func (c *chunkWriter) send(data []byte) error {
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:], c.index)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[8:], crc32.ChecksumIEEE(data))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for attempt := 1; ; attempt++ {
+		c.conn.SetWriteDeadline(time.Now().Add(c.stallTimeout))
+		if _, err := c.w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if _, err := c.w.Write(data); err != nil {
+				return err
+			}
+		}
+		status, err := c.awaitAck()
+		if err == nil && status == chunkAckOK {
+			c.index++
+			return nil
+		}
+		if err != nil && !isTimeout(err) {
+			return err
+		}
+		reason := "was corrupted"
+		if err != nil {
+			reason = "was not acknowledged"
+		}
+		if attempt == maxChunkAttempts {
+			return fmt.Errorf("chunk %d %s after %d attempts", c.index, reason, attempt)
+		}
+		log.Printf("[TRANSFER %s] Chunk %d %s, resending (attempt %d)", c.id, c.index, reason, attempt+1)
+	}
+}
+
+// awaitAck reads acks until the one for the current chunk, skipping late
+// duplicates for earlier ones.
+func (c *chunkWriter) awaitAck() (byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(chunkAckTimeout))
+	for {
+		var ack [5]byte
+		if _, err := io.ReadFull(c.conn, ack[:]); err != nil {
+			return 0, err
+		}
+		switch idx := binary.BigEndian.Uint32(ack[:4]); {
+		case idx == c.index:
+			return ack[4], nil
+		case idx > c.index:
+			return 0, fmt.Errorf("%w: ack for chunk %d while sending %d", errChunkProtocol, idx, c.index)
+		}
+	}
+}
+
+// chunkReader is the receiver side: it reads records from r, acknowledging
+// each on ack, and yields the verified data in order. It returns io.EOF
+// after the end record.
+type chunkReader struct {
+	r     io.Reader
+	ack   io.Writer
+	next  uint32 // index of the next chunk to use
+	buf   []byte // verified data not yet returned
+	ended bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.ended {
+			return 0, io.EOF
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) readRecord() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return noEOF(err)
+	}
+	idx := binary.BigEndian.Uint32(hdr[0:])
+	size := binary.BigEndian.Uint32(hdr[4:])
+	sum := binary.BigEndian.Uint32(hdr[8:])
+	if size > maxChunkRecord || idx > c.next {
+		return fmt.Errorf("%w: chunk %d of %d bytes while expecting %d", errChunkProtocol, idx, size, c.next)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return noEOF(err)
+	}
+
+	status := chunkAckOK
+	if crc32.ChecksumIEEE(data) != sum {
+		status = chunkAckCorrupt
+	}
+	var ack [5]byte
+	binary.BigEndian.PutUint32(ack[:4], idx)
+	ack[4] = status
+	if _, err := c.ack.Write(ack[:]); err != nil {
+		return err
+	}
+	if status != chunkAckOK || idx < c.next {
+		return nil // the sender resends it, or already did
+	}
+	c.next++
+	if size == 0 {
+		c.ended = true
+	}
+	c.buf = data
+	return nil
+}
+
+// noEOF turns a clean EOF in the middle of the record stream into
+// io.ErrUnexpectedEOF: the sender always ends with an end record.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
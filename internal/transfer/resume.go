@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resumeRecord remembers an unfinished receive so a sender retrying the same
+// transfer ID can continue from where it stopped, even after a restart.
+type resumeRecord struct {
+	ID         string `json:"id"`
+	FileName   string `json:"fileName"` // sanitized
+	FileSize   int64  `json:"fileSize"`
+	SenderName string `json:"senderName"`
+	Path       string `json:"path"` // partial data so far
+}
+
+func (s *Service) resumeFile(id string) string {
+	return filepath.Join(s.config.ResumeStateDir, id+".json")
+}
+
+// saveResume records rec in memory and, if ResumeStateDir is set, on disk.
+func (s *Service) saveResume(rec *resumeRecord) {
+	s.mu.Lock()
+	s.resumes[rec.ID] = rec
+	s.mu.Unlock()
+	if s.config.ResumeStateDir == "" {
+		return
+	}
+	data, _ := json.Marshal(rec)
+	if err := os.MkdirAll(s.config.ResumeStateDir, 0700); err != nil {
+		log.Printf("[RESUME] Cannot create state dir: %v", err)
+		return
+	}
+	tmp := s.resumeFile(rec.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("[RESUME] Cannot save state for %s: %v", rec.ID, err)
+		return
+	}
+	os.Rename(tmp, s.resumeFile(rec.ID))
+}
+
+// dropResume forgets the record for id once it can no longer be resumed.
+func (s *Service) dropResume(id string) {
+	s.mu.Lock()
+	delete(s.resumes, id)
+	s.mu.Unlock()
+	if s.config.ResumeStateDir != "" {
+		os.Remove(s.resumeFile(id))
+	}
+}
+
+// loadResumeState reads the records left by a previous run, discarding any
+// whose partial file has gone.
+func (s *Service) loadResumeState() {
+	if s.config.ResumeStateDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(s.config.ResumeStateDir)
+	if err != nil {
+		return
+	}
+	n := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.config.ResumeStateDir, e.Name())
+		data, err := os.ReadFile(path)
+		var rec resumeRecord
+		if err == nil {
+			err = json.Unmarshal(data, &rec)
+		}
+		if err == nil {
+			_, err = os.Stat(rec.Path)
+		}
+		if err != nil || rec.ID == "" {
+			os.Remove(path)
+			continue
+		}
+		s.mu.Lock()
+		s.resumes[rec.ID] = &rec
+		s.mu.Unlock()
+		n++
+	}
+	if n > 0 {
+		log.Printf("[RESUME] %d unfinished receives can be resumed", n)
+	}
+}
+
+// resumePoint returns the record and byte offset to continue meta from, or
+// nil and 0 if it must start over. The offer has to be for the same file
+// from the same sender, and the partial data must still be there.
+func (s *Service) resumePoint(meta wireMetadata) (*resumeRecord, int64) {
+	if !meta.Resume {
+		return nil, 0
+	}
+	s.mu.RLock()
+	rec := s.resumes[meta.ID]
+	s.mu.RUnlock()
+	if rec == nil || rec.FileName != meta.FileName || rec.FileSize != meta.FileSize || rec.SenderName != meta.SenderName {
+		return nil, 0
+	}
+	info, err := os.Stat(rec.Path)
+	if err != nil || info.Size() > rec.FileSize {
+		return nil, 0
+	}
+	return rec, info.Size()
+}
@@ -0,0 +1,97 @@
+package transfer
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+const (
+	retentionSweepInterval = 10 * time.Minute
+	// Files modified this recently are assumed to still be receiving.
+	retentionActiveGrace = time.Minute
+)
+
+type retainedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// runRetention periodically prunes DownloadDir according to FileRetention
+// (max age) and MaxDownloadBytes (total size cap, oldest deleted first).
+func (s *Service) runRetention() {
+	for {
+		s.pruneDownloads(time.Now())
+		time.Sleep(retentionSweepInterval)
+	}
+}
+
+// pruneDownloads performs a single retention sweep as of now and returns the
+// paths it removed.
+func (s *Service) pruneDownloads(now time.Time) []string {
+	// Partial receives are kept for a retry to resume, however old
+	s.mu.RLock()
+	resuming := make(map[string]bool, len(s.resumes))
+	for _, rec := range s.resumes {
+		resuming[rec.Path] = true
+	}
+	s.mu.RUnlock()
+
+	var files []retainedFile
+	var total int64
+	filepath.WalkDir(s.config.DownloadDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		// A sidecar goes with its file, or once that file is gone
+		if IsSidecar(d.Name()) {
+			described := filepath.Join(filepath.Dir(path), strings.TrimSuffix(d.Name()[1:], sidecarSuffix))
+			if !exists(described) {
+				os.Remove(path)
+			}
+			return nil
+		}
+		// Never touch files that are still being written or may be resumed
+		if strings.HasSuffix(path, ".incomplete") || resuming[path] || now.Sub(info.ModTime()) < retentionActiveGrace {
+			return nil
+		}
+		files = append(files, retainedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var removed []string
+	for _, f := range files {
+		expired := s.config.FileRetention > 0 && now.Sub(f.modTime) > s.config.FileRetention
+		overCap := s.config.MaxDownloadBytes > 0 && total > s.config.MaxDownloadBytes
+		if !expired && !overCap {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("[RETENTION] Could not remove %s: %v", f.path, err)
+			continue
+		}
+		os.Remove(sidecarPath(f.path))
+		total -= f.size
+		removed = append(removed, f.path)
+		log.Printf("[RETENTION] Removed %s (%d bytes, modified %s)", f.path, f.size, f.modTime.Format(time.RFC3339))
+	}
+
+	if len(removed) > 0 {
+		s.quota.changed("")
+		s.broadcast(models.EventFilesUpdated, map[string]interface{}{"removed": len(removed)})
+	}
+	return removed
+}
@@ -0,0 +1,77 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"filetransfer/internal/clamav"
+)
+
+// startScan opens a virus scan for a receive into workPath, first feeding it
+// the offset bytes an earlier attempt already wrote. It returns nil when
+// scanning is disabled.
+func (s *Service) startScan(workPath string, offset int64) *clamav.Scan {
+	if s.scanner == nil {
+		return nil
+	}
+	scan := s.scanner.Start()
+	if offset > 0 {
+		f, err := os.Open(workPath)
+		if err == nil {
+			_, err = io.CopyN(scan, f, offset)
+			f.Close()
+		}
+		if err != nil {
+			log.Printf("[SCAN] Cannot rescan resumed %s: %v", workPath, err)
+		}
+	}
+	return scan
+}
+
+// checkScan waits for the verdict on a complete receive. Infected files, and
+// with ScanFailClosed ones that couldn't be scanned, are quarantined and an
+// error is returned; otherwise the file may be moved into place.
+func (s *Service) checkScan(id string, scan *clamav.Scan, workPath, savePath string) error {
+	sig, err := scan.Result()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, clamav.ErrInfected):
+		log.Printf("[SCAN %s] %s is infected with %s", id, filepath.Base(savePath), sig)
+	case !s.config.ScanFailClosed:
+		log.Printf("[SCAN %s] WARNING: accepting %s unscanned: %v", id, filepath.Base(savePath), err)
+		return nil
+	default:
+		log.Printf("[SCAN %s] Cannot scan %s, quarantining it: %v", id, filepath.Base(savePath), err)
+		err = fmt.Errorf("virus scan failed: %w", err)
+	}
+	s.quarantine(id, workPath, filepath.Base(savePath))
+	return err
+}
+
+// quarantine moves a received file out of reach into QuarantineDir under
+// name, or deletes it if there is no quarantine directory.
+func (s *Service) quarantine(id, path, name string) {
+	if dir := s.config.QuarantineDir; dir != "" {
+		dest := filepath.Join(dir, name)
+		if exists(dest) {
+			dest = uniquePath(dest)
+		}
+		err := os.MkdirAll(dir, 0700)
+		if err == nil {
+			err = os.Rename(path, dest)
+		}
+		if err == nil {
+			log.Printf("[SCAN %s] Quarantined as %s", id, dest)
+			return
+		}
+		log.Printf("[SCAN %s] Cannot quarantine, deleting instead: %v", id, err)
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("[SCAN %s] Cannot delete %s: %v", id, path, err)
+	}
+}
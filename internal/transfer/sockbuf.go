@@ -0,0 +1,42 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+)
+
+// maxReaderSize caps the bufio reader on a connection however large the
+// socket's receive buffer is.
+const maxReaderSize = 1 << 20
+
+// tuneConn applies the configured socket buffer sizes to c, or the TCP
+// connection under it.
+func (s *Service) tuneConn(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if n := s.config.SocketReadBuffer; n > 0 {
+		if err := tcp.SetReadBuffer(n); err != nil {
+			log.Printf("[TRANSFER] Cannot set socket read buffer to %d: %v", n, err)
+		}
+	}
+	if n := s.config.SocketWriteBuffer; n > 0 {
+		if err := tcp.SetWriteBuffer(n); err != nil {
+			log.Printf("[TRANSFER] Cannot set socket write buffer to %d: %v", n, err)
+		}
+	}
+}
+
+// readerSize is the bufio reader size for incoming data: as large as the
+// socket's receive buffer, so one read can drain it.
+func (s *Service) readerSize() int {
+	if n := s.config.SocketReadBuffer; n > 0 {
+		return min(n, maxReaderSize)
+	}
+	return 4096 // bufio's default
+}
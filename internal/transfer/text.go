@@ -0,0 +1,84 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"filetransfer/internal/models"
+)
+
+// Transfer kinds carried in wireMetadata.Kind.
+const (
+	KindFile = "file" // the default: saved under the download directory
+	KindText = "text" // short message shown to the user, never written to disk
+)
+
+// maxInMemoryPayload is the largest text transfer kept in memory; bigger
+// ones are saved like files.
+const maxInMemoryPayload = 64 << 10
+
+// inMemory reports whether the payload offered by meta is received into
+// memory rather than onto disk.
+func inMemory(meta wireMetadata) bool {
+	return meta.Kind == KindText && !meta.Compressed && meta.FileSize >= 0 && meta.FileSize <= maxInMemoryPayload
+}
+
+// receiveText reads one framed text payload and hands it to the UI as an
+// EventTextReceived. Nothing is written to disk. conn may be nil.
+func (s *Service) receiveText(conn net.Conn, reader io.Reader, meta wireMetadata) error {
+	userEmail := s.getUsername()
+	t := &models.Transfer{
+		ID:        meta.ID,
+		FileName:  meta.FileName,
+		FileSize:  meta.FileSize,
+		Direction: "receive",
+		PeerID:    meta.SenderID,
+		PeerName:  meta.SenderName,
+		Status:    "receiving",
+		StartTime: time.Now(),
+
+		CompressionRatio: 1.0,
+	}
+	s.mu.Lock()
+	s.transfers[t.ID] = t
+	s.mu.Unlock()
+	s.broadcast(models.EventTransferStarted, t)
+
+	if conn != nil {
+		conn.SetReadDeadline(time.Now().Add(orDefault(s.config.StallTimeout, defaultStallTimeout)))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	var frameLen uint64
+	err := binary.Read(reader, binary.BigEndian, &frameLen)
+	var text []byte
+	if err == nil && frameLen != uint64(meta.FileSize) {
+		err = fmt.Errorf("frame of %d bytes, offered %d", frameLen, meta.FileSize)
+	}
+	if err == nil {
+		text = make([]byte, frameLen)
+		_, err = io.ReadFull(reader, text)
+	}
+	if err != nil {
+		log.Printf("[TRANSFER %s] Text receive error: %v", t.ID, err)
+		s.setError(t, err.Error())
+		s.finish(userEmail, t, "failed")
+		return err
+	}
+
+	s.addProgress(t, len(text))
+	s.countBytes(t, len(text))
+	s.setWireStats(t, int64(len(text)))
+	s.broadcast(models.EventTextReceived, map[string]string{
+		"id":         meta.ID,
+		"senderId":   meta.SenderID,
+		"senderName": meta.SenderName,
+		"text":       string(text),
+	})
+	s.finish(userEmail, t, "completed")
+	log.Printf("[TRANSFER %s] Received %d-byte message from %s", t.ID, len(text), meta.SenderName)
+	return nil
+}
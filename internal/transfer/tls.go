@@ -0,0 +1,81 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"filetransfer/internal/config"
+	"filetransfer/internal/models"
+	"filetransfer/pkg/utils"
+)
+
+// Transfer-level TLS reuses the web UI's certificate. Receivers with one
+// configured only accept TLS; senders use TLS with peers advertising CapTLS
+// and pin the certificate to the fingerprint announced in discovery. That
+// defeats passive eavesdropping and impostors on the transfer port, though
+// not an attacker who can also forge discovery packets.
+
+// loadServerTLS returns the listener TLS config, or nil if TLS is off.
+func loadServerTLS(cfg config.Config) *tls.Config {
+	if !cfg.TLSEnabled() {
+		return nil
+	}
+	cert, err := cfg.LoadTLSCert()
+	if err != nil {
+		log.Printf("[TRANSFER] TLS disabled, cannot load certificate: %v", err)
+		return nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+}
+
+// wrapListener puts TLS on ln when it is configured.
+func (s *Service) wrapListener(ln net.Listener) net.Listener {
+	if s.serverTLS == nil {
+		return ln
+	}
+	return tls.NewListener(ln, s.serverTLS)
+}
+
+// dialPeer connects to peer at addr, over TLS if the peer offers it.
+func (s *Service) dialPeer(peer *models.Device, addr string) (net.Conn, error) {
+	conn, err := s.dialPeerConn(peer, addr)
+	if err != nil {
+		return nil, err // not a typed-nil *tls.Conn
+	}
+	s.tuneConn(conn)
+	return conn, nil
+}
+
+func (s *Service) dialPeerConn(peer *models.Device, addr string) (net.Conn, error) {
+	if peer.CertMismatch {
+		return nil, fmt.Errorf("%w: %s announced a different certificate than the one pinned for it", ErrCertMismatch, peer.ID)
+	}
+	if !peer.Supports(models.CapTLS) {
+		if peer.CertFingerprint != "" {
+			return nil, fmt.Errorf("%w: %s has a certificate but doesn't offer TLS", ErrCertMismatch, peer.ID)
+		}
+		return net.Dial("tcp", addr)
+	}
+	// Peers use self-signed certificates, so chain verification is replaced
+	// by the fingerprint check below.
+	cfg := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}
+	if want := peer.CertFingerprint; want != "" {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("%w: %s presented no certificate", ErrCertMismatch, addr)
+			}
+			got := utils.CertFingerprint(&tls.Certificate{Certificate: rawCerts[:1]})
+			if !strings.EqualFold(got, want) {
+				return fmt.Errorf("%w: %s presented %s, expected %s", ErrCertMismatch, addr, got, want)
+			}
+			return nil
+		}
+	} else {
+		log.Printf("[TRANSFER] WARNING: %s offers TLS but no certificate fingerprint; connecting without verifying it", addr)
+	}
+	return tls.Dial("tcp", addr, cfg)
+}
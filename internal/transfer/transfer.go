@@ -2,47 +2,112 @@ package transfer
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
+	"filetransfer/internal/clamav"
 	"filetransfer/internal/config"
 	"filetransfer/internal/discovery"
 	"filetransfer/internal/models"
 	"filetransfer/internal/storage"
+	"filetransfer/internal/webhook"
 )
 
+var (
+	// ErrSelfTransfer is returned when the target peer is this device.
+	ErrSelfTransfer = errors.New("cannot send to yourself")
+	ErrPeerNotFound = errors.New("peer not found")
+	ErrRejected     = errors.New("receiver rejected the transfer")
+	ErrNoPending    = errors.New("no pending transfer")
+	ErrCancelled    = errors.New("transfer cancelled")
+	ErrStalled      = errors.New("transfer stalled")
+	ErrBadDestDir   = errors.New("destination directory not allowed")
+	ErrCertMismatch = errors.New("peer certificate does not match its pin")
+	ErrBadFileName  = errors.New("invalid file name")
+	ErrInProgress   = errors.New("a transfer with this idempotency key is in progress")
+	ErrSenderGone   = errors.New("sender hung up before the transfer started")
+	ErrNotResumable = errors.New("no earlier send of yours with that ID")
+)
+
+// Store is the persistence the transfer service uses.
+type Store interface {
+	storage.HistoryStore
+	storage.TrustStore
+}
+
+// defaultStallTimeout applies when Config.StallTimeout is zero.
+const defaultStallTimeout = 30 * time.Second
+
 type Service struct {
 	config    config.Config
 	deviceID  string
-	store     *storage.Store
+	store     Store // nil disables history and trusted devices
 	discovery *discovery.Service
 	broadcast func(string, interface{})
 
 	transfers map[string]*models.Transfer
 	pending   map[string]*models.PendingTransfer
+	confirms  map[string]chan bool     // sends waiting for the sender's confirmation
+	recorded  map[string]bool          // transfers whose terminal state is in history
+	resumes   map[string]*resumeRecord // unfinished receives by transfer ID
+	streams   map[string]io.Closer     // connections of streaming transfers, for AbortAll
+	aborted   map[string]bool          // transfers AbortAll stopped, until they finish
 	mu        sync.RWMutex
 
 	getUsername func() string
+	webhook     *webhook.Notifier
+
+	pool   map[string]*pooledConn // idle sender connections by peer address
+	poolMu sync.Mutex
+
+	receiving  chan struct{}   // semaphore bounding concurrent receives
+	listenAddr net.Addr        // where the transfer listener is bound, guarded by mu
+	deviceName string          // recorded in history, guarded by mu
+	serverTLS  *tls.Config     // nil unless a certificate is configured
+	scanner    *clamav.Scanner // nil unless ClamdAddress is set
+	// openFile opens the ".incomplete" file a receive writes to;
+	// os.OpenFile except in tests that make writes fail.
+	openFile func(name string, flag int, perm os.FileMode) (*os.File, error)
+
+	historyMu sync.Mutex     // guards the history buffer file
+	history   *historyWriter // queue of history records to store
+
+	callbacks callbacks    // registered by embedders; see OnProgress
+	bandwidth bandwidth    // traffic counters for Bandwidth
+	limiter   sendLimiter  // shares MaxSendRate among sends by priority
+	hashes    hashIndex    // content hashes of received files, for DuplicateFiles
+	quota     quotaTracker // disk used per user, for UserQuotaBytes and Usage
 }
 
 func NewService(
 	cfg config.Config,
 	deviceID string,
-	store *storage.Store,
+	store Store,
 	disc *discovery.Service,
 	broadcast func(string, interface{}),
 	getUsername func() string,
 ) *Service {
-	return &Service{
+	s := &Service{
 		config:      cfg,
 		deviceID:    deviceID,
 		store:       store,
@@ -50,12 +115,58 @@ func NewService(
 		broadcast:   broadcast,
 		transfers:   make(map[string]*models.Transfer),
 		pending:     make(map[string]*models.PendingTransfer),
+		confirms:    make(map[string]chan bool),
+		recorded:    make(map[string]bool),
+		resumes:     make(map[string]*resumeRecord),
+		streams:     make(map[string]io.Closer),
+		aborted:     make(map[string]bool),
 		getUsername: getUsername,
+		webhook:     webhook.New(cfg.WebhookURL, cfg.WebhookSecret),
+		pool:        make(map[string]*pooledConn),
+		receiving:   make(chan struct{}, orDefault(cfg.MaxIncoming, defaultMaxIncoming)),
+		serverTLS:   loadServerTLS(cfg),
+		scanner:     clamav.New(cfg.ClamdAddress),
+		openFile:    os.OpenFile,
+		bandwidth:   bandwidth{since: time.Now()},
+		deviceName:  cfg.DeviceName,
+	}
+	if store != nil {
+		s.history = newHistoryWriter()
+		go s.runHistoryWriter()
+	}
+	return s
+}
+
+// SetDeviceName changes the device name recorded with later history.
+func (s *Service) SetDeviceName(name string) {
+	s.mu.Lock()
+	s.deviceName = name
+	s.mu.Unlock()
+}
+
+const (
+	defaultMaxIncoming      = 4
+	defaultMaxPendingOffers = 16
+)
+
+func orDefault[T int | time.Duration](v, def T) T {
+	if v > 0 {
+		return v
 	}
+	return def
 }
 
 func (s *Service) Start() {
+	s.replayHistoryBuffer()
+	s.loadResumeState()
+	s.loadUsage()
 	go s.listenTCP()
+	if s.config.FileRetention > 0 || s.config.MaxDownloadBytes > 0 {
+		go s.runRetention()
+	}
+	if s.config.ProgressBatchInterval > 0 {
+		go s.runSnapshots()
+	}
 }
 
 // ----- TCP Listener (Receiver Side) -----
@@ -66,7 +177,15 @@ func (s *Service) listenTCP() {
 		log.Fatal("Transfer listen:", err)
 	}
 	defer ln.Close()
-	log.Printf("Transfer listener on :%d", s.config.TransferPort)
+	s.mu.Lock()
+	s.listenAddr = ln.Addr()
+	s.mu.Unlock()
+	ln = s.wrapListener(ln)
+	if s.serverTLS != nil {
+		log.Printf("Transfer listener on :%d (TLS)", s.config.TransferPort)
+	} else {
+		log.Printf("Transfer listener on :%d", s.config.TransferPort)
+	}
 
 	for {
 		conn, err := ln.Accept()
@@ -78,29 +197,214 @@ func (s *Service) listenTCP() {
 	}
 }
 
+// ListenAddr returns the address the transfer listener is bound to, or nil
+// before it is up.
+func (s *Service) ListenAddr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listenAddr
+}
+
+// protocolVersion is bumped whenever the wire format changes incompatibly.
+// Version 1 is JSON-line metadata, a JSON-line response and a length-prefixed
+// payload. Version 2 sends the metadata and response as headers: a 4-byte
+// big-endian length, then that much JSON. Receivers still accept version 1
+// from peers that don't advertise CapHeader.
+const (
+	protocolVersion       = 2
+	legacyProtocolVersion = 1
+)
+
+// maxHeaderSize bounds a length-prefixed header.
+const maxHeaderSize = 64 << 10
+
 type wireMetadata struct {
+	Version    int    `json:"version"`
 	ID         string `json:"id"`
 	FileName   string `json:"fileName"`
 	FileSize   int64  `json:"fileSize"`
 	SenderID   string `json:"senderId"`
 	SenderName string `json:"senderName"`
+	// KeepAlive asks the receiver to keep the connection open for the
+	// sender's next transfer instead of closing after this one.
+	KeepAlive bool `json:"keepAlive,omitempty"`
+	// Compressed means the framed payload is a gzip stream; the frame
+	// length is still the uncompressed size.
+	Compressed bool `json:"compressed,omitempty"`
+	// Resume marks a retry of an earlier transfer with the same ID; the
+	// receiver may answer with an offset to continue from.
+	Resume bool `json:"resume,omitempty"`
+	// Kind is KindFile (or empty) or KindText; small text payloads are kept
+	// in memory and shown to the user instead of being saved.
+	Kind string `json:"kind,omitempty"`
+	// Reliable means the framed payload is sent as acknowledged chunk
+	// records; see reliable.go. Never combined with Compressed.
+	Reliable bool `json:"reliable,omitempty"`
+	// ContentType is the MIME type the sender detected, so the receiver
+	// doesn't have to sniff the file again.
+	ContentType string `json:"contentType,omitempty"`
+
+	header       bool   // arrived as a length-prefixed header; answer the same way
+	originalName string // FileName as the sender gave it, if sanitizing changed it
 }
 
 type wireResponse struct {
-	Accept bool `json:"accept"`
+	Accept bool   `json:"accept"`
+	Reason string `json:"reason,omitempty"` // why the offer was refused, if not by the user
+	Offset int64  `json:"offset,omitempty"` // bytes the receiver already has (resume only)
 }
 
-func (s *Service) handleIncoming(conn net.Conn) {
-	defer func() {
-		// conn closed after accept/reject decision was acted on
-	}()
+// writeHeader writes v as JSON preceded by its 4-byte big-endian length.
+func writeHeader(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readHeader reads one header written by writeHeader into v, consuming
+// exactly its bytes so whatever follows is left for the caller.
+func readHeader(r io.Reader, v interface{}) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if n > maxHeaderSize {
+		return fmt.Errorf("header of %d bytes exceeds %d", n, maxHeaderSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
 
-	reader := bufio.NewReader(conn)
-	decoder := json.NewDecoder(reader)
+// readMetadata reads an offer in either framing: a version 1 JSON line
+// starts with '{', anything else is a length-prefixed header.
+func readMetadata(r *bufio.Reader) (wireMetadata, error) {
 	var meta wireMetadata
-	if err := decoder.Decode(&meta); err != nil {
-		conn.Close()
-		return
+	first, err := r.Peek(1)
+	if err != nil {
+		return meta, err
+	}
+	if first[0] != '{' {
+		meta.header = true
+		err := readHeader(r, &meta)
+		return meta, err
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(line, &meta)
+}
+
+// respond answers an offer in the framing it arrived in.
+func respond(conn net.Conn, meta wireMetadata, resp wireResponse) error {
+	if meta.header {
+		return writeHeader(conn, resp)
+	}
+	return json.NewEncoder(conn).Encode(resp)
+}
+
+// isTimeout reports whether err is a deadline expiring.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// countingReader tallies the bytes read through it. It implements
+// io.ByteReader so gzip.NewReader doesn't buffer past the end of its stream.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// countingWriter tallies the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// metadataTimeout bounds how long a new connection may take to send its
+// first offer, so connections that never send one don't pile up. A variable
+// so tests can shorten it.
+var metadataTimeout = 30 * time.Second
+
+func (s *Service) handleIncoming(conn net.Conn) {
+	defer conn.Close()
+	s.tuneConn(conn)
+
+	// Metadata reading stops exactly at the payload, so the same reader can
+	// carry several transfers on a kept-alive connection.
+	reader := bufio.NewReaderSize(conn, s.readerSize())
+	conn.SetReadDeadline(time.Now().Add(metadataTimeout))
+	for {
+		meta, err := readMetadata(reader)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if !s.serveTransfer(conn, reader, meta) || !meta.KeepAlive {
+			return
+		}
+		// Persistent connection: wait for the sender's next transfer, but
+		// not forever. Senders drop idle pooled connections sooner than this.
+		conn.SetReadDeadline(time.Now().Add(2 * s.idleTimeout()))
+	}
+}
+
+// serveTransfer runs one offer on conn: it waits for the user's decision,
+// answers the sender and receives the file if accepted. It reports whether
+// the connection is still in a clean state for another transfer.
+func (s *Service) serveTransfer(conn net.Conn, reader *bufio.Reader, meta wireMetadata) bool {
+	if meta.Version != protocolVersion && meta.Version != legacyProtocolVersion {
+		// The payload can't be parsed, so the connection can't be reused either
+		s.refuse(conn, meta, fmt.Sprintf("unsupported protocol version %d (receiver speaks %d)", meta.Version, protocolVersion))
+		return false
+	}
+	name, err := sanitizeFileName(meta.FileName)
+	if err != nil {
+		return s.refuse(conn, meta, fmt.Sprintf("invalid file name: %v", err))
+	}
+	if name != meta.FileName {
+		meta.originalName = meta.FileName
+	}
+	meta.FileName = name
+	if ext, ok := blockedExtension(name, s.config.BlockedExtensions); ok {
+		return s.refuse(conn, meta, fmt.Sprintf("%s files are not accepted", ext))
+	}
+	if !inMemory(meta) && !s.canSave(meta, "") {
+		return s.refuse(conn, meta, storageUnavailable)
+	}
+	if _, offset := s.resumePoint(meta); !inMemory(meta) && !s.fitsQuota(s.quotaDir(""), meta.FileSize-offset) {
+		return s.refuse(conn, meta, quotaExceeded)
 	}
 
 	// Store pending transfer (conn stays open so we can write ACK later)
@@ -111,80 +415,291 @@ func (s *Service) handleIncoming(conn net.Conn) {
 		SenderID:   meta.SenderID,
 		SenderName: meta.SenderName,
 		Response:   make(chan bool, 1),
+
+		ContentType: meta.ContentType,
 	}
 
 	s.mu.Lock()
 	if _, ok := s.pending[meta.ID]; ok {
 		s.mu.Unlock()
-		conn.Close()
-		return
+		return false
+	}
+	if len(s.pending) >= orDefault(s.config.MaxPendingOffers, defaultMaxPendingOffers) {
+		s.mu.Unlock()
+		return s.refuse(conn, meta, "too many pending offers")
 	}
 	s.pending[meta.ID] = pt
 	s.mu.Unlock()
 
-	// Notify UI of incoming request
-	s.broadcast("incoming_request", pt)
+	if s.autoAccepts(meta) {
+		log.Printf("[TRANSFER %s] Auto-accepting %s (%d bytes) from trusted %s", meta.ID, meta.FileName, meta.FileSize, meta.SenderName)
+		pt.Response <- true
+	} else {
+		// Notify UI of incoming request
+		log.Printf("[TRANSFER %s] Offer from %s: %s (%d bytes)", meta.ID, meta.SenderName, meta.FileName, meta.FileSize)
+		s.broadcast(models.EventIncomingRequest, pt)
+		s.notifyIncoming(pt)
+	}
 
-	// Wait for UI decision (timeout 2 minutes)
+	// Wait for the UI decision, the timeout or the sender hanging up
 	var accepted bool
+	var expired string
+	hangup, stopWatch := watchHangup(conn, reader)
 	select {
 	case accepted = <-pt.Response:
-	case <-time.After(2 * time.Minute):
-		accepted = false
+	case <-time.After(pendingOfferTimeout):
+		expired = "timeout"
+	case <-hangup:
+		expired = "disconnected"
+	}
+	stopWatch()
+	lateAccept := false
+	select {
+	case <-hangup:
+		if accepted {
+			// The sender gave up, likely timing out, as the accept came in
+			accepted, expired, lateAccept = false, "disconnected", true
+		}
+	default:
 	}
 
-	// Send response back to sender
+	// Only a bounded number of files stream in at once
 	resp := wireResponse{Accept: accepted}
-	json.NewEncoder(conn).Encode(resp)
+	if accepted {
+		select {
+		case s.receiving <- struct{}{}:
+			defer func() { <-s.receiving }()
+		default:
+			log.Printf("[TRANSFER %s] %d receives already running, rejecting", meta.ID, cap(s.receiving))
+			resp = wireResponse{Reason: "too many concurrent transfers"}
+		}
+	}
+
+	// The directory may have gone away while the user decided
+	if resp.Accept && !inMemory(meta) && !s.canSave(meta, pt.DestDir) {
+		resp = wireResponse{Reason: storageUnavailable}
+	}
+	if resp.Accept {
+		_, resp.Offset = s.resumePoint(meta)
+	}
+	// Other receives may have used the room since the offer came in
+	if resp.Accept && !inMemory(meta) {
+		release, ok := s.reserveQuota(s.quotaDir(pt.DestDir), meta.FileSize-resp.Offset)
+		if ok {
+			defer release()
+		} else {
+			resp = wireResponse{Reason: quotaExceeded}
+		}
+	}
+
+	// Send response back to sender
+	respond(conn, meta, resp)
 
 	s.mu.Lock()
 	delete(s.pending, meta.ID)
 	s.mu.Unlock()
 
-	if !accepted {
-		conn.Close()
-		s.broadcast("transfer_rejected", map[string]string{"id": meta.ID, "fileName": meta.FileName})
-		return
+	if expired != "" {
+		log.Printf("[TRANSFER %s] Offer expired: %s", meta.ID, expired)
+		s.broadcast(models.EventRequestExpired, map[string]string{"id": meta.ID, "fileName": meta.FileName, "reason": expired})
+		if lateAccept {
+			s.expireAccepted(meta)
+		}
+		return expired == "timeout"
+	}
+	if !resp.Accept {
+		log.Printf("[TRANSFER %s] Rejected", meta.ID)
+		ev := map[string]string{"id": meta.ID, "fileName": meta.FileName}
+		if resp.Reason != "" {
+			ev["reason"] = resp.Reason
+		}
+		s.broadcast(models.EventTransferRejected, ev)
+		return true
 	}
 
 	// Accept → receive file
-	// Use MultiReader to include any data that json.NewDecoder might have already read into its internal buffer
-	combinedReader := io.MultiReader(decoder.Buffered(), reader)
-	s.receiveFile(conn, combinedReader, meta)
+	if inMemory(meta) {
+		return s.receiveText(conn, reader, meta) == nil
+	}
+	return s.receiveFile(conn, reader, meta, pt.DestDir) == nil
 }
 
-func (s *Service) receiveFile(conn net.Conn, reader io.Reader, meta wireMetadata) {
-	defer conn.Close()
+// senderGoneError explains an accepted transfer that expired.
+const senderGoneError = "the sender gave up waiting before the transfer was accepted"
 
-	// Skip any leading whitespace (like the newline added by json.NewEncoder.Encode)
-	// by using a bufio.Reader to peek and skip.
-	skipReader := bufio.NewReader(reader)
-	for {
-		b, err := skipReader.Peek(1)
-		if err != nil {
-			break
+// expireAccepted records an offer accepted after its sender hung up as
+// "expired", so the receiver's history doesn't show a failed receive.
+func (s *Service) expireAccepted(meta wireMetadata) {
+	t := &models.Transfer{
+		ID:        meta.ID,
+		FileName:  meta.FileName,
+		FileSize:  meta.FileSize,
+		Direction: "receive",
+		PeerID:    meta.SenderID,
+		PeerName:  meta.SenderName,
+		StartTime: time.Now(),
+		Error:     senderGoneError,
+
+		OriginalName:     meta.originalName,
+		ContentType:      meta.ContentType,
+		CompressionRatio: 1.0,
+	}
+	s.mu.Lock()
+	s.transfers[t.ID] = t
+	s.mu.Unlock()
+	s.finish(s.getUsername(), t, "expired")
+}
+
+// pendingOfferTimeout is how long an incoming offer waits for the user's
+// answer. A variable so tests can shorten it.
+var pendingOfferTimeout = 2 * time.Minute
+
+// watchHangup closes hangup if the sender drops the connection while its
+// offer is pending. The sender writes nothing until answered, so a read
+// that returns is either the hangup or the start of the next frame, which
+// Peek leaves in reader. stop ends the watch; call it before using reader.
+func watchHangup(conn net.Conn, reader *bufio.Reader) (hangup <-chan struct{}, stop func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := reader.Peek(1); err != nil && !isTimeout(err) {
+			close(gone)
 		}
-		if b[0] == '\n' || b[0] == '\r' || b[0] == ' ' {
-			skipReader.ReadByte()
-		} else {
-			break
+	}()
+	return gone, func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// autoAccepts reports whether the device owner trusts the sender of meta
+// enough to skip the prompt for a file this size.
+func (s *Service) autoAccepts(meta wireMetadata) bool {
+	if s.store == nil {
+		return false
+	}
+	trusted, err := s.store.ListTrustedDevices(s.getUsername())
+	if err != nil {
+		log.Printf("[TRANSFER %s] Cannot load trusted devices: %v", meta.ID, err)
+		return false
+	}
+	for _, d := range trusted {
+		if d.TrustLevel != models.TrustAutoAccept {
+			continue
 		}
+		if d.DeviceID != meta.SenderID && (d.Username == "" || !strings.EqualFold(d.Username, meta.SenderName)) {
+			continue
+		}
+		if d.AutoAcceptMaxBytes > 0 && meta.FileSize > d.AutoAcceptMaxBytes {
+			log.Printf("[TRANSFER %s] %d bytes is over the %d byte auto-accept limit for %s; asking", meta.ID, meta.FileSize, d.AutoAcceptMaxBytes, d.DeviceID)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// storageUnavailable is the reason given for offers refused because the
+// file couldn't be saved.
+const storageUnavailable = "receiver storage unavailable"
+
+// canSave reports whether a file offered in meta could be saved in destDir,
+// or the user's download directory if it is empty.
+func (s *Service) canSave(meta wireMetadata, destDir string) bool {
+	if destDir == "" {
+		destDir = s.config.UserDownloadDir(s.getUsername())
+	}
+	if err := config.CheckWritable(destDir); err != nil {
+		log.Printf("[TRANSFER %s] Cannot save into %s: %v", meta.ID, destDir, err)
+		return false
+	}
+	return true
+}
+
+// refuse declines an offer without asking the user, telling the sender why.
+// It reports whether the response was delivered.
+func (s *Service) refuse(conn net.Conn, meta wireMetadata, reason string) bool {
+	log.Printf("[TRANSFER %s] Refusing %q: %s", meta.ID, meta.FileName, reason)
+	return respond(conn, meta, wireResponse{Reason: reason}) == nil
+}
+
+// receiveFile reads one framed payload from reader into destDir, or the
+// user's download directory if it is empty. It does not close conn; the
+// caller owns the connection.
+func (s *Service) receiveFile(conn net.Conn, reader io.Reader, meta wireMetadata, destDir string) error {
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(reader, s.readerSize())
 	}
 
-	savePath := filepath.Join(s.config.DownloadDir, meta.FileName)
-	// Avoid overwriting: append a counter if file exists
-	if _, err := os.Stat(savePath); err == nil {
-		ext := filepath.Ext(meta.FileName)
-		base := meta.FileName[:len(meta.FileName)-len(ext)]
-		savePath = filepath.Join(s.config.DownloadDir, fmt.Sprintf("%s_%d%s", base, time.Now().UnixMilli(), ext))
+	// Never trust the sender's name to stay inside the download directory
+	name, err := sanitizeFileName(meta.FileName)
+	if err != nil {
+		return err
 	}
+	if name != meta.FileName && meta.originalName == "" {
+		meta.originalName = meta.FileName
+	}
+	meta.FileName = name
 
-	file, err := os.Create(savePath)
+	// Files land in the receiving user's own directory
+	userEmail := s.getUsername()
+	defer s.quota.changed(s.quotaDir(destDir))
+	saveDir := destDir
+	if saveDir == "" {
+		saveDir = s.config.UserDownloadDir(userEmail)
+	}
+	if err := os.MkdirAll(saveDir, 0755); err != nil {
+		log.Println("Create download dir error:", err)
+		return err
+	}
+
+	// Data is written to workPath, "<name>.incomplete" beside the final file,
+	// and only renamed into place once complete, so nothing ever sees a
+	// half-written file under the real name. A resumed receive continues the
+	// partial file it left.
+	rec, offset := s.resumePoint(meta)
+	var savePath, workPath string
+	if rec != nil {
+		workPath = rec.Path
+		savePath = strings.TrimSuffix(rec.Path, ".incomplete")
+	} else {
+		savePath = filepath.Join(saveDir, expandFileName(s.config.FilenameTemplate, meta, time.Now()))
+		if exists(savePath) || exists(savePath+".incomplete") {
+			savePath = uniquePath(savePath)
+		}
+		workPath = savePath + ".incomplete"
+	}
+
+	var file *os.File
+	if rec != nil {
+		file, err = s.openFile(workPath, os.O_WRONLY, 0)
+		if err == nil {
+			err = file.Truncate(offset)
+		}
+		if err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		log.Printf("[TRANSFER %s] Resuming %s at %d of %d bytes", meta.ID, meta.FileName, offset, meta.FileSize)
+		// The earlier attempt's terminal entry is superseded by this one
+		s.mu.Lock()
+		delete(s.recorded, meta.ID)
+		s.mu.Unlock()
+	} else {
+		file, err = s.openFile(workPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		rec = &resumeRecord{ID: meta.ID, FileName: meta.FileName, FileSize: meta.FileSize, SenderName: meta.SenderName, Path: workPath}
+	}
 	if err != nil {
 		log.Println("Create file error:", err)
-		return
+		if file != nil {
+			file.Close()
+		}
+		return err
 	}
 	defer file.Close()
+	s.saveResume(rec)
 
 	t := &models.Transfer{
 		ID:        meta.ID,
@@ -195,103 +710,370 @@ func (s *Service) receiveFile(conn net.Conn, reader io.Reader, meta wireMetadata
 		PeerName:  meta.SenderName,
 		Status:    "receiving",
 		StartTime: time.Now(),
+
+		OriginalName:     meta.originalName,
+		ContentType:      meta.ContentType,
+		Transferred:      offset,
+		CompressionRatio: 1.0,
 	}
 	s.mu.Lock()
 	s.transfers[t.ID] = t
 	s.mu.Unlock()
-	s.broadcast("transfer_update", t)
+	s.broadcast(models.EventTransferStarted, t)
+	if conn != nil {
+		defer s.abortable(t.ID, conn)()
+	}
+
+	// The payload is framed: an 8-byte big-endian length, then exactly that
+	// many bytes. Running out early means the connection dropped.
+	var frameLen uint64
+	headerErr := binary.Read(br, binary.BigEndian, &frameLen)
+	wire := &countingReader{r: br}
+	var payload io.Reader = wire
+	// trailer, if set, has to be read to its end after the payload: the
+	// gzip footer or the reliable-mode end record
+	var trailer io.Reader
+	if headerErr == nil && meta.Compressed {
+		var zr *gzip.Reader
+		if zr, headerErr = gzip.NewReader(wire); headerErr == nil {
+			// Stop at the end of this stream; the connection may carry more
+			zr.Multistream(false)
+			payload, trailer = zr, zr
+		}
+	} else if headerErr == nil && meta.Reliable {
+		var ack io.Writer = io.Discard
+		if conn != nil {
+			ack = conn
+		}
+		cr := &chunkReader{r: wire, ack: ack}
+		payload, trailer = cr, cr
+	}
+	body := io.LimitReader(payload, int64(frameLen))
+
+	scan := s.startScan(workPath, offset)
+	if scan != nil {
+		defer scan.Close()
+	}
+	var hasher hash.Hash
+	if s.config.DuplicateFiles != "" {
+		hasher = sha256.New()
+		if offset > 0 {
+			if err := hashPrefix(hasher, workPath, offset); err != nil {
+				log.Printf("[DEDUP %s] Cannot hash resumed %s, not checking it: %v", meta.ID, workPath, err)
+				hasher = nil
+			}
+		}
+	}
 
 	buf := make([]byte, s.config.ChunkSize)
 	lastUpdate := time.Now()
+	meter := newRateMeter(lastUpdate)
+
+	// conn is nil when the payload comes from somewhere other than a socket
+	stallTimeout := orDefault(s.config.StallTimeout, defaultStallTimeout)
+	if conn != nil {
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// A clean close before the frame header: the sender left before our
+	// accept reached it, so nothing was lost and nothing failed
+	if headerErr == io.EOF {
+		log.Printf("[TRANSFER %s] Sender hung up before sending %s", t.ID, meta.FileName)
+		file.Close()
+		if offset > 0 {
+			s.keepPartial(rec)
+		} else {
+			os.Remove(workPath)
+			s.dropResume(t.ID)
+		}
+		s.setError(t, senderGoneError)
+		s.finish(userEmail, t, "expired")
+		return ErrSenderGone
+	}
 
 	for {
-		n, err := skipReader.Read(buf)
+		var n int
+		err := headerErr
+		if err == nil {
+			if conn != nil {
+				conn.SetReadDeadline(time.Now().Add(stallTimeout))
+			}
+			n, err = body.Read(buf)
+		}
+		if n > 0 {
+			if _, werr := file.Write(buf[:n]); werr != nil {
+				// A full disk must not pass for the end of the file
+				err = fmt.Errorf("cannot write %s: %w", meta.FileName, werr)
+				n = 0
+			}
+		}
 		if n > 0 {
-			file.Write(buf[:n])
-			t.Transferred += int64(n)
-			if t.FileSize > 0 {
-				t.Progress = float64(t.Transferred) / float64(t.FileSize) * 100
+			if scan != nil {
+				scan.Write(buf[:n])
+			}
+			if hasher != nil {
+				hasher.Write(buf[:n])
 			}
+			s.addProgress(t, n)
+			s.countBytes(t, n)
 			if time.Since(lastUpdate) > time.Second {
-				elapsed := time.Since(t.StartTime).Seconds()
-				if elapsed > 0 {
-					t.Speed = float64(t.Transferred) / 1024 / 1024 / elapsed
-				}
-				s.broadcast("transfer_update", t)
+				s.updateSpeed(t, meter)
+				s.progress(t)
 				lastUpdate = time.Now()
 			}
 		}
 		if err == io.EOF {
-			break
+			if uint64(t.Transferred-offset) != frameLen {
+				err = io.ErrUnexpectedEOF
+			} else if trailer == nil {
+				break
+			} else if _, err = io.Copy(io.Discard, trailer); err == nil {
+				// Consumed the trailer; gzip's also verifies the checksum
+				break
+			}
+		}
+		if isTimeout(err) {
+			s.setStatus(t, "stalled")
+			s.broadcast(models.EventTransferUpdate, t)
+			err = fmt.Errorf("%w: no data from sender for %s", ErrStalled, stallTimeout)
 		}
 		if err != nil {
-			log.Println("Receive error:", err)
-			t.Status = "failed"
-			s.broadcast("transfer_update", t)
-			if s.store != nil {
-				userEmail := s.getUsername()
-				s.store.AddHistory(userEmail, &models.TransferHistory{
-					ID:        t.ID,
-					FileName:  t.FileName,
-					FileSize:  t.FileSize,
-					Direction: "receive",
-					PeerName:  t.PeerName,
-					Status:    "failed",
-					Timestamp: time.Now(),
-				})
+			log.Printf("[TRANSFER %s] Receive error after %d/%d bytes: %v", t.ID, t.Transferred, t.FileSize, err)
+			file.Close()
+			s.keepPartial(rec)
+			s.setError(t, err.Error())
+			s.finish(userEmail, t, "failed")
+			return err
+		}
+	}
+
+	// A clean EOF only means the sender stopped; make sure it sent everything
+	if meta.FileSize > 0 && t.Transferred != meta.FileSize {
+		log.Printf("[TRANSFER %s] Receive size mismatch for %s: got %d of %d bytes", t.ID, meta.FileName, t.Transferred, meta.FileSize)
+		file.Close()
+		s.keepPartial(rec)
+		err := fmt.Errorf("size mismatch: received %d of %d bytes", t.Transferred, meta.FileSize)
+		s.setError(t, err.Error())
+		s.finish(userEmail, t, "failed")
+		return err
+	}
+
+	err = file.Sync()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("[TRANSFER %s] Cannot save %s: %v", t.ID, meta.FileName, err)
+		s.keepPartial(rec)
+		err = fmt.Errorf("cannot save %s: %w", meta.FileName, err)
+		s.setError(t, err.Error())
+		s.finish(userEmail, t, "failed")
+		return err
+	}
+	if scan != nil {
+		if err := s.checkScan(t.ID, scan, workPath, savePath); err != nil {
+			s.dropResume(t.ID)
+			s.setError(t, err.Error())
+			s.finish(userEmail, t, "failed")
+			return err
+		}
+	}
+	var sum string
+	if hasher != nil {
+		sum = hex.EncodeToString(hasher.Sum(nil))
+		if dup := s.findDuplicate(filepath.Dir(savePath), sum, t.Transferred); dup != "" {
+			s.mu.Lock()
+			t.DuplicateOf = filepath.Base(dup)
+			s.mu.Unlock()
+			if s.config.DuplicateFiles == DuplicateSkip {
+				log.Printf("[TRANSFER %s] %s has the same content as %s; not keeping a copy", t.ID, meta.FileName, dup)
+				os.Remove(workPath)
+				s.dropResume(t.ID)
+				s.mu.Lock()
+				t.FilePath = dup
+				s.mu.Unlock()
+				s.setWireStats(t, wire.n)
+				s.finish(userEmail, t, "completed")
+				return nil
 			}
-			return
+			log.Printf("[TRANSFER %s] %s has the same content as %s", t.ID, meta.FileName, dup)
+		}
+	}
+	if workPath != savePath {
+		// Avoid overwriting anything that appeared under the name meanwhile
+		if exists(savePath) {
+			savePath = uniquePath(savePath)
+		}
+		if err := os.Rename(workPath, savePath); err != nil {
+			log.Printf("[TRANSFER %s] Cannot move file into place: %v", t.ID, err)
+			s.keepPartial(rec)
+			s.setError(t, err.Error())
+			s.finish(userEmail, t, "failed")
+			return err
+		}
+	}
+	s.dropResume(t.ID)
+	if meta.originalName != "" {
+		if err := writeSidecar(savePath, meta); err != nil {
+			log.Printf("[TRANSFER %s] Cannot record original name of %s: %v", t.ID, meta.FileName, err)
+		}
+	}
+	if sum != "" {
+		if info, err := os.Stat(savePath); err == nil {
+			s.hashes.add(savePath, info, sum)
 		}
 	}
 
-	t.Status = "completed"
-	t.Progress = 100
-	s.broadcast("transfer_update", t)
+	s.mu.Lock()
+	t.FilePath = savePath
+	s.mu.Unlock()
+	s.setWireStats(t, wire.n)
+	s.finish(userEmail, t, "completed")
 
-	if s.store != nil {
-		userEmail := s.getUsername()
-		s.store.AddHistory(userEmail, &models.TransferHistory{
-			ID:        t.ID,
-			FileName:  t.FileName,
-			FileSize:  t.FileSize,
-			Direction: "receive",
-			PeerName:  t.PeerName,
-			Status:    "completed",
-			Timestamp: time.Now(),
-		})
+	log.Printf("[TRANSFER %s] Received file: %s from %s → %s", t.ID, meta.FileName, meta.SenderName, savePath)
+	if s.config.OnReceiveCommand != "" {
+		go s.runReceiveHook(t.ID, savePath, meta.SenderName)
 	}
+	return nil
+}
+
+// keepPartial handles a failed receive: the ".incomplete" file and its record
+// are kept so the sender can resume, unless DeletePartialFiles is set.
+func (s *Service) keepPartial(rec *resumeRecord) {
+	if s.config.DeletePartialFiles {
+		if err := os.Remove(rec.Path); err != nil {
+			log.Println("Remove partial file error:", err)
+		}
+		s.dropResume(rec.ID)
+		return
+	}
+	s.saveResume(rec)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
 
-	log.Printf("Received file: %s from %s → %s", meta.FileName, meta.SenderName, savePath)
+// uniquePath returns path with a millisecond timestamp added before the
+// extension, for when the original name is taken.
+func uniquePath(path string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), time.Now().UnixMilli(), ext)
 }
 
 // ----- Sender Side -----
 
+// SendOptions are per-transfer settings for SendStreamWithOptions.
+type SendOptions struct {
+	Priority int // higher is more urgent; 0 is normal
+	// RequireConfirm pauses after the receiver accepts until the sender
+	// calls ConfirmTransfer. Config.RequireSenderConfirm turns it on for all.
+	RequireConfirm bool
+	// SenderEmail is the user sending; it names the sender to the peer and
+	// owns the history entry. Defaults to the device owner.
+	SenderEmail string
+	// Kind is KindFile (the default) or KindText for a short message.
+	Kind string
+	// ResumeID retries an earlier transfer with that ID. The receiver may
+	// ask to skip the bytes it already has, so dataReader must still start
+	// at the beginning of the file.
+	ResumeID string
+	// IdempotencyKey makes the transfer ID deterministic: a retry with the
+	// same key returns the completed transfer instead of sending it again.
+	IdempotencyKey string
+}
+
+// offerResponseTimeout bounds how long a sender waits for the receiver to
+// accept or reject. A variable so tests can shorten it.
+var offerResponseTimeout = 2 * time.Minute
+
+// senderConfirmTimeout is how long an accepted transfer waits for the
+// sender's confirmation before it is cancelled.
+const senderConfirmTimeout = 2 * time.Minute
+
 // SendStream connects to a peer and streams data from a reader.
 func (s *Service) SendStream(peerID string, dataReader io.Reader, fileName string, fileSize int64) error {
+	return s.SendStreamWithOptions(peerID, dataReader, fileName, fileSize, SendOptions{})
+}
+
+// SendStreamWithOptions is SendStream with per-transfer options.
+func (s *Service) SendStreamWithOptions(peerID string, dataReader io.Reader, fileName string, fileSize int64, opts SendOptions) error {
+	if peerID == s.deviceID {
+		return ErrSelfTransfer
+	}
+	// The receiver would refuse it anyway; fail before dialing
+	if _, err := sanitizeFileName(fileName); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadFileName, err)
+	}
 	peer, ok := s.discovery.GetDevice(peerID)
 	if !ok {
-		return fmt.Errorf("peer not found: %s", peerID)
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, peerID)
+	}
+
+	if opts.ResumeID != "" {
+		if err := s.checkResumable(opts.ResumeID, opts.SenderEmail); err != nil {
+			return err
+		}
+	}
+	transferID := opts.ResumeID
+	if opts.IdempotencyKey != "" && transferID == "" {
+		transferID = idempotentID(s.deviceID, opts.SenderEmail, peerID, opts.IdempotencyKey)
+		if done, err := s.checkIdempotent(transferID); done || err != nil {
+			return err
+		}
+	}
+	if transferID == "" {
+		transferID = uuid.New().String()
+	} else {
+		s.mu.Lock()
+		delete(s.recorded, transferID)
+		s.mu.Unlock()
 	}
+	senderName := opts.SenderEmail
+	if senderName == "" {
+		senderName = s.getUsername()
+	}
+
+	// Only ask to keep the connection if the receiver knows how
+	keepAlive := s.config.ReuseConnections && peer.Supports(models.CapKeepAlive)
 
-	transferID := uuid.New().String()
-	senderName := s.getUsername()
+	src := bufio.NewReaderSize(dataReader, entropySample)
+	reliable := s.config.ReliableTransfers && opts.Kind != KindText && peer.Supports(models.CapReliable)
+	compress := !reliable && s.config.Compress && opts.Kind != KindText && peer.Supports(models.CapGzip) && s.shouldCompress(fileName, src)
+	var contentType string
+	if opts.Kind != KindText {
+		contentType = detectContentType(fileName, src)
+	}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+	addr := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+	conn, reused, err := s.acquireConn(peer, addr)
 	if err != nil {
 		return fmt.Errorf("dial peer: %w", err)
 	}
-	defer conn.Close()
+	// clean is set once the connection is known to be in sync with the
+	// receiver, which lets a pooled connection be reused.
+	clean := false
+	defer func() { s.releaseConn(addr, conn, clean && keepAlive) }()
 
-	// Send metadata
 	meta := wireMetadata{
+		Version:    legacyProtocolVersion,
 		ID:         transferID,
 		FileName:   fileName,
 		FileSize:   fileSize,
 		SenderID:   s.deviceID,
 		SenderName: senderName,
+		KeepAlive:  keepAlive,
+		Compressed: compress,
+		Reliable:   reliable,
+		Resume:     opts.ResumeID != "",
+		Kind:       opts.Kind,
+
+		ContentType: contentType,
 	}
-	if err := json.NewEncoder(conn).Encode(meta); err != nil {
-		return fmt.Errorf("send metadata: %w", err)
+	if peer.Supports(models.CapHeader) {
+		meta.Version = protocolVersion
+		meta.header = true
 	}
 
 	t := &models.Transfer{
@@ -303,111 +1085,285 @@ func (s *Service) SendStream(peerID string, dataReader io.Reader, fileName strin
 		PeerName:  peer.Username,
 		Status:    "waiting_acceptance",
 		StartTime: time.Now(),
+		Priority:  opts.Priority,
+
+		SenderEmail:      opts.SenderEmail,
+		ContentType:      contentType,
+		CompressionRatio: 1.0,
 	}
 	s.mu.Lock()
+	// Two requests with the same key or resume ID may both have passed
+	// their check
+	if prev, ok := s.transfers[transferID]; ok && (opts.IdempotencyKey != "" || opts.ResumeID != "") && !terminal(prev.Status) {
+		s.mu.Unlock()
+		clean = true
+		return fmt.Errorf("%w: %s", ErrInProgress, transferID)
+	}
 	s.transfers[transferID] = t
 	s.mu.Unlock()
-	s.broadcast("transfer_update", t)
+	s.broadcast(models.EventTransferStarted, t)
+	log.Printf("[TRANSFER %s] Offering %s (%d bytes) to %s at %s", transferID, fileName, fileSize, peer.Username, addr)
 
-	// Wait for receiver's accept/reject response
-	conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-	var resp wireResponse
-	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
-		t.Status = "failed"
-		t.EndTime = time.Now().UnixMilli()
-		s.broadcast("transfer_update", t)
-		return fmt.Errorf("reading response: %w", err)
+	stopAbort := s.abortable(transferID, conn)
+	defer func() { stopAbort() }()
+
+	// A parked connection may have been closed by the peer while idle; the
+	// offer then never arrived, so it's safe to retry once on a fresh one.
+	resp, err := s.offer(conn, meta)
+	if err != nil && reused && isStaleConnErr(err) {
+		conn.Close()
+		// conn stays the closed one unless the redial works, so the
+		// deferred release never sees a nil connection
+		fresh, dialErr := s.dialPeer(peer, addr)
+		if dialErr != nil {
+			err = dialErr
+		} else {
+			conn = fresh
+			stopAbort()
+			stopAbort = s.abortable(transferID, conn)
+			resp, err = s.offer(conn, meta)
+		}
+	}
+	if err != nil {
+		log.Printf("[TRANSFER %s] Offer failed: %v", transferID, err)
+		s.setError(t, err.Error())
+		if isTimeout(err) {
+			s.finish(senderName, t, "timed_out")
+		} else {
+			s.finish(senderName, t, "failed")
+		}
+		return err
 	}
-	conn.SetReadDeadline(time.Time{}) // clear deadline
 
 	if !resp.Accept {
-		t.Status = "rejected"
-		t.EndTime = time.Now().UnixMilli()
-		s.broadcast("transfer_update", t)
-		if s.store != nil {
-			userEmail := s.getUsername()
-			s.store.AddHistory(userEmail, &models.TransferHistory{
-				ID:        t.ID,
-				FileName:  t.FileName,
-				FileSize:  t.FileSize,
-				Direction: "send",
-				PeerName:  t.PeerName,
-				Status:    "rejected",
-				Timestamp: time.Now(),
-			})
-		}
-		return fmt.Errorf("receiver rejected the transfer")
+		log.Printf("[TRANSFER %s] Rejected by %s %s", transferID, peer.Username, resp.Reason)
+		if resp.Reason != "" {
+			s.setError(t, resp.Reason)
+		}
+		s.finish(senderName, t, "rejected")
+		clean = true
+		if resp.Reason != "" {
+			return fmt.Errorf("%w: %s", ErrRejected, resp.Reason)
+		}
+		return ErrRejected
+	}
+
+	if opts.RequireConfirm || s.config.RequireSenderConfirm {
+		if !s.awaitSenderConfirm(t) {
+			// Closing the connection tells the receiver nothing is coming
+			s.finish(senderName, t, "cancelled")
+			return ErrCancelled
+		}
 	}
 
 	// Accepted → stream the data
-	t.Status = "sending"
-	s.broadcast("transfer_update", t)
+	s.setStatus(t, "sending")
+	s.broadcast(models.EventTransferUpdate, t)
 
+	// Skip what the receiver already has from an earlier attempt
+	offset := resp.Offset
+	if offset < 0 || offset > fileSize || (offset > 0 && !meta.Resume) {
+		err := fmt.Errorf("receiver asked to resume at invalid offset %d", offset)
+		s.setError(t, err.Error())
+		s.finish(senderName, t, "failed")
+		return err
+	}
+	if offset > 0 {
+		log.Printf("[TRANSFER %s] Resuming at %d of %d bytes", transferID, offset, fileSize)
+		if _, err := io.CopyN(io.Discard, src, offset); err != nil {
+			s.setError(t, err.Error())
+			s.finish(senderName, t, "failed")
+			return fmt.Errorf("skip to resume offset: %w", err)
+		}
+		s.addProgress(t, int(offset))
+	}
+
+	// Frame the payload with its exact length so the receiver knows when
+	// it's done without waiting for the connection to close.
+	if err := binary.Write(conn, binary.BigEndian, uint64(fileSize-offset)); err != nil {
+		s.setError(t, err.Error())
+		s.finish(senderName, t, "failed")
+		return fmt.Errorf("send frame header: %w", err)
+	}
+	body := io.LimitReader(src, fileSize-offset)
+
+	// Everything written to the peer goes through wire so we can report how
+	// many bytes actually crossed the network versus the original size.
+	wire := &countingWriter{w: conn}
+	var out io.Writer = wire
+	// A receiver that stops reading would otherwise block Write forever
+	stallTimeout := orDefault(s.config.StallTimeout, defaultStallTimeout)
+	// Both wrap the payload and need closing to finish it off
+	var trailer io.WriteCloser
+	if compress {
+		zw, _ := gzip.NewWriterLevel(wire, gzip.BestSpeed)
+		out, trailer = zw, zw
+	} else if reliable {
+		cw := &chunkWriter{id: transferID, w: wire, conn: conn, stallTimeout: stallTimeout}
+		out, trailer = cw, cw
+	}
 	buf := make([]byte, s.config.ChunkSize)
 	lastUpdate := time.Now()
+	meter := newRateMeter(lastUpdate)
+
+	defer conn.SetWriteDeadline(time.Time{})
+	if s.config.MaxSendRate > 0 {
+		s.limiter.add(transferID, t.Priority)
+		defer s.limiter.remove(transferID)
+	}
 
 	for {
-		n, err := dataReader.Read(buf)
+		n, err := body.Read(buf)
 		if n > 0 {
-			if _, wErr := conn.Write(buf[:n]); wErr != nil {
-				t.Status = "failed"
-				t.EndTime = time.Now().UnixMilli()
-				s.broadcast("transfer_update", t)
+			conn.SetWriteDeadline(time.Now().Add(stallTimeout))
+			if _, wErr := out.Write(buf[:n]); wErr != nil {
+				if isTimeout(wErr) {
+					s.setStatus(t, "stalled")
+					s.broadcast(models.EventTransferUpdate, t)
+					wErr = fmt.Errorf("%w: receiver stopped reading for %s", ErrStalled, stallTimeout)
+				}
+				log.Printf("[TRANSFER %s] Send error after %d/%d bytes: %v", transferID, t.Transferred, fileSize, wErr)
+				s.setError(t, wErr.Error())
+				s.finish(senderName, t, "failed")
 				return wErr
 			}
-			t.Transferred += int64(n)
-			if t.FileSize > 0 {
-				t.Progress = float64(t.Transferred) / float64(t.FileSize) * 100
-			}
+			s.addProgress(t, n)
+			s.countBytes(t, n)
+			s.throttle(t, n)
 			if time.Since(lastUpdate) > time.Second {
-				elapsed := time.Since(t.StartTime).Seconds()
-				if elapsed > 0 {
-					t.Speed = float64(t.Transferred) / 1024 / 1024 / elapsed
-				}
-				s.broadcast("transfer_update", t)
+				s.updateSpeed(t, meter)
+				s.setWireStats(t, wire.n)
+				s.progress(t)
 				lastUpdate = time.Now()
 			}
 		}
 		if err == io.EOF {
-			break
+			if t.Transferred == fileSize {
+				break
+			}
+			err = fmt.Errorf("source ended after %d of %d bytes", t.Transferred, fileSize)
 		}
 		if err != nil {
-			t.Status = "failed"
-			t.EndTime = time.Now().UnixMilli()
-			s.broadcast("transfer_update", t)
+			log.Printf("[TRANSFER %s] Send error after %d/%d bytes: %v", transferID, t.Transferred, fileSize, err)
+			s.setError(t, err.Error())
+			s.finish(senderName, t, "failed")
 			return err
 		}
 	}
 
-	t.Status = "completed"
-	t.Progress = 100
-	t.EndTime = time.Now().UnixMilli()
-	s.broadcast("transfer_update", t)
+	if trailer != nil {
+		conn.SetWriteDeadline(time.Now().Add(stallTimeout))
+		if err := trailer.Close(); err != nil {
+			s.setError(t, err.Error())
+			s.finish(senderName, t, "failed")
+			return err
+		}
+	}
 
-	if s.store != nil {
-		userEmail := s.getUsername()
-		s.store.AddHistory(userEmail, &models.TransferHistory{
-			ID:        t.ID,
-			FileName:  t.FileName,
-			FileSize:  t.FileSize,
-			Direction: "send",
-			PeerName:  t.PeerName,
-			Status:    "completed",
-			Timestamp: time.Now(),
-		})
+	s.setWireStats(t, wire.n)
+	s.finish(senderName, t, "completed")
+	clean = true
+
+	log.Printf("[TRANSFER %s] Sent %s to %s", transferID, fileName, peer.Username)
+	return nil
+}
+
+// awaitSenderConfirm parks an accepted send until ConfirmTransfer is called
+// for it, reporting whether the sender confirmed in time.
+func (s *Service) awaitSenderConfirm(t *models.Transfer) bool {
+	ch := make(chan bool, 1)
+	s.mu.Lock()
+	s.confirms[t.ID] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.confirms, t.ID)
+		s.mu.Unlock()
+	}()
+
+	s.setStatus(t, "awaiting_confirmation")
+	s.broadcast(models.EventTransferUpdate, t)
+	log.Printf("[TRANSFER %s] Accepted by %s, waiting for sender confirmation", t.ID, t.PeerName)
+
+	select {
+	case ok := <-ch:
+		return ok
+	case <-time.After(senderConfirmTimeout):
+		log.Printf("[TRANSFER %s] Sender did not confirm in time", t.ID)
+		return false
 	}
+}
 
-	log.Printf("Sent data %s to %s", fileName, peer.Username)
+// ConfirmTransfer answers a send waiting in awaiting_confirmation: true
+// starts streaming, false cancels it.
+func (s *Service) ConfirmTransfer(id string, confirm bool) error {
+	s.mu.RLock()
+	ch, ok := s.confirms[id]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoPending, id)
+	}
+	select {
+	case ch <- confirm:
+	default: // already answered
+	}
 	return nil
 }
 
+// offer sends the transfer metadata on conn and waits (up to 2 minutes) for
+// the receiver's accept/reject response.
+func (s *Service) offer(conn net.Conn, meta wireMetadata) (wireResponse, error) {
+	var resp wireResponse
+	var err error
+	if meta.header {
+		err = writeHeader(conn, meta)
+	} else {
+		err = json.NewEncoder(conn).Encode(meta)
+	}
+	if err != nil {
+		return resp, fmt.Errorf("send metadata: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(offerResponseTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if meta.header {
+		err = readHeader(conn, &resp)
+	} else {
+		err = json.NewDecoder(conn).Decode(&resp)
+	}
+	if err != nil {
+		return resp, fmt.Errorf("reading response: %w", err)
+	}
+	return resp, nil
+}
+
 // AcceptTransfer signals the pending goroutine to accept and stream.
 func (s *Service) AcceptTransfer(id string) error {
-	s.mu.RLock()
+	return s.AcceptTransferTo(id, "")
+}
+
+// AcceptTransferTo accepts like AcceptTransfer but saves the file in destDir,
+// a relative path under Config.SaveRoot (or the user's download directory).
+func (s *Service) AcceptTransferTo(id, destDir string) error {
+	var dir string
+	if destDir != "" {
+		if !filepath.IsLocal(destDir) {
+			return fmt.Errorf("%w: %s", ErrBadDestDir, destDir)
+		}
+		root := s.config.SaveRoot
+		if root == "" {
+			root = s.config.UserDownloadDir(s.getUsername())
+		}
+		dir = filepath.Join(root, destDir)
+	}
+
+	s.mu.Lock()
 	pt, ok := s.pending[id]
-	s.mu.RUnlock()
+	if ok {
+		pt.DestDir = dir
+	}
+	s.mu.Unlock()
 	if !ok {
-		return fmt.Errorf("no pending transfer: %s", id)
+		return fmt.Errorf("%w: %s", ErrNoPending, id)
 	}
 	pt.Response <- true
 	return nil
@@ -419,28 +1375,244 @@ func (s *Service) RejectTransfer(id string) error {
 	pt, ok := s.pending[id]
 	s.mu.RUnlock()
 	if !ok {
-		return fmt.Errorf("no pending transfer: %s", id)
+		return fmt.Errorf("%w: %s", ErrNoPending, id)
 	}
 	pt.Response <- false
 	return nil
 }
 
-func (s *Service) GetTransfers() []*models.Transfer {
+// recordHistory persists the terminal state of t for userEmail and notifies
+// the configured webhook, if any.
+func (s *Service) recordHistory(userEmail string, t *models.Transfer, status string) {
+	s.mu.Lock()
+	done := s.recorded[t.ID]
+	s.recorded[t.ID] = true
+	deviceName := s.deviceName
+	s.mu.Unlock()
+	if done {
+		log.Printf("[TRANSFER %s] History already recorded, not adding %q", t.ID, status)
+		return
+	}
+	s.notifyTransfer(func(c *callbacks) []func(*models.Transfer) { return c.complete }, t)
+
+	if s.store != nil && !s.config.DisableHistory {
+		item := &models.TransferHistory{
+			ID:        t.ID,
+			FileName:  t.FileName,
+			FileSize:  t.FileSize,
+			Direction: t.Direction,
+			PeerName:  t.PeerName,
+			Status:    status,
+			Timestamp: time.Now(),
+			PeerID:    t.PeerID,
+			FilePath:  t.FilePath,
+
+			DeviceName:   deviceName,
+			OriginalName: t.OriginalName,
+			ContentType:  t.ContentType,
+			DuplicateOf:  t.DuplicateOf,
+			Transferred:  t.Transferred,
+
+			CompressionRatio: t.CompressionRatio,
+			BytesSaved:       t.BytesSaved,
+			AverageSpeed:     t.AverageSpeed,
+		}
+		s.queueHistory(userEmail, item)
+	}
+	s.webhook.Notify("transfer."+status, map[string]interface{}{
+		"user":     userEmail,
+		"transfer": t,
+	})
+}
+
+// ReceivedContentTypes maps the path of each file received since startup to
+// the MIME type its sender detected.
+func (s *Service) ReceivedContentTypes() map[string]string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	types := make(map[string]string)
+	for _, t := range s.transfers {
+		if t.Direction == "receive" && t.FilePath != "" && t.ContentType != "" {
+			types[t.FilePath] = t.ContentType
+		}
+	}
+	return types
+}
+
+// GetTransfers returns a snapshot of every tracked transfer, highest priority
+// first and then oldest first. Each entry is a copy taken under the lock, so
+// callers (e.g. a freshly loaded UI) see a consistent Transferred/Speed/Status
+// triple rather than a half-updated one.
+func (s *Service) GetTransfers() []*models.Transfer {
+	s.mu.RLock()
 	list := make([]*models.Transfer, 0, len(s.transfers))
 	for _, t := range s.transfers {
-		list = append(list, t)
+		cp := *t
+		list = append(list, &cp)
 	}
+	s.mu.RUnlock()
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Priority != list[j].Priority {
+			return list[i].Priority > list[j].Priority
+		}
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
 	return list
 }
 
+// progress tells the UI how t is doing, unless snapshots are batching that.
+func (s *Service) progress(t *models.Transfer) {
+	s.notifyTransfer(func(c *callbacks) []func(*models.Transfer) { return c.progress }, t)
+	if s.config.ProgressBatchInterval > 0 {
+		return
+	}
+	s.broadcast(models.EventTransferProgress, t)
+}
+
+// runSnapshots broadcasts every active transfer together, once per
+// ProgressBatchInterval while there are any.
+func (s *Service) runSnapshots() {
+	for range time.Tick(s.config.ProgressBatchInterval) {
+		if active := s.activeTransfers(); len(active) > 0 {
+			s.broadcast(models.EventTransfersSnapshot, active)
+		}
+	}
+}
+
+// activeTransfers is GetTransfers without those that have finished.
+func (s *Service) activeTransfers() []*models.Transfer {
+	var active []*models.Transfer
+	for _, t := range s.GetTransfers() {
+		if t.EndTime == 0 {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// addProgress records n more bytes moved for t.
+func (s *Service) addProgress(t *models.Transfer, n int) {
+	s.mu.Lock()
+	t.Transferred += int64(n)
+	if t.FileSize > 0 {
+		t.Progress = float64(t.Transferred) / float64(t.FileSize) * 100
+	}
+	s.mu.Unlock()
+}
+
+// speedTau is the time constant of the speed EWMA: samples older than a few
+// multiples of it no longer affect the reading.
+const speedTau = 3 * time.Second
+
+// rateMeter tracks an exponentially weighted moving average of throughput.
+type rateMeter struct {
+	last      time.Time
+	lastBytes int64
+	rate      float64 // bytes/s
+	primed    bool
+}
+
+func newRateMeter(start time.Time) *rateMeter {
+	return &rateMeter{last: start}
+}
+
+// sample folds the bytes moved since the previous sample into the average
+// and returns it in bytes/s. Weighting by elapsed time keeps the result
+// independent of how often it is called.
+func (m *rateMeter) sample(now time.Time, total int64) float64 {
+	dt := now.Sub(m.last).Seconds()
+	if dt <= 0 {
+		return m.rate
+	}
+	inst := float64(total-m.lastBytes) / dt
+	if !m.primed {
+		m.rate, m.primed = inst, true
+	} else {
+		alpha := 1 - math.Exp(-dt/speedTau.Seconds())
+		m.rate += alpha * (inst - m.rate)
+	}
+	m.last, m.lastBytes = now, total
+	return m.rate
+}
+
+// updateSpeed refreshes t.Speed (smoothed) and t.AverageSpeed, both MB/s.
+func (s *Service) updateSpeed(t *models.Transfer, m *rateMeter) {
+	now := time.Now()
+	s.mu.Lock()
+	t.Speed = m.sample(now, t.Transferred) / 1024 / 1024
+	if elapsed := now.Sub(t.StartTime).Seconds(); elapsed > 0 {
+		t.AverageSpeed = float64(t.Transferred) / 1024 / 1024 / elapsed
+	}
+	s.mu.Unlock()
+}
+
+// setWireStats records how many bytes went over the network for t and
+// derives the compression ratio (original/wire) and bytes saved from it.
+func (s *Service) setWireStats(t *models.Transfer, wireBytes int64) {
+	s.mu.Lock()
+	t.WireBytes = wireBytes
+	t.CompressionRatio = 1.0
+	if wireBytes > 0 {
+		t.CompressionRatio = float64(t.Transferred) / float64(wireBytes)
+	}
+	t.BytesSaved = t.Transferred - wireBytes
+	s.mu.Unlock()
+}
+
+// setError records why t failed.
+func (s *Service) setError(t *models.Transfer, msg string) {
+	s.mu.Lock()
+	t.Error = msg
+	s.mu.Unlock()
+}
+
+// finish moves t to the terminal status, tells the UI and records the
+// outcome in userEmail's history. A transfer is only ever recorded once.
+func (s *Service) finish(userEmail string, t *models.Transfer, status string) {
+	s.mu.Lock()
+	if status != "completed" && s.aborted[t.ID] {
+		status = "cancelled"
+		t.Error = abortedError
+	}
+	s.mu.Unlock()
+	s.setStatus(t, status)
+	if status == "completed" {
+		s.broadcast(models.EventTransferCompleted, t)
+	} else {
+		s.broadcast(models.EventTransferFailed, t)
+	}
+	s.recordHistory(userEmail, t, status)
+}
+
+// setStatus moves t to a new status. Terminal statuses also stamp EndTime,
+// and "completed" pins progress at 100%.
+func (s *Service) setStatus(t *models.Transfer, status string) {
+	s.mu.Lock()
+	t.Status = status
+	switch status {
+	case "completed":
+		t.Progress = 100
+		t.EndTime = time.Now().UnixMilli()
+	case "failed", "rejected", "cancelled", "timed_out", "expired":
+		t.EndTime = time.Now().UnixMilli()
+	}
+	if t.EndTime > 0 {
+		if elapsed := time.UnixMilli(t.EndTime).Sub(t.StartTime).Seconds(); elapsed > 0 {
+			t.AverageSpeed = float64(t.Transferred) / 1024 / 1024 / elapsed
+		}
+	}
+	s.mu.Unlock()
+}
+
+// GetPending returns copies of the offers waiting for an accept or reject.
 func (s *Service) GetPending() []*models.PendingTransfer {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	list := make([]*models.PendingTransfer, 0, len(s.pending))
 	for _, p := range s.pending {
-		list = append(list, p)
+		c := *p
+		list = append(list, &c)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
 	return list
 }
@@ -3,86 +3,97 @@ package transfer
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"log"
+	"math/big"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"filetransfer/internal/config"
+	"filetransfer/internal/discovery"
 	"filetransfer/internal/models"
+	"filetransfer/internal/storage/storagemock"
+	"filetransfer/pkg/utils"
 )
 
-func TestReceiveFileBufferAndWhitespaceFix(t *testing.T) {
-	// Setup temporary download directory
+// frame wraps data in the wire framing: 8-byte big-endian length, then data.
+func frame(data []byte) []byte {
+	return frameHeader(uint64(len(data)), data)
+}
+
+// frameHeader prefixes data with an arbitrary declared length, which lets
+// tests simulate streams that end before the frame is complete.
+func frameHeader(length uint64, data []byte) []byte {
+	out := binary.BigEndian.AppendUint64(nil, length)
+	return append(out, data...)
+}
+
+func TestMetadataFraming(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "transfer_test")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	cfg := config.Config{
-		DownloadDir:  tmpDir,
-		TransferPort: 0,
-		ChunkSize:    1024,
-	}
-
-	s := NewService(cfg, "test-device", nil, nil, func(s string, i interface{}) {}, func() string { return "test@example.com" })
-
-	fileName := "test.png"
-	fileData := []byte("pagedata-simulating-image-bytes-which-should-not-be-lost")
-	fileSize := int64(len(fileData))
-	transferID := "test-id"
-
-	meta := wireMetadata{
-		ID:         transferID,
-		FileName:   fileName,
-		FileSize:   fileSize,
-		SenderID:   "sender-id",
-		SenderName: "sender-name",
-	}
-
-	// Create a buffer that contains JSON, a newline, and then file data
-	// This simulates the issue where a newline added by json.Encoder.Encode
-	// or another source gets prepended to the file data.
-	var buf bytes.Buffer
-	json.NewEncoder(&buf).Encode(meta) // Adds a newline
-	buf.Write(fileData)
-
-	// Simulate a connection
-	pr, pw := net.Pipe()
-	defer pr.Close()
-
-	go func() {
-		pw.Write(buf.Bytes())
-		pw.Close()
-	}()
-
-	// Decoding logic from handleIncoming
-	reader := bufio.NewReader(pr)
-	decoder := json.NewDecoder(reader)
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
 
-	var decodedMeta wireMetadata
-	if err := decoder.Decode(&decodedMeta); err != nil {
-		t.Fatalf("Failed to decode metadata: %v", err)
-	}
-
-	// Combined reader from handleIncoming
-	combinedReader := io.MultiReader(decoder.Buffered(), reader)
-
-	// Call receiveFile - it should now handle the buffered data and skip the newline
-	s.receiveFile(pr, combinedReader, decodedMeta)
-
-	// Verify the file content
-	savedPath := filepath.Join(tmpDir, fileName)
-	savedData, err := os.ReadFile(savedPath)
-	if err != nil {
-		t.Fatalf("Failed to read saved file: %v", err)
-	}
+	// Leading whitespace in the file is data, not a metadata separator
+	fileData := []byte("\n \r\npagedata-simulating-image-bytes-which-should-not-be-lost")
+	for _, header := range []bool{true, false} {
+		name := fmt.Sprintf("header-%v.png", header)
+		meta := wireMetadata{
+			Version:    protocolVersion,
+			ID:         name,
+			FileName:   name,
+			FileSize:   int64(len(fileData)),
+			SenderID:   "sender-id",
+			SenderName: "sender-name",
+		}
+		var buf bytes.Buffer
+		if header {
+			writeHeader(&buf, meta)
+		} else {
+			json.NewEncoder(&buf).Encode(meta) // version 1 JSON line
+		}
+		buf.Write(frame(fileData))
 
-	if !bytes.Equal(savedData, fileData) {
-		t.Errorf("Saved data mismatch.\nExpected: %q\nGot:      %q", string(fileData), string(savedData))
+		reader := bufio.NewReader(&buf)
+		got, err := readMetadata(reader)
+		if err != nil {
+			t.Fatalf("readMetadata: %v", err)
+		}
+		if got.header != header || got.ID != name {
+			t.Errorf("metadata = %+v, want header=%v id=%s", got, header, name)
+		}
+		if err := s.receiveFile(nil, reader, got, ""); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := os.ReadFile(filepath.Join(cfg.UserDownloadDir("test@example.com"), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(saved, fileData) {
+			t.Errorf("saved %q, want %q", saved, fileData)
+		}
 	}
 }
 
@@ -102,7 +113,7 @@ func TestDeduplication(t *testing.T) {
 
 	go func() {
 		conn, _ := net.Dial("tcp", l.Addr().String())
-		json.NewEncoder(conn).Encode(wireMetadata{ID: transferID})
+		json.NewEncoder(conn).Encode(wireMetadata{Version: protocolVersion, ID: transferID})
 		conn.Close()
 	}()
 
@@ -117,3 +128,2291 @@ func TestDeduplication(t *testing.T) {
 		t.Error("Pending transfer was incorrectly removed or not found")
 	}
 }
+
+func TestReceiveFileSanitizesTraversalName(t *testing.T) {
+	root, err := os.MkdirTemp("", "transfer_traversal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	downloadDir := filepath.Join(root, "downloads", "inner")
+
+	cfg := config.Config{DownloadDir: downloadDir, ChunkSize: 1024}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	for i, name := range []string{"../../escape0.txt", `..\..\escape1.txt`, "/tmp/../escape2.txt"} {
+		data := []byte(fmt.Sprintf("payload %d", i))
+		meta := wireMetadata{ID: fmt.Sprintf("trav-%d", i), FileName: name, FileSize: int64(len(data))}
+		if err := s.receiveFile(nil, bytes.NewReader(frame(data)), meta, ""); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+
+	for _, escaped := range []string{filepath.Join(root, "escape0.txt"), filepath.Join(root, "downloads", "escape1.txt")} {
+		if _, err := os.Stat(escaped); err == nil {
+			t.Errorf("file escaped the download dir: %s", escaped)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(cfg.UserDownloadDir("test@example.com"), "escape*.txt"))
+	if len(matches) != 3 {
+		t.Errorf("expected 3 files inside the download dir, got %v", matches)
+	}
+
+	for _, bad := range []string{"", "..", "...", " ", ". .", "CON", "nul.txt", "lpt1", "a\x00b"} {
+		if _, err := sanitizeFileName(bad); err == nil {
+			t.Errorf("sanitizeFileName(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSanitizeUnicodeAndLongNames(t *testing.T) {
+	long := strings.Repeat("ü", 150) + ".tar.gz" // 300 bytes of stem
+	for _, tc := range []struct{ in, want string }{
+		{"🎉 party 🎉.png", "🎉 party 🎉.png"},
+		{"שלום.txt", "שלום.txt"},
+		{"cafe\u0301.txt", "caf\u00e9.txt"}, // decomposed, as macOS sends it
+		{"a:b*c?.txt", "a_b_c_.txt"},
+		{"notes.txt. ", "notes.txt"},
+		{"bad\xffbyte.txt", "bad_byte.txt"},
+	} {
+		if got, err := sanitizeFileName(tc.in); err != nil || got != tc.want {
+			t.Errorf("sanitizeFileName(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	got, err := sanitizeFileName(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > maxFileNameBytes || !strings.HasSuffix(got, ".gz") || !utf8.ValidString(got) {
+		t.Errorf("long name shortened to %q (%d bytes)", got, len(got))
+	}
+
+	// The file is saved under the short name and the original is kept
+	dir := t.TempDir()
+	s := NewService(config.Config{DownloadDir: dir, ChunkSize: 1024}, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "" })
+	name := "🎉" + long
+	meta := wireMetadata{ID: "long", FileName: name, FileSize: 4}
+	if err := s.receiveFile(nil, bytes.NewReader(frame([]byte("data"))), meta, ""); err != nil {
+		t.Fatal(err)
+	}
+	tr := s.transfers["long"]
+	if tr.OriginalName != name || !exists(tr.FilePath) || len(filepath.Base(tr.FilePath)) > maxFileNameBytes {
+		t.Errorf("saved as %q, original %q", tr.FilePath, tr.OriginalName)
+	}
+	var sidecar map[string]string
+	if data, err := os.ReadFile(sidecarPath(tr.FilePath)); err != nil || json.Unmarshal(data, &sidecar) != nil || sidecar["originalName"] != name {
+		t.Errorf("sidecar %v, %v", sidecar, err)
+	}
+
+	// A name that needed no change gets no sidecar
+	meta = wireMetadata{ID: "plain", FileName: "plain.txt", FileSize: 4}
+	if err := s.receiveFile(nil, bytes.NewReader(frame([]byte("data"))), meta, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p := sidecarPath(s.transfers["plain"].FilePath); exists(p) {
+		t.Errorf("unexpected sidecar %s", p)
+	}
+}
+
+func TestExpandFileName(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+	meta := wireMetadata{ID: "abc", FileName: "report.final.pdf", SenderName: "alice@example.com"}
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{"", "report.final.pdf"},
+		{"{name}", "report.final.pdf"},
+		{"{sender}_{date}_{name}", "alice@example.com_2024-03-09_report.final.pdf"},
+		{"{base}-{time}.{ext}", "report.final-140507.pdf"},
+		{"{id}/{name}", "abc_report.final.pdf"},
+		{"{unknown}_{name}", "{unknown}_report.final.pdf"},
+		{"..", "report.final.pdf"},
+		{"CON.{ext}", "report.final.pdf"},
+	} {
+		if got := expandFileName(tc.template, meta, now); got != tc.want {
+			t.Errorf("expandFileName(%q) = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+
+	// Separators and other unsafe characters from the sender stay inside one name
+	hostile := wireMetadata{FileName: "a.txt", SenderName: `../../etc\x:y*`}
+	if got := expandFileName("{sender}_{name}", hostile, now); got != ".._.._etc_x_y__a.txt" {
+		t.Errorf("hostile sender expanded to %q", got)
+	}
+}
+
+func TestFilenameTemplateCollisions(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir(), ChunkSize: 1024, FilenameTemplate: "{sender}_{name}"}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	for i, data := range [][]byte{[]byte("first"), []byte("second")} {
+		meta := wireMetadata{ID: fmt.Sprint("tmpl-", i), FileName: "notes.txt", FileSize: int64(len(data)), SenderName: "bob"}
+		if err := s.receiveFile(nil, bytes.NewReader(frame(data)), meta, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := cfg.UserDownloadDir("test@example.com")
+	first, err := os.ReadFile(filepath.Join(dir, "bob_notes.txt"))
+	if err != nil || string(first) != "first" {
+		t.Fatalf("templated file = %q, %v", first, err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "bob_notes_*.txt"))
+	if len(matches) != 1 {
+		t.Fatalf("second receive should get a unique templated name, found %v", matches)
+	}
+	if second, _ := os.ReadFile(matches[0]); string(second) != "second" {
+		t.Errorf("second file = %q", second)
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	s := NewService(config.Config{}, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleIncoming(server)
+
+	json.NewEncoder(client).Encode(wireMetadata{Version: protocolVersion + 1, ID: "future", FileName: "f.txt", FileSize: 1})
+	var resp wireResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if resp.Accept || resp.Reason == "" {
+		t.Errorf("expected a refusal with a reason, got %+v", resp)
+	}
+	if len(s.GetPending()) != 0 {
+		t.Error("incompatible offer was shown to the user")
+	}
+}
+
+func TestOfferExpires(t *testing.T) {
+	defer func(d time.Duration) { pendingOfferTimeout = d }(pendingOfferTimeout)
+	pendingOfferTimeout = 100 * time.Millisecond
+
+	expired := make(chan map[string]string, 2)
+	cfg := config.Config{DownloadDir: t.TempDir()}
+	s := NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if msg == models.EventRequestExpired {
+			expired <- p.(map[string]string)
+		}
+	}, func() string { return "test@example.com" })
+
+	// offer sends metadata on a pipe and returns the sender's end.
+	offer := func(id string) net.Conn {
+		client, server := net.Pipe()
+		go s.handleIncoming(server)
+		json.NewEncoder(client).Encode(wireMetadata{Version: protocolVersion, ID: id, FileName: id + ".txt", FileSize: 4})
+		return client
+	}
+	wait := func(id, reason string) {
+		t.Helper()
+		select {
+		case ev := <-expired:
+			if ev["id"] != id || ev["reason"] != reason {
+				t.Errorf("request_expired = %v, want id %s, reason %s", ev, id, reason)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no request_expired for %s", id)
+		}
+		if len(s.GetPending()) != 0 {
+			t.Errorf("%s still pending after expiring", id)
+		}
+	}
+
+	client := offer("slow")
+	defer client.Close()
+	var resp wireResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil || resp.Accept {
+		t.Fatalf("unanswered offer: resp %+v, err %v", resp, err)
+	}
+	wait("slow", "timeout")
+
+	pendingOfferTimeout = time.Minute
+	gone := offer("gone")
+	for len(s.GetPending()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	gone.Close()
+	wait("gone", "disconnected")
+}
+
+func TestAcceptAfterSenderGaveUp(t *testing.T) {
+	dir := t.TempDir()
+	store := storagemock.New()
+	s := NewService(config.Config{DownloadDir: dir}, "test-device", store, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	// offer sends metadata on a pipe and waits for it to be pending.
+	offer := func(id string) net.Conn {
+		client, server := net.Pipe()
+		go s.handleIncoming(server)
+		json.NewEncoder(client).Encode(wireMetadata{Version: protocolVersion, ID: id, FileName: id + ".txt", FileSize: 4})
+		for len(s.GetPending()) == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return client
+	}
+
+	// The sender's deadline fires just as the accept reaches it
+	client := offer("late")
+	go func() {
+		json.NewDecoder(client).Decode(&wireResponse{})
+		client.Close()
+	}()
+	if err := s.AcceptTransfer("late"); err != nil {
+		t.Fatal(err)
+	}
+	h := waitForHistory(t, store, "test@example.com", 1)
+	if h[0].ID != "late" || h[0].Status != "expired" {
+		t.Errorf("history %+v, want late expired", h[0])
+	}
+	if left, _ := os.ReadDir(s.config.UserDownloadDir("test@example.com")); len(left) != 0 {
+		t.Errorf("files left behind: %v", left)
+	}
+
+	// The sender is already gone when the accept comes; however the race
+	// falls, it is never recorded as failed
+	client = offer("gone")
+	client.Close()
+	s.AcceptTransfer("gone")
+	time.Sleep(100 * time.Millisecond)
+	for _, h := range store.History("test@example.com") {
+		if h.Status == "failed" {
+			t.Errorf("%s recorded as failed", h.ID)
+		}
+	}
+	if len(s.GetPending()) != 0 {
+		t.Error("offer still pending")
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir(), ChunkSize: 1024, UserQuotaBytes: 10}
+	var s *Service
+	s = NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if pt, ok := p.(*models.PendingTransfer); ok && msg == models.EventIncomingRequest {
+			s.AcceptTransfer(pt.ID)
+		}
+	}, func() string { return "test@example.com" })
+	dir := cfg.UserDownloadDir("test@example.com")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("0123"), 0644)
+	s.loadUsage()
+	if got := s.Usage("test@example.com"); got != 4 {
+		t.Fatalf("usage at startup = %d, want 4", got)
+	}
+
+	// offer sends a file of size n and returns the receiver's answer.
+	offer := func(id string, n int) (net.Conn, wireResponse) {
+		client, server := net.Pipe()
+		go s.handleIncoming(server)
+		json.NewEncoder(client).Encode(wireMetadata{Version: protocolVersion, ID: id, FileName: id + ".txt", FileSize: int64(n)})
+		var resp wireResponse
+		if err := json.NewDecoder(client).Decode(&resp); err != nil {
+			t.Fatalf("%s: reading response: %v", id, err)
+		}
+		return client, resp
+	}
+
+	// Under quota: 4 + 5 <= 10
+	client, resp := offer("fits", 5)
+	if !resp.Accept {
+		t.Fatalf("under-quota offer refused: %+v", resp)
+	}
+	client.Write(frame([]byte("abcde")))
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Usage("test@example.com") != 9 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := s.Usage("test@example.com"); got != 9 {
+		t.Fatalf("usage after receive = %d, want 9", got)
+	}
+
+	// Over quota: 9 + 2 > 10, refused without asking
+	client, resp = offer("big", 2)
+	client.Close()
+	if resp.Accept || resp.Reason != quotaExceeded {
+		t.Errorf("over-quota offer: %+v", resp)
+	}
+	if exists(filepath.Join(dir, "big.txt")) {
+		t.Error("over-quota file was saved")
+	}
+}
+
+func TestQuotaDestDir(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir(), SaveRoot: t.TempDir(), ChunkSize: 1024, UserQuotaBytes: 10}
+	var s *Service
+	s = NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if pt, ok := p.(*models.PendingTransfer); ok && msg == models.EventIncomingRequest {
+			s.AcceptTransferTo(pt.ID, "shared")
+		}
+	}, func() string { return "test@example.com" })
+	userDir := cfg.UserDownloadDir("test@example.com")
+	if got := s.quotaDir(filepath.Join(userDir, "sub")); got != userDir {
+		t.Errorf("a directory inside the downloads is charged to %s", got)
+	}
+	shared := filepath.Join(cfg.SaveRoot, "shared")
+	os.MkdirAll(shared, 0755)
+	os.WriteFile(filepath.Join(shared, "old.txt"), []byte("01234567"), 0644)
+
+	offer := func(id string, n int) wireResponse {
+		client, server := net.Pipe()
+		defer client.Close()
+		go s.handleIncoming(server)
+		json.NewEncoder(client).Encode(wireMetadata{Version: protocolVersion, ID: id, FileName: id + ".txt", FileSize: int64(n)})
+		var resp wireResponse
+		if err := json.NewDecoder(client).Decode(&resp); err != nil {
+			t.Fatalf("%s: reading response: %v", id, err)
+		}
+		return resp
+	}
+	// The downloads are empty, but the directory written holds 8 of 10 bytes
+	if resp := offer("big", 5); resp.Accept || resp.Reason != quotaExceeded {
+		t.Errorf("offer past the save directory's quota: %+v", resp)
+	}
+	if resp := offer("small", 2); !resp.Accept {
+		t.Errorf("offer within the save directory's quota: %+v", resp)
+	}
+}
+
+func TestProgressSnapshots(t *testing.T) {
+	events := make(chan []*models.Transfer, 1)
+	s := NewService(config.Config{ProgressBatchInterval: 10 * time.Millisecond}, "test-device", nil, nil, func(msg string, p interface{}) {
+		if msg == models.EventTransferProgress {
+			t.Error("per-transfer progress sent while batching")
+		}
+		if list, ok := p.([]*models.Transfer); ok && msg == models.EventTransfersSnapshot {
+			select {
+			case events <- list:
+			default:
+			}
+		}
+	}, func() string { return "test@example.com" })
+
+	now := time.Now()
+	s.transfers["a"] = &models.Transfer{ID: "a", Status: "sending", StartTime: now}
+	s.transfers["b"] = &models.Transfer{ID: "b", Status: "receiving", StartTime: now.Add(time.Millisecond)}
+	s.transfers["done"] = &models.Transfer{ID: "done", Status: "completed", StartTime: now, EndTime: now.UnixMilli()}
+	s.progress(s.transfers["a"])
+	go s.runSnapshots()
+
+	select {
+	case list := <-events:
+		if len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+			t.Errorf("snapshot = %+v, want the two active transfers", list)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no snapshot broadcast")
+	}
+}
+
+func TestTextKindReceivedInMemory(t *testing.T) {
+	small := []byte("hello from the other laptop")
+	large := bytes.Repeat([]byte("x"), maxInMemoryPayload+1)
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		onDisk bool
+	}{
+		{"small", small, false},
+		{"large", large, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			texts := make(chan string, 1)
+			var s *Service
+			s = NewService(config.Config{DownloadDir: dir, ChunkSize: 4096}, "test-device", nil, nil, func(msg string, p interface{}) {
+				switch msg {
+				case models.EventIncomingRequest:
+					s.AcceptTransfer(p.(*models.PendingTransfer).ID)
+				case models.EventTextReceived:
+					texts <- p.(map[string]string)["text"]
+				}
+			}, func() string { return "test@example.com" })
+
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan bool, 1)
+			meta := wireMetadata{Version: protocolVersion, ID: tc.name, FileName: "message.txt", FileSize: int64(len(tc.data)), SenderName: "peer", Kind: KindText, header: true}
+			go func() { done <- s.serveTransfer(server, bufio.NewReader(server), meta) }()
+
+			var resp wireResponse
+			if err := readHeader(client, &resp); err != nil || !resp.Accept {
+				t.Fatalf("response = %+v, %v", resp, err)
+			}
+			client.Write(frame(tc.data))
+			if !<-done {
+				t.Fatal("receive failed")
+			}
+
+			saved, err := os.ReadFile(filepath.Join(s.config.UserDownloadDir("test@example.com"), "message.txt"))
+			if tc.onDisk {
+				if !bytes.Equal(saved, tc.data) {
+					t.Errorf("large text not saved to disk (err=%v)", err)
+				}
+				if len(texts) != 0 {
+					t.Error("large text was also delivered in memory")
+				}
+				return
+			}
+			if err == nil {
+				t.Error("small text was written to disk")
+			}
+			select {
+			case got := <-texts:
+				if got != string(tc.data) {
+					t.Errorf("text = %q, want %q", got, tc.data)
+				}
+			default:
+				t.Error("no text_received event")
+			}
+		})
+	}
+}
+
+func TestRateMeterTracksRecentThroughput(t *testing.T) {
+	start := time.Now()
+	m := newRateMeter(start)
+
+	// 10s at 1 MB/s, then 10s at 10 MB/s, sampled every second
+	var total int64
+	now := start
+	for i := 0; i < 20; i++ {
+		rate := int64(1 << 20)
+		if i >= 10 {
+			rate = 10 << 20
+		}
+		total += rate
+		now = now.Add(time.Second)
+		m.sample(now, total)
+	}
+
+	got := m.rate / (1 << 20)
+	cumulative := float64(total) / (1 << 20) / now.Sub(start).Seconds()
+	if got < 9 || got > 10.01 {
+		t.Errorf("smoothed speed %.2f MB/s, want close to the current 10 MB/s (cumulative would be %.2f)", got, cumulative)
+	}
+}
+
+// failingReader yields data and then a non-EOF error, like a dropped connection.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestReceiveFileTruncatedStream(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024}
+	var last *models.Transfer
+	s := NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if tr, ok := p.(*models.Transfer); ok {
+			last = tr
+		}
+	}, func() string { return "test@example.com" })
+
+	partial := []byte("only-the-first-part")
+	meta := wireMetadata{ID: "truncated-id", FileName: "big.bin", FileSize: 1000, SenderName: "sender-name"}
+
+	pr, pw := net.Pipe()
+	defer pw.Close()
+	s.receiveFile(pr, &failingReader{data: frameHeader(1000, partial), err: io.ErrUnexpectedEOF}, meta, "")
+
+	if last == nil || last.Status != "failed" {
+		t.Fatalf("expected failed status, got %+v", last)
+	}
+	if last.Transferred != int64(len(partial)) || last.FileSize != 1000 {
+		t.Errorf("failure broadcast should carry progress, got %d/%d", last.Transferred, last.FileSize)
+	}
+
+	userDir := cfg.UserDownloadDir("test@example.com")
+	if _, err := os.Stat(filepath.Join(userDir, "big.bin")); !os.IsNotExist(err) {
+		t.Errorf("partial file left under its final name (err=%v)", err)
+	}
+	data, err := os.ReadFile(filepath.Join(userDir, "big.bin.incomplete"))
+	if err != nil {
+		t.Fatalf("expected .incomplete file: %v", err)
+	}
+	if !bytes.Equal(data, partial) {
+		t.Errorf("incomplete file content = %q, want %q", data, partial)
+	}
+}
+
+func TestReceiveFileNotVisibleUntilComplete(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir(), ChunkSize: 4}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+	final := filepath.Join(cfg.UserDownloadDir("test@example.com"), "a.bin")
+
+	data := []byte("first-half|second-half")
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	meta := wireMetadata{ID: "atomic", FileName: "a.bin", FileSize: int64(len(data)), SenderName: "peer"}
+	go func() { done <- s.receiveFile(nil, pr, meta, "") }()
+
+	pw.Write(frameHeader(uint64(len(data)), data[:10]))
+	deadline := time.Now().Add(5 * time.Second)
+	for !exists(final + ".incomplete") {
+		if time.Now().After(deadline) {
+			t.Fatal("no .incomplete file while receiving")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if exists(final) {
+		t.Error("final name visible before the transfer finished")
+	}
+
+	pw.Write(data[10:])
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(final); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("final file = %q (err=%v), want %q", got, err, data)
+	}
+	if exists(final + ".incomplete") {
+		t.Error(".incomplete file left after success")
+	}
+}
+
+func TestReceiveFileShortStream(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024}
+	var last *models.Transfer
+	s := NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if tr, ok := p.(*models.Transfer); ok {
+			last = tr
+		}
+	}, func() string { return "test@example.com" })
+
+	// Sender declares 100 bytes but closes cleanly after 10
+	meta := wireMetadata{ID: "short-id", FileName: "short.txt", FileSize: 100, SenderName: "sender-name"}
+	pr, pw := net.Pipe()
+	defer pw.Close()
+	s.receiveFile(pr, bytes.NewReader(frameHeader(100, []byte("0123456789"))), meta, "")
+
+	if last == nil || last.Status != "failed" {
+		t.Fatalf("short stream should fail, got %+v", last)
+	}
+	if last.Error == "" {
+		t.Error("expected a size mismatch reason")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.UserDownloadDir("test@example.com"), "short.txt")); !os.IsNotExist(err) {
+		t.Errorf("short file left under its final name (err=%v)", err)
+	}
+}
+
+func TestReceiveFileFramedWithoutClose(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 4}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	data := []byte("framed payload")
+	meta := wireMetadata{ID: "framed-id", FileName: "framed.txt", FileSize: int64(len(data))}
+
+	// The sender keeps its end open after the frame; receiveFile must still finish
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go remote.Write(frame(data))
+
+	done := make(chan struct{})
+	go func() {
+		s.receiveFile(local, local, meta, "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiveFile waited for connection close instead of using the frame length")
+	}
+
+	saved, err := os.ReadFile(filepath.Join(cfg.UserDownloadDir("test@example.com"), "framed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, data) {
+		t.Errorf("saved %q, want %q", saved, data)
+	}
+}
+
+// waitForHistory polls store until email has n history records; history is
+// persisted in the background.
+func waitForHistory(tb testing.TB, store *storagemock.Store, email string, n int) []*models.TransferHistory {
+	tb.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		h := store.History(email)
+		if len(h) >= n || time.Now().After(deadline) {
+			if len(h) != n {
+				tb.Fatalf("got %d history records for %s, want %d", len(h), email, n)
+			}
+			return h
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiveFileRecordsHistory(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := storagemock.New()
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024}
+	s := NewService(cfg, "test-device", store, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	data := []byte("complete payload")
+	ok := wireMetadata{ID: "hist-ok", FileName: "ok.txt", FileSize: int64(len(data)), SenderName: "peer"}
+	s.receiveFile(nil, bytes.NewReader(frame(data)), ok, "")
+	short := wireMetadata{ID: "hist-short", FileName: "short.txt", FileSize: 100, SenderName: "peer"}
+	s.receiveFile(nil, bytes.NewReader(frameHeader(100, []byte("0123"))), short, "")
+
+	got := map[string]*models.TransferHistory{}
+	for _, h := range waitForHistory(t, store, "test@example.com", 2) {
+		got[h.ID] = h
+	}
+	if h := got["hist-ok"]; h == nil || h.Status != "completed" || h.Transferred != int64(len(data)) || h.Direction != "receive" {
+		t.Errorf("completed record = %+v", h)
+	}
+	if h := got["hist-short"]; h == nil || h.Status != "failed" || h.Transferred != 4 {
+		t.Errorf("failed record = %+v", h)
+	}
+}
+
+func TestReceiveFileRunsHook(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "hook.sh")
+	out := filepath.Join(tmpDir, "hook.out")
+	if err := os.WriteFile(script, []byte("printf '%s\\n' \"$@\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024, OnReceiveCommand: "sh " + script}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+
+	// The sender name must reach the hook verbatim, not through a shell
+	sender := "peer $(touch pwned)"
+	data := []byte("hooked")
+	meta := wireMetadata{ID: "hook", FileName: "hook.txt", FileSize: int64(len(data)), SenderName: sender}
+	if err := s.receiveFile(nil, bytes.NewReader(frame(data)), meta, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var got []byte
+	for {
+		var err error
+		if got, err = os.ReadFile(out); err == nil && len(got) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hook did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := filepath.Join(cfg.UserDownloadDir("test@example.com"), "hook.txt") + "\n" + sender + "\n"
+	if string(got) != want {
+		t.Errorf("hook args = %q, want %q", got, want)
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Error("sender name was interpreted by a shell")
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := config.Config{DownloadDir: filepath.Join(tmpDir, "dl"), ResumeStateDir: filepath.Join(tmpDir, "state"), ChunkSize: 4}
+	newService := func() *Service {
+		return NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+	}
+	data := []byte("0123456789abcdefghij")
+	meta := wireMetadata{ID: "resume-id", FileName: "r.bin", FileSize: int64(len(data)), SenderName: "peer"}
+
+	// First attempt dies after 8 bytes
+	first := newService()
+	first.receiveFile(nil, &failingReader{data: frameHeader(uint64(len(data)), data[:8]), err: io.ErrUnexpectedEOF}, meta, "")
+
+	// A restarted receiver picks up the partial file
+	second := newService()
+	second.loadResumeState()
+	meta.Resume = true
+	if _, off := second.resumePoint(meta); off != 8 {
+		t.Fatalf("resume offset = %d, want 8", off)
+	}
+	if err := second.receiveFile(nil, bytes.NewReader(frame(data[8:])), meta, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	userDir := cfg.UserDownloadDir("test@example.com")
+	got, err := os.ReadFile(filepath.Join(userDir, "r.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("resumed file = %q, want %q", got, data)
+	}
+	if _, err := os.Stat(filepath.Join(userDir, "r.bin.incomplete")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind (err=%v)", err)
+	}
+	if left, _ := os.ReadDir(cfg.ResumeStateDir); len(left) != 0 {
+		t.Errorf("resume state not cleaned up: %d entries", len(left))
+	}
+}
+
+func TestSendStreamResumesFromOffset(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	rest := make(chan []byte, 1)
+	sender := fakeReceiver(t, nil, func(conn net.Conn, r *bufio.Reader) {
+		line, _ := r.ReadBytes('\n')
+		var meta wireMetadata
+		json.Unmarshal(line, &meta)
+		if !meta.Resume || meta.ID != "earlier-id" {
+			json.NewEncoder(conn).Encode(wireResponse{Reason: "not a resume"})
+			return
+		}
+		json.NewEncoder(conn).Encode(wireResponse{Accept: true, Offset: 8})
+		var n uint64
+		binary.Read(r, binary.BigEndian, &n)
+		buf := make([]byte, n)
+		io.ReadFull(r, buf)
+		rest <- buf
+	})
+
+	if err := sender.SendStreamWithOptions("receiver", bytes.NewReader(data), "r.bin", int64(len(data)), SendOptions{ResumeID: "earlier-id"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-rest; !bytes.Equal(got, data[8:]) {
+		t.Errorf("sent %q after resuming, want %q", got, data[8:])
+	}
+}
+
+func TestResumeIDOwnership(t *testing.T) {
+	sender, _, _ := startReceiver(t, config.Config{ChunkSize: 1024})
+	sender.mu.Lock()
+	sender.transfers["theirs"] = &models.Transfer{ID: "theirs", Direction: "send", SenderEmail: "b@example.com", Status: "failed"}
+	sender.transfers["running"] = &models.Transfer{ID: "running", Direction: "send", SenderEmail: "a@example.com", Status: "sending"}
+	sender.transfers["mine"] = &models.Transfer{ID: "mine", Direction: "send", SenderEmail: "a@example.com", Status: "failed"}
+	sender.mu.Unlock()
+
+	send := func(id string) error {
+		opts := SendOptions{ResumeID: id, SenderEmail: "a@example.com"}
+		return sender.SendStreamWithOptions("receiver", strings.NewReader("data"), "a.txt", 4, opts)
+	}
+	if err := send("theirs"); !errors.Is(err, ErrNotResumable) {
+		t.Errorf("resuming another user's transfer: %v", err)
+	}
+	if err := send("running"); !errors.Is(err, ErrInProgress) {
+		t.Errorf("resuming a running transfer: %v", err)
+	}
+	sender.mu.Lock()
+	theirs, running := sender.transfers["theirs"].SenderEmail, sender.transfers["running"].Status
+	sender.mu.Unlock()
+	if theirs != "b@example.com" || running != "sending" {
+		t.Errorf("refused resumes changed the transfers: %s, %s", theirs, running)
+	}
+	if err := send("mine"); err != nil {
+		t.Errorf("resuming own failed transfer: %v", err)
+	}
+}
+
+func TestSendLimiterShares(t *testing.T) {
+	var l sendLimiter
+	l.add("normal", 0)
+	l.add("urgent", 1)
+	l.add("extreme", 100)
+	if got, want := l.share("urgent")/l.share("normal"), 2.0; got != want {
+		t.Errorf("priority 1 gets %v times the share of priority 0, want %v", got, want)
+	}
+	if got, want := l.share("extreme")/l.share("normal"), priorityWeight(maxPriorityStep); got != want {
+		t.Errorf("extreme priority ratio %v, want it capped at %v", got, want)
+	}
+	l.remove("extreme")
+	l.remove("urgent")
+	if got := l.share("normal"); got != 1 {
+		t.Errorf("a lone send gets %v of the budget", got)
+	}
+}
+
+func TestPriorityWeightsSendRate(t *testing.T) {
+	const size = 16 << 10
+	sender, _, _ := startReceiver(t, config.Config{ChunkSize: 1024, MaxSendRate: 40 << 10})
+	finished := make(chan int, 2)
+	for _, priority := range []int{0, 1} {
+		go func(priority int) {
+			data := bytes.Repeat([]byte("x"), size)
+			opts := SendOptions{Priority: priority}
+			if err := sender.SendStreamWithOptions("receiver", bytes.NewReader(data), fmt.Sprintf("p%d.bin", priority), size, opts); err != nil {
+				t.Error(err)
+			}
+			finished <- priority
+		}(priority)
+		time.Sleep(10 * time.Millisecond) // the normal send starts first
+	}
+	// At 2/3 of the budget the urgent send finishes well before the other
+	if first := <-finished; first != 1 {
+		t.Errorf("priority %d send finished first", first)
+	}
+	<-finished
+}
+
+// startReceiver runs an auto-accepting receiver on a loopback listener and
+// returns a sender Service whose discovery already knows it as "receiver".
+// accepted counts the TCP connections the receiver has taken.
+func startReceiver(tb testing.TB, senderCfg config.Config) (sender *Service, accepted *int32, dir string) {
+	tb.Helper()
+	dir, err := os.MkdirTemp("", "transfer_recv")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	var recv *Service
+	recvCfg := config.Config{DownloadDir: dir, ChunkSize: senderCfg.ChunkSize,
+		SocketReadBuffer: senderCfg.SocketReadBuffer, SocketWriteBuffer: senderCfg.SocketWriteBuffer}
+	recv = NewService(recvCfg, "receiver", nil, nil,
+		func(msg string, p interface{}) {
+			if pt, ok := p.(*models.PendingTransfer); ok && msg == "incoming_request" {
+				recv.AcceptTransfer(pt.ID)
+			}
+		}, func() string { return "receiver@example.com" })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go recv.handleIncoming(conn)
+		}
+	}()
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{
+		ID:           "receiver",
+		IP:           "127.0.0.1",
+		Port:         ln.Addr().(*net.TCPAddr).Port,
+		Capabilities: models.LocalCapabilities,
+	})
+	sender = NewService(senderCfg, "sender", nil, disc, func(string, interface{}) {}, func() string { return "sender@example.com" })
+	return sender, accepted, recv.config.UserDownloadDir("receiver@example.com")
+}
+
+// writeTestCert writes a self-signed certificate and key into dir.
+func writeTestCert(tb testing.TB, dir string) (certFile, keyFile string) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "filetransfer test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestSendStreamOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	recvCfg := config.Config{DownloadDir: dir, ChunkSize: 1024, TLSCertFile: certFile, TLSKeyFile: keyFile}
+	var recv *Service
+	recv = NewService(recvCfg, "receiver", nil, nil, func(msg string, p interface{}) {
+		if pt, ok := p.(*models.PendingTransfer); ok && msg == models.EventIncomingRequest {
+			recv.AcceptTransfer(pt.ID)
+		}
+	}, func() string { return "receiver@example.com" })
+	if recv.serverTLS == nil {
+		t.Fatal("TLS not enabled on the receiver")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		tln := recv.wrapListener(ln)
+		for {
+			conn, err := tln.Accept()
+			if err != nil {
+				return
+			}
+			go recv.handleIncoming(conn)
+		}
+	}()
+
+	cert, _ := recvCfg.LoadTLSCert()
+	fingerprint := utils.CertFingerprint(&cert)
+	for _, tc := range []struct {
+		name, fingerprint string
+		ok                bool
+	}{
+		{"pinned", fingerprint, true},
+		{"wrong fingerprint", strings.Repeat("0", len(fingerprint)), false},
+	} {
+		disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+		disc.AddManualPeer(&models.Device{
+			ID:              "receiver",
+			IP:              "127.0.0.1",
+			Port:            ln.Addr().(*net.TCPAddr).Port,
+			Capabilities:    append([]string{models.CapTLS}, models.LocalCapabilities...),
+			CertFingerprint: tc.fingerprint,
+		})
+		sender := NewService(config.Config{ChunkSize: 1024}, "sender", nil, disc, func(string, interface{}) {}, func() string { return "sender@example.com" })
+
+		data := []byte("encrypted on the wire")
+		name := strings.ReplaceAll(tc.name, " ", "_") + ".txt"
+		err := sender.SendStream("receiver", bytes.NewReader(data), name, int64(len(data)))
+		if tc.ok != (err == nil) || (err != nil && !errors.Is(err, ErrCertMismatch)) {
+			t.Fatalf("%s: SendStream = %v", tc.name, err)
+		}
+		if !tc.ok {
+			continue
+		}
+		// The receiver may still be moving the file into place
+		path := filepath.Join(recvCfg.UserDownloadDir("receiver@example.com"), name)
+		deadline := time.Now().Add(5 * time.Second)
+		for !exists(path) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: received %q, %v", tc.name, got, err)
+		}
+	}
+
+	// Trust on first use: once pinned, a changed fingerprint is refused
+	// even though it is what the peer now announces.
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	peer := func(fp string) *models.Device {
+		return &models.Device{
+			ID:              "receiver",
+			IP:              "127.0.0.1",
+			Port:            ln.Addr().(*net.TCPAddr).Port,
+			Capabilities:    append([]string{models.CapTLS}, models.LocalCapabilities...),
+			CertFingerprint: fp,
+		}
+	}
+	sender := NewService(config.Config{ChunkSize: 1024}, "sender", nil, disc, func(string, interface{}) {}, func() string { return "sender@example.com" })
+	disc.AddManualPeer(peer(fingerprint))
+	disc.AddManualPeer(peer(strings.Repeat("1", len(fingerprint))))
+	data := []byte("pinned")
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "repinned.txt", int64(len(data))); !errors.Is(err, ErrCertMismatch) {
+		t.Fatalf("SendStream after fingerprint change = %v, want ErrCertMismatch", err)
+	}
+	if !disc.ForgetPin("receiver") {
+		t.Fatal("ForgetPin found no pin")
+	}
+	disc.AddManualPeer(peer(fingerprint))
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "repinned.txt", int64(len(data))); err != nil {
+		t.Fatalf("SendStream after ForgetPin = %v", err)
+	}
+
+	// A pinned peer that stops advertising TLS is not sent to in plaintext
+	downgraded := peer(fingerprint)
+	downgraded.Capabilities = models.LocalCapabilities
+	disc.AddManualPeer(downgraded)
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "downgraded.txt", int64(len(data))); !errors.Is(err, ErrCertMismatch) {
+		t.Fatalf("SendStream after dropping TLS = %v, want ErrCertMismatch", err)
+	}
+	if d, _ := disc.GetDevice("receiver"); d == nil || !d.CertMismatch {
+		t.Errorf("downgraded device not flagged: %+v", d)
+	}
+}
+
+func TestSendStreamReusesConnection(t *testing.T) {
+	sender, accepted, _ := startReceiver(t, config.Config{ChunkSize: 1024, ReuseConnections: true})
+
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("file number %d", i))
+		if err := sender.SendStream("receiver", bytes.NewReader(data), fmt.Sprintf("f%d.txt", i), int64(len(data))); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("expected 1 connection for 3 pooled sends, got %d", n)
+	}
+}
+
+func TestReceiveWriteError(t *testing.T) {
+	cfg := config.Config{DownloadDir: t.TempDir(), ChunkSize: 1024}
+	s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+	// A read-only handle fails every write, as a full disk would
+	s.openFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.OpenFile(name, os.O_RDONLY|os.O_CREATE, perm)
+	}
+
+	data := []byte("never written")
+	meta := wireMetadata{Version: protocolVersion, ID: "full", FileName: "full.txt", FileSize: int64(len(data))}
+	if err := s.receiveFile(nil, bytes.NewReader(frame(data)), meta, ""); err == nil {
+		t.Fatal("receive with failing writes succeeded")
+	}
+	dir := cfg.UserDownloadDir("test@example.com")
+	if exists(filepath.Join(dir, "full.txt")) {
+		t.Error("a file that was never written was moved into place")
+	}
+	if tr := s.GetTransfers(); len(tr) != 1 || tr[0].Status != "failed" || tr[0].Transferred != 0 {
+		t.Errorf("transfers %+v", tr)
+	}
+}
+
+func TestStaleConnRedialFails(t *testing.T) {
+	// A parked connection the peer has since closed, to a peer that is gone
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{ID: "receiver", IP: "127.0.0.1", Port: port})
+	sender := NewService(config.Config{ChunkSize: 1024, ReuseConnections: true}, "sender", nil, disc,
+		func(string, interface{}) {}, func() string { return "sender@example.com" })
+	sender.pool[net.JoinHostPort("127.0.0.1", strconv.Itoa(port))] = &pooledConn{Conn: client, idleSince: time.Now()}
+
+	data := []byte("data")
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "a.txt", int64(len(data))); err == nil {
+		t.Fatal("send over a stale connection to a gone peer succeeded")
+	}
+	if tr := sender.GetTransfers(); len(tr) != 1 || tr[0].Status != "failed" {
+		t.Errorf("transfers %+v", tr)
+	}
+	sender.releaseConn("127.0.0.1:1", nil, true) // must not panic
+}
+
+func TestMaxIncomingLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transfer_limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var s *Service
+	s = NewService(config.Config{DownloadDir: dir, ChunkSize: 1024, MaxIncoming: 2}, "test-device", nil, nil,
+		func(msg string, p interface{}) {
+			if pt, ok := p.(*models.PendingTransfer); ok && msg == "incoming_request" {
+				s.AcceptTransfer(pt.ID)
+			}
+		}, func() string { return "test@example.com" })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleIncoming(conn)
+		}
+	}()
+
+	// offer sends metadata on a new connection and returns the decision.
+	offer := func(id string) (net.Conn, bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(conn).Encode(wireMetadata{Version: protocolVersion, ID: id, FileName: id + ".txt", FileSize: 4})
+		var resp wireResponse
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatalf("%s: reading response: %v", id, err)
+		}
+		return conn, resp.Accept
+	}
+
+	// Two receives stall mid-stream and hold both slots
+	var held []net.Conn
+	for _, id := range []string{"a", "b"} {
+		conn, ok := offer(id)
+		if !ok {
+			t.Fatalf("%s rejected while under the limit", id)
+		}
+		conn.Write(frameHeader(4, []byte("da")))
+		held = append(held, conn)
+	}
+
+	over, ok := offer("c")
+	over.Close()
+	if ok {
+		t.Fatal("third concurrent transfer accepted over MaxIncoming=2")
+	}
+
+	// Finishing the held transfers frees the slots again
+	for _, conn := range held {
+		conn.Write([]byte("ta"))
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.receiving) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, ok := offer("d")
+	conn.Close()
+	if !ok {
+		t.Error("transfer rejected after slots were released")
+	}
+}
+
+func TestSilentConnectionTimesOut(t *testing.T) {
+	defer func(d time.Duration) { metadataTimeout = d }(metadataTimeout)
+	metadataTimeout = 100 * time.Millisecond
+
+	s := NewService(config.Config{DownloadDir: t.TempDir(), ChunkSize: 1024}, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "" })
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		s.handleIncoming(server)
+		close(done)
+	}()
+	// The peer connects and sends nothing
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection without an offer kept open")
+	}
+}
+
+func TestSenderConfirmation(t *testing.T) {
+	sender, _, _ := startReceiver(t, config.Config{ChunkSize: 1024})
+
+	for _, confirm := range []bool{true, false} {
+		done := make(chan error, 1)
+		data := []byte("needs a second look")
+		go func() {
+			done <- sender.SendStreamWithOptions("receiver", bytes.NewReader(data), "confirm.txt", int64(len(data)), SendOptions{RequireConfirm: true})
+		}()
+
+		var id string
+		deadline := time.Now().Add(5 * time.Second)
+		for id == "" && time.Now().Before(deadline) {
+			for _, tr := range sender.GetTransfers() {
+				if tr.Status == "awaiting_confirmation" {
+					id = tr.ID
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if id == "" {
+			t.Fatal("send never reached awaiting_confirmation")
+		}
+		if err := sender.ConfirmTransfer(id, confirm); err != nil {
+			t.Fatal(err)
+		}
+
+		err := <-done
+		if confirm && err != nil {
+			t.Errorf("confirmed send failed: %v", err)
+		}
+		if !confirm && !errors.Is(err, ErrCancelled) {
+			t.Errorf("declined send returned %v, want ErrCancelled", err)
+		}
+	}
+}
+
+func TestCompressionSkipsCompressedTypes(t *testing.T) {
+	sender, _, dir := startReceiver(t, config.Config{ChunkSize: 1024, Compress: true})
+	data := bytes.Repeat([]byte("the same line over and over\n"), 2000)
+
+	for _, tc := range []struct {
+		name       string
+		compressed bool
+	}{
+		{"notes.txt", true},
+		{"archive.zip", false},
+	} {
+		if err := sender.SendStream("receiver", bytes.NewReader(data), tc.name, int64(len(data))); err != nil {
+			t.Fatalf("send %s: %v", tc.name, err)
+		}
+		var tr *models.Transfer
+		for _, x := range sender.GetTransfers() {
+			if x.FileName == tc.name {
+				tr = x
+			}
+		}
+		if tr == nil {
+			t.Fatalf("no transfer recorded for %s", tc.name)
+		}
+		if got := tr.WireBytes < int64(len(data)); got != tc.compressed {
+			t.Errorf("%s: compressed = %v (%d wire bytes for %d), want %v", tc.name, got, tr.WireBytes, len(data), tc.compressed)
+		}
+		// The sender can finish before the receiver has closed the file
+		var got []byte
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got, _ = os.ReadFile(filepath.Join(dir, tc.name)); len(got) == len(data) {
+				break
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: received %d bytes that don't match what was sent", tc.name, len(got))
+		}
+	}
+}
+
+func TestReceiveFileStalledSender(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "transfer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := config.Config{DownloadDir: tmpDir, ChunkSize: 1024, StallTimeout: 100 * time.Millisecond}
+	var statuses []string
+	var last *models.Transfer
+	s := NewService(cfg, "test-device", nil, nil, func(msg string, p interface{}) {
+		if tr, ok := p.(*models.Transfer); ok {
+			statuses = append(statuses, tr.Status)
+			last = tr
+		}
+	}, func() string { return "test@example.com" })
+
+	// The sender writes part of the file, then goes quiet without closing
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go remote.Write(frameHeader(1000, []byte("a little")))
+
+	meta := wireMetadata{ID: "stall-recv", FileName: "stall.bin", FileSize: 1000}
+	err = s.receiveFile(local, local, meta, "")
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("receiveFile = %v, want ErrStalled", err)
+	}
+	if last == nil || last.Status != "failed" || last.Error == "" {
+		t.Fatalf("expected failed with a reason, got %+v", last)
+	}
+	if statuses[len(statuses)-2] != "stalled" {
+		t.Errorf("statuses = %v, want stalled before failed", statuses)
+	}
+}
+
+func TestSendStreamStalledReceiver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Accept the offer, then never read the payload
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadBytes('\n')
+		json.NewEncoder(conn).Encode(wireResponse{Accept: true})
+		time.Sleep(5 * time.Second)
+	}()
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{ID: "receiver", IP: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port})
+	var statuses []string
+	sender := NewService(config.Config{ChunkSize: 64 * 1024, StallTimeout: 200 * time.Millisecond}, "sender", nil, disc,
+		func(msg string, p interface{}) {
+			if tr, ok := p.(*models.Transfer); ok {
+				statuses = append(statuses, tr.Status)
+			}
+		}, func() string { return "sender@example.com" })
+
+	// Far more than the socket buffers can absorb
+	const size = 1 << 30
+	done := make(chan error, 1)
+	go func() { done <- sender.SendStream("receiver", io.LimitReader(zeroReader{}, size), "big.bin", size) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStalled) {
+			t.Fatalf("SendStream = %v, want ErrStalled", err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("SendStream blocked on a receiver that stopped reading")
+	}
+	if n := len(statuses); n < 2 || statuses[n-2] != "stalled" || statuses[n-1] != "failed" {
+		t.Errorf("statuses end %v, want stalled then failed", statuses)
+	}
+}
+
+// fakeReceiver listens on loopback and runs handle for each connection, and
+// returns a sender with the listener registered as peer "receiver". store
+// may be nil.
+func fakeReceiver(tb testing.TB, store *storagemock.Store, handle func(conn net.Conn, r *bufio.Reader)) *Service {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{ID: "receiver", IP: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port})
+	var st Store // a nil *storagemock.Store would not be a nil Store
+	if store != nil {
+		st = store
+	}
+	var sender *Service
+	sender = NewService(config.Config{ChunkSize: 1024}, "sender", st, disc, func(msg string, p interface{}) {
+		// Decline every confirmation request
+		if tr, ok := p.(*models.Transfer); ok && tr.Status == "awaiting_confirmation" {
+			go sender.ConfirmTransfer(tr.ID, false)
+		}
+	}, func() string { return "sender@example.com" })
+	return sender
+}
+
+func TestSendStreamRecordsEachTerminalStatus(t *testing.T) {
+	defer func(d time.Duration) { offerResponseTimeout = d }(offerResponseTimeout)
+	offerResponseTimeout = 200 * time.Millisecond
+
+	respond := func(resp wireResponse) func(net.Conn, *bufio.Reader) {
+		return func(conn net.Conn, r *bufio.Reader) {
+			r.ReadBytes('\n')
+			json.NewEncoder(conn).Encode(resp)
+			if resp.Accept {
+				io.Copy(io.Discard, r)
+			}
+		}
+	}
+	data := []byte("history payload")
+	for _, tc := range []struct {
+		status string
+		handle func(net.Conn, *bufio.Reader)
+		src    io.Reader
+		opts   SendOptions
+	}{
+		{"completed", respond(wireResponse{Accept: true}), bytes.NewReader(data), SendOptions{}},
+		{"rejected", respond(wireResponse{}), bytes.NewReader(data), SendOptions{}},
+		{"failed", respond(wireResponse{Accept: true}), &failingReader{data: data[:4], err: io.ErrUnexpectedEOF}, SendOptions{}},
+		{"timed_out", func(conn net.Conn, r *bufio.Reader) { r.ReadBytes('\n'); time.Sleep(time.Second) }, bytes.NewReader(data), SendOptions{}},
+		{"cancelled", respond(wireResponse{Accept: true}), bytes.NewReader(data), SendOptions{RequireConfirm: true}},
+	} {
+		t.Run(tc.status, func(t *testing.T) {
+			store := storagemock.New()
+			sender := fakeReceiver(t, store, tc.handle)
+			sender.SendStreamWithOptions("receiver", tc.src, "h.txt", int64(len(data)), tc.opts)
+
+			h := waitForHistory(t, store, "sender@example.com", 1)
+			if h[0].Status != tc.status {
+				t.Errorf("history status = %q, want %q", h[0].Status, tc.status)
+			}
+
+			// A second terminal record for the same transfer is dropped
+			tr := sender.GetTransfers()[0]
+			sender.recordHistory("sender@example.com", tr, "failed")
+			time.Sleep(20 * time.Millisecond)
+			if n := len(store.History("sender@example.com")); n != 1 {
+				t.Errorf("got %d history records after a duplicate, want 1", n)
+			}
+		})
+	}
+}
+
+// BenchmarkSendSmallFiles compares sending 100 small files with a fresh
+// connection per file against one pooled connection.
+func BenchmarkSendSmallFiles(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	payload := bytes.Repeat([]byte("x"), 4*1024)
+	for _, reuse := range []bool{false, true} {
+		name := "dial-per-file"
+		if reuse {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			sender, _, _ := startReceiver(b, config.Config{ChunkSize: 32 * 1024, ReuseConnections: reuse})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for f := 0; f < 100; f++ {
+					if err := sender.SendStream("receiver", bytes.NewReader(payload), "small.bin", int64(len(payload))); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+var benchSize = flag.Int64("transfer.benchsize", 64<<20, "payload size in bytes for BenchmarkThroughput")
+
+// zeroReader is an endless source of zero bytes, so large benchmark payloads
+// don't need to be held in memory.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkThroughput streams a -transfer.benchsize payload to a real
+// loopback receiver via SendStream for a range of chunk sizes. The MB/s
+// column is the end-to-end rate, including the receiver's disk writes.
+//
+//	go test ./internal/transfer -run '^$' -bench Throughput -args -transfer.benchsize=268435456
+func BenchmarkThroughput(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, chunk := range []int{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("chunk=%dKB", chunk>>10), func(b *testing.B) {
+			sender, _, _ := startReceiver(b, config.Config{ChunkSize: chunk})
+			b.SetBytes(*benchSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src := io.LimitReader(zeroReader{}, *benchSize)
+				if err := sender.SendStream("receiver", src, "bench.bin", *benchSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSocketBuffers is BenchmarkThroughput at a 64KB chunk size for a
+// range of socket buffer sizes, 0 being the OS default.
+func BenchmarkSocketBuffers(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, size := range []int{0, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size>>10), func(b *testing.B) {
+			sender, _, _ := startReceiver(b, config.Config{ChunkSize: 64 << 10, SocketReadBuffer: size, SocketWriteBuffer: size})
+			b.SetBytes(*benchSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src := io.LimitReader(zeroReader{}, *benchSize)
+				if err := sender.SendStream("receiver", src, "bench.bin", *benchSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	sender, _, dir := startReceiver(t, config.Config{ChunkSize: 1024, SocketReadBuffer: 256 << 10, SocketWriteBuffer: 256 << 10})
+	data := bytes.Repeat([]byte("s"), 100<<10)
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "buf.bin", int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "buf.bin")
+	deadline := time.Now().Add(5 * time.Second)
+	for !exists(path) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+	if n := sender.readerSize(); n != 256<<10 {
+		t.Errorf("reader size %d", n)
+	}
+	if n := (&Service{config: config.Config{SocketReadBuffer: 64 << 20}}).readerSize(); n != maxReaderSize {
+		t.Errorf("reader size %d, want the %d cap", n, maxReaderSize)
+	}
+}
+
+func TestTypedCallbacks(t *testing.T) {
+	dir := t.TempDir()
+	recv := NewService(config.Config{DownloadDir: dir, ChunkSize: 1024}, "receiver", nil, nil,
+		func(string, interface{}) {}, func() string { return "receiver@example.com" })
+	var offers int32
+	recv.OnIncomingRequest(func(pt *models.PendingTransfer) {
+		atomic.AddInt32(&offers, 1)
+		recv.AcceptTransfer(pt.ID)
+	})
+	received := make(chan *models.Transfer, 1)
+	recv.OnTransferComplete(func(tr *models.Transfer) { received <- tr })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go recv.handleIncoming(conn)
+		}
+	}()
+
+	disc := discovery.NewService(config.Config{}, "127.0.0.1", "sender", nil)
+	disc.AddManualPeer(&models.Device{
+		ID:           "receiver",
+		IP:           "127.0.0.1",
+		Port:         ln.Addr().(*net.TCPAddr).Port,
+		Capabilities: models.LocalCapabilities,
+	})
+	sender := NewService(config.Config{ChunkSize: 1024}, "sender", nil, disc, func(string, interface{}) {}, func() string { return "sender@example.com" })
+	var completions int32
+	sender.OnTransferComplete(func(tr *models.Transfer) {
+		atomic.AddInt32(&completions, 1)
+		if tr.Status != "completed" {
+			t.Errorf("sender completion status = %q", tr.Status)
+		}
+	})
+
+	data := []byte("embedded")
+	if err := sender.SendStream("receiver", bytes.NewReader(data), "embedded.txt", int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tr := <-received:
+		if tr.Status != "completed" || tr.FileName != "embedded.txt" {
+			t.Errorf("receiver completion = %+v", tr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver never reported completion")
+	}
+	if n := atomic.LoadInt32(&offers); n != 1 {
+		t.Errorf("OnIncomingRequest fired %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&completions); n != 1 {
+		t.Errorf("sender OnTransferComplete fired %d times, want 1", n)
+	}
+}
+
+func TestZeroByteTransfer(t *testing.T) {
+	sender, _, dir := startReceiver(t, config.Config{ChunkSize: 1024})
+	if err := sender.SendStream("receiver", bytes.NewReader(nil), "empty.bin", 0); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "empty.bin")
+	deadline := time.Now().Add(5 * time.Second)
+	for !exists(path) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("received file: %v, %v", fi, err)
+	}
+	for _, tr := range sender.GetTransfers() {
+		if tr.Status != "completed" || tr.Progress != 100 {
+			t.Errorf("sender transfer = %s at %.0f%%, want completed at 100%%", tr.Status, tr.Progress)
+		}
+	}
+}
+
+func TestEmptyFileNameRejected(t *testing.T) {
+	sender, accepted, _ := startReceiver(t, config.Config{ChunkSize: 1024})
+	for _, name := range []string{"", "  ", ".."} {
+		err := sender.SendStream("receiver", bytes.NewReader([]byte("x")), name, 1)
+		if !errors.Is(err, ErrBadFileName) {
+			t.Errorf("SendStream(%q) = %v, want ErrBadFileName", name, err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 0 {
+		t.Errorf("sender dialed the receiver %d times for unusable names", n)
+	}
+
+	// A sender that doesn't check is refused by the receiver
+	s := NewService(config.Config{DownloadDir: t.TempDir()}, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "test@example.com" })
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleIncoming(server)
+	meta := wireMetadata{Version: protocolVersion, ID: "noname", FileName: "", FileSize: 1, SenderName: "peer"}
+	if err := writeHeader(client, meta); err != nil {
+		t.Fatal(err)
+	}
+	var resp wireResponse
+	if err := readHeader(bufio.NewReader(client), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Accept || !strings.Contains(resp.Reason, "file name is empty") {
+		t.Errorf("response = %+v, want refusal for the empty name", resp)
+	}
+}
+
+func TestBlockedExtensions(t *testing.T) {
+	blocked := []string{".exe", "BAT", " .ps1"}
+	for _, tc := range []struct {
+		name    string
+		blocked bool
+	}{
+		{"setup.exe", true},
+		{"SETUP.EXE", true},
+		{"photo.jpg.exe", true},
+		{"setup.exe.", true},
+		{"setup.exe .", true},
+		{"run.bat", true},
+		{"script.ps1", true},
+		{"photo.jpg", false},
+		{"photo.exe.jpg", false},
+		{"exe", false},
+		{"notes.executable", false},
+	} {
+		if _, got := blockedExtension(tc.name, blocked); got != tc.blocked {
+			t.Errorf("blockedExtension(%q) = %v, want %v", tc.name, got, tc.blocked)
+		}
+	}
+	if _, got := blockedExtension("setup.exe", nil); got {
+		t.Error("nil list blocked setup.exe")
+	}
+
+	// The sender hears why, and the user is never asked
+	var asked int32
+	s := NewService(config.Config{DownloadDir: t.TempDir(), BlockedExtensions: blocked}, "test-device", nil, nil,
+		func(msg string, _ interface{}) {
+			if msg == models.EventIncomingRequest {
+				atomic.AddInt32(&asked, 1)
+			}
+		}, func() string { return "test@example.com" })
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleIncoming(server)
+	meta := wireMetadata{Version: protocolVersion, ID: "blocked", FileName: "invoice.pdf.exe", FileSize: 1, SenderName: "peer"}
+	if err := writeHeader(client, meta); err != nil {
+		t.Fatal(err)
+	}
+	var resp wireResponse
+	if err := readHeader(bufio.NewReader(client), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Accept || !strings.Contains(resp.Reason, ".exe files are not accepted") {
+		t.Errorf("response = %+v, want refusal naming .exe", resp)
+	}
+	if n := atomic.LoadInt32(&asked); n != 0 {
+		t.Errorf("user was asked about a blocked file %d times", n)
+	}
+}
+
+// fakeClamd answers INSTREAM scans, finding anything containing "EICAR".
+// With broken set it drops every connection instead.
+func fakeClamd(t *testing.T, broken bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if broken {
+					return
+				}
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if bytes.Contains(data, []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return "tcp:" + ln.Addr().String()
+}
+
+func TestReceiveFileVirusScan(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		data       string
+		broken     bool
+		failClosed bool
+		wantOK     bool
+	}{
+		{"clean", "harmless", false, false, true},
+		{"infected", "xx EICAR xx", false, false, false},
+		{"unscanned fail open", "harmless", true, false, true},
+		{"unscanned fail closed", "harmless", true, true, false},
+	} {
+		root := t.TempDir()
+		cfg := config.Config{
+			DownloadDir:    filepath.Join(root, "downloads"),
+			QuarantineDir:  filepath.Join(root, "quarantine"),
+			ClamdAddress:   fakeClamd(t, tc.broken),
+			ScanFailClosed: tc.failClosed,
+			ChunkSize:      4,
+		}
+		var failed *models.Transfer
+		s := NewService(cfg, "test-device", nil, nil, func(event string, p interface{}) {
+			if tr, ok := p.(*models.Transfer); ok && event == models.EventTransferFailed {
+				failed = tr
+			}
+		}, func() string { return "" })
+
+		meta := wireMetadata{ID: tc.name, FileName: "file.txt", FileSize: int64(len(tc.data))}
+		err := s.receiveFile(nil, bytes.NewReader(frame([]byte(tc.data))), meta, "")
+		saved := exists(filepath.Join(cfg.DownloadDir, "file.txt"))
+		quarantined := exists(filepath.Join(cfg.QuarantineDir, "file.txt"))
+		if tc.wantOK {
+			if err != nil || !saved || quarantined {
+				t.Errorf("%s: err %v, saved %v, quarantined %v", tc.name, err, saved, quarantined)
+			}
+			continue
+		}
+		if err == nil || saved || !quarantined {
+			t.Errorf("%s: err %v, saved %v, quarantined %v", tc.name, err, saved, quarantined)
+		}
+		if exists(filepath.Join(cfg.DownloadDir, "file.txt.incomplete")) {
+			t.Errorf("%s: partial file left behind", tc.name)
+		}
+		if failed == nil {
+			t.Errorf("%s: no transfer_failed broadcast", tc.name)
+		} else if tc.name == "infected" && !strings.HasPrefix(failed.Error, "infected") {
+			t.Errorf("%s: error %q, want it to start with \"infected\"", tc.name, failed.Error)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	sender, _, _ := startReceiver(t, config.Config{ChunkSize: 1024})
+	for i, size := range []int{3000, 500} {
+		data := bytes.Repeat([]byte("b"), size)
+		if err := sender.SendStream("receiver", bytes.NewReader(data), fmt.Sprintf("bw%d.bin", i), int64(size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := sender.Bandwidth()
+	if r.BytesSent != 3500 || r.BytesReceived != 0 {
+		t.Errorf("totals: sent %d, received %d", r.BytesSent, r.BytesReceived)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].PeerID != "receiver" || r.Peers[0].BytesSent != 3500 {
+		t.Errorf("peers = %+v", r.Peers)
+	}
+	if len(r.Minutes) != bandwidthWindow {
+		t.Fatalf("%d minutes, want %d", len(r.Minutes), bandwidthWindow)
+	}
+	var inWindow int64
+	for _, m := range r.Minutes {
+		inWindow += m.BytesSent
+	}
+	if inWindow != 3500 || r.Minutes[len(r.Minutes)-1].Start.After(time.Now()) {
+		t.Errorf("minutes hold %d bytes, last starts %v", inWindow, r.Minutes[len(r.Minutes)-1].Start)
+	}
+}
+
+func TestOpenLocalFile(t *testing.T) {
+	root := t.TempDir()
+	base := filepath.Join(root, "base")
+	os.MkdirAll(filepath.Join(base, "sub"), 0755)
+	os.WriteFile(filepath.Join(base, "sub", "ok.txt"), []byte("ok"), 0644)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644)
+
+	f, info, err := OpenLocalFile(filepath.Join(base, "sub", "ok.txt"), []string{"", base})
+	if err != nil {
+		t.Fatalf("regular file inside base: %v", err)
+	}
+	f.Close()
+	if info.Size() != 2 {
+		t.Errorf("size %d, want 2", info.Size())
+	}
+
+	if _, _, err := OpenLocalFile(filepath.Join(root, "secret.txt"), []string{base}); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("file outside base: %v, want ErrUnsafePath", err)
+	}
+	if _, _, err := OpenLocalFile(filepath.Join(base, "missing.txt"), []string{base}); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v, want not-exist", err)
+	}
+	if _, _, err := OpenLocalFile(filepath.Join(base, "sub"), []string{base}); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("directory: %v, want ErrUnsafePath", err)
+	}
+
+	if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(base, "escape.txt")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if _, _, err := OpenLocalFile(filepath.Join(base, "escape.txt"), []string{base}); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("symlink escaping base: %v, want ErrUnsafePath", err)
+	}
+	os.Symlink(filepath.Join(base, "sub", "ok.txt"), filepath.Join(base, "inside.txt"))
+	if f, _, err := OpenLocalFile(filepath.Join(base, "inside.txt"), []string{base}); err != nil {
+		t.Errorf("symlink within base: %v", err)
+	} else {
+		f.Close()
+	}
+}
+
+func TestReliableTransfer(t *testing.T) {
+	sender, _, dir := startReceiver(t, config.Config{ChunkSize: 1024, ReliableTransfers: true, ReuseConnections: true})
+	for i, size := range []int{5000, 0, 1024} {
+		data := make([]byte, size)
+		rand.Read(data)
+		name := fmt.Sprintf("reliable%d.bin", i)
+		if err := sender.SendStream("receiver", bytes.NewReader(data), name, int64(size)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		path := filepath.Join(dir, name)
+		deadline := time.Now().Add(5 * time.Second)
+		for !exists(path) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: received %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// corruptOnce flips a bit in the nth write it sees, once.
+type corruptOnce struct {
+	w    io.Writer
+	n    int
+	seen int
+}
+
+func (c *corruptOnce) Write(p []byte) (int, error) {
+	c.seen++
+	if c.seen == c.n && len(p) > 0 {
+		bad := append([]byte(nil), p...)
+		bad[0] ^= 1
+		return c.w.Write(bad)
+	}
+	return c.w.Write(p)
+}
+
+func TestReliableChunkRetransmission(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Writes alternate record header, data; the 4th is the second chunk's data
+	cw := &chunkWriter{id: "test", w: &corruptOnce{w: client, n: 4}, conn: client, stallTimeout: 5 * time.Second}
+	want := bytes.Repeat([]byte("0123456789"), 30)
+	go func() {
+		for i := 0; i < len(want); i += 100 {
+			if _, err := cw.Write(want[i : i+100]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := cw.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	got, err := io.ReadAll(&chunkReader{r: server, ack: server})
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("received %q, %v", got, err)
+	}
+
+	// A receiver that never answers fails the send after the last attempt
+	defer func(d time.Duration) { chunkAckTimeout = d }(chunkAckTimeout)
+	chunkAckTimeout = 20 * time.Millisecond
+	a, b := net.Pipe()
+	defer a.Close()
+	go io.Copy(io.Discard, b)
+	cw = &chunkWriter{id: "test", w: a, conn: a, stallTimeout: time.Second}
+	if _, err := cw.Write([]byte("unheard")); err == nil || !strings.Contains(err.Error(), "not acknowledged after 3 attempts") {
+		t.Errorf("unacknowledged chunk: %v", err)
+	}
+}
+
+func TestDuplicateFiles(t *testing.T) {
+	for _, mode := range []string{DuplicateFlag, DuplicateSkip} {
+		cfg := config.Config{DownloadDir: t.TempDir(), DuplicateFiles: mode, ChunkSize: 4}
+		s := NewService(cfg, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "" })
+		receive := func(id, name, data string) *models.Transfer {
+			meta := wireMetadata{ID: id, FileName: name, FileSize: int64(len(data))}
+			if err := s.receiveFile(nil, bytes.NewReader(frame([]byte(data))), meta, ""); err != nil {
+				t.Fatal(err)
+			}
+			return s.transfers[id]
+		}
+		receive("a", "first.txt", "same content")
+		if tr := receive("b", "other.txt", "different"); tr.DuplicateOf != "" {
+			t.Errorf("%s: different content flagged as duplicate of %q", mode, tr.DuplicateOf)
+		}
+		tr := receive("c", "second.txt", "same content")
+		if tr.DuplicateOf != "first.txt" || tr.Status != "completed" {
+			t.Errorf("%s: duplicateOf %q, status %s", mode, tr.DuplicateOf, tr.Status)
+		}
+		kept := exists(filepath.Join(cfg.DownloadDir, "second.txt"))
+		if kept != (mode == DuplicateFlag) {
+			t.Errorf("%s: second copy kept = %v", mode, kept)
+		}
+		if mode == DuplicateSkip && tr.FilePath != filepath.Join(cfg.DownloadDir, "first.txt") {
+			t.Errorf("%s: file path %q, want the existing copy", mode, tr.FilePath)
+		}
+	}
+}
+
+func TestGetPendingCopies(t *testing.T) {
+	s := NewService(config.Config{}, "test-device", nil, nil, nil, func() string { return "" })
+	s.pending["b"] = &models.PendingTransfer{ID: "b", FileName: "b.txt", Response: make(chan bool)}
+	s.pending["a"] = &models.PendingTransfer{ID: "a", FileName: "a.txt", Response: make(chan bool)}
+
+	list := s.GetPending()
+	if len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("pending = %+v", list)
+	}
+	list[0].FileName = "changed"
+	if s.pending["a"].FileName != "a.txt" {
+		t.Error("GetPending returned the stored offer, not a copy")
+	}
+	data, _ := json.Marshal(list[0])
+	if strings.Contains(string(data), "Response") || strings.Contains(string(data), "DestDir") {
+		t.Errorf("internal fields serialized: %s", data)
+	}
+}
+
+func TestAutoAcceptSizeCap(t *testing.T) {
+	store := storagemock.New()
+	s := NewService(config.Config{}, "test-device", store, nil, func(string, interface{}) {}, func() string { return "owner@example.com" })
+	store.AddTrustedDevice("owner@example.com", &models.TrustedDevice{DeviceID: "laptop", TrustLevel: models.TrustAutoAccept, AutoAcceptMaxBytes: 1 << 20})
+	store.AddTrustedDevice("owner@example.com", &models.TrustedDevice{DeviceID: "phone", TrustLevel: models.TrustAutoAccept})
+
+	for _, tc := range []struct {
+		sender string
+		size   int64
+		want   bool
+	}{
+		{"laptop", 1 << 20, true},    // at the cap
+		{"laptop", 1<<20 + 1, false}, // over it: prompt
+		{"phone", 10 << 30, true},    // no cap
+		{"stranger", 10, false},      // not trusted
+	} {
+		meta := wireMetadata{ID: "x", SenderID: tc.sender, FileSize: tc.size}
+		if got := s.autoAccepts(meta); got != tc.want {
+			t.Errorf("%s, %d bytes: autoAccepts = %v, want %v", tc.sender, tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestHistoryRecordsDeviceName(t *testing.T) {
+	store := storagemock.New()
+	s := NewService(config.Config{DeviceName: "Laptop"}, "test-device", store, nil, func(string, interface{}) {}, func() string { return "" })
+	s.recordHistory("a@example.com", &models.Transfer{ID: "1", Direction: "send"}, "completed")
+	s.SetDeviceName("Work laptop")
+	s.recordHistory("a@example.com", &models.Transfer{ID: "2", Direction: "send"}, "completed")
+
+	names := map[string]string{}
+	for _, h := range waitForHistory(t, store, "a@example.com", 2) {
+		names[h.ID] = h.DeviceName
+	}
+	if names["1"] != "Laptop" || names["2"] != "Work laptop" {
+		t.Errorf("device names = %v", names)
+	}
+}
+
+func TestAbortAll(t *testing.T) {
+	sender, _, _ := startReceiver(t, config.Config{ChunkSize: 4})
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendStream("receiver", pr, "abort.bin", 1000) }()
+	pw.Write(make([]byte, 8)) // returns once the sender is streaming
+
+	offer := make(chan bool, 1)
+	sender.mu.Lock()
+	sender.pending["offer"] = &models.PendingTransfer{ID: "offer", Response: offer}
+	sender.mu.Unlock()
+
+	if n := sender.AbortAll(); n != 2 {
+		t.Errorf("aborted %d, want 2", n)
+	}
+	if ok := <-offer; ok {
+		t.Error("pending offer was accepted")
+	}
+	go func() {
+		for {
+			if _, err := pw.Write(make([]byte, 8)); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("aborted send succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send not aborted")
+	}
+	pr.Close()
+	tr := sender.GetTransfers()[0]
+	if tr.Status != "cancelled" || tr.Error != abortedError {
+		t.Errorf("status %q, error %q", tr.Status, tr.Error)
+	}
+	if len(sender.streams) != 0 || len(sender.aborted) != 0 {
+		t.Errorf("abort state left behind: %v %v", sender.streams, sender.aborted)
+	}
+}
+
+func TestPing(t *testing.T) {
+	sender, _, _ := startReceiver(t, config.Config{})
+	if rtt, err := sender.Ping("receiver"); err != nil || rtt <= 0 {
+		t.Errorf("Ping = %s, %v", rtt, err)
+	}
+	if _, err := sender.Ping("nobody"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("unknown peer: %v", err)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close() // nothing listens there now
+	sender.discovery.AddManualPeer(&models.Device{ID: "closed", IP: "127.0.0.1", Port: port, LastSeen: time.Now()})
+	if _, err := sender.Ping("closed"); err == nil {
+		t.Error("closed port reported reachable")
+	}
+}
+
+func TestUnwritableDownloadDir(t *testing.T) {
+	sender, _, dir := startReceiver(t, config.Config{ChunkSize: 1024})
+	// A file where the directory should be, as when a mount disappears
+	os.RemoveAll(dir)
+	os.MkdirAll(filepath.Dir(dir), 0755)
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := sender.SendStream("receiver", strings.NewReader("data"), "a.txt", 4)
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), storageUnavailable) {
+		t.Errorf("send to a missing directory: %v", err)
+	}
+
+	if os.Getuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	os.Remove(dir)
+	if err := os.Mkdir(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	err = sender.SendStream("receiver", strings.NewReader("data"), "b.txt", 4)
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), storageUnavailable) {
+		t.Errorf("send to a read-only directory: %v", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	sender, accepted, dir := startReceiver(t, config.Config{ChunkSize: 1024})
+	opts := SendOptions{IdempotencyKey: "upload-1"}
+	for i := 0; i < 2; i++ {
+		if err := sender.SendStreamWithOptions("receiver", strings.NewReader("data"), "a.txt", 4, opts); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("retry with the same key was offered again: %d offers", n)
+	}
+	id := idempotentID(sender.deviceID, "", "receiver", "upload-1")
+	sender.mu.Lock()
+	tr := sender.transfers[id]
+	sender.mu.Unlock()
+	if tr == nil || tr.Status != "completed" {
+		t.Errorf("transfer %s: %+v", id, tr)
+	}
+
+	opts.IdempotencyKey = "upload-2"
+	if err := sender.SendStreamWithOptions("receiver", strings.NewReader("data"), "a.txt", 4, opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("a new key should send again: %d offers", n)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 2 {
+		t.Errorf("received %d files, want 2", len(entries))
+	}
+
+	// Another user reusing a key is a different transfer, not a retry
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		opts := SendOptions{IdempotencyKey: "shared", SenderEmail: email}
+		if err := sender.SendStreamWithOptions("receiver", strings.NewReader("data"), "b.txt", 4, opts); err != nil {
+			t.Fatalf("%s: %v", email, err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 4 {
+		t.Errorf("two senders sharing a key: %d offers, want 4", n)
+	}
+}
+
+func TestOfferCarriesContentType(t *testing.T) {
+	types := make(chan string, 4)
+	sender := fakeReceiver(t, nil, func(conn net.Conn, r *bufio.Reader) {
+		meta, err := readMetadata(r)
+		if err != nil {
+			return
+		}
+		types <- meta.ContentType
+		json.NewEncoder(conn).Encode(wireResponse{Reason: "just looking"})
+	})
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	for _, tc := range []struct{ name, data, want string }{
+		{"photo", png, "image/png"},                    // no extension: sniffed
+		{"notes.pdf", "plain text", "application/pdf"}, // the extension wins
+	} {
+		sender.SendStream("receiver", strings.NewReader(tc.data), tc.name, int64(len(tc.data)))
+		if got := <-types; got != tc.want {
+			t.Errorf("%s: content type %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHistoryOff(t *testing.T) {
+	store := storagemock.New()
+	s := NewService(config.Config{}, "test-device", store, nil, func(string, interface{}) {}, func() string { return "" })
+	store.SetIncognito("private@example.com", true)
+	s.recordHistory("private@example.com", &models.Transfer{ID: "1", Direction: "send"}, "completed")
+	s.recordHistory("open@example.com", &models.Transfer{ID: "2", Direction: "send"}, "completed")
+	s.Close() // both writes are done
+	if h := store.History("open@example.com"); len(h) != 1 {
+		t.Errorf("open user has %d history records, want 1", len(h))
+	}
+	if h := store.History("private@example.com"); len(h) != 0 {
+		t.Errorf("incognito user has %d history records", len(h))
+	}
+
+	store = storagemock.New()
+	s = NewService(config.Config{DisableHistory: true}, "test-device", store, nil, func(string, interface{}) {}, func() string { return "" })
+	s.recordHistory("open@example.com", &models.Transfer{ID: "3", Direction: "send"}, "completed")
+	s.Close()
+	if h := store.History("open@example.com"); len(h) != 0 {
+		t.Errorf("DisableHistory still wrote %d records", len(h))
+	}
+}
+
+// downStore is a store whose database is unreachable for history writes.
+type downStore struct{ *storagemock.Store }
+
+func (downStore) AddHistory(string, *models.TransferHistory) error {
+	return errors.New("connection refused")
+}
+
+func TestHistoryBufferedOnClose(t *testing.T) {
+	buffer := filepath.Join(t.TempDir(), "history.jsonl")
+	cfg := config.Config{HistoryBufferFile: buffer}
+	s := NewService(cfg, "test-device", downStore{storagemock.New()}, nil, func(string, interface{}) {}, func() string { return "" })
+	for _, id := range []string{"1", "2", "3"} {
+		s.recordHistory("a@example.com", &models.Transfer{ID: id, Direction: "send"}, "completed")
+	}
+	start := time.Now()
+	s.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close waited out the retries: %s", d)
+	}
+
+	// The next start replays them, in order
+	store := storagemock.New()
+	NewService(cfg, "test-device", store, nil, func(string, interface{}) {}, func() string { return "" }).replayHistoryBuffer()
+	h := store.History("a@example.com")
+	if len(h) != 3 {
+		t.Fatalf("replayed %d records, want 3", len(h))
+	}
+	for i, want := range []string{"1", "2", "3"} {
+		if h[i].ID != want {
+			t.Errorf("record %d is %s, want %s", i, h[i].ID, want)
+		}
+	}
+	if exists(buffer) {
+		t.Error("buffer file kept after a full replay")
+	}
+}
+
+func TestRetentionKeepsPartials(t *testing.T) {
+	dir := t.TempDir()
+	s := NewService(config.Config{DownloadDir: dir, FileRetention: time.Hour}, "test-device", nil, nil, func(string, interface{}) {}, func() string { return "" })
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"done.txt", ".done.txt" + sidecarSuffix, "big.bin.incomplete", "resuming.bin"} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte("data"), 0644)
+		os.Chtimes(p, old, old)
+	}
+	s.resumes["r1"] = &resumeRecord{ID: "r1", Path: filepath.Join(dir, "resuming.bin")}
+
+	removed := s.pruneDownloads(time.Now())
+	if len(removed) != 1 || filepath.Base(removed[0]) != "done.txt" {
+		t.Errorf("removed %v, want only done.txt", removed)
+	}
+	if exists(filepath.Join(dir, ".done.txt"+sidecarSuffix)) {
+		t.Error("sidecar kept after its file was removed")
+	}
+	for _, name := range []string{"big.bin.incomplete", "resuming.bin"} {
+		if !exists(filepath.Join(dir, name)) {
+			t.Errorf("%s was deleted", name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	maxAttempts    = 3
+	requestTimeout = 10 * time.Second
+	// SignatureHeader carries the hex HMAC-SHA256 of the request body,
+	// keyed with the configured secret, as "sha256=<hex>".
+	SignatureHeader = "X-FileTransfer-Signature"
+)
+
+// Notifier POSTs JSON event payloads to a configured URL.
+// A nil *Notifier is valid and drops every event.
+type Notifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// New returns a Notifier for url, or nil when url is empty (webhooks disabled).
+func New(url, secret string) *Notifier {
+	if url == "" {
+		return nil
+	}
+	return &Notifier{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Notify delivers the event asynchronously, retrying with backoff on failure.
+func (n *Notifier) Notify(event string, data interface{}) {
+	if n == nil {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().UTC(),
+		"data":      data,
+	})
+	if err != nil {
+		log.Printf("[WEBHOOK] Marshal %s: %v", event, err)
+		return
+	}
+	go n.deliver(event, body)
+}
+
+func (n *Notifier) deliver(event string, body []byte) {
+	backoff := time.Second
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := n.post(body)
+		if err == nil {
+			return
+		}
+		log.Printf("[WEBHOOK] %s attempt %d/%d failed: %v", event, attempt, maxAttempts, err)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (n *Notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,433 @@
+// Package qrcode is a small QR Code encoder (byte mode, error correction
+// level L, versions 1–10) with PNG output. It covers the short payloads the
+// app needs — pairing URLs and tokens — without pulling in a dependency.
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Code is an encoded QR symbol. Modules[y][x] is true for dark modules.
+type Code struct {
+	Version int
+	Size    int
+	Modules [][]bool
+}
+
+// Per-version parameters for error correction level L.
+type versionInfo struct {
+	ecPerBlock int
+	blocks     []int // data codewords per block
+	align      []int // alignment pattern centre coordinates
+}
+
+var versions = [...]versionInfo{
+	1:  {7, []int{19}, nil},
+	2:  {10, []int{34}, []int{6, 18}},
+	3:  {15, []int{55}, []int{6, 22}},
+	4:  {20, []int{80}, []int{6, 26}},
+	5:  {26, []int{108}, []int{6, 30}},
+	6:  {18, []int{68, 68}, []int{6, 34}},
+	7:  {20, []int{78, 78}, []int{6, 22, 38}},
+	8:  {24, []int{97, 97}, []int{6, 24, 42}},
+	9:  {30, []int{116, 116}, []int{6, 26, 46}},
+	10: {18, []int{68, 68, 69, 69}, []int{6, 28, 50}},
+}
+
+func (v versionInfo) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+// Encode builds the smallest QR code that holds data.
+func Encode(data []byte) (*Code, error) {
+	for ver := 1; ver < len(versions); ver++ {
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*versions[ver].dataCodewords() {
+			return build(ver, countBits, data), nil
+		}
+	}
+	return nil, fmt.Errorf("qrcode: %d bytes is too long", len(data))
+}
+
+// PNG renders the code with scale pixels per module and the standard
+// four-module quiet zone.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	const quiet = 4
+	dim := (c.Size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, dim, dim))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y, row := range c.Modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+quiet)*scale+dx, (y+quiet)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ---- Construction ----
+
+type builder struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func build(ver, countBits int, data []byte) *Code {
+	vi := versions[ver]
+
+	// Bit stream: byte mode, length, payload, terminator, padding.
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := vi.dataCodewords() * 8
+	term := capacity - len(bits)
+	if term > 4 {
+		term = 4
+	}
+	bits.append(0, term)
+	bits.append(0, (8-len(bits)%8)%8)
+	codewords := bits.bytes()
+	for pad := byte(0xEC); len(codewords) < vi.dataCodewords(); pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	b := newBuilder(ver)
+	b.drawFunctionPatterns(ver)
+	b.drawCodewords(interleave(vi, codewords))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		b.applyMask(mask)
+		b.drawFormatBits(mask)
+		if p := b.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		b.applyMask(mask) // XOR again to undo
+	}
+	b.applyMask(best)
+	b.drawFormatBits(best)
+
+	return &Code{Version: ver, Size: b.size, Modules: b.modules}
+}
+
+func newBuilder(ver int) *builder {
+	size := 17 + 4*ver
+	b := &builder{size: size}
+	b.modules = make([][]bool, size)
+	b.function = make([][]bool, size)
+	for i := range b.modules {
+		b.modules[i] = make([]bool, size)
+		b.function[i] = make([]bool, size)
+	}
+	return b
+}
+
+func (b *builder) set(x, y int, dark bool) {
+	b.modules[y][x] = dark
+	b.function[y][x] = true
+}
+
+func (b *builder) drawFunctionPatterns(ver int) {
+	for i := 0; i < b.size; i++ {
+		b.set(6, i, i%2 == 0)
+		b.set(i, 6, i%2 == 0)
+	}
+	b.drawFinder(3, 3)
+	b.drawFinder(b.size-4, 3)
+	b.drawFinder(3, b.size-4)
+
+	align := versions[ver].align
+	last := len(align) - 1
+	for i, y := range align {
+		for j, x := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					b.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	b.drawFormatBits(0) // reserve the area; real bits are drawn after masking
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		v := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (v>>i)&1 != 0
+			a, c := b.size-11+i%3, i/3
+			b.set(a, c, bit)
+			b.set(c, a, bit)
+		}
+	}
+}
+
+func (b *builder) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= b.size || y >= b.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			b.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (b *builder) drawFormatBits(mask int) {
+	const eclL = 1
+	data := eclL<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		b.set(8, i, bit(i))
+	}
+	b.set(8, 7, bit(6))
+	b.set(8, 8, bit(7))
+	b.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		b.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		b.set(b.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		b.set(8, b.size-15+i, bit(i))
+	}
+	b.set(8, b.size-8, true) // dark module
+}
+
+func (b *builder) drawCodewords(data []byte) {
+	i := 0
+	for right := b.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < b.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = b.size - 1 - vert
+				}
+				if !b.function[y][x] && i < len(data)*8 {
+					b.modules[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (b *builder) applyMask(mask int) {
+	for y := 0; y < b.size; y++ {
+		for x := 0; x < b.size; x++ {
+			if b.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				b.modules[y][x] = !b.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores runs, 2x2 blocks and dark/light balance (ISO 18004 rules
+// 1, 2 and 4); it's only used to compare masks against each other.
+func (b *builder) penalty() int {
+	p := 0
+	for i := 0; i < b.size; i++ {
+		runRow, runCol := 1, 1
+		for j := 1; j < b.size; j++ {
+			if b.modules[i][j] == b.modules[i][j-1] {
+				runRow++
+				if runRow == 5 {
+					p += 3
+				} else if runRow > 5 {
+					p++
+				}
+			} else {
+				runRow = 1
+			}
+			if b.modules[j][i] == b.modules[j-1][i] {
+				runCol++
+				if runCol == 5 {
+					p += 3
+				} else if runCol > 5 {
+					p++
+				}
+			} else {
+				runCol = 1
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < b.size; y++ {
+		for x := 0; x < b.size; x++ {
+			if b.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := b.modules[y][x]
+				if c == b.modules[y-1][x] && c == b.modules[y][x-1] && c == b.modules[y-1][x-1] {
+					p += 3
+				}
+			}
+		}
+	}
+	total := b.size * b.size
+	p += (abs(dark*20-total*10) + total - 1) / total * 10
+	return p
+}
+
+// ---- Error correction ----
+
+func interleave(vi versionInfo, data []byte) []byte {
+	divisor := rsDivisor(vi.ecPerBlock)
+	var blocks, ecc [][]byte
+	off := 0
+	maxLen := 0
+	for _, n := range vi.blocks {
+		blk := data[off : off+n]
+		off += n
+		blocks = append(blocks, blk)
+		ecc = append(ecc, rsRemainder(blk, divisor))
+		maxLen = max(maxLen, n)
+	}
+	var out []byte
+	for i := 0; i < maxLen; i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	for i := 0; i < vi.ecPerBlock; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// ---- Helpers ----
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, (val>>i)&1 != 0)
+	}
+}
+
+func (bb bitBuffer) bytes() []byte {
+	out := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			out[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+	return out
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
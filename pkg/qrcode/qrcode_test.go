@@ -0,0 +1,249 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// Generator for 7 EC codewords, α^87 α^229 α^146 α^149 α^238 α^102 α^21
+	if got, want := rsDivisor(7), []byte{127, 122, 154, 164, 11, 68, 117}; !bytes.Equal(got, want) {
+		t.Errorf("rsDivisor(7) = %v, want %v", got, want)
+	}
+	// The "HELLO WORLD" 1-M example: 16 data codewords, 10 EC codewords
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("EC codewords = %v, want %v", got, want)
+	}
+}
+
+func TestVersionSelection(t *testing.T) {
+	// ISO 18004 byte-mode capacities at level L, versions 1-10
+	capacity := []int{1: 17, 2: 32, 3: 53, 4: 78, 5: 106, 6: 134, 7: 154, 8: 192, 9: 230, 10: 271}
+	for ver := 1; ver < len(capacity); ver++ {
+		for _, n := range []int{capacity[ver-1] + 1, capacity[ver]} {
+			c, err := Encode(bytes.Repeat([]byte("a"), n))
+			if err != nil {
+				t.Fatalf("%d bytes: %v", n, err)
+			}
+			if c.Version != ver || c.Size != 17+4*ver || len(c.Modules) != c.Size {
+				t.Errorf("%d bytes: version %d size %d, want version %d", n, c.Version, c.Size, ver)
+			}
+		}
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	c, err := Encode(make([]byte, 150))
+	if err != nil || c.Version != 7 {
+		t.Fatalf("version %d, %v", c.Version, err)
+	}
+	// Both copies hold the standard version 7 block, 000111 110010010100
+	var right, below int
+	for i := 0; i < 18; i++ {
+		a, b := c.Size-11+i%3, i/3
+		if c.Modules[b][a] {
+			right |= 1 << i
+		}
+		if c.Modules[a][b] {
+			below |= 1 << i
+		}
+	}
+	if right != 0x07C94 || below != 0x07C94 {
+		t.Errorf("version info %018b / %018b", right, below)
+	}
+}
+
+func TestTooLong(t *testing.T) {
+	_, err := Encode(make([]byte, 272))
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("272 bytes: %v", err)
+	}
+}
+
+func TestFormatInfo(t *testing.T) {
+	// Format strings for level L, masks 0-7
+	formatL := [8]string{
+		"111011111000100", "111001011110011", "111110110101010", "111100010011101",
+		"110011000101111", "110001100011000", "110110001000001", "110100101110110",
+	}
+	for _, payload := range []string{"a", "pairing-token-0123456789", strings.Repeat("xyz", 60)} {
+		c, err := Encode([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := readFormat(c)
+		if first != second {
+			t.Errorf("%d bytes: format copies differ: %015b %015b", len(payload), first, second)
+		}
+		mask := (first ^ 0x5412) >> 10 & 7
+		if got := fmt.Sprintf("%015b", first); got != formatL[mask] {
+			t.Errorf("%d bytes: format %s, want level L %s", len(payload), got, formatL[mask])
+		}
+		if !c.Modules[c.Size-8][8] {
+			t.Errorf("%d bytes: dark module missing", len(payload))
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		{},
+		[]byte("https://192.168.1.20:8080/api/pair/claim"),
+		bytes.Repeat([]byte{0x00, 0xFF, 0x5A}, 40),
+		bytes.Repeat([]byte("0123456789"), 27), // version 10, four blocks
+	}
+	for _, data := range payloads {
+		c, err := Encode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decode(t, c); !bytes.Equal(got, data) {
+			t.Errorf("version %d: decoded %q, want %q", c.Version, got, data)
+		}
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.PNG(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dim := (c.Size + 8) * 3; img.Bounds().Dx() != dim || img.Bounds().Dy() != dim {
+		t.Fatalf("image is %v, want %dx%d", img.Bounds(), dim, dim)
+	}
+	gray := func(x, y int) uint32 { r, _, _, _ := img.At(x, y).RGBA(); return r }
+	if gray(0, 0) == 0 {
+		t.Error("quiet zone is dark")
+	}
+	if gray(4*3, 4*3) != 0 {
+		t.Error("finder corner is light")
+	}
+}
+
+// readFormat returns the two copies of the 15-bit format information.
+func readFormat(c *Code) (first, second int) {
+	at := func(x, y, i int, v *int) {
+		if c.Modules[y][x] {
+			*v |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		at(8, i, i, &first)
+	}
+	at(8, 7, 6, &first)
+	at(8, 8, 7, &first)
+	at(7, 8, 8, &first)
+	for i := 9; i < 15; i++ {
+		at(14-i, 8, i, &first)
+	}
+	for i := 0; i < 8; i++ {
+		at(c.Size-1-i, 8, i, &second)
+	}
+	for i := 8; i < 15; i++ {
+		at(8, c.Size-15+i, i, &second)
+	}
+	return first, second
+}
+
+// decode reads c back: it unmasks, collects the codewords in placement
+// order, checks each block's error correction and parses the byte-mode
+// segment.
+func decode(t *testing.T, c *Code) []byte {
+	t.Helper()
+	format, _ := readFormat(c)
+	mask := (format ^ 0x5412) >> 10 & 7
+
+	b := newBuilder(c.Version)
+	b.drawFunctionPatterns(c.Version)
+	for y := range b.modules {
+		copy(b.modules[y], c.Modules[y])
+	}
+	b.applyMask(mask)
+
+	vi := versions[c.Version]
+	total := vi.dataCodewords() + vi.ecPerBlock*len(vi.blocks)
+	var bits bitBuffer
+	for right := b.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < b.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = b.size - 1 - vert
+				}
+				if !b.function[y][x] && len(bits) < total*8 {
+					bits = append(bits, b.modules[y][x])
+				}
+			}
+		}
+	}
+	codewords := bits.bytes()
+
+	blocks := make([][]byte, len(vi.blocks))
+	i := 0
+	for k := 0; k < vi.blocks[len(vi.blocks)-1]; k++ {
+		for n, size := range vi.blocks {
+			if k < size {
+				blocks[n] = append(blocks[n], codewords[i])
+				i++
+			}
+		}
+	}
+	ecc := make([][]byte, len(vi.blocks))
+	for k := 0; k < vi.ecPerBlock; k++ {
+		for n := range vi.blocks {
+			ecc[n] = append(ecc[n], codewords[i])
+			i++
+		}
+	}
+	var data []byte
+	for n, blk := range blocks {
+		if want := rsRemainder(blk, rsDivisor(vi.ecPerBlock)); !bytes.Equal(ecc[n], want) {
+			t.Errorf("version %d block %d: EC codewords %v, want %v", c.Version, n, ecc[n], want)
+		}
+		data = append(data, blk...)
+	}
+
+	var stream bitBuffer
+	for _, d := range data {
+		stream.append(int(d), 8)
+	}
+	read := func(n int) int {
+		v := 0
+		for _, bit := range stream[:n] {
+			v <<= 1
+			if bit {
+				v |= 1
+			}
+		}
+		stream = stream[n:]
+		return v
+	}
+	if mode := read(4); mode != 0x4 {
+		t.Fatalf("version %d: mode %#x, want byte mode", c.Version, mode)
+	}
+	countBits := 8
+	if c.Version >= 10 {
+		countBits = 16
+	}
+	out := make([]byte, read(countBits))
+	for k := range out {
+		out[k] = byte(read(8))
+	}
+	return out
+}
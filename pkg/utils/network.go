@@ -14,3 +14,33 @@ func GetLocalIP() string {
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	return localAddr.IP.String()
 }
+
+// SubnetBroadcast returns the directed broadcast address of the local
+// interface network containing ip (e.g. 192.168.1.255 for 192.168.1.10/24).
+// It falls back to the limited broadcast address 255.255.255.255.
+func SubnetBroadcast(ip string) net.IP {
+	target := net.ParseIP(ip).To4()
+	addrs, err := net.InterfaceAddrs()
+	if target == nil || err != nil {
+		return net.IPv4bcast
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.Contains(target) {
+			continue
+		}
+		mask := ipnet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		if len(mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = target[i] | ^mask[i]
+		}
+		return bcast
+	}
+	return net.IPv4bcast
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+)
+
+// CertFingerprint returns the hex SHA-256 of cert's leaf certificate, or ""
+// if it has none.
+func CertFingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
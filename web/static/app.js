@@ -7,8 +7,10 @@ const App = (() => {
     let selectedDeviceId = null;
     let selectedFile = null;
     let ws = null;
+    let revoked = false; // session ended elsewhere; stop reconnecting
     let scanInterval = null;
     let activeTransfers = {};
+    let historyMode = { incognito: false, historyDisabled: false };
 
     // ----------------------------------------------------------------
     // Init
@@ -27,9 +29,45 @@ const App = (() => {
             if (r.status === 401) { window.location.href = '/'; return; }
             const data = await r.json();
             document.getElementById('me-email').textContent = data.email;
+            document.getElementById('me-device').textContent = `· ${data.deviceName}`;
+            historyMode = { incognito: !!data.incognito, historyDisabled: !!data.historyDisabled };
+            renderHistoryMode();
         } catch (e) { /* ignore */ }
     }
 
+    // Shows whether new transfers are being recorded
+    function renderHistoryMode() {
+        const note = document.getElementById('history-off-note');
+        const btn = document.getElementById('incognito-btn');
+        note.style.display = historyMode.historyDisabled || historyMode.incognito ? '' : 'none';
+        note.textContent = historyMode.historyDisabled
+            ? 'History is turned off on this server; new transfers are not recorded.'
+            : 'Incognito: your new transfers are not recorded.';
+        btn.style.display = historyMode.historyDisabled ? 'none' : '';
+        btn.classList.toggle('active', historyMode.incognito);
+        btn.title = historyMode.incognito ? 'Record history again' : 'Stop recording history (incognito)';
+    }
+
+    async function toggleIncognito() {
+        const incognito = !historyMode.incognito;
+        try {
+            const r = await fetch('/api/settings/incognito', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ incognito })
+            });
+            if (!r.ok) {
+                const d = await r.json();
+                showFlash(d.error || 'Could not change the history setting', 'error');
+                return;
+            }
+            historyMode.incognito = incognito;
+            renderHistoryMode();
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
     // ----------------------------------------------------------------
     // Tab routing
     // ----------------------------------------------------------------
@@ -50,6 +88,10 @@ const App = (() => {
         const proto = location.protocol === 'https:' ? 'wss' : 'ws';
         ws = new WebSocket(`${proto}://${location.host}/ws`);
 
+        // Updates may have been missed while disconnected (or before the
+        // page loaded) — pull the authoritative snapshot on every (re)connect.
+        ws.onopen = () => { loadActiveTransfers(); loadPendingTransfers(); };
+
         ws.onmessage = (evt) => {
             try {
                 const msg = JSON.parse(evt.data);
@@ -58,7 +100,7 @@ const App = (() => {
         };
 
         ws.onclose = () => {
-            setTimeout(connectWS, 2000); // auto-reconnect
+            if (!revoked) setTimeout(connectWS, 2000); // auto-reconnect
         };
     }
 
@@ -69,9 +111,33 @@ const App = (() => {
             case 'incoming_request':
                 showIncomingToast(payload);
                 break;
+            case 'transfer_started':
+            case 'transfer_progress':
             case 'transfer_update':
+            case 'transfer_completed':
+            case 'transfer_failed':
                 updateActiveTransfer(payload);
                 break;
+            case 'text_received':
+                showFlash(`Message from ${payload.senderName}: ${payload.text}`, 'success');
+                break;
+            case 'transfers_snapshot':
+                payload.forEach(updateActiveTransfer);
+                break;
+            case 'session_revoked':
+                revoked = true;
+                window.location.href = '/';
+                break;
+            case 'device_online':
+            case 'device_offline':
+                scanDevices();
+                break;
+            case 'files_updated':
+                if (currentTab === 'downloads') loadFiles();
+                break;
+            case 'request_expired':
+                dismissToast(payload.id);
+                break;
             case 'transfer_rejected':
                 removeActiveTransfer(payload.id);
                 showFlash(`Transfer rejected: ${payload.fileName}`, 'error');
@@ -84,7 +150,11 @@ const App = (() => {
     // ----------------------------------------------------------------
     async function scanDevices() {
         try {
-            const r = await fetch('/api/devices');
+            // Polling isn't user activity, so it mustn't hold off the idle logout
+            const group = document.getElementById('group-filter').value.trim();
+            const url = group ? `/api/devices?group=${encodeURIComponent(group)}` : '/api/devices';
+            const r = await fetch(url, { headers: { 'X-Background-Request': '1' } });
+            if (r.status === 401) { window.location.href = '/'; return; }
             if (!r.ok) return;
             const devices = await r.json();
             renderDevices(devices);
@@ -116,15 +186,81 @@ const App = (() => {
             card.innerHTML = `
         <div class="device-avatar">${initial}</div>
         <div class="device-info">
-          <div class="device-username">${esc(dev.username || 'Unknown')}</div>
+          <div class="device-username">${esc(dev.username || (dev.users && dev.users[0]) || 'Nobody signed in')}</div>
           <div class="device-name">${esc(dev.name)}</div>
           <div class="device-ip">${esc(dev.ip)}:${dev.port}</div>
-        </div>`;
+          ${(dev.groups || []).map(g => `<span class="device-group">${esc(g)}</span>`).join('')}
+        </div>
+        <button class="btn-group" title="Groups">🏷</button>
+        <button class="btn-ping" title="Check this device can be reached for transfers">⇄</button>
+        <button class="btn-trust" title="Always accept files from this device">★</button>`;
+            card.querySelector('.btn-group').onclick = e => { e.stopPropagation(); groupDevice(dev); };
+            card.querySelector('.btn-ping').onclick = e => { e.stopPropagation(); pingDevice(dev); };
+            card.querySelector('.btn-trust').onclick = e => { e.stopPropagation(); trustDevice(dev); };
             card.onclick = () => openSendDrawer(dev);
             grid.appendChild(card);
         });
     }
 
+    async function groupDevice(dev) {
+        const groups = prompt('Groups for this device, separated by commas (e.g. office, home):', (dev.groups || []).join(', '));
+        if (groups === null) return;
+        try {
+            const r = await fetch('/api/devices/groups', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ deviceId: dev.id, groups: groups.split(',') })
+            });
+            if (!r.ok) {
+                const d = await r.json();
+                showFlash(d.error || 'Could not save groups', 'error');
+                return;
+            }
+            scanDevices();
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
+    async function pingDevice(dev) {
+        try {
+            const r = await fetch('/api/devices/ping', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ deviceId: dev.id })
+            });
+            const d = await r.json();
+            if (!r.ok) showFlash(d.error || 'Ping failed', 'error');
+            else if (d.reachable) showFlash(`${dev.name} is reachable (${d.latencyMs.toFixed(1)} ms)`, 'success');
+            else showFlash(`${dev.name} can't be reached on port ${dev.port}: ${d.error}`, 'error');
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
+    async function trustDevice(dev) {
+        const limit = prompt('Accept files automatically up to how many MB? Leave empty for any size.', '');
+        if (limit === null) return;
+        const mb = parseFloat(limit) || 0;
+        try {
+            const r = await fetch('/api/settings/trusted', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    deviceId: dev.id, username: dev.username || '',
+                    autoAcceptMaxBytes: mb > 0 ? Math.round(mb * 1024 * 1024) : 0
+                })
+            });
+            if (r.ok) showFlash(`Files from ${dev.username || dev.name}${mb > 0 ? ` up to ${limit} MB` : ''} will be accepted automatically`, 'success');
+            else {
+                const d = await r.json();
+                showFlash(d.error || 'Could not trust device', 'error');
+            }
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
     // ----------------------------------------------------------------
     // Send Drawer
     // ----------------------------------------------------------------
@@ -174,7 +310,9 @@ const App = (() => {
         fd.append('file', selectedFile);
 
         try {
-            const r = await fetch('/api/transfer/send', { method: 'POST', body: fd });
+            const r = selectedFile.size > RESUMABLE_THRESHOLD
+                ? await sendResumable(selectedFile, selectedDeviceId, btn)
+                : await fetch('/api/transfer/send', { method: 'POST', body: fd });
             let data;
             try {
                 data = await r.json();
@@ -197,11 +335,97 @@ const App = (() => {
         }
     }
 
+    // The server fetches the URL and streams it to the peer
+    async function sendFromURL() {
+        const input = document.getElementById('send-url-input');
+        const url = input.value.trim();
+        if (!url || !selectedDeviceId) return;
+        const btn = document.getElementById('send-url-btn');
+        btn.disabled = true;
+        try {
+            const r = await fetch('/api/transfer/send-url', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ deviceId: selectedDeviceId, url })
+            });
+            const data = await r.json().catch(() => ({}));
+            if (!r.ok) {
+                showFlash(data.error || 'Send failed', 'error');
+            } else {
+                showFlash('Transfer sent', 'success');
+                input.value = '';
+                closeDrawer();
+            }
+        } catch (e) {
+            showFlash('Network error: ' + e.message, 'error');
+        } finally {
+            btn.disabled = false;
+        }
+    }
+
+    // Large files go up in parts so a dropped connection resumes where it
+    // stopped instead of starting over. Resolves to the complete call's response.
+    const RESUMABLE_THRESHOLD = 64 * 1024 * 1024;
+    const UPLOAD_PART = 8 * 1024 * 1024;
+
+    async function sendResumable(file, deviceId, btn) {
+        let uploadId = null, offset = 0, failures = 0;
+        while (offset < file.size) {
+            const part = file.slice(offset, offset + UPLOAD_PART);
+            const url = uploadId
+                ? `/api/transfer/upload?uploadId=${uploadId}&offset=${offset}`
+                : `/api/transfer/upload?fileName=${encodeURIComponent(file.name)}&fileSize=${file.size}`;
+            try {
+                const r = await fetch(url, { method: 'POST', body: part });
+                const data = await r.json().catch(() => ({}));
+                if (data.uploadId) uploadId = data.uploadId;
+                if (typeof data.offset === 'number') offset = data.offset;
+                if (!r.ok && r.status !== 409 && r.status !== 400) return r;
+                if (r.ok) failures = 0;
+                else if (++failures > 5) return r;
+            } catch (e) {
+                if (++failures > 5) throw e;
+                await new Promise(res => setTimeout(res, 1000 * failures));
+                if (uploadId) {
+                    const st = await fetch(`/api/transfer/upload?uploadId=${uploadId}`).catch(() => null);
+                    if (st && st.ok) offset = (await st.json()).offset;
+                }
+            }
+            btn.textContent = `Uploading ${Math.floor(offset * 100 / file.size)}%`;
+        }
+        btn.textContent = 'Sending...';
+        return fetch('/api/transfer/upload/complete', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ uploadId, deviceId }),
+        });
+    }
+
     // ----------------------------------------------------------------
     // Active Transfers
     // ----------------------------------------------------------------
+    async function loadActiveTransfers() {
+        try {
+            const r = await fetch('/api/transfers/active');
+            if (!r.ok) return;
+            const transfers = await r.json();
+            activeTransfers = {};
+            transfers.forEach(t => { activeTransfers[t.id] = t; });
+            renderActiveTransfers();
+        } catch (e) { }
+    }
+
+    // Offers that arrived while no socket was open never got a toast.
+    async function loadPendingTransfers() {
+        try {
+            const r = await fetch('/api/transfers/pending');
+            if (!r.ok) return;
+            (await r.json()).forEach(showIncomingToast);
+        } catch (e) { }
+    }
+
     function updateActiveTransfer(t) {
-        if (['completed', 'failed', 'rejected'].includes(t.status)) {
+        if (['completed', 'failed', 'rejected', 'cancelled', 'timed_out', 'expired'].includes(t.status) && !t.endTime) {
             t.endTime = Date.now();
         }
         activeTransfers[t.id] = t;
@@ -218,7 +442,7 @@ const App = (() => {
         const section = document.getElementById('active-section');
         const items = Object.values(activeTransfers).filter(t => {
             // Keep if not completed/failed/rejected
-            if (!['completed', 'failed', 'rejected'].includes(t.status)) return true;
+            if (!['completed', 'failed', 'rejected', 'cancelled', 'timed_out', 'expired'].includes(t.status)) return true;
             // Or if it was completed/failed/rejected very recently (within 5 seconds)
             const elapsed = (Date.now() - (t.endTime || 0)) / 1000;
             return elapsed < 5;
@@ -238,6 +462,11 @@ const App = (() => {
         <div class="transfer-info">
           <div class="transfer-name">${esc(t.fileName)}</div>
           <div class="transfer-meta">${t.direction === 'send' ? 'To' : 'From'} ${esc(t.peerName)} · ${speed}${statusLabel(t.status)}</div>
+          ${t.status === 'awaiting_confirmation' ? `
+          <div class="toast-actions">
+            <button class="btn-accept" onclick="App.confirmTransfer('${t.id}', true)">✔ Send</button>
+            <button class="btn-reject" onclick="App.confirmTransfer('${t.id}', false)">✕ Cancel</button>
+          </div>` : ''}
         </div>
         <div class="transfer-progress-wrap">
           <div class="progress-bar-bg"><div class="progress-bar-fill" style="width:${pct}%"></div></div>
@@ -254,6 +483,7 @@ const App = (() => {
     // Incoming File Request Toast
     // ----------------------------------------------------------------
     function showIncomingToast(pt) {
+        if (document.getElementById(`toast-${pt.id}`)) return;
         const container = document.getElementById('incoming-toast-container');
         const toast = document.createElement('div');
         toast.className = 'incoming-toast';
@@ -265,10 +495,11 @@ const App = (() => {
       </div>
       <div class="toast-body">
         <strong>${esc(pt.senderName)}</strong> wants to send you<br>
-        <strong>${esc(pt.fileName)}</strong> (${fmtSize(pt.fileSize)})
+        ${fileIcon(pt.fileName, pt.contentType)} <strong>${esc(pt.fileName)}</strong> (${fmtSize(pt.fileSize)})
       </div>
       <div class="toast-actions">
         <button class="btn-accept" onclick="App.acceptTransfer('${pt.id}')">✔ Accept</button>
+        <button class="btn-accept" onclick="App.acceptTransferTo('${pt.id}')">📁 Save to…</button>
         <button class="btn-reject" onclick="App.rejectTransfer('${pt.id}')">✕ Reject</button>
       </div>`;
         container.appendChild(toast);
@@ -282,13 +513,38 @@ const App = (() => {
         if (el) el.remove();
     }
 
-    async function acceptTransfer(id) {
+    function acceptTransferTo(id) {
+        const dir = prompt('Folder to save into (relative to your downloads):');
+        if (dir === null) return;
+        acceptTransfer(id, dir.trim());
+    }
+
+    async function renameDevice() {
+        const current = document.getElementById('me-device').textContent.replace(/^· /, '');
+        const name = prompt('Device name, as peers see it:', current);
+        if (name === null || !name.trim() || name.trim() === current) return;
+        try {
+            const r = await fetch('/api/settings/device-name', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ name: name.trim() })
+            });
+            const d = await r.json();
+            if (!r.ok) { showFlash(d.error || 'Rename failed', 'error'); return; }
+            document.getElementById('me-device').textContent = `· ${d.deviceName}`;
+            showFlash('Device renamed', 'success');
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
+    async function acceptTransfer(id, destDir) {
         dismissToast(id);
         try {
             const r = await fetch('/api/transfer/accept', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ transferId: id })
+                body: JSON.stringify({ transferId: id, destDir: destDir || '' })
             });
             if (r.ok) showFlash('Accepted — receiving file...', 'success');
             else {
@@ -300,6 +556,22 @@ const App = (() => {
         }
     }
 
+    async function confirmTransfer(id, confirm) {
+        try {
+            const r = await fetch('/api/transfer/confirm', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ transferId: id, confirm })
+            });
+            if (!r.ok) {
+                const d = await r.json();
+                showFlash(d.error || 'Confirm failed', 'error');
+            }
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
     async function rejectTransfer(id) {
         dismissToast(id);
         try {
@@ -340,12 +612,19 @@ const App = (() => {
             const card = document.createElement('div');
             card.className = 'file-card';
             card.innerHTML = `
-        <div class="file-icon">${fileIcon(f.name)}</div>
+        <div class="file-icon">${fileIcon(f.name, f.contentType)}</div>
         <div class="file-meta">
           <div class="file-name">${esc(f.name)}</div>
           <div class="file-sub">${fmtSize(f.size)} · ${fmtTime(f.timestamp)}</div>
         </div>
         <a class="btn-dl" href="/dl/${encodeURIComponent(f.name)}" download="${esc(f.name)}">⬇ Download</a>`;
+            if (/\.(jpe?g|png|gif)$/i.test(f.name)) {
+                const img = document.createElement('img');
+                img.className = 'file-thumb';
+                img.alt = '';
+                img.src = '/api/files/thumbnail?name=' + encodeURIComponent(f.name);
+                img.onload = () => card.querySelector('.file-icon').replaceChildren(img);
+            }
             list.appendChild(card);
         });
 
@@ -364,6 +643,8 @@ const App = (() => {
             if (!r.ok) return;
             const history = await r.json();
             renderHistory(history);
+            const skipped = r.headers.get('X-History-Skipped');
+            if (skipped) showFlash(`${skipped} history entries could not be read and are not shown`, 'error');
         } catch (e) { }
     }
 
@@ -396,26 +677,51 @@ const App = (() => {
 
         const tbody = document.getElementById('history-body');
         history.forEach(item => {
-            const dir = item.direction === 'send'
+            const dir = (item.direction === 'send'
                 ? '<span style="color:#a78bfa">↑ Sent</span>'
-                : '<span style="color:#34d399">↓ Received</span>';
+                : '<span style="color:#34d399">↓ Received</span>')
+                + (item.deviceName ? `<br><small>${item.direction === 'send' ? 'from' : 'on'} ${esc(item.deviceName)}</small>` : '');
             const tr = document.createElement('tr');
             tr.innerHTML = `
-         <td class="file-col">${esc(item.fileName)}</td>
+         <td class="file-col"${item.originalName ? ` title="Sent as ${esc(item.originalName)}"` : ''}>${fileIcon(item.fileName, item.contentType)} ${esc(item.fileName)}${item.duplicateOf
+                ? `<br><small title="Same content as a file already received">duplicate of ${esc(item.duplicateOf)}</small>`
+                : ''}</td>
         <td>${dir}</td>
         <td>${esc(item.peerName)}</td>
-        <td>${fmtSize(item.fileSize)}</td>
+        <td>${item.status === 'failed' && item.transferred
+                ? `${fmtSize(item.transferred)} of ${fmtSize(item.fileSize)}`
+                : fmtSize(item.fileSize)}</td>
         <td>${fmtTime(item.timestamp)}</td>
         <td><span class="status-badge status-${item.status}">${item.status}</span></td>
         <td>
           ${item.direction === 'receive' && item.status === 'completed'
                     ? `<a class="btn-dl-sm" href="/dl/${encodeURIComponent(item.fileName)}" download="${esc(item.fileName)}">⬇ Download</a>`
                     : ''}
+          ${item.filePath
+                    ? `<button class="btn-dl-sm btn-resend">↻ Send again</button>`
+                    : ''}
         </td>`;
+            const resend = tr.querySelector('.btn-resend');
+            if (resend) resend.onclick = () => resendFromHistory(item);
             tbody.appendChild(tr);
         });
     }
 
+    async function resendFromHistory(item) {
+        try {
+            const r = await fetch('/api/history/resend', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ id: item.id })
+            });
+            const d = await r.json();
+            if (r.ok) showFlash(`Sending ${item.fileName} to ${item.peerName} again`, 'success');
+            else showFlash(d.error || 'Could not resend', 'error');
+        } catch (e) {
+            showFlash('Network error', 'error');
+        }
+    }
+
     // ----------------------------------------------------------------
     // Auth
     // ----------------------------------------------------------------
@@ -466,7 +772,10 @@ const App = (() => {
         return str.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
     }
 
-    function fileIcon(name) {
+    // fileIcon picks by the sender's MIME type when known, else by extension
+    function fileIcon(name, contentType) {
+        const family = { image: '🖼️', video: '🎬', audio: '🎵' }[(contentType || '').split('/')[0]];
+        if (family) return family;
         const ext = (name || '').split('.').pop().toLowerCase();
         const map = {
             jpg: '🖼️', jpeg: '🖼️', png: '🖼️', gif: '🖼️', svg: '🖼️', webp: '🖼️',
@@ -480,7 +789,7 @@ const App = (() => {
     }
 
     function statusLabel(s) {
-        const map = { 'waiting_acceptance': '⏳ Awaiting acceptance', 'sending': '📤 Sending', 'receiving': '📥 Receiving', 'completed': '✔ Done', 'failed': '✘ Failed', 'rejected': '✘ Rejected' };
+        const map = { 'waiting_acceptance': '⏳ Awaiting acceptance', 'sending': '📤 Sending', 'receiving': '📥 Receiving', 'completed': '✔ Done', 'failed': '✘ Failed', 'rejected': '✘ Rejected', 'awaiting_confirmation': '⏸ Accepted — confirm to send', 'cancelled': '✘ Cancelled', 'stalled': '⚠ Stalled', 'timed_out': '✘ Timed out', 'expired': '⌛ Expired' };
         return map[s] || s;
     }
 
@@ -501,7 +810,7 @@ const App = (() => {
         });
     });
 
-    return { init, switchTab, scanDevices, openSendDrawer, closeDrawer, onFileSelect, doSend, acceptTransfer, rejectTransfer, logout };
+    return { init, switchTab, scanDevices, openSendDrawer, closeDrawer, onFileSelect, doSend, acceptTransfer, acceptTransferTo, rejectTransfer, confirmTransfer, renameDevice, toggleIncognito, sendFromURL, logout };
 })();
 
 // Kick off on load